@@ -127,6 +127,11 @@ func (bc *Client) GetTS(ctx context.Context, duration time.Duration, ts uint64)
 	if err != nil {
 		return 0, errors.Trace(err)
 	}
+	// a backup ts in the future passes the check above trivially, but it is invalid.
+	err = utils.CheckBackupTSNotInFuture(ctx, bc.mgr.GetPDClient(), backupTS, utils.DefaultMaxClockSkew)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
 	log.Info("backup encode timestamp", zap.Uint64("BackupTS", backupTS))
 	return backupTS, nil
 }
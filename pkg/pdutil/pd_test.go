@@ -168,3 +168,20 @@ func (s *testPDControllerSuite) TestPDVersion(c *C) {
 	c.Assert(r.Minor, Equals, expectV.Minor)
 	c.Assert(r.PreRelease, Equals, expectV.PreRelease)
 }
+
+func (s *testPDControllerSuite) TestParseHotReadKeysRate(c *C) {
+	content := []byte(`{
+		"as_peer": {"1": {"total_flow_bytes": 100, "total_flow_keys": 10, "regions_count": 1}},
+		"as_leader": {
+			"1": {"total_flow_bytes": 100, "total_flow_keys": 10.5, "regions_count": 1},
+			"2": {"total_flow_bytes": 200, "total_flow_keys": 20, "regions_count": 2}
+		}
+	}`)
+	rate, err := parseHotReadKeysRate(content)
+	c.Assert(err, IsNil)
+	c.Assert(rate, Equals, 30.5)
+
+	rate, err = parseHotReadKeysRate([]byte(`{}`))
+	c.Assert(err, IsNil)
+	c.Assert(rate, Equals, 0.0)
+}
@@ -31,6 +31,7 @@ var Nop UndoFunc = func(context.Context) error { return nil }
 const (
 	resetTSURL       = "/pd/api/v1/admin/reset-ts"
 	placementRuleURL = "/pd/api/v1/config/rules"
+	hotReadURL       = "/pd/api/v1/hotspot/regions/read"
 )
 
 // ResetTS resets the timestamp of PD to a bigger value.
@@ -101,6 +102,60 @@ func GetPlacementRules(ctx context.Context, pdAddr string, tlsConf *tls.Config)
 	return rules, nil
 }
 
+// hotPeersStat is the read statistics of a store reported by PD, we only care about the total flow here.
+type hotPeersStat struct {
+	TotalBytesRate float64 `json:"total_flow_bytes"`
+	TotalKeysRate  float64 `json:"total_flow_keys"`
+}
+
+// storeHotPeersInfos is the response of the hot read API of PD.
+type storeHotPeersInfos struct {
+	AsLeader map[uint64]*hotPeersStat `json:"as_leader"`
+}
+
+// GetHotReadKeysRate returns the sum of read keys per second of the hot regions of all stores.
+// It is a cheap approximation of the foreground read load of the cluster.
+func GetHotReadKeysRate(ctx context.Context, pdAddr string, tlsConf *tls.Config) (float64, error) {
+	cli := httputil.NewClient(tlsConf)
+	prefix := "http://"
+	if tlsConf != nil {
+		prefix = "https://"
+	}
+	reqURL := prefix + pdAddr + hotReadURL
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	resp, err := cli.Do(req)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(resp.Body)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.Annotatef(berrors.ErrPDInvalidResponse, "get hot read regions failed: resp=%v, code=%d", buf.String(), resp.StatusCode)
+	}
+	return parseHotReadKeysRate(buf.Bytes())
+}
+
+func parseHotReadKeysRate(content []byte) (float64, error) {
+	var infos storeHotPeersInfos
+	if err := json.Unmarshal(content, &infos); err != nil {
+		return 0, errors.Trace(err)
+	}
+	rate := 0.0
+	for _, stat := range infos.AsLeader {
+		if stat != nil {
+			rate += stat.TotalKeysRate
+		}
+	}
+	return rate, nil
+}
+
 // SearchPlacementRule returns the placement rule matched to the table or nil.
 func SearchPlacementRule(tableID int64, placementRules []placement.Rule, role placement.PeerRoleType) *placement.Rule {
 	for _, rule := range placementRules {
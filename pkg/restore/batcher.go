@@ -4,16 +4,25 @@ package restore
 
 import (
 	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/opentracing/opentracing-go"
+	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/backup"
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
 
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/logutil"
 	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/summary"
+	"github.com/pingcap/br/pkg/utils"
 )
 
 // SendType is the 'type' of a send.
@@ -29,16 +38,62 @@ const (
 	SendAll
 	// SendAllThenClose will make the batcher send all pending ranges and then close itself.
 	SendAllThenClose
+	// SendAllThenNotify will make the batcher send all pending ranges and tables, then notify the Flush waiting.
+	SendAllThenNotify
+	// SendUntilLessThanBatchThenNotify is like SendUntilLessThanBatch, then notifies the Add blocked on it,
+	// see BatcherOptions.BlockAddOnFlush.
+	SendUntilLessThanBatchThenNotify
 )
 
+// autoCommitGracePeriod is the time limit of the final flush when the context of auto commit is done.
+const autoCommitGracePeriod = 3 * time.Second
+
+// staleCheckInterval is the interval of checking whether any pending table is stale, see BatcherOptions.MaxPendingAge.
+const staleCheckInterval = 10 * time.Millisecond
+
+// DefaultMinAutoCommitInterval is the default floor of the auto commit interval,
+// a shorter interval would spin the worker and hammer the sender.
+const DefaultMinAutoCommitInterval = 10 * time.Millisecond
+
 // Batcher collects ranges to restore and send batching split/ingest request.
 type Batcher struct {
 	cachedTables   []TableWithRange
 	cachedTablesMu *sync.Mutex
+	// rewriteRules is the rewrite rules of all tables added, guarded by rewriteRulesMu,
+	// which is separated from cachedTablesMu, so appending huge rule sets won't block draining.
 	rewriteRules   *RewriteRules
+	rewriteRulesMu *sync.Mutex
+	// rewriteRuleIndex indexes rewriteRules for detecting conflicts, guarded by rewriteRulesMu.
+	rewriteRuleIndex rewriteRuleIndex
+	// cachedTablesAddedAt is when each of the cached tables was added, guarded by cachedTablesMu.
+	cachedTablesAddedAt []time.Time
+	// inFlight is the IDs of tables added but not fully restored yet, guarded by cachedTablesMu.
+	inFlight map[int64]struct{}
+	// maxInFlightTables is the count of in-flight tables at which the table creator is signaled to back off,
+	// zero means never.
+	maxInFlightTables int
+
+	// opts are the options the batcher is created with, only for Config.
+	opts BatcherOptions
 
 	// autoCommitJoiner is for joining the background batch sender.
 	autoCommitJoiner chan<- struct{}
+	// autoCommitDone would be closed once the background batch sender exits,
+	// so we won't wait for a worker which has exited by itself(e.g. its context is done).
+	autoCommitDone <-chan struct{}
+	// autoCommitInterval is the interval of auto commit, zero if auto commit is disabled.
+	autoCommitInterval time.Duration
+	// autoCommitEnabled is 1 while auto commit is enabled, accessed atomically,
+	// so the contextCleaner knows whether the pending ranges would be flushed in the grace period.
+	autoCommitEnabled int32
+	// autoCommitJoinTimeout is the max time to wait for the auto commit worker to stop, zero means forever.
+	autoCommitJoinTimeout time.Duration
+	// minAutoCommitInterval is the floor of the auto commit interval, zero means DefaultMinAutoCommitInterval.
+	minAutoCommitInterval time.Duration
+	// sendMu makes sure batches are drained and sent in the same order.
+	sendMu *sync.Mutex
+	// sendClosed is whether the sender has been closed, guarded by sendMu.
+	sendClosed bool
 	// everythingIsDone is for waiting for worker done: that is, after we send a
 	// signal to autoCommitJoiner, we must give it enough time to get things done.
 	// Then, it should notify us by this wait group.
@@ -48,6 +103,10 @@ type Batcher struct {
 	sendErr chan<- error
 	// sendCh is for communiate with sendWorker.
 	sendCh chan<- SendType
+	// cancel cancels the context of the workers of the batcher.
+	cancel context.CancelFunc
+	// events is the recent events, for diagnosing crashes.
+	events *eventRing
 	// outCh is for output the restored table, so it can be sent to do something like checksum.
 	outCh chan<- CreatedTable
 
@@ -55,13 +114,197 @@ type Batcher struct {
 	manager            ContextManager
 	batchSizeThreshold int
 	size               int32
+	// batchBytesThreshold is the max total size of files of a batch, zero means unlimited.
+	// a range larger than it would still be sent, in a batch by itself.
+	batchBytesThreshold uint64
+	// bytes is the total size of files of the pending ranges.
+	bytes uint64
+	// rewriteRulesSizeLimit is the max in-memory size of the rewrite rules of a batch,
+	// zero means unlimited.
+	rewriteRulesSizeLimit int
+	// blockAddOnFlush makes Add block until the flush triggered by it is done.
+	blockAddOnFlush bool
+	// maxPendingAge is the max duration a table can be pending in the batcher, zero means unlimited.
+	maxPendingAge time.Duration
+	// maxTablesPerBatch is the max count of tables fully drained(and then emitted) by a batch, zero means unlimited.
+	maxTablesPerBatch int
+	// metrics is where the batches sent are observed, nil means no metrics.
+	metrics *BatcherMetrics
+	// cachedTablesLimit is the sanity limit of the count of cached tables, zero means unlimited.
+	cachedTablesLimit int
+	// cachedTablesLimitAction is what to do once cachedTablesLimit is reached.
+	cachedTablesLimitAction CachedTablesLimitAction
+	// paused is non-zero if the batcher is paused, see Pause.
+	paused int32
+	// aborted is whether the batcher is aborted, tables added then are discarded, guarded by cachedTablesMu.
+	aborted bool
+	// checkpoint records the ranges restored, ranges in it would be skipped when adding.
+	checkpoint *Checkpoint
+
+	progressMu *sync.Mutex
+	progress   RestoreProgress
+	reporter   ProgressReporter
+	// bytesPerCF is the total size of files sent of each column family, guarded by progressMu.
+	bytesPerCF map[string]uint64
+	// totalBytes is the total size of files to restore, the ETA is estimated only if it is set.
+	totalBytes uint64
+	eta        *ETAEstimator
+	// batchLatency is the digest of the duration of passing each batch to the sender(i.e. RestoreBatch).
+	batchLatency *LatencyDigest
+	// accounts is the accounting of each table by the ID in the backup, guarded by progressMu.
+	accounts map[int64]*tableAccount
+
+	// rangeFilters are applied in order, a range is skipped once any of them doesn't keep it.
+	rangeFilters []RangeFilter
+	// skipped is what skipped by each range filter by its name, guarded by progressMu.
+	skipped map[string]*RestoreCount
+	// emitTimeout is how long emitting a table to the output channel would be retried before failing,
+	// zero means blocking until the consumer accepts it.
+	emitTimeout time.Duration
+	// clock is the source of time for retrying emitting, see BatcherOptions.Clock.
+	clock            utils.Clock
+	emitRetryBackoff time.Duration
+	// keyspaces is the target keyspace of each table by the ID in the backup.
+	keyspaces map[int64]KeyspaceID
+	// tableGroups is the group of each table by the ID in the backup, only accessed by contextCleaner once set.
+	tableGroups map[int64]*tableGroup
+	// reorder buffers the restored tables so they are emitted in the order they are added, nil if disabled.
+	// it is only accessed by contextCleaner once set.
+	reorder *reorderBuffer
+	// addSeq is the sequence of each table added by its ID, guarded by cachedTablesMu.
+	// it is only maintained when reorder is set.
+	addSeq     map[int64]uint64
+	nextAddSeq uint64
+	// onTableStarted is called once the first range of each table is sent, nil means no callback.
+	onTableStarted func(CreatedTable)
+	// onTableRestored is called once each table is restored, before it is emitted, nil means no callback.
+	// it is only called by contextCleaner.
+	onTableRestored func(context.Context, CreatedTable) error
+	// started is the IDs of tables whose ranges have been sent, guarded by startedMu.
+	started   map[int64]struct{}
+	startedMu sync.Mutex
+	// drainStrategy decides which cached tables go into the next batch, nil means FIFODrainStrategy.
+	drainStrategy DrainStrategy
+	// restoreWaiters are closed once the tables are restored by the ID, for SendAndWait, guarded by restoreWaitersMu.
+	restoreWaiters   map[int64]chan struct{}
+	restoreWaitersMu sync.Mutex
+	// flushWaiters are the Flush calls waiting, in the order they are sent to the send worker.
+	// the send worker closes the first of them once the flush is done.
+	flushWaiters   []chan struct{}
+	flushWaitersMu sync.Mutex
+	// blockedAdds are the Add calls blocked by BatcherOptions.BlockAddOnFlush, each of them sends a command to the send worker,
+	// which closes the first of them once the command is done. the waiters may be in a different order from
+	// the commands, but any flush started after the waiter is registered covers the ranges added by that Add.
+	blockedAdds   []chan struct{}
+	blockedAddsMu sync.Mutex
+	// flushMu serializes the Flush calls.
+	flushMu sync.Mutex
+	// closeOnce makes sure the batcher is closed once, closeDone is closed once closing is done.
+	closeOnce sync.Once
+	closeDone chan struct{}
+}
+
+// tableGroup is a group of tables which should be emitted together.
+type tableGroup struct {
+	size int
+	// done is the tables restored but not emitted yet.
+	done []CreatedTable
+}
+
+// reorderBuffer reorders the restored tables by the sequence they are added.
+type reorderBuffer struct {
+	// limit is the max count of tables buffered.
+	limit int
+	// next is the sequence of the next table to emit.
+	next    uint64
+	pending map[uint64]CreatedTable
 }
 
-// Len calculate the current size of this batcher.
+// push puts the restored table into the buffer, and returns the tables can be emitted in order.
+// once the buffer exceeds the limit, the tables missing before the earliest buffered one are skipped,
+// and would be emitted as soon as they are restored.
+func (r *reorderBuffer) push(seq uint64, tbl CreatedTable) []CreatedTable {
+	if seq < r.next {
+		return []CreatedTable{tbl}
+	}
+	r.pending[seq] = tbl
+	ready := r.popReady()
+	for len(r.pending) > r.limit {
+		earliest := r.earliest()
+		log.Warn("too many tables waiting for the earlier added ones, emit them out of order",
+			zap.Uint64("waiting for", r.next),
+			zap.Uint64("skip to", earliest),
+			zap.Int("buffered", len(r.pending)),
+		)
+		r.next = earliest
+		ready = append(ready, r.popReady()...)
+	}
+	return ready
+}
+
+// popReady pops the tables which are next to emit.
+func (r *reorderBuffer) popReady() []CreatedTable {
+	ready := make([]CreatedTable, 0)
+	for {
+		tbl, ok := r.pending[r.next]
+		if !ok {
+			return ready
+		}
+		ready = append(ready, tbl)
+		delete(r.pending, r.next)
+		r.next++
+	}
+}
+
+// earliest returns the earliest sequence buffered, the buffer must not be empty.
+func (r *reorderBuffer) earliest() uint64 {
+	first := true
+	earliest := uint64(0)
+	for seq := range r.pending {
+		if first || seq < earliest {
+			earliest = seq
+			first = false
+		}
+	}
+	return earliest
+}
+
+// flush pops all tables buffered in order, skipping the tables missing(e.g. they failed to restore).
+func (r *reorderBuffer) flush() []CreatedTable {
+	seqs := make([]uint64, 0, len(r.pending))
+	for seq := range r.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	tables := make([]CreatedTable, 0, len(seqs))
+	for _, seq := range seqs {
+		tables = append(tables, r.pending[seq])
+		delete(r.pending, seq)
+		r.next = seq + 1
+	}
+	return tables
+}
+
+// Len calculate the current size of this batcher, i.e. the count of ranges pending.
+// it is safe to call it concurrently with Add and draining.
 func (b *Batcher) Len() int {
 	return int(atomic.LoadInt32(&b.size))
 }
 
+// ByteLen returns the total size of files of the ranges pending, it is accounted along with Len.
+// it is safe to call it concurrently with Add and draining.
+func (b *Batcher) ByteLen() uint64 {
+	return atomic.LoadUint64(&b.bytes)
+}
+
+// isFull checks whether the batcher has reached the threshold of a batch.
+func (b *Batcher) isFull() bool {
+	if b.batchSizeThreshold > 0 && b.Len() >= b.batchSizeThreshold {
+		return true
+	}
+	return b.batchBytesThreshold > 0 && b.ByteLen() >= b.batchBytesThreshold
+}
+
 // contextCleaner is the worker goroutine that cleaning the 'context'
 // (e.g. make regions leave restore mode).
 func (b *Batcher) contextCleaner(ctx context.Context, tables <-chan []CreatedTable) {
@@ -74,69 +317,557 @@ func (b *Batcher) contextCleaner(ctx context.Context, tables <-chan []CreatedTab
 		}
 	}()
 	defer b.everythingIsDone.Done()
+	// the auto commit flushes the pending ranges in a grace period once the context is done(see flushWithGrace),
+	// keep handling the restored tables in the same period, so the tables flushed still reach the output.
+	cleanCtx, cancel := b.withGrace(ctx)
+	defer cancel()
 	for {
 		select {
-		case <-ctx.Done():
+		case <-cleanCtx.Done():
+			// the sender may still emit tables until it is closed, don't block it.
+			go func() {
+				for range tables {
+				}
+			}()
 			return
 		case tbls, ok := <-tables:
 			if !ok {
 				return
 			}
-			if err := b.manager.Leave(ctx, tbls); err != nil {
-				b.sendErr <- err
+			if err := b.cleanTables(cleanCtx, tbls); err != nil {
+				b.emitError(err)
 				return
 			}
-			for _, tbl := range tbls {
-				b.outCh <- tbl
+		}
+	}
+}
+
+// withGrace returns a context which is done autoCommitGracePeriod after ctx is done if auto commit is enabled,
+// or right after ctx is done otherwise, nothing is flushed then.
+// the batcher being aborted doesn't have the grace period either, because nothing is expected to be emitted then.
+func (b *Batcher) withGrace(ctx context.Context) (context.Context, context.CancelFunc) {
+	graceCtx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		select {
+		case <-graceCtx.Done():
+			return
+		case <-ctx.Done():
+		}
+		if atomic.LoadInt32(&b.autoCommitEnabled) == 0 || b.isAborted() {
+			return
+		}
+		timer := time.NewTimer(autoCommitGracePeriod)
+		defer timer.Stop()
+		select {
+		case <-graceCtx.Done():
+		case <-timer.C:
+		}
+	}()
+	return graceCtx, cancel
+}
+
+// cleanTables makes the restored tables leave the restore context, and emits them.
+func (b *Batcher) cleanTables(ctx context.Context, tbls []CreatedTable) error {
+	if err := b.manager.Leave(ctx, tbls); err != nil {
+		return err
+	}
+	b.cachedTablesMu.Lock()
+	for _, tbl := range tbls {
+		delete(b.inFlight, tbl.Table.ID)
+	}
+	b.cachedTablesMu.Unlock()
+	// the tables may be held back from emitting below, don't let SendAndWait wait for that.
+	b.notifyRestored(tbls)
+	tbls = b.runOnTableRestored(ctx, tbls)
+	if err := b.emit(ctx, b.reorderTables(tbls)); err != nil {
+		return err
+	}
+	if b.checkpoint != nil {
+		done, err := b.checkpoint.RecordTablesDone(ctx, tbls)
+		if err != nil {
+			return err
+		}
+		b.updateProgress(func(p *RestoreProgress) {
+			p.TablesDone = done
+		})
+		return nil
+	}
+	b.updateProgress(func(p *RestoreProgress) {
+		p.TablesDone += len(tbls)
+	})
+	return nil
+}
+
+// isAborted returns whether the batcher is aborted.
+func (b *Batcher) isAborted() bool {
+	b.cachedTablesMu.Lock()
+	defer b.cachedTablesMu.Unlock()
+	return b.aborted
+}
+
+// runOnTableRestored calls onTableRestored for each restored table,
+// it returns the tables passed, the errors of the others are sent to the error channel.
+func (b *Batcher) runOnTableRestored(ctx context.Context, tbls []CreatedTable) []CreatedTable {
+	if b.onTableRestored == nil {
+		return tbls
+	}
+	passed := make([]CreatedTable, 0, len(tbls))
+	for _, tbl := range tbls {
+		if err := b.onTableRestored(ctx, tbl); err != nil {
+			log.Error("the callback failed on the restored table, it won't be emitted",
+				zap.Stringer("table", tbl.Table.Name), zap.Error(err))
+			b.emitError(errors.Annotatef(err, "failed on the restored table %s", tbl.Table.Name))
+			continue
+		}
+		passed = append(passed, tbl)
+	}
+	return passed
+}
+
+// reorderTables returns the restored tables can be emitted in the order they are added,
+// the others are buffered until the earlier added tables are restored. see BatcherOptions.OrderedOutputLimit.
+func (b *Batcher) reorderTables(tbls []CreatedTable) []CreatedTable {
+	if b.reorder == nil {
+		return tbls
+	}
+	ready := make([]CreatedTable, 0, len(tbls))
+	for _, tbl := range tbls {
+		b.cachedTablesMu.Lock()
+		seq, ok := b.addSeq[tbl.Table.ID]
+		delete(b.addSeq, tbl.Table.ID)
+		b.cachedTablesMu.Unlock()
+		if !ok {
+			// the table isn't added by Add, there is no order of it.
+			ready = append(ready, tbl)
+			continue
+		}
+		ready = append(ready, b.reorder.push(seq, tbl)...)
+	}
+	return ready
+}
+
+// emitReordered emits the tables still buffered for reordering in order, whether the earlier added ones are restored.
+func (b *Batcher) emitReordered(ctx context.Context) {
+	if b.reorder == nil {
+		return
+	}
+	tables := b.reorder.flush()
+	if len(tables) > 0 {
+		log.Warn("some tables added earlier aren't restored, emit the later ones anyway", zap.Int("tables", len(tables)))
+	}
+	if err := b.emit(ctx, tables); err != nil {
+		b.emitError(err)
+	}
+}
+
+// emit sends the restored tables to the output channel,
+// a table in a group is deferred until all tables of the group are restored, then they are emitted together.
+func (b *Batcher) emit(ctx context.Context, tbls []CreatedTable) error {
+	for _, tbl := range tbls {
+		group, ok := b.tableGroups[tbl.OldTable.Info.ID]
+		if !ok {
+			if err := b.emitTable(ctx, tbl); err != nil {
+				return err
+			}
+			continue
+		}
+		group.done = append(group.done, tbl)
+		if len(group.done) < group.size {
+			log.Debug("deferring emitting table until its group is restored",
+				zap.Stringer("table", tbl.Table.Name),
+				zap.Int("done", len(group.done)),
+				zap.Int("group size", group.size),
+			)
+			continue
+		}
+		for _, t := range group.done {
+			if err := b.emitTable(ctx, t); err != nil {
+				return err
 			}
 		}
+		group.done = nil
+	}
+	return nil
+}
+
+// defaultEmitRetryBackoff is the initial backoff of retrying emitting if it isn't set.
+const defaultEmitRetryBackoff = 10 * time.Millisecond
+
+// emitTable sends the table to the output channel, until ctx is done.
+// if the emit timeout is set, it retries with backoff while the consumer cannot accept, until the timeout
+// or ctx is done.
+func (b *Batcher) emitTable(ctx context.Context, tbl CreatedTable) error {
+	if b.emitTimeout <= 0 {
+		select {
+		case b.outCh <- tbl:
+			return nil
+		case <-ctx.Done():
+			return errors.Annotatef(ctx.Err(), "failed to emit table %s", tbl.Table.Name)
+		}
+	}
+	deadline := b.clock.Now().Add(b.emitTimeout)
+	backoff := b.emitRetryBackoff
+	if backoff <= 0 {
+		backoff = defaultEmitRetryBackoff
+	}
+	for {
+		select {
+		case b.outCh <- tbl:
+			return nil
+		default:
+		}
+		remaining := deadline.Sub(b.clock.Now())
+		if remaining <= 0 {
+			return errors.Annotatef(berrors.ErrRestoreEmitTimeout,
+				"the consumer cannot accept table %s in %s", tbl.Table.Name, b.emitTimeout)
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		log.Debug("the consumer cannot accept the restored table, retry later",
+			zap.Stringer("table", tbl.Table.Name),
+			zap.Duration("backoff", backoff),
+		)
+		select {
+		case <-ctx.Done():
+			return errors.Annotatef(ctx.Err(), "failed to emit table %s", tbl.Table.Name)
+		case <-b.clock.After(backoff):
+		}
+		backoff *= 2
 	}
 }
 
-// NewBatcher creates a new batcher by a sender and a context manager.
+// notifyRestored notifies SendAndWait waiting for the tables that they are restored.
+func (b *Batcher) notifyRestored(tbls []CreatedTable) {
+	b.restoreWaitersMu.Lock()
+	defer b.restoreWaitersMu.Unlock()
+	for _, tbl := range tbls {
+		if waiter, ok := b.restoreWaiters[tbl.Table.ID]; ok {
+			close(waiter)
+			delete(b.restoreWaiters, tbl.Table.ID)
+		}
+	}
+}
+
+// emitIncompleteGroups emits the tables deferred by groups never completed(e.g. some tables aren't restored).
+func (b *Batcher) emitIncompleteGroups(ctx context.Context) {
+	for _, group := range b.tableGroups {
+		if len(group.done) == 0 {
+			continue
+		}
+		log.Warn("some tables of the group aren't restored, emit the restored ones anyway",
+			zap.Int("done", len(group.done)),
+			zap.Int("group size", group.size),
+		)
+		for _, t := range group.done {
+			if err := b.emitTable(ctx, t); err != nil {
+				b.emitError(err)
+				return
+			}
+		}
+		group.done = nil
+	}
+}
+
+// BatcherOptions are the options of a batcher, which are fixed once the batcher is created.
+// The zero value is the default options.
+type BatcherOptions struct {
+	// BytesThreshold is the max total size of files of a batch, zero means unlimited.
+	// a range exceeding the threshold by itself would be sent in its own batch.
+	BytesThreshold uint64
+	// TotalBytes is the total size of files to restore, then the ETA of the restore would be estimated
+	// by the throughput of the recent minute. zero means no ETA.
+	TotalBytes uint64
+	// ProgressReporter is the reporter the batcher reports its progress to if it isn't nil.
+	ProgressReporter ProgressReporter
+	// OnTableStarted is called once the first range of each table is sent, i.e. the table starts ingesting,
+	// it is always called before the table is emitted to the output channel. the calls are serialized,
+	// but a slow callback would block sending. the tables without any range to restore never start.
+	OnTableStarted func(CreatedTable)
+	// OnTableRestored is called once each table is restored(i.e. all of its ranges are restored),
+	// before it is emitted to the output channel, which is useful for per-table post-processing like checksum.
+	// once it fails, the error is sent to the error channel, and the table is neither emitted nor recorded
+	// as done in the checkpoint. the calls are serialized, and a slow callback would delay emitting the tables.
+	OnTableRestored func(context.Context, CreatedTable) error
+	// RewriteRulesSizeLimit is the max in-memory size of rewrite rules of a batch,
+	// a batch whose rewrite rules exceed the limit would fail, rather than making BR OOM. zero means unlimited.
+	RewriteRulesSizeLimit int
+	// AutoCommitJoinTimeout is the max time DisableAutoCommit(and Close) waits for the auto commit worker to stop,
+	// after that the worker would be left stopping in background. zero means waiting forever.
+	AutoCommitJoinTimeout time.Duration
+	// MinAutoCommitInterval is the floor of the auto commit interval,
+	// a shorter interval passed to EnableAutoCommit would be raised to it. zero means DefaultMinAutoCommitInterval.
+	MinAutoCommitInterval time.Duration
+	// BlockAddOnFlush makes Add block while the flush triggered by it is in progress,
+	// which provides backpressure to the caller, so the pending ranges won't pile up when flushing is slow.
+	BlockAddOnFlush bool
+	// MaxInFlightTables is the count of in-flight tables(see InFlightTables) at which
+	// the batcher signals backpressure to the table creator, see TableCreationBackpressure. zero means never.
+	MaxInFlightTables int
+	// MaxPendingAge is the max duration a table can be pending(i.e. not fully drained) in the batcher,
+	// once the oldest pending table exceeds it, all pending ranges would be sent when next table is added,
+	// or when the send worker checks it, at most staleCheckInterval later, regardless of the size of the batch.
+	// zero means unlimited.
+	MaxPendingAge time.Duration
+	// MaxTablesPerBatch is the max count of tables fully drained by a batch, zero means unlimited.
+	// tables fully drained are emitted together once the batch is restored,
+	// so it bounds the burst of emitting when lots of tiny tables are drained at once,
+	// which gives the consumer of the output channel(e.g. checksum) a chance to keep up.
+	MaxTablesPerBatch int
+	// CachedTablesLimit is the sanity limit of the count of tables cached(i.e. added but not drained),
+	// which catches the producer adding tables without the batches being drained, before running out of memory.
+	// unlike the thresholds, it counts tables rather than ranges. zero means unlimited.
+	CachedTablesLimit int
+	// CachedTablesLimitAction is what to do once CachedTablesLimit is reached, required if the limit is set.
+	CachedTablesLimitAction CachedTablesLimitAction
+	// Metrics is the prometheus metrics the batches sent are observed to if it isn't nil, see NewBatcherMetrics.
+	Metrics *BatcherMetrics
+	// Checkpoint makes the ranges recorded in it skipped when adding to the batcher if it isn't nil,
+	// and the progress would start from the progress recorded in it.
+	Checkpoint *Checkpoint
+	// RangeFilters skip the ranges not kept by them when adding to the batcher,
+	// which are reported as discrepancies by Reconciliation.
+	// a range would be skipped once any of the filters doesn't keep it, and it is counted to the first of them.
+	RangeFilters []RangeFilter
+	// EmitTimeout makes emitting a restored table retry with backoff(doubled each time, starting from
+	// EmitRetryBackoff) while the consumer of the output channel cannot accept, then fail with
+	// ErrRestoreEmitTimeout after the timeout, instead of blocking indefinitely. zero means blocking.
+	EmitTimeout time.Duration
+	// EmitRetryBackoff is the initial backoff of retrying emitting, zero means defaultEmitRetryBackoff.
+	EmitRetryBackoff time.Duration
+	// Clock is the source of time for retrying emitting, nil means utils.SystemClock.
+	Clock utils.Clock
+	// EventBufferSize makes the batcher keep the last EventBufferSize events(adds, sends and errors) in memory,
+	// which can be dumped by DumpRecentEvents. zero means recording nothing.
+	EventBufferSize int
+	// KeyspaceMapping routes the ranges of each table(by its ID in the backup) to the target keyspace,
+	// by prefixing the new key prefixes of its rewrite rules with the keyspace prefix.
+	// so the rewrite rules of the tables mapped must not be empty.
+	// once it is set, a batch never mixes the tables of different keyspaces(including the tables not mapped).
+	KeyspaceMapping map[int64]KeyspaceID
+	// TableGroups are the groups of tables by their IDs in the backup,
+	// the tables in a group would be emitted to the output channel together, once all of them are restored.
+	// a table can belong to at most one group.
+	TableGroups [][]int64
+	// OrderedOutputLimit makes the restored tables emitted to the output channel in the order they are added,
+	// even they are restored out of order(e.g. a large table spans batches, while the later added ones fit in one).
+	// at most OrderedOutputLimit tables are buffered waiting for the earlier added ones, once exceeded,
+	// the tables buffered are emitted anyway, so a table failed to restore won't hold the others forever.
+	// zero disables it.
+	OrderedOutputLimit int
+	// DrainStrategy decides which cached tables go into the next batch if it isn't nil,
+	// by default they are drained in the order they are added(i.e. FIFODrainStrategy).
+	DrainStrategy DrainStrategy
+}
+
+// validate checks the options, returns ErrInvalidArgument if any of them is invalid.
+func (opts *BatcherOptions) validate() error {
+	for _, n := range []struct {
+		name  string
+		value int64
+	}{
+		{"rewrite rules size limit", int64(opts.RewriteRulesSizeLimit)},
+		{"max in-flight tables", int64(opts.MaxInFlightTables)},
+		{"max tables per batch", int64(opts.MaxTablesPerBatch)},
+		{"cached tables limit", int64(opts.CachedTablesLimit)},
+		{"event buffer size", int64(opts.EventBufferSize)},
+		{"ordered output limit", int64(opts.OrderedOutputLimit)},
+		{"auto commit join timeout", int64(opts.AutoCommitJoinTimeout)},
+		{"min auto commit interval", int64(opts.MinAutoCommitInterval)},
+		{"max pending age", int64(opts.MaxPendingAge)},
+		{"emit timeout", int64(opts.EmitTimeout)},
+		{"emit retry backoff", int64(opts.EmitRetryBackoff)},
+	} {
+		if n.value < 0 {
+			return errors.Annotatef(berrors.ErrInvalidArgument, "the %s is negative", n.name)
+		}
+	}
+	if opts.CachedTablesLimit > 0 &&
+		opts.CachedTablesLimitAction != CachedTablesLimitWarn && opts.CachedTablesLimitAction != CachedTablesLimitError {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"unknown cached tables limit action %q", opts.CachedTablesLimitAction)
+	}
+	for table, keyspace := range opts.KeyspaceMapping {
+		if keyspace > MaxKeyspaceID {
+			return errors.Annotatef(berrors.ErrInvalidArgument,
+				"keyspace %d of table %d exceeds the max keyspace ID %d", keyspace, table, MaxKeyspaceID)
+		}
+	}
+	seen := make(map[int64]struct{})
+	for _, ids := range opts.TableGroups {
+		for _, id := range ids {
+			if _, ok := seen[id]; ok {
+				return errors.Annotatef(berrors.ErrInvalidArgument, "table %d belongs to more than one group", id)
+			}
+			seen[id] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// NewBatcher creates a new batcher by a sender and a context manager, with the default options.
 // the former defines how the 'restore' a batch(i.e. send, or 'push down' the task to where).
 // the context manager defines the 'lifetime' of restoring tables(i.e. how to enter 'restore' mode, and how to exit).
 // this batcher will work background, send batches per second, or batch size reaches limit.
 // and it will emit full-restored tables to the output channel returned.
+// it panics if the sender is nil, rather than panicking deep in the workers later.
 func NewBatcher(
 	ctx context.Context,
 	sender BatchSender,
 	manager ContextManager,
 	errCh chan<- error,
 ) (*Batcher, <-chan CreatedTable) {
+	return newBatcher(ctx, sender, manager, errCh, BatcherOptions{})
+}
+
+// NewBatcherWithOptions creates a new batcher like NewBatcher, with the options.
+// it returns ErrInvalidArgument if the options are invalid.
+func NewBatcherWithOptions(
+	ctx context.Context,
+	sender BatchSender,
+	manager ContextManager,
+	errCh chan<- error,
+	opts BatcherOptions,
+) (*Batcher, <-chan CreatedTable, error) {
+	if err := opts.validate(); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	b, output := newBatcher(ctx, sender, manager, errCh, opts)
+	return b, output, nil
+}
+
+// newBatcher creates a new batcher with the validated options, the options are applied before the workers start.
+func newBatcher(
+	ctx context.Context,
+	sender BatchSender,
+	manager ContextManager,
+	errCh chan<- error,
+	opts BatcherOptions,
+) (*Batcher, <-chan CreatedTable) {
+	if sender == nil {
+		panic("the sender of batcher is nil")
+	}
 	output := make(chan CreatedTable, defaultChannelSize)
 	sendChan := make(chan SendType, 2)
+	ctx, cancel := context.WithCancel(ctx)
 	b := &Batcher{
-		rewriteRules:       EmptyRewriteRule(),
-		sendErr:            errCh,
-		outCh:              output,
-		sender:             sender,
-		manager:            manager,
-		sendCh:             sendChan,
-		cachedTablesMu:     new(sync.Mutex),
-		everythingIsDone:   new(sync.WaitGroup),
-		batchSizeThreshold: 1,
+		cancel:                  cancel,
+		opts:                    opts,
+		events:                  new(eventRing),
+		rewriteRules:            EmptyRewriteRule(),
+		rewriteRuleIndex:        newRewriteRuleIndex(),
+		sendErr:                 errCh,
+		outCh:                   output,
+		sender:                  sender,
+		manager:                 manager,
+		sendCh:                  sendChan,
+		cachedTablesMu:          new(sync.Mutex),
+		rewriteRulesMu:          new(sync.Mutex),
+		inFlight:                make(map[int64]struct{}),
+		sendMu:                  new(sync.Mutex),
+		everythingIsDone:        new(sync.WaitGroup),
+		batchSizeThreshold:      1,
+		batchBytesThreshold:     opts.BytesThreshold,
+		progressMu:              new(sync.Mutex),
+		bytesPerCF:              make(map[string]uint64),
+		batchLatency:            NewLatencyDigest(),
+		accounts:                make(map[int64]*tableAccount),
+		skipped:                 make(map[string]*RestoreCount),
+		closeDone:               make(chan struct{}),
+		restoreWaiters:          make(map[int64]chan struct{}),
+		clock:                   opts.Clock,
+		reporter:                opts.ProgressReporter,
+		onTableRestored:         opts.OnTableRestored,
+		rewriteRulesSizeLimit:   opts.RewriteRulesSizeLimit,
+		autoCommitJoinTimeout:   opts.AutoCommitJoinTimeout,
+		minAutoCommitInterval:   opts.MinAutoCommitInterval,
+		blockAddOnFlush:         opts.BlockAddOnFlush,
+		maxInFlightTables:       opts.MaxInFlightTables,
+		maxPendingAge:           opts.MaxPendingAge,
+		maxTablesPerBatch:       opts.MaxTablesPerBatch,
+		cachedTablesLimit:       opts.CachedTablesLimit,
+		cachedTablesLimitAction: opts.CachedTablesLimitAction,
+		metrics:                 opts.Metrics,
+		checkpoint:              opts.Checkpoint,
+		rangeFilters:            opts.RangeFilters,
+		emitRetryBackoff:        opts.EmitRetryBackoff,
+		emitTimeout:             opts.EmitTimeout,
+		keyspaces:               opts.KeyspaceMapping,
+		drainStrategy:           opts.DrainStrategy,
+	}
+	if b.clock == nil {
+		b.clock = utils.SystemClock
+	}
+	if opts.OnTableStarted != nil {
+		b.onTableStarted = opts.OnTableStarted
+		b.started = make(map[int64]struct{})
+	}
+	if opts.Checkpoint != nil {
+		b.progress = opts.Checkpoint.Progress()
+	}
+	if opts.TotalBytes > 0 {
+		b.totalBytes = opts.TotalBytes
+		b.eta = NewETAEstimator(DefaultETAWindow)
+		b.eta.SetTotal(opts.TotalBytes)
+		b.eta.Observe(time.Now(), b.progress.BytesSent)
+	}
+	if _, ok := b.drainStrategy.(FIFODrainStrategy); ok {
+		b.drainStrategy = nil
+	}
+	if opts.EventBufferSize > 0 {
+		b.events.resize(opts.EventBufferSize)
+	}
+	if len(opts.TableGroups) > 0 {
+		b.tableGroups = make(map[int64]*tableGroup)
+		for _, ids := range opts.TableGroups {
+			group := &tableGroup{size: len(ids)}
+			for _, id := range ids {
+				b.tableGroups[id] = group
+			}
+		}
+	}
+	if opts.OrderedOutputLimit > 0 {
+		b.reorder = &reorderBuffer{limit: opts.OrderedOutputLimit, pending: make(map[uint64]CreatedTable)}
+		b.addSeq = make(map[int64]uint64)
 	}
 	b.everythingIsDone.Add(2)
 	go b.sendWorker(ctx, sendChan)
 	restoredTables := make(chan []CreatedTable, defaultChannelSize)
 	go b.contextCleaner(ctx, restoredTables)
-	sink := chanTableSink{restoredTables, errCh}
+	sink := chanTableSink{restoredTables, errCh, b.events}
 	sender.PutSink(sink)
 	return b, output
 }
 
 // EnableAutoCommit enables the batcher commit batch periodically even batcher size isn't big enough.
 // we make this function for disable AutoCommit in some case.
-func (b *Batcher) EnableAutoCommit(ctx context.Context, delay time.Duration) {
+// it returns ErrAutoCommitAlreadyEnabled if auto commit has been enabled, and the former worker keeps working.
+func (b *Batcher) EnableAutoCommit(ctx context.Context, delay time.Duration) error {
 	if b.autoCommitJoiner != nil {
 		// IMO, making two auto commit goroutine wouldn't be a good idea.
 		// If desire(e.g. change the peroid of auto commit), please disable auto commit firstly.
-		log.L().DPanic("enabling auto commit on a batcher that auto commit has been enabled, which isn't allowed")
+		log.Warn("enabling auto commit on a batcher that auto commit has been enabled, which isn't allowed",
+			zap.Duration("interval", b.autoCommitInterval), zap.Duration("new-interval", delay))
+		return errors.Annotatef(berrors.ErrAutoCommitAlreadyEnabled, "interval %s", b.autoCommitInterval)
+	}
+	minInterval := b.minAutoCommitInterval
+	if minInterval <= 0 {
+		minInterval = DefaultMinAutoCommitInterval
+	}
+	if delay < minInterval {
+		log.Warn("the auto commit interval is too short, use the min interval instead",
+			zap.Duration("interval", delay), zap.Duration("min-interval", minInterval))
+		delay = minInterval
 	}
 	joiner := make(chan struct{})
-	go b.autoCommitWorker(ctx, joiner, delay)
+	done := make(chan struct{})
+	go b.autoCommitWorker(ctx, joiner, done, delay)
 	b.autoCommitJoiner = joiner
+	b.autoCommitDone = done
+	b.autoCommitInterval = delay
+	atomic.StoreInt32(&b.autoCommitEnabled, 1)
+	return nil
 }
 
 // DisableAutoCommit blocks the current goroutine until the worker can gracefully stop,
@@ -144,8 +875,13 @@ func (b *Batcher) EnableAutoCommit(ctx context.Context, delay time.Duration) {
 func (b *Batcher) DisableAutoCommit() {
 	b.joinAutoCommitWorker()
 	b.autoCommitJoiner = nil
+	b.autoCommitInterval = 0
+	atomic.StoreInt32(&b.autoCommitEnabled, 0)
 }
 
+// waitUntilSendDone sends all pending ranges, then waits for the workers to stop.
+// the ranges are drained whether their batch fails or not(the error goes to the error channel),
+// so each pending range is sent once, and a failing sender or context manager cannot make it loop.
 func (b *Batcher) waitUntilSendDone() {
 	b.sendCh <- SendAllThenClose
 	b.everythingIsDone.Wait()
@@ -153,10 +889,25 @@ func (b *Batcher) waitUntilSendDone() {
 
 // joinAutoCommitWorker blocks the current goroutine until the worker can gracefully stop.
 // return immediately when auto commit disabled.
+// if the worker doesn't stop in autoCommitJoinTimeout, leave it stopping in background.
 func (b *Batcher) joinAutoCommitWorker() {
 	if b.autoCommitJoiner != nil {
 		log.Debug("gracefully stopping worker goroutine")
-		b.autoCommitJoiner <- struct{}{}
+		var timeout <-chan time.Time
+		if b.autoCommitJoinTimeout > 0 {
+			timer := time.NewTimer(b.autoCommitJoinTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case b.autoCommitJoiner <- struct{}{}:
+		case <-b.autoCommitDone:
+			log.Debug("worker goroutine has exited")
+		case <-timeout:
+			// the worker would exit once it receives from the closed joiner.
+			log.Warn("timeout when waiting for the auto commit worker stop, leave it stopping in background",
+				zap.Duration("timeout", b.autoCommitJoinTimeout))
+		}
 		close(b.autoCommitJoiner)
 		log.Debug("gracefully stopped worker goroutine")
 	}
@@ -165,20 +916,76 @@ func (b *Batcher) joinAutoCommitWorker() {
 // sendWorker is the 'worker' that send all ranges to TiKV.
 // TODO since all operations are asynchronous now, it's possible to remove this worker.
 func (b *Batcher) sendWorker(ctx context.Context, send <-chan SendType) {
-	sendUntil := func(lessOrEqual int) {
-		for b.Len() > lessOrEqual {
-			b.Send(ctx)
+	sendUntil := func(needsSend func() bool) {
+		b.sendMu.Lock()
+		defer b.sendMu.Unlock()
+		b.sendWhile(ctx, needsSend)
+	}
+	notEmpty := func() bool { return b.Len() > 0 }
+	overBatch := func() bool {
+		if b.batchSizeThreshold > 0 && b.Len() > b.batchSizeThreshold {
+			return true
 		}
+		return b.Len() > 0 && b.batchBytesThreshold > 0 && b.ByteLen() >= b.batchBytesThreshold
 	}
 
-	for sendType := range send {
+	// the stale tables are checked periodically, so they are sent even if no more table is added.
+	// there is nothing to check if the pending age is unlimited, leave the channel nil then.
+	var staleTick <-chan time.Time
+	if b.maxPendingAge > 0 {
+		ticker := time.NewTicker(staleCheckInterval)
+		defer ticker.Stop()
+		staleTick = ticker.C
+	}
+	for {
+		var sendType SendType
+		select {
+		case <-staleTick:
+			if b.isStale() {
+				sendUntil(notEmpty)
+			}
+			continue
+		case t, ok := <-send:
+			if !ok {
+				return
+			}
+			sendType = t
+		}
 		switch sendType {
 		case SendUntilLessThanBatch:
-			sendUntil(b.batchSizeThreshold)
+			sendUntil(overBatch)
+		case SendUntilLessThanBatchThenNotify:
+			sendUntil(overBatch)
+			b.blockedAddsMu.Lock()
+			close(b.blockedAdds[0])
+			b.blockedAdds = b.blockedAdds[1:]
+			b.blockedAddsMu.Unlock()
 		case SendAll:
-			sendUntil(0)
+			sendUntil(notEmpty)
+		case SendAllThenNotify:
+			b.sendMu.Lock()
+			b.sendWhile(ctx, notEmpty)
+			for b.hasPendingTables() {
+				b.sendBatch(ctx, b.drainRanges())
+			}
+			b.sendMu.Unlock()
+			b.flushWaitersMu.Lock()
+			close(b.flushWaiters[0])
+			b.flushWaiters = b.flushWaiters[1:]
+			b.flushWaitersMu.Unlock()
 		case SendAllThenClose:
-			sendUntil(0)
+			b.sendMu.Lock()
+			b.sendWhile(ctx, notEmpty)
+			// tables without any range(e.g. all ranges are restored according to the checkpoint)
+			// won't make the batcher non-empty, send them lastly so they can be emitted.
+			// there may be more than one batch of them if the tables per batch are limited.
+			for b.hasPendingTables() {
+				b.sendBatch(ctx, b.drainRanges())
+			}
+			// a worker left in background(e.g. auto commit worker which timed out when joining)
+			// may still try to send, don't let it send to the closed sender.
+			b.sendClosed = true
+			b.sendMu.Unlock()
 			b.sender.Close()
 			b.everythingIsDone.Done()
 			return
@@ -186,19 +993,28 @@ func (b *Batcher) sendWorker(ctx context.Context, send <-chan SendType) {
 	}
 }
 
-func (b *Batcher) autoCommitWorker(ctx context.Context, joiner <-chan struct{}, delay time.Duration) {
+func (b *Batcher) autoCommitWorker(
+	ctx context.Context,
+	joiner <-chan struct{},
+	done chan<- struct{},
+	delay time.Duration,
+) {
 	tick := time.NewTicker(delay)
-	defer tick.Stop()
+	defer func() {
+		tick.Stop()
+		close(done)
+	}()
 	for {
 		select {
 		case <-joiner:
 			log.Debug("graceful stop signal received")
 			return
 		case <-ctx.Done():
-			b.sendErr <- ctx.Err()
+			b.flushWithGrace()
+			b.emitError(ctx.Err())
 			return
 		case <-tick.C:
-			if b.Len() > 0 {
+			if b.Len() > 0 && !b.isPaused() {
 				log.Debug("sending batch because time limit exceed", zap.Int("size", b.Len()))
 				b.asyncSend(SendAll)
 			}
@@ -206,6 +1022,59 @@ func (b *Batcher) autoCommitWorker(ctx context.Context, joiner <-chan struct{},
 	}
 }
 
+// flushWithGrace tries its best to send all pending ranges with a fresh context,
+// which would be canceled after autoCommitGracePeriod.
+// the contextCleaner keeps handling the restored tables in the same period, so they reach the output.
+// Note the batches may still be discarded by the sender if the context of the sender is done.
+func (b *Batcher) flushWithGrace() {
+	if b.Len() == 0 {
+		return
+	}
+	log.Info("context done, flushing pending ranges before auto commit stops", zap.Int("size", b.Len()))
+	ctx, cancel := context.WithTimeout(context.Background(), autoCommitGracePeriod)
+	defer cancel()
+	for b.Len() > 0 && ctx.Err() == nil {
+		b.Send(ctx)
+	}
+}
+
+// Flush sends all ranges and tables cached by the send worker, like the auto commit does,
+// so the results go to the output and error channels as usual, and the auto commit isn't touched.
+// it returns once all of them are passed to the sender, or ctx is done.
+// it is useful at logical checkpoints, e.g. a database is finished. don't call it concurrently with Close.
+func (b *Batcher) Flush(ctx context.Context) error {
+	b.sendMu.Lock()
+	closed := b.sendClosed
+	b.sendMu.Unlock()
+	if closed {
+		log.Warn("flushing after the batcher closed, skipping", zap.Int("size", b.Len()))
+		return nil
+	}
+	done := make(chan struct{})
+	// serialize the flushes, so the waiters are in the same order as the commands.
+	b.flushMu.Lock()
+	b.flushWaitersMu.Lock()
+	b.flushWaiters = append(b.flushWaiters, done)
+	b.flushWaitersMu.Unlock()
+	select {
+	case b.sendCh <- SendAllThenNotify:
+		b.flushMu.Unlock()
+	case <-ctx.Done():
+		// the command isn't sent, so the waiter is still the last one.
+		b.flushWaitersMu.Lock()
+		b.flushWaiters = b.flushWaiters[:len(b.flushWaiters)-1]
+		b.flushWaitersMu.Unlock()
+		b.flushMu.Unlock()
+		return errors.Annotate(ctx.Err(), "failed to flush the batcher")
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Annotate(ctx.Err(), "failed to wait for flushing the batcher")
+	}
+}
+
 func (b *Batcher) asyncSend(t SendType) {
 	// add a check here so we won't replica sending.
 	if len(b.sendCh) == 0 {
@@ -221,6 +1090,62 @@ type DrainResult struct {
 	BlankTablesAfterSend []CreatedTable
 	RewriteRules         *RewriteRules
 	Ranges               []rtree.Range
+
+	// sent is what each table sends in this batch.
+	sent countOfTables
+	// splitAt is when the regions of this batch were split, set by the tikvSender.
+	splitAt time.Time
+	// tableRanges is the ranges of each table in this batch.
+	tableRanges []tableRanges
+}
+
+// tableRanges is the ranges of a table in a batch.
+type tableRanges struct {
+	table  CreatedTable
+	ranges []rtree.Range
+}
+
+// files returns all files of the ranges.
+func (tr tableRanges) files() []*backup.File {
+	files := make([]*backup.File, 0, len(tr.ranges)*2)
+	for _, rng := range tr.ranges {
+		files = append(files, rng.Files...)
+	}
+	return files
+}
+
+// Size returns the total size of the files of this drain result.
+func (result DrainResult) Size() uint64 {
+	size := uint64(0)
+	for _, rng := range result.Ranges {
+		size += rangeSize(rng)
+	}
+	return size
+}
+
+// cfOf returns the column family of the file, which is inferred by its name if the file doesn't record it.
+func cfOf(file *backup.File) string {
+	switch {
+	case len(file.GetCf()) > 0:
+		return file.GetCf()
+	case strings.Contains(file.GetName(), writeCFName):
+		return writeCFName
+	case strings.Contains(file.GetName(), defaultCFName):
+		return defaultCFName
+	case strings.Contains(file.GetName(), lockCFName):
+		return lockCFName
+	default:
+		return unknownCFName
+	}
+}
+
+// rangeSize returns the total size of files of the range.
+func rangeSize(rng rtree.Range) uint64 {
+	size := uint64(0)
+	for _, f := range rng.Files {
+		size += f.GetSize_()
+	}
+	return size
 }
 
 // Files returns all files of this drain result.
@@ -238,6 +1163,7 @@ func newDrainResult() DrainResult {
 		BlankTablesAfterSend: make([]CreatedTable, 0),
 		RewriteRules:         EmptyRewriteRule(),
 		Ranges:               make([]rtree.Range, 0),
+		sent:                 make(countOfTables),
 	}
 }
 
@@ -264,19 +1190,49 @@ func (b *Batcher) drainRanges() DrainResult {
 
 	b.cachedTablesMu.Lock()
 	defer b.cachedTablesMu.Unlock()
+	b.reorderCachedTables()
 
+	collectedBytes := uint64(0)
+	var batchKeyspace keyspaceOfTable
 	for offset, thisTable := range b.cachedTables {
 		thisTableLen := len(thisTable.Range)
 		collected := len(result.Ranges)
 
-		result.RewriteRules.Append(*thisTable.RewriteRule)
+		if b.maxTablesPerBatch > 0 && len(result.BlankTablesAfterSend) >= b.maxTablesPerBatch {
+			log.Debug("stop draining because the batch has drained enough tables",
+				zap.Int("tables", len(result.BlankTablesAfterSend)))
+			b.cachedTables = b.cachedTables[offset:]
+			b.cachedTablesAddedAt = b.cachedTablesAddedAt[offset:]
+			return result
+		}
+
+		// a batch never spans keyspaces, or the ranges would be ingested with the rewrite rules of another keyspace.
+		if b.keyspaces != nil {
+			keyspace := b.keyspaceOf(thisTable.OldTable.Info.ID)
+			if offset > 0 && keyspace != batchKeyspace {
+				log.Debug("stop draining at the table of another keyspace",
+					zap.Stringer("table", thisTable.Table.Name),
+					zap.Uint32("keyspace", uint32(keyspace.id)),
+					zap.Uint32("batch-keyspace", uint32(batchKeyspace.id)),
+				)
+				b.cachedTables = b.cachedTables[offset:]
+				b.cachedTablesAddedAt = b.cachedTablesAddedAt[offset:]
+				return result
+			}
+			batchKeyspace = keyspace
+		}
+
+		result.RewriteRules.AppendUnique(*thisTable.RewriteRule)
 		result.TablesToSend = append(result.TablesToSend, thisTable.CreatedTable)
 
+		drainSize, drainBytes := b.drainSizeOf(thisTable.Range, collected, collectedBytes)
+		collectedBytes += drainBytes
+		atomic.AddUint64(&b.bytes, ^(drainBytes - 1))
+
 		// the batch is full, we should stop here!
-		// we use strictly greater than because when we send a batch at equal, the offset should plus one.
+		// we don't stop when the table fits the batch exactly, because then the offset should plus one.
 		// (because the last table is sent, we should put it in emptyTables), and this will introduce extra complex.
-		if thisTableLen+collected > b.batchSizeThreshold {
-			drainSize := b.batchSizeThreshold - collected
+		if drainSize < thisTableLen {
 			thisTableRanges := thisTable.Range
 
 			var drained []rtree.Range
@@ -288,7 +1244,10 @@ func (b *Batcher) drainRanges() DrainResult {
 				zap.Int("drained", drainSize),
 			)
 			result.Ranges = append(result.Ranges, drained...)
+			result.sent.of(thisTable.CreatedTable).add(countOfRanges(drained))
+			result.tableRanges = append(result.tableRanges, tableRanges{table: thisTable.CreatedTable, ranges: drained})
 			b.cachedTables = b.cachedTables[offset:]
+			b.cachedTablesAddedAt = b.cachedTablesAddedAt[offset:]
 			atomic.AddInt32(&b.size, -int32(len(drained)))
 			return result
 		}
@@ -297,6 +1256,10 @@ func (b *Batcher) drainRanges() DrainResult {
 		// let's 'drain' the ranges of current table. This op must not make the batch full.
 		result.Ranges = append(result.Ranges, thisTable.Range...)
 		atomic.AddInt32(&b.size, -int32(len(thisTable.Range)))
+		result.sent.of(thisTable.CreatedTable).add(countOfRanges(thisTable.Range))
+		if len(thisTable.Range) > 0 {
+			result.tableRanges = append(result.tableRanges, tableRanges{table: thisTable.CreatedTable, ranges: thisTable.Range})
+		}
 		// clear the table length.
 		b.cachedTables[offset].Range = []rtree.Range{}
 		log.Debug("draining table to batch",
@@ -308,9 +1271,47 @@ func (b *Batcher) drainRanges() DrainResult {
 
 	// all tables are drained.
 	b.cachedTables = []TableWithRange{}
+	b.cachedTablesAddedAt = []time.Time{}
 	return result
 }
 
+// drainSizeOf returns how many ranges(and the total size of them) from the head of the ranges
+// can be drained into the batch, which has collected `collected` ranges with `collectedBytes` bytes.
+// the first range of a batch is always drained even if it exceeds the bytes threshold by itself,
+// or the batcher would never make progress.
+func (b *Batcher) drainSizeOf(ranges []rtree.Range, collected int, collectedBytes uint64) (int, uint64) {
+	drainSize := len(ranges)
+	if b.batchSizeThreshold > 0 && drainSize+collected > b.batchSizeThreshold {
+		drainSize = b.batchSizeThreshold - collected
+	}
+	if b.batchBytesThreshold == 0 {
+		size := uint64(0)
+		for _, rng := range ranges[:drainSize] {
+			size += rangeSize(rng)
+		}
+		return drainSize, size
+	}
+	size := uint64(0)
+	for i, rng := range ranges[:drainSize] {
+		thisSize := rangeSize(rng)
+		if collectedBytes+size+thisSize <= b.batchBytesThreshold {
+			size += thisSize
+			continue
+		}
+		if collected == 0 && i == 0 {
+			log.Warn("a single range exceeds the bytes threshold of a batch, sending it in its own batch",
+				logutil.Key("startKey", rng.StartKey),
+				logutil.Key("endKey", rng.EndKey),
+				zap.Uint64("size", thisSize),
+				zap.Uint64("threshold", b.batchBytesThreshold),
+			)
+			return 1, thisSize
+		}
+		return i, size
+	}
+	return drainSize, size
+}
+
 // Send sends all pending requests in the batcher.
 // returns tables sent FULLY in the current batch.
 func (b *Batcher) Send(ctx context.Context) {
@@ -320,28 +1321,308 @@ func (b *Batcher) Send(ctx context.Context) {
 		ctx = opentracing.ContextWithSpan(ctx, span1)
 	}
 
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+	if b.sendClosed {
+		log.Warn("sending after the batcher closed, skipping", zap.Int("size", b.Len()))
+		return
+	}
+	drainResult := b.drainRanges()
+	b.sendBatch(ctx, drainResult)
+}
+
+// SendAndWait is like Send, but it returns only after the sender restored the tables sent FULLY in the batch,
+// with these tables. the tables are still emitted to the output channel, which must be drained, too.
+// it doesn't wait for emitting, which may be held back(e.g. by BatcherOptions.TableGroups or OrderedOutputLimit),
+// or never happen if BatcherOptions.OnTableRestored fails on the table.
+// if some tables cannot be restored(the error is emitted to the error channel), it waits until ctx is done.
+func (b *Batcher) SendAndWait(ctx context.Context) ([]CreatedTable, error) {
+	b.sendMu.Lock()
+	if b.sendClosed {
+		b.sendMu.Unlock()
+		log.Warn("sending after the batcher closed, skipping", zap.Int("size", b.Len()))
+		return nil, nil
+	}
 	drainResult := b.drainRanges()
+	tables := drainResult.BlankTablesAfterSend
+	waiters := make([]chan struct{}, 0, len(tables))
+	b.restoreWaitersMu.Lock()
+	for _, tbl := range tables {
+		waiter := make(chan struct{})
+		b.restoreWaiters[tbl.Table.ID] = waiter
+		waiters = append(waiters, waiter)
+	}
+	b.restoreWaitersMu.Unlock()
+	err := b.sendBatch(ctx, drainResult)
+	b.sendMu.Unlock()
+	if err != nil {
+		b.forgetRestoreWaiters(tables)
+		return nil, errors.Trace(err)
+	}
+
+	for _, waiter := range waiters {
+		select {
+		case <-waiter:
+		case <-ctx.Done():
+			b.forgetRestoreWaiters(tables)
+			return nil, errors.Annotate(ctx.Err(), "failed to wait for the tables of the batch restored")
+		}
+	}
+	return tables, nil
+}
+
+// forgetRestoreWaiters unregisters the waiters of the tables, which would never be waited.
+func (b *Batcher) forgetRestoreWaiters(tables []CreatedTable) {
+	b.restoreWaitersMu.Lock()
+	defer b.restoreWaitersMu.Unlock()
+	for _, tbl := range tables {
+		delete(b.restoreWaiters, tbl.Table.ID)
+	}
+}
+
+// sendWhile sends batches one by one until needsSend returns false.
+// they aren't sent concurrently, because RestoreBatch only queues the batch to the sender,
+// whose workers split and ingest the queued batches concurrently(see TiKVSenderOptions.SplitConcurrency),
+// so sending concurrently would parallelize nothing but entering the context.
+// the caller should hold sendMu.
+func (b *Batcher) sendWhile(ctx context.Context, needsSend func() bool) {
+	for needsSend() {
+		b.sendBatch(ctx, b.drainRanges())
+	}
+}
+
+// sendBatch makes the tables of the batch enter the restore context, and then send the batch to the sender.
+// the error is emitted, it is returned only for the caller to know the batch failed.
+func (b *Batcher) sendBatch(ctx context.Context, drainResult DrainResult) error {
 	tbs := drainResult.TablesToSend
 	ranges := drainResult.Ranges
 	log.Info("restore batch start", rtree.ZapRanges(ranges), ZapTables(tbs))
+	b.events.record(EventSend, fmt.Sprintf("%d ranges of %d tables", len(ranges), len(tbs)))
+	if err := b.checkRewriteRulesSize(drainResult.RewriteRules); err != nil {
+		b.emitError(err)
+		return err
+	}
 	// Leave is called at b.contextCleaner
 	if err := b.manager.Enter(ctx, drainResult.TablesToSend); err != nil {
-		b.sendErr <- err
-		return
+		b.emitError(err)
+		return err
 	}
+	b.notifyTablesStarted(tbs)
+	start := time.Now()
 	b.sender.RestoreBatch(drainResult)
+	took := time.Since(start)
+	b.batchLatency.Observe(took)
+	if b.metrics != nil {
+		b.metrics.observeBatch(drainResult, took)
+	}
+	b.updateProgress(func(p *RestoreProgress) {
+		p.RangesSent += len(ranges)
+		p.BytesSent += drainResult.Size()
+		for _, f := range drainResult.Files() {
+			b.bytesPerCF[cfOf(f)] += f.GetSize_()
+		}
+		for id, sent := range drainResult.sent {
+			if account, ok := b.accounts[id]; ok {
+				account.Sent.add(*sent)
+			}
+		}
+	})
+	return nil
+}
+
+// notifyTablesStarted calls onTableStarted for the tables sent for the first time.
+func (b *Batcher) notifyTablesStarted(tbs []CreatedTable) {
+	if b.onTableStarted == nil {
+		return
+	}
+	b.startedMu.Lock()
+	defer b.startedMu.Unlock()
+	for _, tbl := range tbs {
+		if _, ok := b.started[tbl.Table.ID]; ok {
+			continue
+		}
+		b.started[tbl.Table.ID] = struct{}{}
+		b.onTableStarted(tbl)
+	}
+}
+
+// emitError sends the error to the error channel, and records it as an event.
+func (b *Batcher) emitError(err error) {
+	b.events.record(EventError, err.Error())
+	b.sendErr <- err
+}
+
+// DumpRecentEvents returns the recent events of the batcher, the oldest first.
+// nothing would be recorded unless BatcherOptions.EventBufferSize is set.
+func (b *Batcher) DumpRecentEvents() []BatcherEvent {
+	return b.events.recent()
+}
+
+// DumpOnPanic logs the recent events if the current goroutine is panicking, then keeps panicking.
+// install it by `defer batcher.DumpOnPanic()` in the goroutines driving the restore.
+func (b *Batcher) DumpOnPanic() {
+	if r := recover(); r != nil {
+		log.Error("panic during restoring, dumping the recent events of the batcher",
+			zap.Any("panic", r), zap.Any("events", b.DumpRecentEvents()))
+		panic(r)
+	}
+}
+
+// checkRewriteRulesSize checks whether the rewrite rules exceed the size limit.
+func (b *Batcher) checkRewriteRulesSize(rules *RewriteRules) error {
+	if b.rewriteRulesSizeLimit <= 0 {
+		return nil
+	}
+	size := rules.Size()
+	if size > b.rewriteRulesSizeLimit {
+		log.Warn("rewrite rules of the batch are too large",
+			zap.Int("size", size),
+			zap.Int("limit", b.rewriteRulesSizeLimit),
+		)
+		return errors.Annotatef(berrors.ErrRestoreRewriteRulesTooLarge,
+			"rewrite rules take %d bytes, exceed the limit %d bytes", size, b.rewriteRulesSizeLimit)
+	}
+	return nil
+}
+
+// updateProgress updates the progress of this batcher, and then report it to the reporter.
+func (b *Batcher) updateProgress(update func(p *RestoreProgress)) {
+	b.progressMu.Lock()
+	defer b.progressMu.Unlock()
+	update(&b.progress)
+	if b.eta != nil {
+		b.eta.Observe(time.Now(), b.progress.BytesSent)
+	}
+	if b.reporter != nil {
+		b.reporter.ReportProgress(b.progress)
+	}
 }
 
 func (b *Batcher) sendIfFull() {
-	if b.Len() >= b.batchSizeThreshold {
+	if b.isPaused() {
+		return
+	}
+	if b.isFull() {
 		log.Debug("sending batch because batcher is full", zap.Int("size", b.Len()))
+		if b.blockAddOnFlush {
+			b.sendMu.Lock()
+			closed := b.sendClosed
+			b.sendMu.Unlock()
+			if closed {
+				log.Warn("adding after the batcher closed, skipping sending", zap.Int("size", b.Len()))
+				return
+			}
+			// don't skip sending like asyncSend, or nobody would notify us.
+			done := make(chan struct{})
+			b.blockedAddsMu.Lock()
+			b.blockedAdds = append(b.blockedAdds, done)
+			b.blockedAddsMu.Unlock()
+			b.sendCh <- SendUntilLessThanBatchThenNotify
+			<-done
+			return
+		}
 		b.asyncSend(SendUntilLessThanBatch)
 	}
 }
 
 // Add adds a task to the Batcher.
 func (b *Batcher) Add(tbs TableWithRange) {
+	if err := b.checkCachedTablesLimit(); err != nil {
+		log.Error("too many tables cached, refusing to add table",
+			zap.Stringer("db", tbs.OldTable.DB.Name),
+			zap.Stringer("table", tbs.Table.Name),
+			zap.Error(err))
+		b.emitError(err)
+		return
+	}
+	if keyspace, ok := b.keyspaces[tbs.OldTable.Info.ID]; ok {
+		log.Debug("routing table to keyspace",
+			zap.Stringer("table", tbs.Table.Name),
+			zap.Uint32("keyspace", uint32(keyspace)),
+		)
+		tbs.RewriteRule = tbs.RewriteRule.WithNewKeyPrefix(keyspace.Prefix())
+	}
+	// check the rewrite rules before anything else, so a table whose rules conflict with the added ones
+	// is neither restored nor accounted(e.g. in the progress or by the checkpoint).
+	b.rewriteRulesMu.Lock()
+	// the rules already added(e.g. by another part of the same table) needn't be appended again.
+	fresh := b.rewriteRuleIndex.unindexed(*tbs.RewriteRule)
+	if err := b.rewriteRuleIndex.add(*tbs.RewriteRule); err != nil {
+		b.rewriteRulesMu.Unlock()
+		log.Error("the rewrite rules of table conflict with the added ones",
+			zap.Stringer("db", tbs.OldTable.DB.Name),
+			zap.Stringer("table", tbs.Table.Name),
+			zap.Error(err))
+		b.emitError(err)
+		return
+	}
+	b.rewriteRules.Append(fresh)
+	b.rewriteRulesMu.Unlock()
+
+	account := b.accountOf(tbs.CreatedTable)
+	b.progressMu.Lock()
+	account.added(tbs.Range)
+	b.progressMu.Unlock()
+	if b.checkpoint != nil {
+		remaining := b.checkpoint.RemoveRestored(tbs.Range, tbs.RewriteRule)
+		skipped := countOfRanges(tbs.Range)
+		skipped.sub(countOfRanges(remaining))
+		b.progressMu.Lock()
+		account.Checkpointed.add(skipped)
+		b.progressMu.Unlock()
+		if len(remaining) < len(tbs.Range) {
+			log.Info("skipping ranges restored according to the checkpoint",
+				zap.Stringer("db", tbs.OldTable.DB.Name),
+				zap.Stringer("table", tbs.Table.Name),
+				zap.Int("skipped", len(tbs.Range)-len(remaining)),
+				zap.Int("remaining", len(remaining)),
+			)
+		}
+		tbs.Range = remaining
+	}
+	if len(b.rangeFilters) > 0 {
+		kept := make([]rtree.Range, 0, len(tbs.Range))
+		filtered := make(map[string][]rtree.Range)
+	FilterRanges:
+		for _, rng := range tbs.Range {
+			for _, filter := range b.rangeFilters {
+				if !filter.KeepRange(tbs.CreatedTable, rng) {
+					name := rangeFilterName(filter)
+					filtered[name] = append(filtered[name], rng)
+					continue FilterRanges
+				}
+			}
+			kept = append(kept, rng)
+		}
+		if len(kept) < len(tbs.Range) {
+			log.Info("skipping ranges by the filter",
+				zap.Stringer("db", tbs.OldTable.DB.Name),
+				zap.Stringer("table", tbs.Table.Name),
+				zap.Int("skipped", len(tbs.Range)-len(kept)),
+				zap.Int("remaining", len(kept)),
+			)
+		}
+		b.progressMu.Lock()
+		for name, ranges := range filtered {
+			count := countOfRanges(ranges)
+			account.Filtered.add(count)
+			skipped, ok := b.skipped[name]
+			if !ok {
+				skipped = new(RestoreCount)
+				b.skipped[name] = skipped
+			}
+			skipped.add(count)
+		}
+		b.progressMu.Unlock()
+		tbs.Range = kept
+	}
+	b.events.record(EventAdd, fmt.Sprintf("table %s(%d) with %d ranges", tbs.Table.Name, tbs.Table.ID, len(tbs.Range)))
 	b.cachedTablesMu.Lock()
+	if b.aborted {
+		b.cachedTablesMu.Unlock()
+		log.Warn("adding table to an aborted batcher, discarding it", zap.Stringer("table", tbs.Table.Name))
+		return
+	}
 	log.Debug("adding table to batch",
 		zap.Stringer("db", tbs.OldTable.DB.Name),
 		zap.Stringer("table", tbs.Table.Name),
@@ -351,25 +1632,496 @@ func (b *Batcher) Add(tbs TableWithRange) {
 		zap.Int("batch size", b.Len()),
 	)
 	b.cachedTables = append(b.cachedTables, tbs)
-	b.rewriteRules.Append(*tbs.RewriteRule)
+	b.cachedTablesAddedAt = append(b.cachedTablesAddedAt, time.Now())
+	b.inFlight[tbs.Table.ID] = struct{}{}
+	if _, ok := b.addSeq[tbs.Table.ID]; b.reorder != nil && !ok {
+		b.addSeq[tbs.Table.ID] = b.nextAddSeq
+		b.nextAddSeq++
+	}
 	atomic.AddInt32(&b.size, int32(len(tbs.Range)))
+	for _, rng := range tbs.Range {
+		atomic.AddUint64(&b.bytes, rangeSize(rng))
+	}
 	b.cachedTablesMu.Unlock()
 
 	b.sendIfFull()
+	b.sendIfStale()
+}
+
+// checkCachedTablesLimit checks the count of cached tables against the sanity limit before adding a table.
+// once the limit is reached, it returns an error with CachedTablesLimitError,
+// or logs a warning with CachedTablesLimitWarn, each time the count reaches a multiple of the limit,
+// so the warning is loud but won't flood the log.
+func (b *Batcher) checkCachedTablesLimit() error {
+	if b.cachedTablesLimit <= 0 {
+		return nil
+	}
+	b.cachedTablesMu.Lock()
+	cached := len(b.cachedTables)
+	b.cachedTablesMu.Unlock()
+	if cached < b.cachedTablesLimit {
+		return nil
+	}
+	if b.cachedTablesLimitAction == CachedTablesLimitError {
+		return errors.Annotatef(berrors.ErrRestoreTooManyCachedTables,
+			"%d tables cached, reach the limit %d", cached, b.cachedTablesLimit)
+	}
+	if cached%b.cachedTablesLimit == 0 {
+		log.Warn("too many tables cached in the batcher, are the batches drained?",
+			zap.Int("cached", cached),
+			zap.Int("limit", b.cachedTablesLimit))
+		b.events.record(EventWarn, fmt.Sprintf("%d tables cached, reach the limit %d", cached, b.cachedTablesLimit))
+	}
+	return nil
+}
+
+// accountOf returns the accounting of the table, creates it if it doesn't exist.
+func (b *Batcher) accountOf(table CreatedTable) *tableAccount {
+	b.progressMu.Lock()
+	defer b.progressMu.Unlock()
+	account, ok := b.accounts[table.OldTable.Info.ID]
+	if !ok {
+		account = newTableAccount(table)
+		b.accounts[table.OldTable.Info.ID] = account
+	}
+	return account
+}
+
+// Reconciliation returns the report comparing what each table added has in the backup with what has been sent,
+// sorted by the table ID in the backup.
+func (b *Batcher) Reconciliation() []TableReconciliation {
+	b.progressMu.Lock()
+	defer b.progressMu.Unlock()
+	return reconcile(b.accounts)
+}
+
+// Progress returns the progress of each table added, by the ID of the table created for restoring.
+// a table drained across batches counts the ranges of each batch once the batch is sent.
+func (b *Batcher) Progress() map[int64]TableProgress {
+	b.progressMu.Lock()
+	defer b.progressMu.Unlock()
+	progress := make(map[int64]TableProgress, len(b.accounts))
+	for _, account := range b.accounts {
+		progress[account.newTableID] = account.progress()
+	}
+	return progress
+}
+
+// sendIfStale sends all pending ranges if the oldest pending table has been pending longer than maxPendingAge.
+// so a table whose tail ranges never fill the batch won't wait forever, even if auto commit is disabled.
+// the send worker checks it periodically as well, so it works even if no more table is added.
+func (b *Batcher) sendIfStale() {
+	if b.isStale() {
+		b.asyncSend(SendAll)
+	}
+}
+
+// isStale returns whether the oldest pending table has been pending longer than maxPendingAge.
+func (b *Batcher) isStale() bool {
+	if b.maxPendingAge <= 0 || b.isPaused() {
+		return false
+	}
+	b.cachedTablesMu.Lock()
+	defer b.cachedTablesMu.Unlock()
+	// the oldest table may not be the first one, if the tables are reordered by the drain strategy.
+	for _, addedAt := range b.cachedTablesAddedAt {
+		if time.Since(addedAt) >= b.maxPendingAge {
+			log.Debug("sending batch because some table has been pending too long",
+				zap.Duration("max-pending-age", b.maxPendingAge))
+			return true
+		}
+	}
+	return false
+}
+
+// Pause makes the batcher only cache the ranges added, until Resume is called.
+// while paused, neither a full batch, a stale table nor the auto commit would trigger sending,
+// but Send and Close still send the pending ranges.
+// it is useful for throttling the restore temporarily, e.g. when the cluster is under scheduling pressure.
+func (b *Batcher) Pause() {
+	if atomic.CompareAndSwapInt32(&b.paused, 0, 1) {
+		log.Info("batcher paused", zap.Int("size", b.Len()))
+	}
+}
+
+// Resume resumes the batcher paused, and sends the backlog over the threshold.
+func (b *Batcher) Resume() {
+	if !atomic.CompareAndSwapInt32(&b.paused, 1, 0) {
+		return
+	}
+	log.Info("batcher resumed", zap.Int("size", b.Len()))
+	b.sendIfFull()
+}
+
+func (b *Batcher) isPaused() bool {
+	return atomic.LoadInt32(&b.paused) != 0
+}
+
+// InFlightTables returns the IDs of tables whose ranges are cached or being restored,
+// i.e. the tables added but not fully restored yet. It is safe to call it concurrently.
+func (b *Batcher) InFlightTables() []int64 {
+	b.cachedTablesMu.Lock()
+	defer b.cachedTablesMu.Unlock()
+	ids := make([]int64, 0, len(b.inFlight))
+	for id := range b.inFlight {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// TableCreationBackpressure returns a callback for the creator of tables(which is upstream of Add) to poll
+// before creating more tables, it returns true while the count of in-flight tables reaches the limit set by
+// BatcherOptions.MaxInFlightTables, so created-but-empty tables won't pile up(and hold DDL locks) when ingesting is slow.
+// the callback is safe to be called concurrently, and always returns false if there isn't a limit.
+func (b *Batcher) TableCreationBackpressure() func() bool {
+	return func() bool {
+		if b.maxInFlightTables <= 0 {
+			return false
+		}
+		b.cachedTablesMu.Lock()
+		defer b.cachedTablesMu.Unlock()
+		return len(b.inFlight) >= b.maxInFlightTables
+	}
+}
+
+func (b *Batcher) hasPendingTables() bool {
+	b.cachedTablesMu.Lock()
+	defer b.cachedTablesMu.Unlock()
+	return len(b.cachedTables) > 0
+}
+
+// RewriteRulesSize estimates the in-memory size of rewrite rules of all tables added to this batcher.
+func (b *Batcher) RewriteRulesSize() int {
+	b.rewriteRulesMu.Lock()
+	defer b.rewriteRulesMu.Unlock()
+	return b.rewriteRules.Size()
+}
+
+// RewriteRules returns a copy of the rewrite rules of all tables added to this batcher.
+func (b *Batcher) RewriteRules() *RewriteRules {
+	b.rewriteRulesMu.Lock()
+	defer b.rewriteRulesMu.Unlock()
+	rules := EmptyRewriteRule()
+	rules.Append(*b.rewriteRules)
+	return rules
 }
 
 // Close closes the batcher, sending all pending requests, close updateCh.
+// it blocks until everything is flushed, see CloseContext for closing with a deadline.
 func (b *Batcher) Close() {
+	_ = b.CloseContext(context.Background())
+}
+
+// CloseContext is like Close, but it returns once ctx is done, with ErrRestoreCloseTimeout if closing isn't done yet,
+// e.g. some store is wedged. the closing goes on in background then, and the output channel would be closed
+// once everything is flushed. calling it(or Close) again waits for the same closing.
+func (b *Batcher) CloseContext(ctx context.Context) error {
+	b.closeOnce.Do(func() {
+		go func() {
+			defer close(b.closeDone)
+			b.close()
+		}()
+	})
+	select {
+	case <-b.closeDone:
+		return nil
+	case <-ctx.Done():
+		log.Warn("timeout when closing the batcher, leave it closing in background", zap.Int("pending", b.Len()))
+		return errors.Annotatef(berrors.ErrRestoreCloseTimeout, "closing isn't done, %d ranges are pending: %s", b.Len(), ctx.Err())
+	}
+}
+
+func (b *Batcher) close() {
 	log.Info("sending batch lastly on close", zap.Int("size", b.Len()))
 	b.DisableAutoCommit()
 	b.waitUntilSendDone()
+	b.flushCheckpoint()
+	// the context of the batcher may be done already, the emit timeout still bounds the final emitting.
+	b.emitReordered(context.Background())
+	b.emitIncompleteGroups(context.Background())
+	close(b.outCh)
+	close(b.sendCh)
+
+	stats := b.Stats()
+	log.Info("bytes sent of each column family", zap.Any("bytes", stats.BytesPerCF))
+	for cf, bytes := range stats.BytesPerCF {
+		summary.CollectUint(fmt.Sprintf("%s CF bytes", cf), bytes)
+	}
+	if latency := stats.BatchLatency; latency != nil {
+		log.Info("latency of sending batches", zap.Any("latency", latency))
+		summary.CollectDuration("batch latency p50", latency.P50)
+		summary.CollectDuration("batch latency p90", latency.P90)
+		summary.CollectDuration("batch latency p99", latency.P99)
+	}
+	for name, skipped := range b.SkippedByFilters() {
+		log.Info("skipped by the range filter", zap.String("filter", name), zap.Any("skipped", skipped))
+		summary.CollectInt(fmt.Sprintf("ranges skipped by %s filter", name), skipped.Ranges)
+		summary.CollectInt(fmt.Sprintf("files skipped by %s filter", name), skipped.Files)
+		summary.CollectUint(fmt.Sprintf("bytes skipped by %s filter", name), skipped.Bytes)
+	}
+	logReconciliation(b.Reconciliation())
+}
+
+// Abort stops the batcher fast, instead of flushing everything like Close:
+// it discards the cached ranges, cancels the batches in flight(if the sender is an AbortableSender),
+// and closes the output channel once the workers exit.
+// It returns the tables discarded, with their ranges not sent yet, tables added later are discarded too.
+// if ctx is done before the workers exit, it returns without waiting, and the output channel would be
+// closed in background.
+// it shares the shutdown with Close, so calling Close(or Abort again) after it only waits for the same shutdown.
+func (b *Batcher) Abort(ctx context.Context) []TableWithRange {
+	b.cachedTablesMu.Lock()
+	b.aborted = true
+	discarded := b.cachedTables
+	b.cachedTables = []TableWithRange{}
+	b.cachedTablesAddedAt = []time.Time{}
+	for _, tbl := range discarded {
+		delete(b.inFlight, tbl.Table.ID)
+	}
+	atomic.StoreInt32(&b.size, 0)
+	atomic.StoreUint64(&b.bytes, 0)
+	b.cachedTablesMu.Unlock()
+	log.Warn("aborting the batcher", zap.Int("discarded tables", len(discarded)))
+
+	b.cancel()
+	if sender, ok := b.sender.(AbortableSender); ok {
+		sender.Abort()
+	}
+	b.closeOnce.Do(func() {
+		go func() {
+			defer close(b.closeDone)
+			b.abort()
+		}()
+	})
+	select {
+	case <-b.closeDone:
+	case <-ctx.Done():
+		log.Warn("timeout when waiting for the batcher to abort, leave it stopping in background")
+	}
+	return discarded
+}
+
+// abort is the shutdown of Abort, like close, but the tables held(e.g. by table groups) are never emitted.
+func (b *Batcher) abort() {
+	b.DisableAutoCommit()
+	b.waitUntilSendDone()
+	b.flushCheckpoint()
 	close(b.outCh)
 	close(b.sendCh)
 }
 
+// flushCheckpoint saves the progress recorded in the checkpoint but not saved yet, if there is a checkpoint.
+func (b *Batcher) flushCheckpoint() {
+	if b.checkpoint == nil {
+		return
+	}
+	if err := b.checkpoint.Flush(context.Background()); err != nil {
+		log.Warn("failed to flush the checkpoint, the progress recorded lately would be redone", zap.Error(err))
+	}
+}
+
 // SetThreshold sets the threshold that how big the batch size reaching need to send batch.
+// zero means the count of ranges is unlimited, then the batches are measured by bytes only(see BatcherOptions.BytesThreshold),
+// which makes the batches even in data volume when the sizes of ranges vary.
 // note this function isn't goroutine safe yet,
 // just set threshold before anything starts(e.g. EnableAutoCommit), please.
 func (b *Batcher) SetThreshold(newThreshold int) {
 	b.batchSizeThreshold = newThreshold
 }
+
+// Stats returns the current statistics of the batcher.
+func (b *Batcher) Stats() RestoreStats {
+	b.progressMu.Lock()
+	defer b.progressMu.Unlock()
+	stats := RestoreStats{
+		RestoreProgress: b.progress,
+		TotalBytes:      b.totalBytes,
+		BytesPerCF:      make(map[string]uint64, len(b.bytesPerCF)),
+	}
+	for cf, bytes := range b.bytesPerCF {
+		stats.BytesPerCF[cf] = bytes
+	}
+	if b.eta != nil {
+		if eta, ok := b.eta.ETA(); ok {
+			stats.ETA = &eta
+		}
+	}
+	if latency, ok := b.batchLatency.Percentiles(); ok {
+		stats.BatchLatency = &latency
+	}
+	if sender, ok := b.sender.(splitClassifyingSender); ok {
+		split := sender.SplitResult()
+		stats.Split = &split
+	}
+	if sender, ok := b.sender.(firstIngestTimingSender); ok {
+		if elapsed, ok := sender.TimeToFirstIngest(); ok {
+			stats.TimeToFirstIngest = &elapsed
+		}
+	}
+	if sender, ok := b.sender.(dryRunSender); ok {
+		if report, ok := sender.DryRunReport(); ok {
+			stats.DryRun = &report
+		}
+	}
+	if sender, ok := b.sender.(emptyFilesSkippingSender); ok {
+		stats.SkippedEmptyFiles = sender.SkippedEmptyFiles()
+	}
+	if sender, ok := b.sender.(lockFilesSkippingSender); ok {
+		stats.SkippedLockFiles = sender.SkippedLockFiles()
+	}
+	return stats
+}
+
+// CachedTablesLimitAction is what the batcher does once the count of cached tables reaches the limit,
+// see BatcherOptions.CachedTablesLimit.
+type CachedTablesLimitAction string
+
+const (
+	// CachedTablesLimitWarn logs a warning, and the table is still added.
+	CachedTablesLimitWarn CachedTablesLimitAction = "warn"
+	// CachedTablesLimitError emits an error, and the table isn't added.
+	CachedTablesLimitError CachedTablesLimitAction = "error"
+)
+
+// SkippedByFilters returns what has been skipped by the range filters, by the names of the filters.
+func (b *Batcher) SkippedByFilters() map[string]RestoreCount {
+	b.progressMu.Lock()
+	defer b.progressMu.Unlock()
+	result := make(map[string]RestoreCount, len(b.skipped))
+	for name, count := range b.skipped {
+		result[name] = *count
+	}
+	return result
+}
+
+// keyspaceOfTable is the keyspace a table is routed to, mapped is false if the table isn't routed.
+type keyspaceOfTable struct {
+	id     KeyspaceID
+	mapped bool
+}
+
+// keyspaceOf returns the keyspace the table(by its ID in the backup) is routed to.
+func (b *Batcher) keyspaceOf(tableID int64) keyspaceOfTable {
+	id, ok := b.keyspaces[tableID]
+	return keyspaceOfTable{id: id, mapped: ok}
+}
+
+// BatcherConfig is a snapshot of the configuration of a batcher, which is useful for reproducing a restore.
+// each of BatcherOptions is in it, by the same name or the name in the option tag(see deriveConfig).
+type BatcherConfig struct {
+	BatchSizeThreshold    int           `json:"batch-size-threshold"`
+	BatchBytesThreshold   uint64        `json:"batch-bytes-threshold" option:"BytesThreshold"`
+	TotalBytes            uint64        `json:"total-bytes"`
+	AutoCommit            bool          `json:"auto-commit"`
+	AutoCommitInterval    time.Duration `json:"auto-commit-interval"`
+	AutoCommitJoinTimeout time.Duration `json:"auto-commit-join-timeout"`
+	MinAutoCommitInterval time.Duration `json:"min-auto-commit-interval"`
+	RewriteRulesSizeLimit int           `json:"rewrite-rules-size-limit"`
+	MaxPendingAge         time.Duration `json:"max-pending-age"`
+	MaxTablesPerBatch     int           `json:"max-tables-per-batch"`
+	MaxInFlightTables     int           `json:"max-in-flight-tables"`
+	BlockAddOnFlush       bool          `json:"block-add-on-flush"`
+	Checkpoint            bool          `json:"checkpoint"`
+	Metrics               bool          `json:"metrics"`
+	Clock                 bool          `json:"clock"`
+	ProgressReporter      bool          `json:"progress-reporter"`
+	OnTableStarted        bool          `json:"on-table-started"`
+	OnTableRestored       bool          `json:"on-table-restored"`
+	RangeFilter           bool          `json:"range-filter" option:"RangeFilters"`
+	DrainStrategy         bool          `json:"drain-strategy"`
+	EmitRetryBackoff      time.Duration `json:"emit-retry-backoff"`
+	EmitTimeout           time.Duration `json:"emit-timeout"`
+	EventBufferSize       int           `json:"event-buffer-size"`
+	// CachedTablesLimitAction is empty if CachedTablesLimit is zero.
+	CachedTablesLimit       int                     `json:"cached-tables-limit"`
+	CachedTablesLimitAction CachedTablesLimitAction `json:"cached-tables-limit-action,omitempty"`
+	// OrderedOutputLimit is zero if the tables are emitted in the order they are restored.
+	OrderedOutputLimit int                  `json:"ordered-output-limit"`
+	KeyspaceMapping    map[int64]KeyspaceID `json:"keyspace-mapping,omitempty"`
+	TableGroups        [][]int64            `json:"table-groups,omitempty"`
+	// Sender is the configuration of the sender, nil if the sender doesn't expose its configuration.
+	Sender *SenderConfig `json:"sender,omitempty"`
+}
+
+// deriveConfig sets the fields of the config from the options, so a new option cannot be missed by the config.
+// the options of plain data are copied, the others(e.g. callbacks) are reported by whether they are set.
+// it panics if an option isn't in the config, which is a bug caught by the tests.
+func (opts *BatcherOptions) deriveConfig(cfg *BatcherConfig) {
+	cfgValue := reflect.ValueOf(cfg).Elem()
+	fields := make(map[string]reflect.Value, cfgValue.NumField())
+	for i := 0; i < cfgValue.NumField(); i++ {
+		field := cfgValue.Type().Field(i)
+		name := field.Name
+		if option, ok := field.Tag.Lookup("option"); ok {
+			name = option
+		}
+		fields[name] = cfgValue.Field(i)
+	}
+	optsValue := reflect.ValueOf(opts).Elem()
+	for i := 0; i < optsValue.NumField(); i++ {
+		name := optsValue.Type().Field(i).Name
+		option := optsValue.Field(i)
+		field, ok := fields[name]
+		switch {
+		case !ok:
+			panic(fmt.Sprintf("the batcher option %s isn't in BatcherConfig", name))
+		case field.Type() == option.Type():
+			field.Set(option)
+		case field.Kind() == reflect.Bool:
+			field.SetBool(!option.IsZero())
+		default:
+			panic(fmt.Sprintf("the batcher option %s is %s, which cannot be %s in BatcherConfig",
+				name, option.Type(), field.Type()))
+		}
+	}
+}
+
+// splitClassifyingSender is a sender which can expose the outcome of splitting.
+type splitClassifyingSender interface {
+	SplitResult() SplitResult
+}
+
+// firstIngestTimingSender is a sender which can expose the time to the first files ingested.
+type firstIngestTimingSender interface {
+	TimeToFirstIngest() (time.Duration, bool)
+}
+
+// dryRunSender is a sender which can expose what would have been restored in dry-run mode.
+type dryRunSender interface {
+	DryRunReport() (DryRunReport, bool)
+}
+
+// emptyFilesSkippingSender is a sender which can expose the count of empty files skipped.
+type emptyFilesSkippingSender interface {
+	SkippedEmptyFiles() int
+}
+
+// lockFilesSkippingSender is a sender which can expose the count of lock CF files skipped.
+type lockFilesSkippingSender interface {
+	SkippedLockFiles() int
+}
+
+// configurableSender is a sender which can expose its configuration.
+type configurableSender interface {
+	Config() SenderConfig
+}
+
+// Config returns a snapshot of the current configuration of the batcher.
+// like SetThreshold, it isn't goroutine safe to call this concurrently with it.
+func (b *Batcher) Config() BatcherConfig {
+	cfg := BatcherConfig{
+		BatchSizeThreshold: b.batchSizeThreshold,
+		AutoCommit:         b.autoCommitJoiner != nil,
+		AutoCommitInterval: b.autoCommitInterval,
+	}
+	b.opts.deriveConfig(&cfg)
+	if b.cachedTablesLimit == 0 {
+		cfg.CachedTablesLimitAction = ""
+	}
+	if sender, ok := b.sender.(configurableSender); ok {
+		senderCfg := sender.Config()
+		cfg.Sender = &senderCfg
+	}
+	return cfg
+}
@@ -5,19 +5,31 @@ package restore_test
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"testing"
 	"time"
 
+	"github.com/pingcap/kvproto/pkg/backup"
 	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/pingcap/br/pkg/restore"
 
 	. "github.com/pingcap/check"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/parser/model"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/lightning/metric"
 	"github.com/pingcap/br/pkg/rtree"
 	"github.com/pingcap/br/pkg/utils"
 )
@@ -29,6 +41,7 @@ type drySender struct {
 
 	rewriteRules *restore.RewriteRules
 	ranges       []rtree.Range
+	batches      [][]rtree.Range
 	nBatch       int
 
 	sink restore.TableSink
@@ -45,6 +58,7 @@ func (sender *drySender) RestoreBatch(ranges restore.DrainResult) {
 	sender.nBatch++
 	sender.rewriteRules.Append(*ranges.RewriteRules)
 	sender.ranges = append(sender.ranges, ranges.Ranges...)
+	sender.batches = append(sender.batches, ranges.Ranges)
 	sender.sink.EmitTables(ranges.BlankTablesAfterSend...)
 }
 
@@ -60,6 +74,12 @@ func (sender *drySender) Ranges() []rtree.Range {
 	return sender.ranges
 }
 
+func (sender *drySender) Batches() [][]rtree.Range {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	return append([][]rtree.Range{}, sender.batches...)
+}
+
 func newDrySender() *drySender {
 	return &drySender{
 		rewriteRules: restore.EmptyRewriteRule(),
@@ -188,6 +208,19 @@ func fakeRange(startKey, endKey string) rtree.Range {
 	}
 }
 
+func fakeRangeWithSize(startKey, endKey string, size uint64) rtree.Range {
+	rng := fakeRange(startKey, endKey)
+	rng.Files = []*backup.File{
+		{
+			Name:     startKey + ".sst",
+			StartKey: []byte(startKey),
+			EndKey:   []byte(endKey),
+			Size_:    size,
+		},
+	}
+	return rng
+}
+
 func join(nested [][]rtree.Range) (plain []rtree.Range) {
 	for _, ranges := range nested {
 		plain = append(plain, ranges...)
@@ -243,7 +276,7 @@ func (*testBatcherSuite) TestAutoSend(c *C) {
 	c.Assert(batcher.Len(), Greater, 0)
 
 	// enable auto commit.
-	batcher.EnableAutoCommit(ctx, 100*time.Millisecond)
+	c.Assert(batcher.EnableAutoCommit(ctx, 100*time.Millisecond), IsNil)
 	time.Sleep(200 * time.Millisecond)
 
 	c.Assert(sender.RangeLen(), Greater, 0)
@@ -288,6 +321,213 @@ func (*testBatcherSuite) TestSplitRangeOnSameTable(c *C) {
 	}
 }
 
+func (*testBatcherSuite) TestNilSender(c *C) {
+	errCh := make(chan error, 8)
+	c.Assert(func() {
+		restore.NewBatcher(context.Background(), nil, newMockManager(), errCh)
+	}, PanicMatches, "the sender of batcher is nil")
+}
+
+func (*testBatcherSuite) TestMockSender(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	sender := restore.NewMockSender()
+	sender.FailBatch(1, errors.New("injected failure"))
+	batcher, _ := restore.NewBatcher(ctx, sender, crashTolerantManager{newMockManager()}, errCh)
+	batcher.SetThreshold(2)
+
+	simpleTable := fakeTableWithRange(1, []rtree.Range{
+		fakeRange("caa", "cab"), fakeRange("cac", "cad"),
+		fakeRange("cae", "caf"), fakeRange("cag", "cai"),
+		fakeRange("caj", "cak"), fakeRange("cal", "cam"),
+	})
+	simpleTable.RewriteRule = fakeRewriteRules("a", "b")
+
+	batcher.Add(simpleTable)
+	batcher.Close()
+	errs := restore.Exhaust(errCh)
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errs[0], ErrorMatches, "injected failure")
+
+	// the table is drained partially by each batch, and emitted by the last one.
+	batches := sender.Batches()
+	c.Assert(batches, HasLen, 3)
+	for i, batch := range batches {
+		c.Assert(batch.Ranges, DeepEquals, simpleTable.Range[i*2:i*2+2])
+		c.Assert(batch.RewriteRules.Table, DeepEquals, simpleTable.RewriteRule.Table)
+	}
+	c.Assert(batches[0].Tables, HasLen, 0)
+	c.Assert(batches[1].Tables, HasLen, 0)
+	c.Assert(batches[2].Tables, HasLen, 1)
+	c.Assert(batches[2].Tables[0].Table.ID, Equals, int64(1))
+}
+
+func readHistogramCount(c *C, histogram prometheus.Histogram) uint64 {
+	var m dto.Metric
+	c.Assert(histogram.Write(&m), IsNil)
+	return m.GetHistogram().GetSampleCount()
+}
+
+func (*testBatcherSuite) TestBatcherMetrics(c *C) {
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	registry := prometheus.NewRegistry()
+	metrics, err := restore.NewBatcherMetrics(registry)
+	c.Assert(err, IsNil)
+	batcher, _, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{Metrics: metrics})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(2)
+	// the metrics cannot be registered twice.
+	_, err = restore.NewBatcherMetrics(registry)
+	c.Assert(err, NotNil)
+
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		fakeRangeWithSize("caa", "cab", 10), fakeRangeWithSize("cac", "cad", 10),
+		fakeRangeWithSize("cae", "caf", 10), fakeRangeWithSize("cag", "cai", 10),
+		fakeRangeWithSize("caj", "cak", 10), fakeRangeWithSize("cal", "cam", 10),
+	}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(sender.BatchCount(), Equals, 3)
+
+	c.Assert(metric.ReadCounter(metrics.BatchesSent), Equals, float64(3))
+	c.Assert(metric.ReadHistogramSum(metrics.RangesPerBatch), Equals, float64(6))
+	c.Assert(readHistogramCount(c, metrics.RangesPerBatch), Equals, uint64(3))
+	c.Assert(metric.ReadHistogramSum(metrics.BytesPerBatch), Equals, float64(60))
+	c.Assert(readHistogramCount(c, metrics.SendDuration), Equals, uint64(3))
+}
+
+func (*testBatcherSuite) TestOversizedRange(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	manager := newMockManager()
+	batcher, _, err := restore.NewBatcherWithOptions(ctx, sender, manager, errCh,
+		restore.BatcherOptions{BytesThreshold: 100})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(10)
+
+	ranges := []rtree.Range{
+		fakeRangeWithSize("caa", "cab", 40),
+		fakeRangeWithSize("cab", "cac", 500),
+		fakeRangeWithSize("cac", "cad", 40),
+		fakeRangeWithSize("cad", "cae", 40),
+	}
+	batcher.Add(fakeTableWithRange(1, ranges))
+	batcher.Close()
+
+	c.Assert(sender.Batches(), DeepEquals, [][]rtree.Range{
+		ranges[:1],
+		// the oversized range is sent in its own batch.
+		ranges[1:2],
+		ranges[2:],
+	})
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestBytesOnlyThreshold(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	batcher, _, err := restore.NewBatcherWithOptions(ctx, sender, newMockManager(), errCh,
+		restore.BatcherOptions{BytesThreshold: 100, BlockAddOnFlush: true})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(0)
+
+	// many tiny ranges and a few large ones.
+	table1 := make([]rtree.Range, 0, 12)
+	for i := 0; i < 12; i++ {
+		table1 = append(table1, fakeRangeWithSize(fmt.Sprintf("a%02d", i), fmt.Sprintf("a%02dz", i), 10))
+	}
+	table2 := []rtree.Range{
+		fakeRangeWithSize("baa", "bab", 60),
+		fakeRangeWithSize("bab", "bac", 60),
+		fakeRangeWithSize("bac", "bad", 30),
+	}
+	batcher.Add(fakeTableWithRange(1, table1))
+	// the first 10 ranges of table 1 are sent when the bytes reach the threshold, regardless of the count of ranges.
+	c.Assert(sender.Batches(), DeepEquals, [][]rtree.Range{table1[:10]})
+	c.Assert(batcher.Len(), Equals, 2)
+	batcher.Add(fakeTableWithRange(2, table2))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+
+	c.Assert(sender.Batches(), DeepEquals, [][]rtree.Range{
+		table1[:10],
+		// the partial table drained by the bytes budget.
+		append(append([]rtree.Range{}, table1[10:]...), table2[0]),
+		table2[1:],
+	})
+}
+
+func (*testBatcherSuite) TestFlushStalePartialTable(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	manager := newMockManager()
+	batcher, _, err := restore.NewBatcherWithOptions(ctx, sender, manager, errCh,
+		restore.BatcherOptions{MaxPendingAge: 50 * time.Millisecond})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(4)
+
+	stale := fakeTableWithRange(1, []rtree.Range{
+		fakeRange("aaa", "aab"), fakeRange("aab", "aac"),
+		fakeRange("aac", "aad"), fakeRange("aad", "aae"),
+		fakeRange("aae", "aaf"),
+	})
+	batcher.Add(stale)
+	waitForSend()
+	// the tail of the table doesn't fill the batch.
+	c.Assert(sender.Ranges(), HasLen, 4)
+	c.Assert(batcher.Len(), Equals, 1)
+
+	time.Sleep(100 * time.Millisecond)
+	// the stale tail is sent without any more table added.
+	c.Assert(batcher.Len(), Equals, 0)
+	c.Assert(sender.Ranges(), DeepEquals, stale.Range)
+
+	fresh := fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab")})
+	batcher.Add(fresh)
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(batcher.Len(), Equals, 0)
+	c.Assert(sender.Ranges(), DeepEquals, append(stale.Range, fresh.Range...))
+
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestBytesPerCF(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(2)
+
+	withFiles := func(startKey, endKey string, files ...*backup.File) rtree.Range {
+		rng := fakeRange(startKey, endKey)
+		rng.Files = files
+		return rng
+	}
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		withFiles("aaa", "aab",
+			&backup.File{Name: "1_write.sst", Cf: "write", Size_: 10},
+			&backup.File{Name: "1_default.sst", Cf: "default", Size_: 100}),
+		withFiles("aab", "aac",
+			&backup.File{Name: "2_write.sst", Cf: "write", Size_: 20}),
+		// the column family is inferred by the name if it isn't recorded.
+		withFiles("aac", "aad",
+			&backup.File{Name: "3_default.sst", Size_: 200},
+			&backup.File{Name: "3_write.sst", Size_: 30}),
+	}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(batcher.Stats().BytesPerCF, DeepEquals, map[string]uint64{
+		"write":   60,
+		"default": 300,
+	})
+}
+
 func (*testBatcherSuite) TestRewriteRules(c *C) {
 	tableRanges := [][]rtree.Range{
 		{fakeRange("aaa", "aab")},
@@ -384,3 +624,1676 @@ func (*testBatcherSuite) TestBatcherLen(c *C) {
 	default:
 	}
 }
+
+type recordProgressReporter struct {
+	mu      sync.Mutex
+	reports []restore.RestoreProgress
+}
+
+func (r *recordProgressReporter) ReportProgress(progress restore.RestoreProgress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reports = append(r.reports, progress)
+}
+
+func (r *recordProgressReporter) Reports() []restore.RestoreProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]restore.RestoreProgress{}, r.reports...)
+}
+
+func (*testBatcherSuite) TestProgressReporter(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	manager := newMockManager()
+	reporter := new(recordProgressReporter)
+	batcher, _, err := restore.NewBatcherWithOptions(ctx, sender, manager, errCh,
+		restore.BatcherOptions{ProgressReporter: reporter})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(2)
+
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		fakeRangeWithSize("aaa", "aab", 10),
+		fakeRangeWithSize("aac", "aad", 20),
+		fakeRangeWithSize("aae", "aaf", 30),
+	}))
+	waitForSend()
+	reports := reporter.Reports()
+	c.Assert(len(reports), Greater, 0)
+	last := reports[len(reports)-1]
+	c.Assert(last.RangesSent, Equals, 2)
+	c.Assert(last.BytesSent, Equals, uint64(30))
+
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{
+		fakeRangeWithSize("baa", "bab", 5),
+	}))
+	batcher.Close()
+
+	reports = reporter.Reports()
+	for i := 1; i < len(reports); i++ {
+		c.Assert(reports[i].RangesSent, GreaterEqual, reports[i-1].RangesSent)
+		c.Assert(reports[i].TablesDone, GreaterEqual, reports[i-1].TablesDone)
+	}
+	c.Assert(reports[len(reports)-1], DeepEquals, restore.RestoreProgress{
+		TablesDone: 2,
+		RangesSent: 4,
+		BytesSent:  65,
+	})
+	select {
+	case err := <-errCh:
+		c.Fatal(errors.Trace(err))
+	default:
+	}
+}
+
+func (*testBatcherSuite) TestRewriteRulesSizeLimit(c *C) {
+	const ruleCount = 10000
+	rules := restore.EmptyRewriteRule()
+	for i := 0; i < ruleCount; i++ {
+		rules.Data = append(rules.Data, &import_sstpb.RewriteRule{
+			OldKeyPrefix: []byte(fmt.Sprintf("t%05d", i)),
+			NewKeyPrefix: []byte(fmt.Sprintf("n%05d", i)),
+		})
+	}
+	// each rule takes 64 bytes of overhead and 12 bytes of prefixes.
+	expectedSize := ruleCount * (64 + 12)
+	c.Assert(rules.Size(), Equals, expectedSize)
+
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	manager := newMockManager()
+	batcher, _, err := restore.NewBatcherWithOptions(ctx, sender, manager, errCh,
+		restore.BatcherOptions{RewriteRulesSizeLimit: expectedSize - 1})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(1)
+
+	table := fakeTableWithRange(1, []rtree.Range{fakeRange("caa", "cab"), fakeRange("cac", "cad")})
+	table.RewriteRule = rules
+	batcher.Add(table)
+	c.Assert(batcher.RewriteRulesSize(), Equals, expectedSize)
+	batcher.Close()
+
+	c.Assert(sender.RangeLen(), Equals, 0)
+	errs := restore.Exhaust(errCh)
+	c.Assert(errs, Not(HasLen), 0)
+	for _, err := range errs {
+		c.Assert(err, ErrorMatches, ".*rewrite rules too large.*")
+	}
+}
+
+func (*testBatcherSuite) TestFlushOnAutoCommitDeadline(c *C) {
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	manager := newMockManager()
+	batcher, _ := restore.NewBatcher(context.Background(), sender, manager, errCh)
+	batcher.SetThreshold(1024)
+
+	simpleTable := fakeTableWithRange(1, []rtree.Range{fakeRange("caa", "cab"), fakeRange("cac", "cad")})
+	batcher.Add(simpleTable)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// the ticker won't fire before the deadline.
+	c.Assert(batcher.EnableAutoCommit(ctx, time.Hour), IsNil)
+
+	select {
+	case err := <-errCh:
+		c.Assert(errors.Cause(err), Equals, context.DeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		c.Fatal("auto commit didn't stop on deadline")
+	}
+	c.Assert(sender.Ranges(), DeepEquals, simpleTable.Range)
+	c.Assert(batcher.Len(), Equals, 0)
+
+	// closing shouldn't block even the auto commit worker has exited.
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestEmitFlushedOnCanceled(c *C) {
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	ctx, cancel := context.WithCancel(context.Background())
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(1024)
+	c.Assert(batcher.EnableAutoCommit(ctx, time.Hour), IsNil)
+
+	simpleTable := fakeTableWithRange(1, []rtree.Range{fakeRange("caa", "cab"), fakeRange("cac", "cad")})
+	batcher.Add(simpleTable)
+	cancel()
+
+	// the table flushed in the grace period still reaches the output, though the batcher is canceled.
+	select {
+	case tbl := <-outCh:
+		c.Assert(tbl.Table.ID, Equals, int64(1))
+	case <-time.After(5 * time.Second):
+		c.Fatal("the table flushed after canceled isn't emitted")
+	}
+	c.Assert(errors.Cause(<-errCh), Equals, context.Canceled)
+	c.Assert(sender.Ranges(), DeepEquals, simpleTable.Range)
+
+	batcher.Close()
+	c.Assert(collectTableIDs(outCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestConfig(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	sender, err := restore.NewTiKVSender(ctx, &fakeRestorer{}, nopProgress{}, restore.TiKVSenderOptions{
+		ReadThrottle: &restore.ReadThrottle{HighReadQPS: 1000, Concurrency: 2},
+	})
+	c.Assert(err, IsNil)
+	batcher, _, err := restore.NewBatcherWithOptions(ctx, sender, newMockManager(), errCh,
+		restore.BatcherOptions{BytesThreshold: 4096, RewriteRulesSizeLimit: 1024})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(42)
+	c.Assert(batcher.EnableAutoCommit(ctx, time.Minute), IsNil)
+
+	c.Assert(batcher.Config(), DeepEquals, restore.BatcherConfig{
+		BatchSizeThreshold:    42,
+		BatchBytesThreshold:   4096,
+		AutoCommit:            true,
+		AutoCommitInterval:    time.Minute,
+		RewriteRulesSizeLimit: 1024,
+		Sender: &restore.SenderConfig{
+			ReadThrottleQPS:      1000,
+			ThrottledConcurrency: 2,
+		},
+	})
+
+	batcher.DisableAutoCommit()
+	cfg := batcher.Config()
+	c.Assert(cfg.AutoCommit, IsFalse)
+	c.Assert(cfg.AutoCommitInterval, Equals, time.Duration(0))
+	batcher.Close()
+
+	// the options which aren't plain data are reported by whether they are set.
+	metrics, err := restore.NewBatcherMetrics(prometheus.NewRegistry())
+	c.Assert(err, IsNil)
+	batcher, _, err = restore.NewBatcherWithOptions(ctx, newDrySender(), newMockManager(), errCh,
+		restore.BatcherOptions{
+			TotalBytes:      1 << 20,
+			EventBufferSize: 16,
+			KeyspaceMapping: map[int64]restore.KeyspaceID{1: 2},
+			TableGroups:     [][]int64{{1, 3}},
+			Metrics:         metrics,
+			Clock:           utils.SystemClock,
+		})
+	c.Assert(err, IsNil)
+	cfg = batcher.Config()
+	c.Assert(cfg.TotalBytes, Equals, uint64(1<<20))
+	c.Assert(cfg.EventBufferSize, Equals, 16)
+	c.Assert(cfg.KeyspaceMapping, DeepEquals, map[int64]restore.KeyspaceID{1: 2})
+	c.Assert(cfg.TableGroups, DeepEquals, [][]int64{{1, 3}})
+	c.Assert(cfg.Metrics, IsTrue)
+	c.Assert(cfg.Clock, IsTrue)
+	c.Assert(cfg.ProgressReporter, IsFalse)
+	_, err = json.Marshal(cfg)
+	c.Assert(err, IsNil)
+	batcher.Close()
+
+	// the batcher with a sender which doesn't expose its configuration.
+	batcher, _ = restore.NewBatcher(ctx, newDrySender(), newMockManager(), errCh)
+	c.Assert(batcher.Config().Sender, IsNil)
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestInvalidOptions(c *C) {
+	errCh := make(chan error, 8)
+	for _, opts := range []restore.BatcherOptions{
+		{MaxTablesPerBatch: -1},
+		{EmitTimeout: -time.Second},
+		{CachedTablesLimit: 3},
+		{CachedTablesLimit: 3, CachedTablesLimitAction: "ignore"},
+	} {
+		_, _, err := restore.NewBatcherWithOptions(context.Background(), newDrySender(), newMockManager(), errCh, opts)
+		c.Assert(errors.Cause(err), Equals, berrors.ErrInvalidArgument, Commentf("options %+v", opts))
+	}
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestDisableAutoCommitAfterCanceled(c *C) {
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	batcher, _ := restore.NewBatcher(context.Background(), sender, newMockManager(), errCh)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Assert(batcher.EnableAutoCommit(ctx, time.Hour), IsNil)
+	cancel()
+	c.Assert(errors.Cause(<-errCh), Equals, context.Canceled)
+
+	disabled := make(chan struct{})
+	go func() {
+		batcher.DisableAutoCommit()
+		close(disabled)
+	}()
+	select {
+	case <-disabled:
+	case <-time.After(5 * time.Second):
+		c.Fatal("DisableAutoCommit blocks after the auto commit worker exited")
+	}
+	batcher.Close()
+}
+
+// blockingSender is a drySender which blocks on RestoreBatch until released.
+type blockingSender struct {
+	*drySender
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (sender blockingSender) RestoreBatch(ranges restore.DrainResult) {
+	select {
+	case sender.entered <- struct{}{}:
+	default:
+	}
+	<-sender.release
+	sender.drySender.RestoreBatch(ranges)
+}
+
+func (*testBatcherSuite) TestAutoCommitJoinTimeout(c *C) {
+	errCh := make(chan error, 8)
+	sender := blockingSender{
+		drySender: newDrySender(),
+		entered:   make(chan struct{}, 1),
+		release:   make(chan struct{}),
+	}
+	batcher, _, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{AutoCommitJoinTimeout: 100 * time.Millisecond})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(1024)
+	simpleTable := fakeTableWithRange(1, []rtree.Range{fakeRange("caa", "cab"), fakeRange("cac", "cad")})
+	batcher.Add(simpleTable)
+
+	// the worker would be blocked by the sender when flushing.
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Assert(batcher.EnableAutoCommit(ctx, time.Hour), IsNil)
+	cancel()
+	<-sender.entered
+
+	disabled := make(chan struct{})
+	go func() {
+		batcher.DisableAutoCommit()
+		close(disabled)
+	}()
+	select {
+	case <-disabled:
+	case <-time.After(5 * time.Second):
+		c.Fatal("DisableAutoCommit doesn't respect the timeout")
+	}
+
+	close(sender.release)
+	batcher.Close()
+	c.Assert(sender.Ranges(), DeepEquals, simpleTable.Range)
+	errs := restore.Exhaust(errCh)
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errors.Cause(errs[0]), Equals, context.Canceled)
+}
+
+func (*testBatcherSuite) TestBlockAddOnFlush(c *C) {
+	errCh := make(chan error, 8)
+	sender := blockingSender{
+		drySender: newDrySender(),
+		entered:   make(chan struct{}, 1),
+		release:   make(chan struct{}),
+	}
+	batcher, _, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{BlockAddOnFlush: true})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(2)
+
+	added := make(chan struct{})
+	go func() {
+		batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("caa", "cab"), fakeRange("cac", "cad")}))
+		close(added)
+	}()
+	<-sender.entered
+	// the flush is blocked by the sender, so does Add.
+	select {
+	case <-added:
+		c.Fatal("Add returns while the flush triggered by it is in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(sender.release)
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		c.Fatal("Add doesn't resume after the flush is done")
+	}
+	c.Assert(sender.Ranges(), HasLen, 2)
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestBlockAddOnFlushOnlyNotifiesBlockedAdd(c *C) {
+	errCh := make(chan error, 8)
+	sender := blockingSender{
+		drySender: newDrySender(),
+		entered:   make(chan struct{}, 1),
+		release:   make(chan struct{}),
+	}
+	batcher, _, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{BlockAddOnFlush: true})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(3)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("caa", "cab"), fakeRange("cac", "cad")}))
+
+	// the flush on closing isn't blocking any Add, so it has nobody to notify.
+	closed := make(chan struct{})
+	go func() {
+		batcher.Close()
+		close(closed)
+	}()
+	<-sender.entered
+	close(sender.release)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the send worker is stuck on notifying a blocked Add which doesn't exist")
+	}
+	c.Assert(sender.Ranges(), HasLen, 2)
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestBlockAddOnFlushAfterClose(c *C) {
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	batcher, _, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{BlockAddOnFlush: true})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(1)
+	batcher.Close()
+
+	// the batcher is full, but nobody would send the ranges once it is closed.
+	added := make(chan struct{})
+	go func() {
+		batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("caa", "cab")}))
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the Add after closing is blocked on a flush which never happens")
+	}
+	c.Assert(sender.Ranges(), HasLen, 0)
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestEnableAutoCommitTwice(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(1024)
+	c.Assert(batcher.EnableAutoCommit(ctx, 100*time.Millisecond), IsNil)
+
+	err := batcher.EnableAutoCommit(ctx, time.Hour)
+	c.Assert(errors.Cause(err), Equals, berrors.ErrAutoCommitAlreadyEnabled)
+	c.Assert(batcher.Config().AutoCommitInterval, Equals, 100*time.Millisecond)
+
+	// the original worker still works.
+	simpleTable := fakeTableWithRange(1, []rtree.Range{fakeRange("caa", "cab")})
+	batcher.Add(simpleTable)
+	time.Sleep(300 * time.Millisecond)
+	c.Assert(sender.Ranges(), DeepEquals, simpleTable.Range)
+
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestMinAutoCommitInterval(c *C) {
+	core, logs := observer.New(zap.WarnLevel)
+	origin := log.L()
+	log.ReplaceGlobals(zap.New(zapcore.NewTee(origin.Core(), core)), nil)
+	defer log.ReplaceGlobals(origin, nil)
+
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, newDrySender(), newMockManager(), errCh)
+	c.Assert(batcher.EnableAutoCommit(ctx, time.Microsecond), IsNil)
+	c.Assert(batcher.Config().AutoCommitInterval, Equals, restore.DefaultMinAutoCommitInterval)
+	warnings := logs.FilterMessageSnippet("auto commit interval is too short").All()
+	c.Assert(warnings, HasLen, 1)
+	c.Assert(warnings[0].ContextMap()["interval"], Equals, time.Microsecond)
+	batcher.DisableAutoCommit()
+	batcher.Close()
+
+	batcher, _, err := restore.NewBatcherWithOptions(ctx, newDrySender(), newMockManager(), errCh,
+		restore.BatcherOptions{MinAutoCommitInterval: time.Second})
+	c.Assert(err, IsNil)
+	c.Assert(batcher.EnableAutoCommit(ctx, 100*time.Millisecond), IsNil)
+	c.Assert(batcher.Config().AutoCommitInterval, Equals, time.Second)
+	batcher.DisableAutoCommit()
+	// an interval above the floor is kept.
+	c.Assert(batcher.EnableAutoCommit(ctx, time.Minute), IsNil)
+	c.Assert(batcher.Config().AutoCommitInterval, Equals, time.Minute)
+	c.Assert(logs.FilterMessageSnippet("auto commit interval is too short").Len(), Equals, 2)
+
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestInFlightTables(c *C) {
+	errCh := make(chan error, 8)
+	sender := blockingSender{
+		drySender: newDrySender(),
+		entered:   make(chan struct{}, 1),
+		release:   make(chan struct{}),
+	}
+	batcher, outCh := restore.NewBatcher(context.Background(), sender, newMockManager(), errCh)
+	batcher.SetThreshold(2)
+	c.Assert(batcher.InFlightTables(), HasLen, 0)
+
+	// table 1 is being sent, and table 2 is cached.
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab"), fakeRange("aab", "aac")}))
+	<-sender.entered
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab")}))
+	c.Assert(batcher.InFlightTables(), DeepEquals, []int64{1, 2})
+
+	close(sender.release)
+	tbl := <-outCh
+	c.Assert(tbl.Table.ID, Equals, int64(1))
+	c.Assert(batcher.InFlightTables(), DeepEquals, []int64{2})
+
+	batcher.Close()
+	c.Assert(batcher.InFlightTables(), HasLen, 0)
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestTableCreationBackpressure(c *C) {
+	errCh := make(chan error, 8)
+	sender := blockingSender{
+		drySender: newDrySender(),
+		entered:   make(chan struct{}, 1),
+		release:   make(chan struct{}),
+	}
+	batcher, outCh, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{MaxInFlightTables: 2})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(2)
+	shouldBackoff := batcher.TableCreationBackpressure()
+	c.Assert(batcher.Config().MaxInFlightTables, Equals, 2)
+	c.Assert(shouldBackoff(), IsFalse)
+
+	// table 1 is being sent, and table 2 is cached, the limit is reached.
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab"), fakeRange("aab", "aac")}))
+	<-sender.entered
+	c.Assert(shouldBackoff(), IsFalse)
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab")}))
+	c.Assert(shouldBackoff(), IsTrue)
+
+	// once table 1 is restored, the creator can go on.
+	close(sender.release)
+	tbl := <-outCh
+	c.Assert(tbl.Table.ID, Equals, int64(1))
+	c.Assert(batcher.InFlightTables(), HasLen, 1)
+	c.Assert(shouldBackoff(), IsFalse)
+
+	batcher.Close()
+	c.Assert(shouldBackoff(), IsFalse)
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+// skipStartKeyFilter skips the ranges starting with the key.
+type skipStartKeyFilter struct {
+	startKey string
+}
+
+func (f skipStartKeyFilter) KeepRange(table restore.CreatedTable, rng rtree.Range) bool {
+	return string(rng.StartKey) != f.startKey
+}
+
+func (*testBatcherSuite) TestReconciliation(c *C) {
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	batcher, _, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{RangeFilters: []restore.RangeFilter{skipStartKeyFilter{startKey: "aab"}}})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(2)
+	c.Assert(batcher.Config().RangeFilter, IsTrue)
+
+	table1Ranges := []rtree.Range{
+		fakeRangeWithSize("aaa", "aab", 10),
+		fakeRangeWithSize("aab", "aac", 20),
+		fakeRangeWithSize("aac", "aad", 30),
+	}
+	table1 := fakeTableWithRange(1, table1Ranges)
+	// the backup manifest records the files of table 1.
+	for _, rng := range table1Ranges {
+		table1.OldTable.Files = append(table1.OldTable.Files, rng.Files...)
+	}
+	batcher.Add(table1)
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRangeWithSize("baa", "bab", 40)}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(sender.RangeLen(), Equals, 3)
+
+	report := batcher.Reconciliation()
+	c.Assert(report, HasLen, 2)
+	c.Assert(report[0].TableID, Equals, int64(1))
+	c.Assert(report[0].Backup, Equals, restore.RestoreCount{Ranges: 3, Files: 3, Bytes: 60})
+	c.Assert(report[0].Sent, Equals, restore.RestoreCount{Ranges: 2, Files: 2, Bytes: 40})
+	c.Assert(report[0].Filtered, Equals, restore.RestoreCount{Ranges: 1, Files: 1, Bytes: 20})
+	c.Assert(report[0].HasDiscrepancy(), IsTrue)
+	c.Assert(report[1].TableID, Equals, int64(2))
+	c.Assert(report[1].Sent, Equals, report[1].Backup)
+	c.Assert(report[1].HasDiscrepancy(), IsFalse)
+}
+
+// skipPrefixFilter skips the ranges starting with the prefix.
+type skipPrefixFilter struct {
+	prefix string
+}
+
+func (f skipPrefixFilter) KeepRange(table restore.CreatedTable, rng rtree.Range) bool {
+	return !strings.HasPrefix(string(rng.StartKey), f.prefix)
+}
+
+func (f skipPrefixFilter) FilterName() string {
+	return "prefix"
+}
+
+func (*testBatcherSuite) TestSkippedByFilters(c *C) {
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	batcher, _, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{RangeFilters: []restore.RangeFilter{
+			skipPrefixFilter{prefix: "b"},
+			skipStartKeyFilter{startKey: "aab"},
+			skipStartKeyFilter{startKey: "bab"},
+		}})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(2)
+
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		fakeRangeWithSize("aaa", "aab", 10),
+		fakeRangeWithSize("aab", "aac", 20),
+		fakeRangeWithSize("aac", "aad", 30),
+	}))
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{
+		fakeRangeWithSize("baa", "bab", 40),
+		fakeRangeWithSize("bab", "bac", 50),
+	}))
+	// skipped by both filters, counted to the first one.
+	batcher.Add(fakeTableWithRange(3, []rtree.Range{fakeRangeWithSize("bab", "bac", 60)}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(sender.RangeLen(), Equals, 2)
+
+	c.Assert(batcher.SkippedByFilters(), DeepEquals, map[string]restore.RestoreCount{
+		"prefix":                       {Ranges: 3, Files: 3, Bytes: 150},
+		restore.DefaultRangeFilterName: {Ranges: 1, Files: 1, Bytes: 20},
+	})
+}
+
+func (*testBatcherSuite) TestTableGroups(c *C) {
+	errCh := make(chan error, 8)
+	_, _, err := restore.NewBatcherWithOptions(context.Background(), newDrySender(), newMockManager(), errCh,
+		restore.BatcherOptions{TableGroups: [][]int64{{1, 2}, {2, 3}}})
+	c.Assert(err, ErrorMatches, ".*table 2 belongs to more than one group.*")
+	batcher, outCh, err := restore.NewBatcherWithOptions(context.Background(), newDrySender(), newMockManager(), errCh,
+		restore.BatcherOptions{TableGroups: [][]int64{{1, 2}}})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(1)
+
+	// table 1 is restored before table 3, but deferred until table 2 is restored.
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab")}))
+	batcher.Add(fakeTableWithRange(3, []rtree.Range{fakeRange("caa", "cab")}))
+	tbl := <-outCh
+	c.Assert(tbl.Table.ID, Equals, int64(3))
+	select {
+	case tbl := <-outCh:
+		c.Fatalf("table %d is emitted before its group is restored", tbl.Table.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab")}))
+	ids := []int64{(<-outCh).Table.ID, (<-outCh).Table.ID}
+	c.Assert(ids, DeepEquals, []int64{1, 2})
+
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+// holdFirstSender holds the tables of the first batch until released, as if the first batch is restored slowly.
+type holdFirstSender struct {
+	mu      sync.Mutex
+	sink    restore.TableSink
+	batches int
+	held    []restore.CreatedTable
+}
+
+func (sender *holdFirstSender) PutSink(sink restore.TableSink) {
+	sender.sink = sink
+}
+
+func (sender *holdFirstSender) RestoreBatch(ranges restore.DrainResult) {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	sender.batches++
+	if sender.batches == 1 {
+		sender.held = ranges.BlankTablesAfterSend
+		return
+	}
+	sender.sink.EmitTables(ranges.BlankTablesAfterSend...)
+}
+
+func (sender *holdFirstSender) release() {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	sender.sink.EmitTables(sender.held...)
+}
+
+func (sender *holdFirstSender) Close() {
+	sender.sink.Close()
+}
+
+func assertNoOutput(c *C, outCh <-chan restore.CreatedTable) {
+	select {
+	case tbl := <-outCh:
+		c.Fatalf("table %d is emitted before the earlier added tables", tbl.Table.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func (*testBatcherSuite) TestOrderedOutput(c *C) {
+	errCh := make(chan error, 8)
+	sender := &holdFirstSender{}
+	batcher, outCh, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{OrderedOutputLimit: 8})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(1)
+	c.Assert(batcher.Config().OrderedOutputLimit, Equals, 8)
+
+	// table 2 and 3 are restored before table 1, but emitted after it.
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab")}))
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab")}))
+	batcher.Add(fakeTableWithRange(3, []rtree.Range{fakeRange("caa", "cab")}))
+	assertNoOutput(c, outCh)
+	sender.release()
+	ids := []int64{(<-outCh).Table.ID, (<-outCh).Table.ID, (<-outCh).Table.ID}
+	c.Assert(ids, DeepEquals, []int64{1, 2, 3})
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestOrderedOutputLimit(c *C) {
+	errCh := make(chan error, 8)
+	sender := &holdFirstSender{}
+	batcher, outCh, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{OrderedOutputLimit: 1})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(1)
+
+	// once more than one table is buffered, they are emitted without waiting for table 1.
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab")}))
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab")}))
+	assertNoOutput(c, outCh)
+	batcher.Add(fakeTableWithRange(3, []rtree.Range{fakeRange("caa", "cab")}))
+	ids := []int64{(<-outCh).Table.ID, (<-outCh).Table.ID}
+	c.Assert(ids, DeepEquals, []int64{2, 3})
+
+	// table 1 is emitted once restored.
+	sender.release()
+	c.Assert((<-outCh).Table.ID, Equals, int64(1))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+
+	// the tables buffered are emitted on close, even the earlier ones are never restored.
+	sender = &holdFirstSender{}
+	batcher, outCh, err = restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{OrderedOutputLimit: 8})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(1)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab")}))
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab")}))
+	batcher.Close()
+	ids = make([]int64, 0)
+	for tbl := range outCh {
+		ids = append(ids, tbl.Table.ID)
+	}
+	c.Assert(ids, DeepEquals, []int64{2})
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+// wedgedSender blocks restoring until released, as if some store is wedged.
+type wedgedSender struct {
+	sink    restore.TableSink
+	release chan struct{}
+}
+
+func (sender *wedgedSender) PutSink(sink restore.TableSink) {
+	sender.sink = sink
+}
+
+func (sender *wedgedSender) RestoreBatch(ranges restore.DrainResult) {
+	<-sender.release
+	sender.sink.EmitTables(ranges.BlankTablesAfterSend...)
+}
+
+func (sender *wedgedSender) Close() {
+	sender.sink.Close()
+}
+
+func (*testBatcherSuite) TestCloseContext(c *C) {
+	errCh := make(chan error, 8)
+	sender := &wedgedSender{release: make(chan struct{})}
+	batcher, outCh := restore.NewBatcher(context.Background(), sender, newMockManager(), errCh)
+	batcher.SetThreshold(2)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab")}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := batcher.CloseContext(ctx)
+	c.Assert(errors.Cause(err) == berrors.ErrRestoreCloseTimeout, IsTrue, Commentf("%s", err)) // nolint:errorlint
+	select {
+	case _, ok := <-outCh:
+		c.Fatalf("the output is emitted before closing is done, ok = %v", ok)
+	default:
+	}
+
+	// closing again waits for the same closing, the output is closed once.
+	close(sender.release)
+	batcher.Close()
+	c.Assert(batcher.CloseContext(context.Background()), IsNil)
+	c.Assert((<-outCh).Table.ID, Equals, int64(1))
+	_, ok := <-outCh
+	c.Assert(ok, IsFalse)
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestOnTableStarted(c *C) {
+	errCh := make(chan error, 8)
+	var mu sync.Mutex
+	events := make([]string, 0)
+	record := func(event string, id int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, fmt.Sprintf("%s %d", event, id))
+	}
+	batcher, outCh, err := restore.NewBatcherWithOptions(context.Background(), newDrySender(), newMockManager(), errCh,
+		restore.BatcherOptions{OnTableStarted: func(tbl restore.CreatedTable) {
+			record("started", tbl.Table.ID)
+		}})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(2)
+	c.Assert(batcher.Config().OnTableStarted, IsTrue)
+
+	// table 1 is sent by two batches, it starts once.
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		fakeRange("aaa", "aab"), fakeRange("aab", "aac"), fakeRange("aac", "aad"),
+	}))
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab")}))
+	batcher.Close()
+	for tbl := range outCh {
+		record("done", tbl.Table.ID)
+	}
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(events, HasLen, 4)
+	for _, id := range []int64{1, 2} {
+		started, done := -1, -1
+		for i, event := range events {
+			switch event {
+			case fmt.Sprintf("started %d", id):
+				c.Assert(started, Equals, -1, Commentf("table %d starts twice: %v", id, events))
+				started = i
+			case fmt.Sprintf("done %d", id):
+				done = i
+			}
+		}
+		c.Assert(started >= 0 && started < done, IsTrue, Commentf("events of table %d: %v", id, events))
+	}
+}
+
+// addTablesBeyondOutput adds more tables than the output channel can buffer.
+func addTablesBeyondOutput(batcher *restore.Batcher) int {
+	n := 1100
+	batcher.SetThreshold(n)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("%04d", i)
+		batcher.Add(fakeTableWithRange(int64(i), []rtree.Range{fakeRange(key, key+"z")}))
+	}
+	return n
+}
+
+func (*testBatcherSuite) TestEmitRetry(c *C) {
+	errCh := make(chan error, 8)
+	batcher, outCh, err := restore.NewBatcherWithOptions(context.Background(), newDrySender(), newMockManager(), errCh,
+		restore.BatcherOptions{EmitRetryBackoff: 10 * time.Millisecond, EmitTimeout: 5 * time.Second})
+	c.Assert(err, IsNil)
+	n := addTablesBeyondOutput(batcher)
+
+	// the consumer is unavailable for a while.
+	received := make(chan int)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		count := 0
+		for range outCh {
+			count++
+		}
+		received <- count
+	}()
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(<-received, Equals, n)
+}
+
+func (*testBatcherSuite) TestEmitTimeout(c *C) {
+	errCh := make(chan error, 8)
+	batcher, _, err := restore.NewBatcherWithOptions(context.Background(), newDrySender(), newMockManager(), errCh,
+		restore.BatcherOptions{EmitRetryBackoff: 10 * time.Millisecond, EmitTimeout: 100 * time.Millisecond})
+	c.Assert(err, IsNil)
+	c.Assert(batcher.Config().EmitTimeout, Equals, 100*time.Millisecond)
+	addTablesBeyondOutput(batcher)
+
+	// nobody consumes the output.
+	batcher.Close()
+	errs := restore.Exhaust(errCh)
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errors.Cause(errs[0]), Equals, berrors.ErrRestoreEmitTimeout)
+}
+
+func (*testBatcherSuite) TestEmitRetryCanceled(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 8)
+	batcher, _, err := restore.NewBatcherWithOptions(ctx, newDrySender(), newMockManager(), errCh,
+		restore.BatcherOptions{EmitRetryBackoff: 10 * time.Millisecond, EmitTimeout: time.Minute})
+	c.Assert(err, IsNil)
+	addTablesBeyondOutput(batcher)
+
+	// nobody consumes the output, the retrying stops once the context is done, rather than after the timeout.
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	closed := make(chan struct{})
+	go func() {
+		batcher.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		c.Fatal("emitting is still retried after the context is done")
+	}
+	restore.Exhaust(errCh)
+}
+
+func (*testBatcherSuite) TestKeyspaceMapping(c *C) {
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	_, _, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{KeyspaceMapping: map[int64]restore.KeyspaceID{1: 1 << 24}})
+	c.Assert(err, ErrorMatches, ".*exceeds the max keyspace ID.*")
+	batcher, _, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{KeyspaceMapping: map[int64]restore.KeyspaceID{1: 1, 2: 0x020304}})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(2)
+
+	table1 := fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab")})
+	table1.RewriteRule = fakeRewriteRules("a", "t1")
+	table2 := fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab")})
+	table2.RewriteRule = fakeRewriteRules("b", "t2")
+	batcher.Add(table1)
+	batcher.Add(table2)
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+
+	rules := sender.rewriteRules.Table
+	c.Assert(rules, HasLen, 2)
+	c.Assert(rules[0].GetOldKeyPrefix(), DeepEquals, []byte("a"))
+	c.Assert(rules[0].GetNewKeyPrefix(), DeepEquals, []byte("x\x00\x00\x01t1"))
+	c.Assert(rules[1].GetOldKeyPrefix(), DeepEquals, []byte("b"))
+	c.Assert(rules[1].GetNewKeyPrefix(), DeepEquals, []byte("x\x02\x03\x04t2"))
+	// the rewrite rules of the caller are untouched.
+	c.Assert(table1.RewriteRule.Table[0].GetNewKeyPrefix(), DeepEquals, []byte("t1"))
+}
+
+// emitCountingSender records the count of tables emitted by each batch.
+type emitCountingSender struct {
+	*drySender
+	emitted []int
+}
+
+func (sender *emitCountingSender) RestoreBatch(ranges restore.DrainResult) {
+	sender.mu.Lock()
+	sender.emitted = append(sender.emitted, len(ranges.BlankTablesAfterSend))
+	sender.mu.Unlock()
+	sender.drySender.RestoreBatch(ranges)
+}
+
+func (*testBatcherSuite) TestMaxTablesPerBatch(c *C) {
+	errCh := make(chan error, 8)
+	sender := &emitCountingSender{drySender: newDrySender()}
+	batcher, outCh, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{MaxTablesPerBatch: 3})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(100)
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("%03d", i)
+		batcher.Add(fakeTableWithRange(int64(i), []rtree.Range{fakeRange(key+"a", key+"b")}))
+	}
+	// tables without any range are limited, too.
+	for i := 10; i < 15; i++ {
+		batcher.Add(fakeTableWithRange(int64(i), []rtree.Range{}))
+	}
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	tables := 0
+	for range outCh {
+		tables++
+	}
+	c.Assert(tables, Equals, 15)
+	c.Assert(sender.RangeLen(), Equals, 10)
+	c.Assert(sender.emitted, DeepEquals, []int{3, 3, 3, 3, 3})
+}
+
+func (*testBatcherSuite) TestCachedTablesLimit(c *C) {
+	addTables := func(batcher *restore.Batcher, n int) {
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("%03d", i)
+			batcher.Add(fakeTableWithRange(int64(i), []rtree.Range{fakeRange(key+"a", key+"b")}))
+		}
+	}
+
+	errCh := make(chan error, 8)
+	batcher, _, err := restore.NewBatcherWithOptions(context.Background(), newDrySender(), newMockManager(), errCh,
+		restore.BatcherOptions{
+			EventBufferSize:         16,
+			CachedTablesLimit:       3,
+			CachedTablesLimitAction: restore.CachedTablesLimitWarn,
+		})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(100)
+	c.Assert(batcher.Config().CachedTablesLimitAction, Equals, restore.CachedTablesLimitWarn)
+	addTables(batcher, 8)
+	// warned once 3 and 6 tables are cached, but the tables are still added.
+	warnings := make([]string, 0)
+	for _, event := range batcher.DumpRecentEvents() {
+		if event.Kind == restore.EventWarn {
+			warnings = append(warnings, event.Message)
+		}
+	}
+	c.Assert(warnings, DeepEquals, []string{
+		"3 tables cached, reach the limit 3",
+		"6 tables cached, reach the limit 3",
+	})
+	c.Assert(batcher.Len(), Equals, 8)
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+
+	batcher, _, err = restore.NewBatcherWithOptions(context.Background(), newDrySender(), newMockManager(), errCh,
+		restore.BatcherOptions{CachedTablesLimit: 3, CachedTablesLimitAction: restore.CachedTablesLimitError})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(100)
+	addTables(batcher, 4)
+	c.Assert(batcher.Len(), Equals, 3)
+	batcher.Close()
+	errs := restore.Exhaust(errCh)
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errors.Cause(errs[0]), Equals, berrors.ErrRestoreTooManyCachedTables)
+	c.Assert(errs[0], ErrorMatches, ".*3 tables cached, reach the limit 3.*")
+}
+
+func (*testBatcherSuite) TestExhaustErr(c *C) {
+	errCh := make(chan error, 8)
+	c.Assert(restore.ExhaustErr(errCh), IsNil)
+
+	errCh <- berrors.ErrRestoreEmitTimeout
+	c.Assert(restore.ExhaustErr(errCh), Equals, berrors.ErrRestoreEmitTimeout)
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+
+	errCh <- errors.New("the first")
+	errCh <- errors.New("the second")
+	err := restore.ExhaustErr(errCh)
+	c.Assert(err, ErrorMatches, "2 errors occurred: the first; the second")
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestPauseAndResume(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	batcher, _, err := restore.NewBatcherWithOptions(ctx, sender, newMockManager(), errCh,
+		restore.BatcherOptions{BlockAddOnFlush: true})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(2)
+	c.Assert(batcher.EnableAutoCommit(ctx, 20*time.Millisecond), IsNil)
+
+	batcher.Pause()
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		fakeRange("aaa", "aab"), fakeRange("aab", "aac"), fakeRange("aac", "aad"),
+		fakeRange("aad", "aae"), fakeRange("aae", "aaf"),
+	}))
+	// neither the full batch nor the auto commit sends while paused.
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(batcher.Len(), Equals, 5)
+	c.Assert(sender.BatchCount(), Equals, 0)
+
+	// the backlog over the threshold is flushed once resumed.
+	batcher.DisableAutoCommit()
+	batcher.Resume()
+	c.Assert(batcher.Len(), LessEqual, 2)
+	c.Assert(sender.BatchCount(), GreaterEqual, 2)
+	batcher.Close()
+	c.Assert(sender.RangeLen(), Equals, 5)
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestTableProgress(c *C) {
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	batcher, _, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{BlockAddOnFlush: true})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(3)
+	newTable := func(id int64, rngs []rtree.Range) restore.TableWithRange {
+		table := fakeTableWithRange(id, rngs)
+		table.Table = &model.TableInfo{ID: id + 100}
+		return table
+	}
+
+	batcher.Add(newTable(1, []rtree.Range{
+		fakeRange("aaa", "aab"), fakeRange("aab", "aac"), fakeRange("aac", "aad"),
+		fakeRange("aad", "aae"), fakeRange("aae", "aaf"),
+	}))
+	// the table straddles two batches.
+	c.Assert(batcher.Progress(), DeepEquals, map[int64]restore.TableProgress{
+		101: {Restored: 3, Total: 5},
+	})
+	batcher.Add(newTable(2, []rtree.Range{fakeRange("baa", "bab"), fakeRange("bab", "bac")}))
+	c.Assert(batcher.Progress(), DeepEquals, map[int64]restore.TableProgress{
+		101: {Restored: 5, Total: 5},
+		102: {Restored: 1, Total: 2},
+	})
+	batcher.Close()
+	c.Assert(batcher.Progress(), DeepEquals, map[int64]restore.TableProgress{
+		101: {Restored: 5, Total: 5},
+		102: {Restored: 2, Total: 2},
+	})
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestBatchNeverSpansKeyspaces(c *C) {
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	batcher, _, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{KeyspaceMapping: map[int64]restore.KeyspaceID{1: 1, 2: 1, 3: 2}})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(8)
+
+	tables := []restore.TableWithRange{
+		fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab")}),
+		fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab"), fakeRange("bab", "bac")}),
+		fakeTableWithRange(3, []rtree.Range{fakeRange("caa", "cab")}),
+		// not mapped to any keyspace.
+		fakeTableWithRange(4, []rtree.Range{fakeRange("daa", "dab")}),
+	}
+	for _, table := range tables {
+		table.RewriteRule = fakeRewriteRules(string(table.Range[0].StartKey[:1]), "t")
+		batcher.Add(table)
+	}
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(sender.Batches(), DeepEquals, [][]rtree.Range{
+		{fakeRange("aaa", "aab"), fakeRange("baa", "bab"), fakeRange("bab", "bac")},
+		{fakeRange("caa", "cab")},
+		{fakeRange("daa", "dab")},
+	})
+}
+
+func (*testBatcherSuite) TestConcurrentLen(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(1 << 20)
+
+	const adders, tablesPerAdder, rangeSize = 8, 50, 10
+	totalRanges := adders * tablesPerAdder * 2
+	totalBytes := uint64(totalRanges * rangeSize)
+	addWg := new(sync.WaitGroup)
+	for i := 0; i < adders; i++ {
+		addWg.Add(1)
+		go func(i int) {
+			defer addWg.Done()
+			for j := 0; j < tablesPerAdder; j++ {
+				prefix := fmt.Sprintf("%02d%03d", i, j)
+				batcher.Add(fakeTableWithRange(int64(i*tablesPerAdder+j), []rtree.Range{
+					fakeRangeWithSize(prefix+"a", prefix+"b", rangeSize),
+					fakeRangeWithSize(prefix+"b", prefix+"c", rangeSize),
+				}))
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	getterWg := new(sync.WaitGroup)
+	for i := 0; i < 2; i++ {
+		getterWg.Add(1)
+		go func() {
+			defer getterWg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if n := batcher.Len(); n < 0 || n > totalRanges {
+					c.Errorf("unexpected len %d", n)
+				}
+				if bytes := batcher.ByteLen(); bytes > totalBytes {
+					c.Errorf("unexpected byte len %d", bytes)
+				}
+			}
+		}()
+	}
+	// drain concurrently too.
+	getterWg.Add(1)
+	go func() {
+		defer getterWg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				batcher.Send(ctx)
+			}
+		}
+	}()
+	addWg.Wait()
+	close(done)
+	getterWg.Wait()
+
+	// the pending ranges and bytes are consistent with what has been drained.
+	c.Assert(batcher.ByteLen(), Equals, uint64(batcher.Len()*rangeSize))
+	c.Assert(batcher.Len(), Equals, totalRanges-sender.RangeLen())
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(batcher.Len(), Equals, 0)
+	c.Assert(batcher.ByteLen(), Equals, uint64(0))
+	c.Assert(sender.RangeLen(), Equals, totalRanges)
+}
+
+func (*testBatcherSuite) TestMergedRewriteRules(c *C) {
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(context.Background(), newDrySender(), newMockManager(), errCh)
+	batcher.SetThreshold(1000)
+	expected := restore.EmptyRewriteRule()
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		table := fakeTableWithRange(int64(i), []rtree.Range{fakeRange(fmt.Sprintf("%d", i), fmt.Sprintf("%dz", i))})
+		table.RewriteRule = fakeRewriteRules(fmt.Sprintf("%d", i), fmt.Sprintf("%d", i+100))
+		expected.Append(*table.RewriteRule)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batcher.Add(table)
+		}()
+	}
+	wg.Wait()
+
+	rules := batcher.RewriteRules()
+	c.Assert(batcher.RewriteRulesSize(), Equals, expected.Size())
+	c.Assert(rules.Table, HasLen, len(expected.Table))
+	for _, rule := range expected.Table {
+		found := false
+		for _, merged := range rules.Table {
+			if bytes.Equal(merged.GetOldKeyPrefix(), rule.GetOldKeyPrefix()) {
+				c.Assert(merged.GetNewKeyPrefix(), DeepEquals, rule.GetNewKeyPrefix())
+				found = true
+			}
+		}
+		c.Assert(found, IsTrue, Commentf("rule of %s is missing", rule.GetOldKeyPrefix()))
+	}
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+// ruleCountingSender records the count of rewrite rules of each batch.
+type ruleCountingSender struct {
+	*drySender
+	counts [][2]int
+}
+
+func (sender *ruleCountingSender) RestoreBatch(ranges restore.DrainResult) {
+	sender.counts = append(sender.counts, [2]int{len(ranges.RewriteRules.Table), len(ranges.RewriteRules.Data)})
+	sender.drySender.RestoreBatch(ranges)
+}
+
+func (*testBatcherSuite) TestRewriteRulesOfPartialDrains(c *C) {
+	errCh := make(chan error, 8)
+	sender := &ruleCountingSender{drySender: newDrySender()}
+	batcher, _ := restore.NewBatcher(context.Background(), sender, newMockManager(), errCh)
+	batcher.SetThreshold(1)
+	rules := fakeRewriteRules("a", "t1")
+	rules.Data = append(rules.Data, rules.Table...)
+
+	// the table is drained across three batches, and the rest of the table is added again.
+	table := fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab"), fakeRange("aab", "aac"), fakeRange("aac", "aad")})
+	table.RewriteRule = rules
+	batcher.Add(table)
+	rest := fakeTableWithRange(1, []rtree.Range{fakeRange("aad", "aae")})
+	rest.RewriteRule = rules
+	batcher.Add(rest)
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+
+	c.Assert(len(sender.counts), GreaterEqual, 3)
+	for _, count := range sender.counts {
+		c.Assert(count, DeepEquals, [2]int{1, 1})
+	}
+	merged := batcher.RewriteRules()
+	c.Assert(merged.Table, HasLen, 1)
+	c.Assert(merged.Data, HasLen, 1)
+	c.Assert(batcher.RewriteRulesSize(), Equals, rules.Size())
+}
+
+func (*testBatcherSuite) TestConflictingRewriteRules(c *C) {
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(context.Background(), newDrySender(), newMockManager(), errCh)
+	table1 := fakeTableWithRange(1, []rtree.Range{fakeRange("a", "az")})
+	table1.RewriteRule = fakeRewriteRules("a", "t1")
+	table2 := fakeTableWithRange(2, []rtree.Range{fakeRange("a", "az")})
+	table2.RewriteRule = fakeRewriteRules("a", "t2")
+	batcher.Add(table1)
+	batcher.Add(table2)
+	batcher.Close()
+
+	errs := restore.Exhaust(errCh)
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errors.Cause(errs[0]), Equals, berrors.ErrRestoreRewriteRuleConflict)
+	// the conflicting table isn't restored.
+	restored := make([]int64, 0)
+	for table := range outCh {
+		restored = append(restored, table.Table.ID)
+	}
+	c.Assert(restored, DeepEquals, []int64{1})
+	c.Assert(batcher.RewriteRules().Table, HasLen, 1)
+	// nor is it accounted.
+	progress := batcher.Progress()
+	c.Assert(progress, HasLen, 1)
+	_, ok := progress[2]
+	c.Assert(ok, IsFalse)
+}
+
+// slowAbortableSender is a sender whose batches last long until it is aborted.
+type slowAbortableSender struct {
+	*drySender
+	entered chan struct{}
+	aborted chan struct{}
+	once    sync.Once
+}
+
+func (sender *slowAbortableSender) RestoreBatch(ranges restore.DrainResult) {
+	sender.entered <- struct{}{}
+	select {
+	case <-sender.aborted:
+	case <-time.After(10 * time.Second):
+		sender.drySender.RestoreBatch(ranges)
+	}
+}
+
+func (sender *slowAbortableSender) Abort() {
+	sender.once.Do(func() { close(sender.aborted) })
+}
+
+func (*testBatcherSuite) TestAbort(c *C) {
+	errCh := make(chan error, 8)
+	sender := &slowAbortableSender{
+		drySender: newDrySender(),
+		entered:   make(chan struct{}, 1),
+		aborted:   make(chan struct{}),
+	}
+	batcher, outCh := restore.NewBatcher(context.Background(), sender, crashTolerantManager{newMockManager()}, errCh)
+	batcher.SetThreshold(2)
+
+	// table 1 is being sent, and table 2 is cached.
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab"), fakeRange("aab", "aac")}))
+	<-sender.entered
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab")}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	discarded := batcher.Abort(ctx)
+	c.Assert(time.Since(start), Less, time.Second)
+	c.Assert(discarded, HasLen, 1)
+	c.Assert(discarded[0].Table.ID, Equals, int64(2))
+	c.Assert(discarded[0].Range, HasLen, 1)
+	c.Assert(batcher.Len(), Equals, 0)
+
+	// the output channel is closed, and nothing is restored.
+	for tbl := range outCh {
+		c.Fatalf("table %d is emitted after aborting", tbl.Table.ID)
+	}
+	c.Assert(sender.RangeLen(), Equals, 0)
+}
+
+func (*testBatcherSuite) TestCloseAfterAbort(c *C) {
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	batcher, outCh := restore.NewBatcher(context.Background(), sender, crashTolerantManager{newMockManager()}, errCh)
+	batcher.SetThreshold(2)
+	c.Assert(batcher.EnableAutoCommit(context.Background(), time.Hour), IsNil)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab")}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Assert(batcher.Abort(ctx), HasLen, 1)
+	// the usual deferred Close, and aborting again, only wait for the same shutdown.
+	c.Assert(batcher.CloseContext(ctx), IsNil)
+	batcher.Close()
+	c.Assert(batcher.Abort(ctx), HasLen, 0)
+	// tables added after aborting are discarded.
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab")}))
+	c.Assert(batcher.Len(), Equals, 0)
+
+	c.Assert(collectTableIDs(outCh), HasLen, 0)
+	c.Assert(sender.RangeLen(), Equals, 0)
+}
+
+func (*testBatcherSuite) TestRecentEvents(c *C) {
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(context.Background(), newDrySender(), newMockManager(), errCh)
+	batcher.SetThreshold(1000)
+	batcher.Add(fakeTableWithRange(0, []rtree.Range{fakeRange("0", "0z")}))
+	c.Assert(batcher.DumpRecentEvents(), HasLen, 0)
+	batcher.Close()
+
+	batcher, _, err := restore.NewBatcherWithOptions(context.Background(), newDrySender(), newMockManager(), errCh,
+		restore.BatcherOptions{EventBufferSize: 3})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(1000)
+	for i := 1; i <= 5; i++ {
+		batcher.Add(fakeTableWithRange(int64(i), []rtree.Range{fakeRange(fmt.Sprintf("%d", i), fmt.Sprintf("%dz", i))}))
+	}
+	events := batcher.DumpRecentEvents()
+	c.Assert(events, HasLen, 3)
+	for i, event := range events {
+		c.Assert(event.Kind, Equals, restore.EventAdd)
+		c.Assert(strings.Contains(event.Message, fmt.Sprintf("(%d)", i+3)), IsTrue, Commentf("event %d is %s", i, event.Message))
+	}
+
+	batcher.Close()
+	events = batcher.DumpRecentEvents()
+	c.Assert(events, HasLen, 3)
+	c.Assert(events[2].Kind, Equals, restore.EventSend)
+}
+
+func (*testBatcherSuite) TestNoopSender(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	sender := restore.NewNoopSender(20 * time.Millisecond)
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(2)
+
+	start := time.Now()
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		fakeRange("aaa", "aab"), fakeRange("aab", "aac"), fakeRange("aac", "aad"),
+	}))
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab")}))
+	batcher.Close()
+	c.Assert(time.Since(start), GreaterEqual, 40*time.Millisecond)
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+
+	c.Assert(sender.BatchCount(), Equals, 2)
+	c.Assert(sender.RangeCount(), Equals, 4)
+	tables := 0
+	for range outCh {
+		tables++
+	}
+	c.Assert(tables, Equals, 2)
+}
+
+func benchmarkBatcher(b *testing.B, tables, rangesPerTable int) {
+	ctx := context.Background()
+	ranges := make([]rtree.Range, 0, rangesPerTable)
+	for i := 0; i < rangesPerTable; i++ {
+		ranges = append(ranges, fakeRange(fmt.Sprintf("%08d", i), fmt.Sprintf("%08d", i+1)))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		errCh := make(chan error, 8)
+		sender := restore.NewNoopSender(0)
+		batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+		batcher.SetThreshold(128)
+		go func() {
+			for range outCh {
+			}
+		}()
+		for t := 0; t < tables; t++ {
+			batcher.Add(fakeTableWithRange(int64(t), ranges))
+		}
+		batcher.Close()
+		if sender.RangeCount() != tables*rangesPerTable {
+			b.Fatalf("ranges sent %d, expected %d", sender.RangeCount(), tables*rangesPerTable)
+		}
+	}
+}
+
+func BenchmarkBatcher100Tables(b *testing.B) {
+	benchmarkBatcher(b, 100, 100)
+}
+
+func BenchmarkBatcher1kTables(b *testing.B) {
+	benchmarkBatcher(b, 1000, 10)
+}
+
+// BenchmarkAddWithLargeRewriteRules adds tables with large rule sets concurrently,
+// while another goroutine keeps draining them.
+func BenchmarkAddWithLargeRewriteRules(b *testing.B) {
+	rules := restore.EmptyRewriteRule()
+	for i := 0; i < 1000; i++ {
+		rules.Append(*fakeRewriteRules(fmt.Sprintf("%04d", i), fmt.Sprintf("%04d", i+1000)))
+	}
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, restore.NewNoopSender(0), newMockManager(), errCh)
+	batcher.SetThreshold(1 << 30)
+	go func() {
+		for range outCh {
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				batcher.Send(ctx)
+			}
+		}
+	}()
+	var id int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			table := fakeTableWithRange(atomic.AddInt64(&id, 1), []rtree.Range{})
+			table.RewriteRule = rules
+			batcher.Add(table)
+		}
+	})
+	b.StopTimer()
+	close(done)
+	batcher.Close()
+}
+
+// reversedDrainStrategy drains the tables added later first.
+type reversedDrainStrategy struct {
+	invalid bool
+}
+
+func (s reversedDrainStrategy) Order(tables []restore.TableWithRange) []int {
+	if s.invalid {
+		return []int{0}
+	}
+	order := make([]int, 0, len(tables))
+	for i := len(tables) - 1; i >= 0; i-- {
+		order = append(order, i)
+	}
+	return order
+}
+
+func drainWithStrategy(c *C, strategy restore.DrainStrategy) [][]rtree.Range {
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	batcher, _, err := restore.NewBatcherWithOptions(context.Background(), sender, newMockManager(), errCh,
+		restore.BatcherOptions{DrainStrategy: strategy})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(2)
+	batcher.Pause()
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab")}))
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab")}))
+	batcher.Add(fakeTableWithRange(3, []rtree.Range{fakeRange("caa", "cab")}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	return sender.Batches()
+}
+
+func (*testBatcherSuite) TestDrainStrategy(c *C) {
+	c.Assert(drainWithStrategy(c, restore.FIFODrainStrategy{}), DeepEquals, [][]rtree.Range{
+		{fakeRange("aaa", "aab"), fakeRange("baa", "bab")},
+		{fakeRange("caa", "cab")},
+	})
+	c.Assert(drainWithStrategy(c, reversedDrainStrategy{}), DeepEquals, [][]rtree.Range{
+		{fakeRange("caa", "cab"), fakeRange("baa", "bab")},
+		{fakeRange("aaa", "aab")},
+	})
+	// an invalid order is ignored.
+	c.Assert(drainWithStrategy(c, reversedDrainStrategy{invalid: true}), DeepEquals, [][]rtree.Range{
+		{fakeRange("aaa", "aab"), fakeRange("baa", "bab")},
+		{fakeRange("caa", "cab")},
+	})
+}
+
+func tableIDs(tables []restore.CreatedTable) []int64 {
+	ids := make([]int64, 0, len(tables))
+	for _, tbl := range tables {
+		ids = append(ids, tbl.Table.ID)
+	}
+	return ids
+}
+
+func (*testBatcherSuite) TestSendAndWait(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, newDrySender(), newMockManager(), errCh)
+	batcher.SetThreshold(3)
+	batcher.Pause()
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab"), fakeRange("aab", "aac")}))
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab"), fakeRange("bab", "bac")}))
+
+	// table 2 isn't sent fully by the first batch.
+	tables, err := batcher.SendAndWait(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(tableIDs(tables), DeepEquals, []int64{1})
+	c.Assert((<-outCh).Table.ID, Equals, int64(1))
+	tables, err = batcher.SendAndWait(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(tableIDs(tables), DeepEquals, []int64{2})
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+
+	// it gives up waiting once the context is done.
+	sender := &holdFirstSender{}
+	batcher, _ = restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(3)
+	batcher.Pause()
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab")}))
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = batcher.SendAndWait(timeoutCtx)
+	c.Assert(err, ErrorMatches, ".*failed to wait for the tables of the batch restored.*")
+	sender.release()
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+}
+
+func (*testBatcherSuite) TestSendAndWaitHeldBackTables(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	batcher, outCh, err := restore.NewBatcherWithOptions(ctx, newDrySender(), newMockManager(), errCh,
+		restore.BatcherOptions{OnTableRestored: func(ctx context.Context, tbl restore.CreatedTable) error {
+			return errors.New("checksum mismatch")
+		}})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(3)
+	batcher.Pause()
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab")}))
+
+	// the table is never emitted, but it is restored.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	tables, err := batcher.SendAndWait(timeoutCtx)
+	c.Assert(err, IsNil)
+	c.Assert(tableIDs(tables), DeepEquals, []int64{1})
+	batcher.Close()
+	c.Assert(collectTableIDs(outCh), HasLen, 0)
+	c.Assert(restore.Exhaust(errCh), HasLen, 1)
+}
+
+func (*testBatcherSuite) TestFlush(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(2)
+	c.Assert(batcher.EnableAutoCommit(ctx, time.Hour), IsNil)
+
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab")}))
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{}))
+	c.Assert(batcher.Flush(ctx), IsNil)
+	// everything cached is flushed, even the table without any range.
+	c.Assert(batcher.Len(), Equals, 0)
+	c.Assert(sender.RangeLen(), Equals, 1)
+	c.Assert(tableIDs([]restore.CreatedTable{<-outCh, <-outCh}), DeepEquals, []int64{1, 2})
+	// the auto commit keeps working.
+	c.Assert(batcher.Config().AutoCommit, IsTrue)
+
+	batcher.Add(fakeTableWithRange(3, []rtree.Range{fakeRange("caa", "cab")}))
+	batcher.Close()
+	c.Assert((<-outCh).Table.ID, Equals, int64(3))
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+
+	// flushing a closed batcher is a no-op.
+	c.Assert(batcher.Flush(ctx), IsNil)
+}
+
+func (*testBatcherSuite) TestOnTableRestored(c *C) {
+	errCh := make(chan error, 8)
+	var mu sync.Mutex
+	restored := make([]int64, 0)
+	onRestored := func(ctx context.Context, tbl restore.CreatedTable) error {
+		mu.Lock()
+		defer mu.Unlock()
+		restored = append(restored, tbl.Table.ID)
+		if tbl.Table.ID == 2 {
+			return errors.New("checksum mismatch")
+		}
+		return nil
+	}
+	batcher, outCh, err := restore.NewBatcherWithOptions(context.Background(), newDrySender(), newMockManager(), errCh,
+		restore.BatcherOptions{OnTableRestored: onRestored})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(1)
+	c.Assert(batcher.Config().OnTableRestored, IsTrue)
+
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab")}))
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab")}))
+	batcher.Add(fakeTableWithRange(3, []rtree.Range{fakeRange("caa", "cab")}))
+	batcher.Close()
+
+	ids := make([]int64, 0)
+	for tbl := range outCh {
+		ids = append(ids, tbl.Table.ID)
+	}
+	// the table failed in the callback isn't emitted.
+	c.Assert(ids, DeepEquals, []int64{1, 3})
+	c.Assert(restored, DeepEquals, []int64{1, 2, 3})
+	errs := restore.Exhaust(errCh)
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errs[0], ErrorMatches, ".*failed on the restored table.*checksum mismatch.*")
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	pd "github.com/tikv/pd/client"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/conn"
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// CapacityPlan is the estimation of the cluster capacity required by a restore.
+type CapacityPlan struct {
+	// TotalBytes is the total size of the files to restore, without replicas.
+	TotalBytes uint64 `json:"total-bytes"`
+	// Regions is the count of regions after split, each range would be split into a region.
+	Regions int `json:"regions"`
+	// BytesPerStore is the bytes each store would receive, including the replicas.
+	BytesPerStore map[uint64]uint64 `json:"bytes-per-store"`
+	// RegionsPerStore is the count of peers each store would hold.
+	RegionsPerStore map[uint64]int `json:"regions-per-store"`
+}
+
+// PlanCapacity estimates the capacity required by restoring the tables without splitting or ingesting,
+// by the TiKV stores of the cluster, assuming the regions would be scattered evenly,
+// and each region has `replicas` peers on distinct stores.
+func PlanCapacity(
+	ctx context.Context,
+	pdClient pd.Client,
+	tables []TableWithRange,
+	replicas int,
+) (*CapacityPlan, error) {
+	stores, err := conn.GetAllTiKVStores(ctx, pdClient, conn.SkipTiFlash)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	storeIDs := make([]uint64, 0, len(stores))
+	for _, store := range stores {
+		if store.GetState() == metapb.StoreState_Up {
+			storeIDs = append(storeIDs, store.GetId())
+		}
+	}
+	if len(storeIDs) == 0 {
+		return nil, errors.Annotate(berrors.ErrPDInvalidResponse, "no TiKV store is up")
+	}
+	sort.Slice(storeIDs, func(i, j int) bool { return storeIDs[i] < storeIDs[j] })
+	if replicas > len(storeIDs) {
+		log.Warn("there are fewer stores than replicas", zap.Int("stores", len(storeIDs)), zap.Int("replicas", replicas))
+		replicas = len(storeIDs)
+	}
+
+	plan := &CapacityPlan{
+		BytesPerStore:   make(map[uint64]uint64, len(storeIDs)),
+		RegionsPerStore: make(map[uint64]int, len(storeIDs)),
+	}
+	for _, table := range tables {
+		for _, rng := range table.Range {
+			size := rangeSize(rng)
+			// scatter the peers of the region round robin.
+			for i := 0; i < replicas; i++ {
+				store := storeIDs[(plan.Regions+i)%len(storeIDs)]
+				plan.BytesPerStore[store] += size
+				plan.RegionsPerStore[store]++
+			}
+			plan.TotalBytes += size
+			plan.Regions++
+		}
+	}
+	log.Info("capacity required by the restore is estimated",
+		zap.Uint64("total-bytes", plan.TotalBytes),
+		zap.Int("regions", plan.Regions),
+		zap.Int("stores", len(storeIDs)),
+		zap.Int("replicas", replicas),
+	)
+	return plan, nil
+}
+
+// PlanCapacity estimates the capacity required by restoring the tables to the cluster of the client.
+// See PlanCapacity for details.
+func (rc *Client) PlanCapacity(ctx context.Context, tables []TableWithRange, replicas int) (*CapacityPlan, error) {
+	return PlanCapacity(ctx, rc.pdClient, tables, replicas)
+}
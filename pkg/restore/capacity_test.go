@@ -0,0 +1,63 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"context"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	pd "github.com/tikv/pd/client"
+
+	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/rtree"
+)
+
+type testCapacitySuite struct{}
+
+var _ = Suite(&testCapacitySuite{})
+
+type storesPDClient struct {
+	pd.Client
+	stores []*metapb.Store
+}
+
+func (c storesPDClient) GetAllStores(context.Context, ...pd.GetStoreOption) ([]*metapb.Store, error) {
+	return c.stores, nil
+}
+
+func (*testCapacitySuite) TestPlanCapacity(c *C) {
+	pdClient := storesPDClient{stores: []*metapb.Store{
+		{Id: 4, State: metapb.StoreState_Up},
+		{Id: 1, State: metapb.StoreState_Up},
+		{Id: 3, State: metapb.StoreState_Up},
+		{Id: 2, State: metapb.StoreState_Up},
+		{Id: 5, State: metapb.StoreState_Up, Labels: []*metapb.StoreLabel{{Key: "engine", Value: "tiflash"}}},
+		{Id: 6, State: metapb.StoreState_Offline},
+	}}
+	tables := []restore.TableWithRange{
+		fakeTableWithRange(1, []rtree.Range{
+			fakeRangeWithSize("aaa", "aab", 10),
+			fakeRangeWithSize("aab", "aac", 20),
+		}),
+		fakeTableWithRange(2, []rtree.Range{
+			fakeRangeWithSize("baa", "bab", 30),
+			fakeRangeWithSize("bab", "bac", 40),
+		}),
+	}
+	plan, err := restore.PlanCapacity(context.Background(), pdClient, tables, 2)
+	c.Assert(err, IsNil)
+	c.Assert(plan.TotalBytes, Equals, uint64(100))
+	c.Assert(plan.Regions, Equals, 4)
+	// the peers of regions are placed on stores [1, 2], [2, 3], [3, 4], [4, 1].
+	c.Assert(plan.BytesPerStore, DeepEquals, map[uint64]uint64{1: 50, 2: 30, 3: 50, 4: 70})
+	c.Assert(plan.RegionsPerStore, DeepEquals, map[uint64]int{1: 2, 2: 2, 3: 2, 4: 2})
+
+	// replicas are limited by the stores.
+	plan, err = restore.PlanCapacity(context.Background(), pdClient, tables, 5)
+	c.Assert(err, IsNil)
+	c.Assert(plan.BytesPerStore, DeepEquals, map[uint64]uint64{1: 100, 2: 100, 3: 100, 4: 100})
+
+	_, err = restore.PlanCapacity(context.Background(), storesPDClient{}, tables, 3)
+	c.Assert(err, ErrorMatches, ".*no TiKV store is up.*")
+}
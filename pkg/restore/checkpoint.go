@@ -0,0 +1,269 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+// CheckpointRange is a restored range recorded in the checkpoint.
+// the keys are the keys in the backup, i.e. they are not rewritten.
+type CheckpointRange struct {
+	StartKey []byte `json:"start-key"`
+	EndKey   []byte `json:"end-key"`
+	// Target is the key prefix the range is restored into, i.e. the new prefix of the rewrite rule of StartKey,
+	// so the same backup restored into other tables won't be skipped by the checkpoint.
+	Target []byte `json:"target,omitempty"`
+}
+
+// CheckpointData is the persistent content of a checkpoint.
+type CheckpointData struct {
+	RestoredRanges []CheckpointRange `json:"restored-ranges"`
+	// RestoredBytes is the total size of files of the restored ranges.
+	RestoredBytes uint64 `json:"restored-bytes"`
+	// DoneTables are the IDs(in the backup) of tables fully restored.
+	DoneTables []int64 `json:"done-tables"`
+}
+
+// CheckpointStore is where the checkpoint persists.
+type CheckpointStore interface {
+	// Load loads the checkpoint data, returns empty data if there isn't any checkpoint.
+	Load(ctx context.Context) (*CheckpointData, error)
+	// Save saves the checkpoint data, overwriting the former one.
+	Save(ctx context.Context, data *CheckpointData) error
+}
+
+type storageCheckpointStore struct {
+	storage storage.ExternalStorage
+	name    string
+	format  CheckpointFormat
+}
+
+// NewStorageCheckpointStore makes a checkpoint store that saves the checkpoint
+// as a JSON file named `name` in the external storage.
+func NewStorageCheckpointStore(s storage.ExternalStorage, name string) CheckpointStore {
+	return NewStorageCheckpointStoreWithFormat(s, name, JSONCheckpointFormat{})
+}
+
+// NewStorageCheckpointStoreWithFormat is like NewStorageCheckpointStore, but the checkpoint is serialized by the format,
+// e.g. BinaryCheckpointFormat, which trades the readability for the size.
+func NewStorageCheckpointStoreWithFormat(s storage.ExternalStorage, name string, format CheckpointFormat) CheckpointStore {
+	return storageCheckpointStore{
+		storage: s,
+		name:    name,
+		format:  format,
+	}
+}
+
+func (s storageCheckpointStore) Load(ctx context.Context) (*CheckpointData, error) {
+	exists, err := s.storage.FileExists(ctx, s.name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !exists {
+		return &CheckpointData{}, nil
+	}
+	content, err := s.storage.ReadFile(ctx, s.name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	data := new(CheckpointData)
+	if err := s.format.Unmarshal(content, data); err != nil {
+		return nil, errors.Annotatef(err, "failed to parse checkpoint %s", s.name)
+	}
+	return data, nil
+}
+
+func (s storageCheckpointStore) Save(ctx context.Context, data *CheckpointData) error {
+	content, err := s.format.Marshal(data)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(s.storage.WriteFile(ctx, s.name, content))
+}
+
+// DefaultCheckpointSaveInterval is the default min interval between saving the checkpoint, see SetSaveInterval.
+const DefaultCheckpointSaveInterval = 10 * time.Second
+
+// Checkpoint records the ranges have been restored, so a restarted restore
+// can skip them, even when the table they belong to is partially restored.
+type Checkpoint struct {
+	mu       sync.Mutex
+	store    CheckpointStore
+	data     CheckpointData
+	restored map[string]struct{}
+	done     map[int64]struct{}
+
+	// saveInterval is the min interval between saving the checkpoint, since each save rewrites the whole checkpoint.
+	saveInterval time.Duration
+	lastSaved    time.Time
+	// dirty is set once anything is recorded but not saved yet.
+	dirty bool
+}
+
+// LoadCheckpoint loads the checkpoint from the store.
+func LoadCheckpoint(ctx context.Context, store CheckpointStore) (*Checkpoint, error) {
+	data, err := store.Load(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cp := &Checkpoint{
+		store:    store,
+		data:     *data,
+		restored: make(map[string]struct{}, len(data.RestoredRanges)),
+		done:     make(map[int64]struct{}, len(data.DoneTables)),
+
+		saveInterval: DefaultCheckpointSaveInterval,
+		lastSaved:    time.Now(),
+	}
+	for _, rng := range data.RestoredRanges {
+		cp.restored[restoredRangeKey(rng.StartKey, rng.EndKey, rng.Target)] = struct{}{}
+	}
+	for _, id := range data.DoneTables {
+		cp.done[id] = struct{}{}
+	}
+	return cp, nil
+}
+
+func checkpointKey(startKey, endKey []byte) string {
+	return hex.EncodeToString(startKey) + "-" + hex.EncodeToString(endKey)
+}
+
+// restoredRangeKey is the key of a range restored into the target in the checkpoint.
+func restoredRangeKey(startKey, endKey, target []byte) string {
+	return checkpointKey(startKey, endKey) + "@" + hex.EncodeToString(target)
+}
+
+// checkpointTarget returns the key prefix the range is restored into by the rewrite rules.
+func checkpointTarget(rng rtree.Range, rewriteRules *RewriteRules) []byte {
+	if rewriteRules == nil {
+		return nil
+	}
+	return matchOldPrefix(rng.StartKey, rewriteRules).GetNewKeyPrefix()
+}
+
+// SetSaveInterval sets the min interval between saving the checkpoint, the ranges and tables recorded
+// within the interval are saved by the next record after it, or by Flush.
+// zero means saving on every record. set it before the restore starts, please.
+func (cp *Checkpoint) SetSaveInterval(interval time.Duration) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.saveInterval = interval
+}
+
+// IsRestored checks whether the range has been restored by the rewrite rules.
+func (cp *Checkpoint) IsRestored(rng rtree.Range, rewriteRules *RewriteRules) bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	_, ok := cp.restored[restoredRangeKey(rng.StartKey, rng.EndKey, checkpointTarget(rng, rewriteRules))]
+	return ok
+}
+
+// RemoveRestored returns the ranges haven't been restored by the rewrite rules.
+func (cp *Checkpoint) RemoveRestored(ranges []rtree.Range, rewriteRules *RewriteRules) []rtree.Range {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	remaining := make([]rtree.Range, 0, len(ranges))
+	for _, rng := range ranges {
+		key := restoredRangeKey(rng.StartKey, rng.EndKey, checkpointTarget(rng, rewriteRules))
+		if _, ok := cp.restored[key]; !ok {
+			remaining = append(remaining, rng)
+		}
+	}
+	return remaining
+}
+
+// RecordRestored records the ranges restored by the rewrite rules, and then persists the checkpoint
+// if the save interval has elapsed since the last save.
+func (cp *Checkpoint) RecordRestored(ctx context.Context, ranges []rtree.Range, rewriteRules *RewriteRules) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for _, rng := range ranges {
+		target := checkpointTarget(rng, rewriteRules)
+		key := restoredRangeKey(rng.StartKey, rng.EndKey, target)
+		if _, ok := cp.restored[key]; ok {
+			continue
+		}
+		cp.restored[key] = struct{}{}
+		cp.data.RestoredRanges = append(cp.data.RestoredRanges, CheckpointRange{
+			StartKey: rng.StartKey,
+			EndKey:   rng.EndKey,
+			Target:   target,
+		})
+		for _, f := range rng.Files {
+			cp.data.RestoredBytes += f.GetSize_()
+		}
+		cp.dirty = true
+	}
+	return errors.Trace(cp.maybeSave(ctx))
+}
+
+// RecordTablesDone records the tables fully restored, and then persists the checkpoint.
+// it returns the count of tables done, including those done before the restart.
+func (cp *Checkpoint) RecordTablesDone(ctx context.Context, tables []CreatedTable) (int, error) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for _, tbl := range tables {
+		id := tbl.OldTable.Info.ID
+		if _, ok := cp.done[id]; ok {
+			continue
+		}
+		cp.done[id] = struct{}{}
+		cp.data.DoneTables = append(cp.data.DoneTables, id)
+		cp.dirty = true
+	}
+	return len(cp.data.DoneTables), errors.Trace(cp.maybeSave(ctx))
+}
+
+// maybeSave saves the checkpoint if anything isn't saved and the save interval has elapsed.
+// the caller should hold mu.
+func (cp *Checkpoint) maybeSave(ctx context.Context) error {
+	if !cp.dirty || time.Since(cp.lastSaved) < cp.saveInterval {
+		return nil
+	}
+	return cp.save(ctx)
+}
+
+// save saves the checkpoint, the caller should hold mu.
+func (cp *Checkpoint) save(ctx context.Context) error {
+	if err := cp.store.Save(ctx, &cp.data); err != nil {
+		return errors.Trace(err)
+	}
+	cp.dirty = false
+	cp.lastSaved = time.Now()
+	return nil
+}
+
+// Flush saves the ranges and tables recorded but not saved yet, regardless of the save interval.
+// call it once the restore stops, or they would be restored again by the restarted restore.
+func (cp *Checkpoint) Flush(ctx context.Context) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if !cp.dirty {
+		return nil
+	}
+	log.Debug("flushing the checkpoint", zap.Int("ranges", len(cp.data.RestoredRanges)))
+	return errors.Trace(cp.save(ctx))
+}
+
+// Progress returns the cumulative progress recorded in the checkpoint,
+// which is the start point of the progress of a restarted restore.
+func (cp *Checkpoint) Progress() RestoreProgress {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return RestoreProgress{
+		TablesDone: len(cp.data.DoneTables),
+		RangesSent: len(cp.data.RestoredRanges),
+		BytesSent:  cp.data.RestoredBytes,
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/pingcap/errors"
+)
+
+// CheckpointFormat is how the checkpoint data is serialized, see NewStorageCheckpointStoreWithFormat.
+type CheckpointFormat interface {
+	Marshal(data *CheckpointData) ([]byte, error)
+	Unmarshal(content []byte, data *CheckpointData) error
+}
+
+// JSONCheckpointFormat serializes the checkpoint as JSON, which is readable, and the default format.
+type JSONCheckpointFormat struct{}
+
+// Marshal implements CheckpointFormat.
+func (JSONCheckpointFormat) Marshal(data *CheckpointData) ([]byte, error) {
+	content, err := json.Marshal(data)
+	return content, errors.Trace(err)
+}
+
+// Unmarshal implements CheckpointFormat.
+func (JSONCheckpointFormat) Unmarshal(content []byte, data *CheckpointData) error {
+	return errors.Trace(json.Unmarshal(content, data))
+}
+
+// binaryCheckpointMagic is the header of the checkpoints in BinaryCheckpointFormat, with the version.
+var binaryCheckpointMagic = []byte("BRCP\x01")
+
+// BinaryCheckpointFormat serializes the checkpoint compactly, which is useful for huge restores.
+// the keys are stored as is(rather than base64 in JSON), and the integers are varints.
+type BinaryCheckpointFormat struct{}
+
+// Marshal implements CheckpointFormat.
+func (BinaryCheckpointFormat) Marshal(data *CheckpointData) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(binaryCheckpointMagic)+len(data.RestoredRanges)*64))
+	buf.Write(binaryCheckpointMagic)
+	scratch := make([]byte, binary.MaxVarintLen64)
+	writeUvarint := func(v uint64) {
+		buf.Write(scratch[:binary.PutUvarint(scratch, v)])
+	}
+	writeBytes := func(b []byte) {
+		writeUvarint(uint64(len(b)))
+		buf.Write(b)
+	}
+	writeUvarint(uint64(len(data.RestoredRanges)))
+	for _, rng := range data.RestoredRanges {
+		writeBytes(rng.StartKey)
+		writeBytes(rng.EndKey)
+		writeBytes(rng.Target)
+	}
+	writeUvarint(data.RestoredBytes)
+	writeUvarint(uint64(len(data.DoneTables)))
+	for _, id := range data.DoneTables {
+		buf.Write(scratch[:binary.PutVarint(scratch, id)])
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal implements CheckpointFormat.
+func (BinaryCheckpointFormat) Unmarshal(content []byte, data *CheckpointData) error {
+	if !bytes.HasPrefix(content, binaryCheckpointMagic) {
+		return errors.New("not a binary checkpoint, or the version is unsupported")
+	}
+	r := bytes.NewReader(content[len(binaryCheckpointMagic):])
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if n > uint64(r.Len()) {
+			return nil, errors.Trace(io.ErrUnexpectedEOF)
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return b, errors.Trace(err)
+	}
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// each range takes at least 3 bytes, don't allocate too much for a corrupted count.
+	if n > uint64(r.Len()) {
+		return errors.Trace(io.ErrUnexpectedEOF)
+	}
+	ranges := make([]CheckpointRange, 0, n)
+	for i := uint64(0); i < n; i++ {
+		startKey, err := readBytes()
+		if err != nil {
+			return err
+		}
+		endKey, err := readBytes()
+		if err != nil {
+			return err
+		}
+		target, err := readBytes()
+		if err != nil {
+			return err
+		}
+		if len(target) == 0 {
+			// keep it the same as the JSON format, where an empty target is omitted.
+			target = nil
+		}
+		ranges = append(ranges, CheckpointRange{StartKey: startKey, EndKey: endKey, Target: target})
+	}
+	restoredBytes, err := binary.ReadUvarint(r)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	n, err = binary.ReadUvarint(r)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if n > uint64(r.Len()) {
+		return errors.Trace(io.ErrUnexpectedEOF)
+	}
+	tables := make([]int64, 0, n)
+	for i := uint64(0); i < n; i++ {
+		id, err := binary.ReadVarint(r)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		tables = append(tables, id)
+	}
+	if r.Len() > 0 {
+		return errors.Errorf("%d unexpected trailing bytes in the binary checkpoint", r.Len())
+	}
+	*data = CheckpointData{
+		RestoredRanges: ranges,
+		RestoredBytes:  restoredBytes,
+		DoneTables:     tables,
+	}
+	return nil
+}
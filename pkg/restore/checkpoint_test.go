@@ -0,0 +1,299 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/backup"
+
+	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+type testCheckpointSuite struct{}
+
+var _ = Suite(&testCheckpointSuite{})
+
+type nopProgress struct{}
+
+func (nopProgress) Inc()   {}
+func (nopProgress) Close() {}
+
+// fakeRestorer restores files by recording them, and fails when restoring the file named `failOn`.
+type fakeRestorer struct {
+	mu       sync.Mutex
+	failOn   string
+	restored []string
+	// calls records the file names of each call to RestoreFiles.
+	calls [][]string
+	// splits records the ranges of each call to SplitRanges.
+	splits [][]rtree.Range
+}
+
+func (r *fakeRestorer) SplitRanges(
+	ctx context.Context,
+	ranges []rtree.Range,
+	rewriteRules *restore.RewriteRules,
+	updateCh glue.Progress,
+) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.splits = append(r.splits, ranges)
+	return nil
+}
+
+func (r *fakeRestorer) RestoreFiles(
+	ctx context.Context,
+	files []*backup.File,
+	rewriteRules *restore.RewriteRules,
+	updateCh glue.Progress,
+) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	call := make([]string, 0, len(files))
+	for _, f := range files {
+		call = append(call, f.GetName())
+	}
+	r.calls = append(r.calls, call)
+	for _, f := range files {
+		if f.GetName() == r.failOn {
+			return errors.Errorf("injected failure on restoring %s", f.GetName())
+		}
+		r.restored = append(r.restored, f.GetName())
+	}
+	return nil
+}
+
+func (r *fakeRestorer) Restored() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.restored...)
+}
+
+func (r *fakeRestorer) Calls() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]string{}, r.calls...)
+}
+
+func (r *fakeRestorer) Splits() [][]rtree.Range {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]rtree.Range{}, r.splits...)
+}
+
+// crashTolerantManager is a context manager that doesn't complain about tables left when closing,
+// because the restore may 'crash' in the middle of a table.
+type crashTolerantManager struct {
+	*recordCurrentTableManager
+}
+
+func (crashTolerantManager) Close(ctx context.Context) {}
+
+func runRestoreWithCheckpoint(
+	c *C,
+	store restore.CheckpointStore,
+	restorer *fakeRestorer,
+	table restore.TableWithRange,
+	reporter restore.ProgressReporter,
+) ([]restore.CreatedTable, []error) {
+	ctx := context.Background()
+	cp, err := restore.LoadCheckpoint(ctx, store)
+	c.Assert(err, IsNil)
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{Checkpoint: cp})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, outCh, err := restore.NewBatcherWithOptions(ctx, sender, crashTolerantManager{newMockManager()}, errCh,
+		restore.BatcherOptions{Checkpoint: cp, ProgressReporter: reporter})
+	c.Assert(err, IsNil)
+	batcher.SetThreshold(1)
+	batcher.Add(table)
+	batcher.Close()
+
+	tables := make([]restore.CreatedTable, 0)
+	for tbl := range outCh {
+		tables = append(tables, tbl)
+	}
+	return tables, restore.Exhaust(errCh)
+}
+
+func (*testCheckpointSuite) TestResumePartiallyRestoredTable(c *C) {
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	store := restore.NewStorageCheckpointStore(s, "checkpoint.json")
+	ranges := []rtree.Range{
+		fakeRangeWithSize("aaa", "aab", 1),
+		fakeRangeWithSize("aab", "aac", 1),
+		fakeRangeWithSize("aac", "aad", 1),
+		fakeRangeWithSize("aad", "aae", 1),
+	}
+
+	// the first run 'crashes' at the third range of the table.
+	restorer := &fakeRestorer{failOn: "aac.sst"}
+	tables, errs := runRestoreWithCheckpoint(c, store, restorer, fakeTableWithRange(1, ranges), nil)
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errs[0], ErrorMatches, ".*injected failure.*")
+	c.Assert(tables, HasLen, 0)
+	c.Assert(restorer.Restored(), DeepEquals, []string{"aaa.sst", "aab.sst"})
+
+	data, err := store.Load(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(data.RestoredRanges, HasLen, 2)
+
+	// the second run should only restore the remaining ranges, and emit the table.
+	restorer = &fakeRestorer{}
+	tables, errs = runRestoreWithCheckpoint(c, store, restorer, fakeTableWithRange(1, ranges), nil)
+	c.Assert(errs, HasLen, 0)
+	c.Assert(tables, HasLen, 1)
+	c.Assert(restorer.Restored(), DeepEquals, []string{"aac.sst", "aad.sst"})
+
+	// once all ranges are restored, the table would still be emitted, without restoring anything.
+	restorer = &fakeRestorer{}
+	tables, errs = runRestoreWithCheckpoint(c, store, restorer, fakeTableWithRange(1, ranges), nil)
+	c.Assert(errs, HasLen, 0)
+	c.Assert(tables, HasLen, 1)
+	c.Assert(restorer.Restored(), HasLen, 0)
+}
+
+func (*testCheckpointSuite) TestResumeProgress(c *C) {
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	store := restore.NewStorageCheckpointStore(s, "checkpoint.json")
+	ranges := []rtree.Range{
+		fakeRangeWithSize("aaa", "aab", 10),
+		fakeRangeWithSize("aab", "aac", 20),
+		fakeRangeWithSize("aac", "aad", 30),
+		fakeRangeWithSize("aad", "aae", 40),
+	}
+	lastProgress := func(reporter *recordProgressReporter) restore.RestoreProgress {
+		reports := reporter.Reports()
+		c.Assert(len(reports), Greater, 0)
+		return reports[len(reports)-1]
+	}
+
+	restorer := &fakeRestorer{failOn: "aac.sst"}
+	_, errs := runRestoreWithCheckpoint(c, store, restorer, fakeTableWithRange(1, ranges), new(recordProgressReporter))
+	c.Assert(errs, HasLen, 1)
+
+	// the resumed restore should report the progress made before the restart.
+	reporter := new(recordProgressReporter)
+	restorer = &fakeRestorer{}
+	tables, errs := runRestoreWithCheckpoint(c, store, restorer, fakeTableWithRange(1, ranges), reporter)
+	c.Assert(errs, HasLen, 0)
+	c.Assert(tables, HasLen, 1)
+	c.Assert(reporter.Reports()[0].RangesSent, Greater, 2)
+	c.Assert(lastProgress(reporter), DeepEquals, restore.RestoreProgress{
+		TablesDone: 1,
+		RangesSent: 4,
+		BytesSent:  100,
+	})
+
+	// the table done before the restart shouldn't be counted twice.
+	reporter = new(recordProgressReporter)
+	_, errs = runRestoreWithCheckpoint(c, store, &fakeRestorer{}, fakeTableWithRange(1, ranges), reporter)
+	c.Assert(errs, HasLen, 0)
+	c.Assert(lastProgress(reporter), DeepEquals, restore.RestoreProgress{
+		TablesDone: 1,
+		RangesSent: 4,
+		BytesSent:  100,
+	})
+}
+
+func (*testCheckpointSuite) TestCheckpointFormats(c *C) {
+	data := &restore.CheckpointData{
+		RestoredRanges: []restore.CheckpointRange{
+			{StartKey: []byte("aaa"), EndKey: []byte("aab")},
+			{StartKey: []byte("aab\x00\xff"), EndKey: []byte("aac"), Target: []byte("t1")},
+		},
+		RestoredBytes: 1 << 40,
+		DoneTables:    []int64{1, 42, -1},
+	}
+	sizes := make(map[string]int)
+	for name, format := range map[string]restore.CheckpointFormat{
+		"json":   restore.JSONCheckpointFormat{},
+		"binary": restore.BinaryCheckpointFormat{},
+	} {
+		content, err := format.Marshal(data)
+		c.Assert(err, IsNil)
+		sizes[name] = len(content)
+
+		s, err := storage.NewLocalStorage(c.MkDir())
+		c.Assert(err, IsNil)
+		store := restore.NewStorageCheckpointStoreWithFormat(s, "checkpoint", format)
+		c.Assert(store.Save(context.Background(), data), IsNil)
+		loaded, err := store.Load(context.Background())
+		c.Assert(err, IsNil, Commentf("format %s", name))
+		c.Assert(loaded, DeepEquals, data, Commentf("format %s", name))
+	}
+	c.Assert(sizes["binary"], Less, sizes["json"])
+
+	// a checkpoint in another format shouldn't be silently accepted.
+	content, err := restore.JSONCheckpointFormat{}.Marshal(data)
+	c.Assert(err, IsNil)
+	c.Assert(restore.BinaryCheckpointFormat{}.Unmarshal(content, new(restore.CheckpointData)), NotNil)
+}
+
+func (*testCheckpointSuite) TestCheckpointTarget(c *C) {
+	ctx := context.Background()
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	cp, err := restore.LoadCheckpoint(ctx, restore.NewStorageCheckpointStore(s, "checkpoint.json"))
+	c.Assert(err, IsNil)
+	ranges := []rtree.Range{fakeRange("aaa", "aab"), fakeRange("aab", "aac")}
+	c.Assert(cp.RecordRestored(ctx, ranges, fakeRewriteRules("a", "t1")), IsNil)
+
+	c.Assert(cp.RemoveRestored(ranges, fakeRewriteRules("a", "t1")), HasLen, 0)
+	c.Assert(cp.IsRestored(ranges[0], fakeRewriteRules("a", "t1")), IsTrue)
+	// the same ranges restored into another table aren't restored yet.
+	c.Assert(cp.RemoveRestored(ranges, fakeRewriteRules("a", "t2")), DeepEquals, ranges)
+	c.Assert(cp.IsRestored(ranges[0], nil), IsFalse)
+}
+
+// countingCheckpointStore is a checkpoint store in memory, which counts the saves.
+type countingCheckpointStore struct {
+	saves int
+	data  restore.CheckpointData
+}
+
+func (s *countingCheckpointStore) Load(ctx context.Context) (*restore.CheckpointData, error) {
+	data := s.data
+	return &data, nil
+}
+
+func (s *countingCheckpointStore) Save(ctx context.Context, data *restore.CheckpointData) error {
+	s.saves++
+	s.data = *data
+	return nil
+}
+
+func (*testCheckpointSuite) TestCheckpointSaveInterval(c *C) {
+	ctx := context.Background()
+	store := new(countingCheckpointStore)
+	cp, err := restore.LoadCheckpoint(ctx, store)
+	c.Assert(err, IsNil)
+	cp.SetSaveInterval(time.Hour)
+	for _, rng := range []rtree.Range{fakeRange("aaa", "aab"), fakeRange("aab", "aac"), fakeRange("aac", "aad")} {
+		c.Assert(cp.RecordRestored(ctx, []rtree.Range{rng}, nil), IsNil)
+	}
+	// the records within the interval are saved together by the flush.
+	c.Assert(store.saves, Equals, 0)
+	c.Assert(cp.Flush(ctx), IsNil)
+	c.Assert(store.saves, Equals, 1)
+	c.Assert(store.data.RestoredRanges, HasLen, 3)
+	c.Assert(cp.Flush(ctx), IsNil)
+	c.Assert(store.saves, Equals, 1)
+
+	// zero interval saves on every record.
+	cp.SetSaveInterval(0)
+	c.Assert(cp.RecordRestored(ctx, []rtree.Range{fakeRange("aad", "aae")}, nil), IsNil)
+	_, err = cp.RecordTablesDone(ctx, []restore.CreatedTable{fakeTableWithRange(1, nil).CreatedTable})
+	c.Assert(err, IsNil)
+	c.Assert(store.saves, Equals, 3)
+}
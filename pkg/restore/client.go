@@ -17,6 +17,7 @@ import (
 	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/backup"
 	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/log"
 	"github.com/pingcap/parser/model"
@@ -41,6 +42,7 @@ import (
 	"github.com/pingcap/br/pkg/glue"
 	"github.com/pingcap/br/pkg/logutil"
 	"github.com/pingcap/br/pkg/pdutil"
+	"github.com/pingcap/br/pkg/rtree"
 	"github.com/pingcap/br/pkg/storage"
 	"github.com/pingcap/br/pkg/summary"
 	"github.com/pingcap/br/pkg/utils"
@@ -89,6 +91,11 @@ type Client struct {
 	// and restore stats with #dump.LoadStatsFromJSON
 	statsHandler *handle.Handle
 	dom          *domain.Domain
+
+	completionReporter CompletionReporter
+
+	// dbNameMapper maps the name of a database in the backup to the name of the database restoring into.
+	dbNameMapper func(name model.CIStr) model.CIStr
 }
 
 // NewRestoreClient returns a new RestoreClient.
@@ -126,6 +133,33 @@ func NewRestoreClient(
 	}, nil
 }
 
+// SetDBNameMapper sets the hook which maps the name of a database in the backup
+// to the name of the database restoring into, so a backup can be restored into a renamed database.
+func (rc *Client) SetDBNameMapper(mapper func(name model.CIStr) model.CIStr) {
+	rc.dbNameMapper = mapper
+}
+
+// targetDBName returns the name of the database which the database in the backup restores into.
+func (rc *Client) targetDBName(name model.CIStr) model.CIStr {
+	if rc.dbNameMapper == nil {
+		return name
+	}
+	return rc.dbNameMapper(name)
+}
+
+// targetTable returns the table whose database is replaced with the database it restores into.
+func (rc *Client) targetTable(table *utils.Table) *utils.Table {
+	target := rc.targetDBName(table.DB.Name)
+	if target.L == table.DB.Name.L {
+		return table
+	}
+	db := table.DB.Clone()
+	db.Name = target
+	newTable := *table
+	newTable.DB = db
+	return &newTable
+}
+
 // SetRateLimit to set rateLimit.
 func (rc *Client) SetRateLimit(rateLimit uint64) {
 	rc.rateLimit = rateLimit
@@ -301,6 +335,21 @@ func (rc *Client) GetPlacementRules(ctx context.Context, pdAddrs []string) ([]pl
 	return placementRules, errors.Trace(errRetry)
 }
 
+// GetHotReadKeysRate returns the read keys rate of hot regions reported by PD,
+// which approximately reflects the foreground read load of the cluster.
+func (rc *Client) GetHotReadKeysRate(ctx context.Context, pdAddrs []string) (float64, error) {
+	var rate float64
+	i := 0
+	errRetry := utils.WithRetry(ctx, func() error {
+		var err error
+		idx := i % len(pdAddrs)
+		i++
+		rate, err = pdutil.GetHotReadKeysRate(ctx, pdAddrs[idx], rc.tlsConf)
+		return errors.Trace(err)
+	}, newPDReqBackoffer())
+	return rate, errors.Trace(errRetry)
+}
+
 // GetDatabases returns all databases.
 func (rc *Client) GetDatabases() []*utils.Database {
 	dbs := make([]*utils.Database, 0, len(rc.databases))
@@ -340,6 +389,12 @@ func (rc *Client) CreateDatabase(ctx context.Context, db *model.DBInfo) error {
 		log.Info("skip create database", zap.Stringer("database", db.Name))
 		return nil
 	}
+	if target := rc.targetDBName(db.Name); target.L != db.Name.L {
+		log.Info("restore database into another name",
+			zap.Stringer("database", db.Name), zap.Stringer("target", target))
+		db = db.Clone()
+		db.Name = target
+	}
 	return rc.db.CreateDatabase(ctx, db)
 }
 
@@ -388,15 +443,29 @@ func (rc *Client) createTable(
 	table *utils.Table,
 	newTS uint64,
 ) (CreatedTable, error) {
+	target := rc.targetTable(table)
+	// the databases in the backup are created before their tables, only a mapped one may be missing.
+	if target != table {
+		targetDB, ok := dom.InfoSchema().SchemaByName(target.DB.Name)
+		if !ok {
+			return CreatedTable{}, errors.Annotatef(berrors.ErrRestoreSchemaNotExists,
+				"database %s which table %s restores into doesn't exist", target.DB.Name, table.Info.Name)
+		}
+		log.Debug("restore table into another database",
+			zap.Stringer("table", table.Info.Name),
+			zap.Stringer("database", table.DB.Name),
+			zap.Stringer("target", targetDB.Name),
+			zap.Int64("target id", targetDB.ID))
+	}
 	if rc.IsSkipCreateSQL() {
 		log.Info("skip create table and alter autoIncID", zap.Stringer("table", table.Info.Name))
 	} else {
-		err := db.CreateTable(ctx, table)
+		err := db.CreateTable(ctx, target)
 		if err != nil {
 			return CreatedTable{}, errors.Trace(err)
 		}
 	}
-	newTableInfo, err := rc.GetTableSchema(dom, table.DB.Name, table.Info.Name)
+	newTableInfo, err := rc.GetTableSchema(dom, target.DB.Name, table.Info.Name)
 	if err != nil {
 		return CreatedTable{}, errors.Trace(err)
 	}
@@ -537,12 +606,80 @@ func (rc *Client) setSpeedLimit(ctx context.Context) error {
 	return nil
 }
 
+// ValidateFiles checks the files in the external storage aren't corrupted.
+func (rc *Client) ValidateFiles(ctx context.Context, files []*backup.File) error {
+	return NewStorageFileValidator(rc.storage).ValidateFiles(ctx, files)
+}
+
+// GroupFilesByRegion groups the files by the region they would be ingested into.
+func (rc *Client) GroupFilesByRegion(
+	ctx context.Context,
+	files []*backup.File,
+	rewriteRules *RewriteRules,
+) ([][]*backup.File, error) {
+	return GroupFilesByRegion(ctx, NewSplitClient(rc.GetPDClient(), rc.GetTLSConfig()), files, rewriteRules)
+}
+
+// LocateFileStore returns the store which the file would be ingested into.
+func (rc *Client) LocateFileStore(ctx context.Context, file *backup.File, rewriteRules *RewriteRules) (uint64, error) {
+	return LocateFileStore(ctx, rc.toolClient, file, rewriteRules)
+}
+
+// LocateFileStores returns the stores of all peers of the regions which the file would be ingested into.
+func (rc *Client) LocateFileStores(
+	ctx context.Context, file *backup.File, rewriteRules *RewriteRules,
+) ([]uint64, error) {
+	return LocateFileStores(ctx, rc.toolClient, file, rewriteRules)
+}
+
+// SplitKeys implements KeySplitter.
+func (rc *Client) SplitKeys(ctx context.Context, keys [][]byte, opts SplitOptions, updateCh glue.Progress) error {
+	splitter := NewRegionSplitterWithOptions(NewSplitClient(rc.GetPDClient(), rc.GetTLSConfig()), opts)
+	return splitter.SplitKeys(ctx, keys, func(keys [][]byte) {
+		for range keys {
+			updateCh.Inc()
+		}
+	})
+}
+
+// SplitRanges implements TiKVRestorer.
+func (rc *Client) SplitRanges(
+	ctx context.Context,
+	ranges []rtree.Range,
+	rewriteRules *RewriteRules,
+	updateCh glue.Progress,
+) error {
+	return SplitRanges(ctx, rc, ranges, rewriteRules, updateCh)
+}
+
+// SplitRangesWithResult implements ClassifiedSplitter.
+func (rc *Client) SplitRangesWithResult(
+	ctx context.Context,
+	ranges []rtree.Range,
+	rewriteRules *RewriteRules,
+	opts SplitOptions,
+	updateCh glue.Progress,
+) (SplitResult, error) {
+	return SplitRangesWithResult(ctx, rc, ranges, rewriteRules, opts, updateCh)
+}
+
 // RestoreFiles tries to restore the files.
 func (rc *Client) RestoreFiles(
 	ctx context.Context,
 	files []*backup.File,
 	rewriteRules *RewriteRules,
 	updateCh glue.Progress,
+) error {
+	return rc.RestoreFilesWithPriority(ctx, files, rewriteRules, kvrpcpb.CommandPri_Normal, updateCh)
+}
+
+// RestoreFilesWithPriority implements PrioritizedRestorer.
+func (rc *Client) RestoreFilesWithPriority(
+	ctx context.Context,
+	files []*backup.File,
+	rewriteRules *RewriteRules,
+	pri kvrpcpb.CommandPri,
+	updateCh glue.Progress,
 ) (err error) {
 	start := time.Now()
 	defer func() {
@@ -577,7 +714,7 @@ func (rc *Client) RestoreFiles(
 						zap.Duration("take", time.Since(fileStart)))
 					updateCh.Inc()
 				}()
-				return rc.fileImporter.Import(ectx, fileReplica, rewriteRules)
+				return rc.fileImporter.ImportWithPriority(ectx, fileReplica, rewriteRules, pri)
 			})
 	}
 	if err := eg.Wait(); err != nil {
@@ -717,6 +854,34 @@ func (rc *Client) switchTiKVMode(ctx context.Context, mode import_sstpb.SwitchMo
 	return nil
 }
 
+// TableChecksum is the checksum of a table.
+type TableChecksum struct {
+	Crc64Xor   uint64
+	TotalKvs   uint64
+	TotalBytes uint64
+}
+
+// TableCompletion is the event that a table has been fully restored and validated.
+type TableCompletion struct {
+	Table CreatedTable
+	// Checksum is the checksum calculated from the restored table,
+	// nil if the table isn't verified by checksum(e.g. there isn't checksum in the backup).
+	Checksum *TableChecksum
+}
+
+// CompletionReporter receives the completion of tables.
+type CompletionReporter interface {
+	// ReportCompletion reports a table is completed.
+	// this may be called concurrently, so implementations must be goroutine-safe.
+	ReportCompletion(completion TableCompletion)
+}
+
+// SetCompletionReporter sets the reporter which receives the completion of each table
+// once its checksum is validated by GoValidateChecksum.
+func (rc *Client) SetCompletionReporter(reporter CompletionReporter) {
+	rc.completionReporter = reporter
+}
+
 // GoValidateChecksum forks a goroutine to validate checksum after restore.
 // it returns a channel fires a struct{} when all things get done.
 func (rc *Client) GoValidateChecksum(
@@ -754,10 +919,13 @@ func (rc *Client) GoValidateChecksum(
 					return
 				}
 				workers.ApplyOnErrorGroup(wg, func() error {
-					err := rc.execChecksum(ectx, tbl, kvClient, concurrency)
+					cs, err := rc.execChecksum(ectx, tbl, kvClient, concurrency)
 					if err != nil {
 						return errors.Trace(err)
 					}
+					if rc.completionReporter != nil {
+						rc.completionReporter.ReportCompletion(TableCompletion{Table: tbl, Checksum: cs})
+					}
 					updateCh.Inc()
 					return nil
 				})
@@ -767,7 +935,14 @@ func (rc *Client) GoValidateChecksum(
 	return outCh
 }
 
-func (rc *Client) execChecksum(ctx context.Context, tbl CreatedTable, kvClient kv.Client, concurrency uint) error {
+// execChecksum validates the checksum of the table, returns the checksum calculated,
+// or nil if the table has no checksum in the backup.
+func (rc *Client) execChecksum(
+	ctx context.Context,
+	tbl CreatedTable,
+	kvClient kv.Client,
+	concurrency uint,
+) (*TableChecksum, error) {
 	logger := log.With(
 		zap.String("db", tbl.OldTable.DB.Name.O),
 		zap.String("table", tbl.OldTable.Info.Name.O),
@@ -775,7 +950,7 @@ func (rc *Client) execChecksum(ctx context.Context, tbl CreatedTable, kvClient k
 
 	if tbl.OldTable.NoChecksum() {
 		logger.Warn("table has no checksum, skipping checksum")
-		return nil
+		return nil, nil
 	}
 
 	if span := opentracing.SpanFromContext(ctx); span != nil && span.Tracer() != nil {
@@ -786,20 +961,20 @@ func (rc *Client) execChecksum(ctx context.Context, tbl CreatedTable, kvClient k
 
 	startTS, err := rc.GetTS(ctx)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 	exe, err := checksum.NewExecutorBuilder(tbl.Table, startTS).
 		SetOldTable(tbl.OldTable).
 		SetConcurrency(concurrency).
 		Build()
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 	checksumResp, err := exe.Execute(ctx, kvClient, func() {
 		// TODO: update progress here.
 	})
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
 	table := tbl.OldTable
@@ -814,7 +989,7 @@ func (rc *Client) execChecksum(ctx context.Context, tbl CreatedTable, kvClient k
 			zap.Uint64("origin tidb total bytes", table.TotalBytes),
 			zap.Uint64("calculated total bytes", checksumResp.TotalBytes),
 		)
-		return errors.Annotate(berrors.ErrRestoreChecksumMismatch, "failed to validate checksum")
+		return nil, errors.Annotate(berrors.ErrRestoreChecksumMismatch, "failed to validate checksum")
 	}
 	if table.Stats != nil {
 		logger.Info("start loads analyze after validate checksum",
@@ -825,7 +1000,11 @@ func (rc *Client) execChecksum(ctx context.Context, tbl CreatedTable, kvClient k
 			logger.Error("analyze table failed", zap.Any("table", table.Stats), zap.Error(err))
 		}
 	}
-	return nil
+	return &TableChecksum{
+		Crc64Xor:   checksumResp.Checksum,
+		TotalKvs:   checksumResp.TotalKvs,
+		TotalBytes: checksumResp.TotalBytes,
+	}, nil
 }
 
 const (
@@ -1009,7 +1188,7 @@ func (rc *Client) PreCheckTableClusterIndex(
 	dom *domain.Domain,
 ) error {
 	for _, table := range tables {
-		oldTableInfo, err := rc.GetTableSchema(dom, table.DB.Name, table.Info.Name)
+		oldTableInfo, err := rc.GetTableSchema(dom, rc.targetDBName(table.DB.Name), table.Info.Name)
 		// table exists in database
 		if err == nil {
 			if table.Info.IsCommonHandle != oldTableInfo.IsCommonHandle {
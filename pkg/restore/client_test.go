@@ -3,8 +3,10 @@
 package restore_test
 
 import (
+	"context"
 	"math"
 	"strconv"
+	"sync"
 	"time"
 
 	. "github.com/pingcap/check"
@@ -12,6 +14,7 @@ import (
 	"github.com/pingcap/parser/mysql"
 	"github.com/pingcap/parser/types"
 	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/testkit"
 	"github.com/pingcap/tidb/util/testleak"
 	"google.golang.org/grpc/keepalive"
 
@@ -99,6 +102,119 @@ func (s *testRestoreClientSuite) TestCreateTables(c *C) {
 	}
 }
 
+func (s *testRestoreClientSuite) TestCreateTablesIntoRenamedDB(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.SetDBNameMapper(func(name model.CIStr) model.CIStr {
+		if name.L == "origin" {
+			return model.NewCIStr("renamed")
+		}
+		return name
+	})
+
+	backupDB := &model.DBInfo{
+		ID:      1000,
+		Name:    model.NewCIStr("origin"),
+		Charset: "utf8mb4",
+		Collate: "utf8mb4_bin",
+	}
+	c.Assert(client.CreateDatabase(context.Background(), backupDB), IsNil)
+	intField := types.NewFieldType(mysql.TypeLong)
+	intField.Charset = "binary"
+	table := &utils.Table{
+		DB: backupDB,
+		Info: &model.TableInfo{
+			ID:   1001,
+			Name: model.NewCIStr("t"),
+			Columns: []*model.ColumnInfo{{
+				ID:        1,
+				Name:      model.NewCIStr("id"),
+				FieldType: *intField,
+				State:     model.StatePublic,
+			}},
+			Charset: "utf8mb4",
+			Collate: "utf8mb4_bin",
+		},
+	}
+	rules, newTables, err := client.CreateTables(s.mock.Domain, []*utils.Table{table}, 0)
+	c.Assert(err, IsNil)
+	c.Assert(newTables, HasLen, 1)
+	// the backup meta shouldn't be modified.
+	c.Assert(table.DB.Name.O, Equals, "origin")
+
+	info, err := s.mock.Domain.GetSnapshotInfoSchema(math.MaxUint64)
+	c.Assert(err, IsNil)
+	_, isExist := info.SchemaByName(model.NewCIStr("origin"))
+	c.Assert(isExist, IsFalse)
+	created, err := info.TableByName(model.NewCIStr("renamed"), model.NewCIStr("t"))
+	c.Assert(err, IsNil)
+	c.Assert(newTables[0].ID, Equals, created.Meta().ID)
+	c.Assert(rules.Table, HasLen, 1)
+	c.Assert(tablecodec.DecodeTableID(rules.Table[0].GetOldKeyPrefix()), Equals, int64(1001))
+	c.Assert(tablecodec.DecodeTableID(rules.Table[0].GetNewKeyPrefix()), Equals, created.Meta().ID)
+}
+
+type recordCompletionReporter struct {
+	mu          sync.Mutex
+	completions []restore.TableCompletion
+}
+
+func (r *recordCompletionReporter) ReportCompletion(completion restore.TableCompletion) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.completions = append(r.completions, completion)
+}
+
+func (s *testRestoreClientSuite) TestCompletionCarriesChecksum(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	reporter := &recordCompletionReporter{}
+	client.SetCompletionReporter(reporter)
+
+	tk := testkit.NewTestKit(c, s.mock.Storage)
+	tk.MustExec("use test")
+	tk.MustExec("drop table if exists completion;")
+	tk.MustExec("create table completion (a int);")
+	tk.MustExec("insert into completion values (10);")
+	info, err := s.mock.Domain.GetSnapshotInfoSchema(math.MaxUint64)
+	c.Assert(err, IsNil)
+	dbSchema, isExist := info.SchemaByName(model.NewCIStr("test"))
+	c.Assert(isExist, IsTrue)
+	table, err := info.TableByName(model.NewCIStr("test"), model.NewCIStr("completion"))
+	c.Assert(err, IsNil)
+
+	// the mock cluster returns a dummy checksum (all fields are 1).
+	tbl := restore.CreatedTable{
+		RewriteRule: restore.EmptyRewriteRule(),
+		Table:       table.Meta(),
+		OldTable: &utils.Table{
+			DB:         dbSchema,
+			Info:       table.Meta(),
+			Crc64Xor:   1,
+			TotalKvs:   1,
+			TotalBytes: 1,
+		},
+	}
+	tableStream := make(chan restore.CreatedTable, 1)
+	tableStream <- tbl
+	close(tableStream)
+	errCh := make(chan error, 8)
+	<-client.GoValidateChecksum(context.Background(), tableStream, s.mock.Storage.GetClient(), errCh, nopProgress{}, 4)
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+
+	c.Assert(reporter.completions, HasLen, 1)
+	c.Assert(reporter.completions[0].Table.Table.ID, Equals, table.Meta().ID)
+	c.Assert(reporter.completions[0].Checksum, DeepEquals, &restore.TableChecksum{
+		Crc64Xor:   1,
+		TotalKvs:   1,
+		TotalBytes: 1,
+	})
+}
+
 func (s *testRestoreClientSuite) TestIsOnline(c *C) {
 	c.Assert(s.mock.Start(), IsNil)
 	defer s.mock.Stop()
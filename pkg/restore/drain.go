@@ -0,0 +1,68 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// DrainStrategy decides which cached tables go into the next batch, see BatcherOptions.DrainStrategy.
+// e.g. a locality-aware strategy may put the tables targeting the same stores together, to reduce the overhead of splitting.
+type DrainStrategy interface {
+	// Order returns the order to drain the cached tables, by their indexes in `tables`,
+	// the tables come first are drained into the next batch first, until the batch is full.
+	// it must return a permutation of the indexes. the ranges of a table are always drained in order.
+	Order(tables []TableWithRange) []int
+}
+
+// FIFODrainStrategy drains the tables in the order they are added, which is the default strategy.
+type FIFODrainStrategy struct{}
+
+// Order implements DrainStrategy.
+func (FIFODrainStrategy) Order(tables []TableWithRange) []int {
+	order := make([]int, 0, len(tables))
+	for i := range tables {
+		order = append(order, i)
+	}
+	return order
+}
+
+// isPermutation checks whether the order is a permutation of [0, n).
+func isPermutation(order []int, n int) bool {
+	if len(order) != n {
+		return false
+	}
+	seen := make([]bool, n)
+	for _, i := range order {
+		if i < 0 || i >= n || seen[i] {
+			return false
+		}
+		seen[i] = true
+	}
+	return true
+}
+
+// reorderCachedTables reorders the cached tables by the drain strategy, the caller must hold cachedTablesMu.
+// the tables are left as they are if the strategy returns an invalid order.
+func (b *Batcher) reorderCachedTables() {
+	if b.drainStrategy == nil || len(b.cachedTables) <= 1 {
+		return
+	}
+	order := b.drainStrategy.Order(b.cachedTables)
+	if !isPermutation(order, len(b.cachedTables)) {
+		log.Warn("the drain strategy returns an invalid order, drain the tables in order they are added",
+			zap.Ints("order", order), zap.Int("tables", len(b.cachedTables)))
+		return
+	}
+	tables := make([]TableWithRange, 0, len(order))
+	addedAt := make([]time.Time, 0, len(order))
+	for _, i := range order {
+		tables = append(tables, b.cachedTables[i])
+		addedAt = append(addedAt, b.cachedTablesAddedAt[i])
+	}
+	b.cachedTables = tables
+	b.cachedTablesAddedAt = addedAt
+}
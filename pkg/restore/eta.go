@@ -0,0 +1,73 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultETAWindow is the default length of the sliding window for estimating the throughput.
+const DefaultETAWindow = time.Minute
+
+type throughputSample struct {
+	at   time.Time
+	done uint64
+}
+
+// ETAEstimator estimates the remaining time of a restore by the throughput of the recent sliding window,
+// so a burst long ago(e.g. ranges skipped by the checkpoint) won't affect the estimation.
+type ETAEstimator struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	total   uint64
+	samples []throughputSample
+}
+
+// NewETAEstimator creates an estimator which estimates by the throughput in the window.
+func NewETAEstimator(window time.Duration) *ETAEstimator {
+	return &ETAEstimator{
+		window: window,
+	}
+}
+
+// SetTotal sets the total bytes to restore.
+func (e *ETAEstimator) SetTotal(total uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.total = total
+}
+
+// Observe records the bytes done at the time.
+// samples older than the window would be dropped, but at least one of them is kept as the start of the window.
+func (e *ETAEstimator) Observe(at time.Time, done uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.samples = append(e.samples, throughputSample{at: at, done: done})
+	outdated := 0
+	for outdated+1 < len(e.samples) && at.Sub(e.samples[outdated+1].at) >= e.window {
+		outdated++
+	}
+	e.samples = e.samples[outdated:]
+}
+
+// ETA returns the estimated remaining time.
+// the second return value is false if it cannot be estimated yet(e.g. nothing done in the window).
+func (e *ETAEstimator) ETA() (time.Duration, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.samples) < 2 {
+		return 0, false
+	}
+	first, last := e.samples[0], e.samples[len(e.samples)-1]
+	elapsed := last.at.Sub(first.at)
+	if elapsed <= 0 || last.done <= first.done {
+		return 0, false
+	}
+	if last.done >= e.total {
+		return 0, true
+	}
+	rate := float64(last.done-first.done) / elapsed.Seconds()
+	return time.Duration(float64(e.total-last.done) / rate * float64(time.Second)), true
+}
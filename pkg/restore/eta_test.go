@@ -0,0 +1,49 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"time"
+
+	. "github.com/pingcap/check"
+
+	"github.com/pingcap/br/pkg/restore"
+)
+
+type testETASuite struct{}
+
+var _ = Suite(&testETASuite{})
+
+func (*testETASuite) TestETAConvergesOnSteadyThroughput(c *C) {
+	estimator := restore.NewETAEstimator(10 * time.Second)
+	estimator.SetTotal(10000)
+	start := time.Unix(0, 0)
+	_, ok := estimator.ETA()
+	c.Assert(ok, IsFalse)
+
+	// a burst at first, 500 bytes per second.
+	done := uint64(0)
+	for i := 0; i <= 10; i++ {
+		estimator.Observe(start.Add(time.Duration(i)*time.Second), done)
+		done += 500
+	}
+	eta, ok := estimator.ETA()
+	c.Assert(ok, IsTrue)
+	c.Assert(eta, Equals, 10*time.Second)
+
+	// then 100 bytes per second steadily, the burst should be forgotten once it leaves the window.
+	done -= 500
+	for i := 11; i <= 30; i++ {
+		done += 100
+		estimator.Observe(start.Add(time.Duration(i)*time.Second), done)
+	}
+	c.Assert(done, Equals, uint64(7000))
+	eta, ok = estimator.ETA()
+	c.Assert(ok, IsTrue)
+	c.Assert(eta, Equals, 30*time.Second)
+
+	estimator.Observe(start.Add(31*time.Second), 10000)
+	eta, ok = estimator.ETA()
+	c.Assert(ok, IsTrue)
+	c.Assert(eta, Equals, time.Duration(0))
+}
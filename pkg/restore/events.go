@@ -0,0 +1,71 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"sync"
+	"time"
+)
+
+// BatcherEventKind is the kind of a batcher event.
+type BatcherEventKind string
+
+const (
+	// EventAdd is recorded when a table is added to the batcher.
+	EventAdd BatcherEventKind = "add"
+	// EventSend is recorded when a batch is sent.
+	EventSend BatcherEventKind = "send"
+	// EventError is recorded when an error is emitted.
+	EventError BatcherEventKind = "error"
+	// EventWarn is recorded when the batcher finds something suspicious, e.g. too many tables cached.
+	EventWarn BatcherEventKind = "warn"
+)
+
+// BatcherEvent is an event of the batcher, recorded for diagnosing crashes.
+type BatcherEvent struct {
+	At      time.Time        `json:"at"`
+	Kind    BatcherEventKind `json:"kind"`
+	Message string           `json:"message"`
+}
+
+// eventRing is a ring buffer of the recent events, it records nothing if the size is zero.
+type eventRing struct {
+	mu     sync.Mutex
+	events []BatcherEvent
+	// next is the index the next event would be put at.
+	next int
+	full bool
+}
+
+// resize resets the ring buffer with the new size, the recorded events are dropped.
+func (r *eventRing) resize(size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = make([]BatcherEvent, size)
+	r.next = 0
+	r.full = false
+}
+
+func (r *eventRing) record(kind BatcherEventKind, message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) == 0 {
+		return
+	}
+	r.events[r.next] = BatcherEvent{At: time.Now(), Kind: kind, Message: message}
+	r.next++
+	if r.next == len(r.events) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// recent returns the recorded events, the oldest first.
+func (r *eventRing) recent() []BatcherEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]BatcherEvent{}, r.events[:r.next]...)
+	}
+	return append(append([]BatcherEvent{}, r.events[r.next:]...), r.events[:r.next]...)
+}
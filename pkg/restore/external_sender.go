@@ -0,0 +1,221 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/logutil"
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+// ExternalStorageManifestName is the name of the manifest of all batches written by ExternalStorageSender.
+const ExternalStorageManifestName = "restore-manifest.json"
+
+// ExternalStorageBatchManifestName returns the name of the manifest of the `seq`-th(from zero) batch
+// written by ExternalStorageSender.
+func ExternalStorageBatchManifestName(seq int) string {
+	return fmt.Sprintf("restore-manifest.%06d.json", seq)
+}
+
+// ExternalStorageRange is a range written by ExternalStorageSender, with its keys rewritten.
+type ExternalStorageRange struct {
+	StartKey []byte `json:"start-key"`
+	EndKey   []byte `json:"end-key"`
+	// Files are the names of the rewritten SSTs of the range in the target storage.
+	Files []string `json:"files"`
+}
+
+// ExternalStorageSender is a BatchSender which writes the rewritten SSTs to an external storage(e.g. S3)
+// instead of ingesting them into TiKV, so a restore can be validated offline by inspecting the result.
+// Like LocalSSTSender, it rewrites the keys of the backup files by the rewrite rules, and regions are never split.
+// The rewritten ranges of each batch are written to ExternalStorageBatchManifestName in the target storage
+// once the batch is done, so the manifests cover the batches written even if the restore stops halfway.
+// The ranges of all batches are written to ExternalStorageManifestName once the sender is closed.
+type ExternalStorageSender struct {
+	source storage.ExternalStorage
+	target storage.ExternalStorage
+	// scratch is the local directory where the SSTs are rewritten before being written to the target.
+	scratch string
+
+	inCh chan DrainResult
+	wg   *sync.WaitGroup
+	// batches is the count of batches written, only accessed by the restore worker.
+	batches int
+
+	// ranges is the ranges written so far, guarded by rangesMu.
+	ranges   []ExternalStorageRange
+	rangesMu sync.Mutex
+
+	sink TableSink
+}
+
+// NewExternalStorageSender creates a sender which reads the backup files from the source storage,
+// and writes the rewritten SSTs to the target storage, with the same names.
+// the batches are written in background until ctx is done.
+func NewExternalStorageSender(
+	ctx context.Context,
+	source, target storage.ExternalStorage,
+) (*ExternalStorageSender, error) {
+	scratch, err := ioutil.TempDir("", "br-external-sender")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sender := &ExternalStorageSender{
+		source:  source,
+		target:  target,
+		scratch: scratch,
+		inCh:    make(chan DrainResult, defaultChannelSize),
+		wg:      new(sync.WaitGroup),
+	}
+	sender.wg.Add(1)
+	go sender.restoreWorker(ctx)
+	return sender, nil
+}
+
+// PutSink implements BatchSender.
+func (s *ExternalStorageSender) PutSink(sink TableSink) {
+	s.sink = sink
+}
+
+// RestoreBatch implements BatchSender.
+func (s *ExternalStorageSender) RestoreBatch(result DrainResult) {
+	s.inCh <- result
+}
+
+// restoreWorker writes the batches one by one until the sender is closed, then writes the manifest of all batches.
+// it stops once ctx is done, and the batches not written yet are dropped.
+func (s *ExternalStorageSender) restoreWorker(ctx context.Context) {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case result, ok := <-s.inCh:
+			if !ok {
+				s.rangesMu.Lock()
+				ranges := s.ranges
+				s.rangesMu.Unlock()
+				if err := s.writeManifest(ctx, ExternalStorageManifestName, ranges); err != nil {
+					log.Error("failed to write the manifest to the external storage", zap.Error(err))
+					s.sink.EmitError(err)
+				}
+				return
+			}
+			s.restoreBatch(ctx, result)
+		}
+	}
+}
+
+// restoreBatch writes the rewritten SSTs of the batch, then the manifest of the batch.
+func (s *ExternalStorageSender) restoreBatch(ctx context.Context, result DrainResult) {
+	ranges := make([]ExternalStorageRange, 0, len(result.Ranges))
+	for _, rng := range result.Ranges {
+		written := ExternalStorageRange{
+			Files: make([]string, 0, len(rng.Files)),
+		}
+		var err error
+		written.StartKey, err = rewriteRangeKey(rng.StartKey, result.RewriteRules)
+		if err == nil {
+			written.EndKey, err = rewriteRangeKey(rng.EndKey, result.RewriteRules)
+		}
+		if err != nil {
+			log.Error("failed to rewrite the range", logutil.Key("start", rng.StartKey), zap.Error(err))
+			s.sink.EmitError(err)
+			return
+		}
+		for _, file := range rng.Files {
+			if err := ctx.Err(); err != nil {
+				s.sink.EmitError(errors.Trace(err))
+				return
+			}
+			if err := s.writeFile(ctx, file, result.RewriteRules); err != nil {
+				log.Error("failed to write the rewritten SST to the external storage", logutil.File(file), zap.Error(err))
+				s.sink.EmitError(err)
+				return
+			}
+			written.Files = append(written.Files, file.GetName())
+		}
+		ranges = append(ranges, written)
+	}
+	if err := s.writeManifest(ctx, ExternalStorageBatchManifestName(s.batches), ranges); err != nil {
+		log.Error("failed to write the manifest of the batch to the external storage", zap.Error(err))
+		s.sink.EmitError(err)
+		return
+	}
+	s.batches++
+	s.rangesMu.Lock()
+	s.ranges = append(s.ranges, ranges...)
+	s.rangesMu.Unlock()
+
+	log.Info("external storage restore batch done", rtree.ZapRanges(result.Ranges))
+	s.sink.EmitTables(result.BlankTablesAfterSend...)
+}
+
+// rewriteRangeKey rewrites the key of a range by the rewrite rules,
+// the key must be covered by a rule unless there is no rewrite rule at all.
+func rewriteRangeKey(key []byte, rewriteRules *RewriteRules) ([]byte, error) {
+	if rewriteRules == nil {
+		return key, nil
+	}
+	rewritten, rule := replacePrefix(key, rewriteRules)
+	if rule == nil {
+		return nil, errors.Annotatef(berrors.ErrRestoreInvalidRewrite,
+			"cannot find rewrite rule for range key %s", hex.EncodeToString(key))
+	}
+	return rewritten, nil
+}
+
+// writeManifest writes the ranges to the manifest named `name`.
+func (s *ExternalStorageSender) writeManifest(ctx context.Context, name string, ranges []ExternalStorageRange) error {
+	content, err := json.Marshal(ranges)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Annotatef(s.target.WriteFile(ctx, name, content), "failed to write the manifest %s", name)
+}
+
+// writeFile rewrites the backup file in the scratch directory, then writes it to the target storage.
+func (s *ExternalStorageSender) writeFile(ctx context.Context, file *backup.File, rewriteRules *RewriteRules) error {
+	if err := rewriteSSTToDir(ctx, s.source, file, rewriteRules, s.scratch); err != nil {
+		return errors.Trace(err)
+	}
+	path := filepath.Join(s.scratch, filepath.Base(file.GetName()))
+	defer os.Remove(path)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Annotatef(s.target.WriteFile(ctx, file.GetName(), content), "failed to write %s", file.GetName())
+}
+
+// Ranges returns the ranges written so far, with their keys rewritten.
+func (s *ExternalStorageSender) Ranges() []ExternalStorageRange {
+	s.rangesMu.Lock()
+	defer s.rangesMu.Unlock()
+	return append([]ExternalStorageRange{}, s.ranges...)
+}
+
+// Close implements BatchSender.
+// it waits for the batches sent to be written, and the manifest of all batches,
+// which is written even if no batch was written.
+func (s *ExternalStorageSender) Close() {
+	close(s.inCh)
+	s.wg.Wait()
+	os.RemoveAll(s.scratch)
+	s.sink.Close()
+}
@@ -0,0 +1,159 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/backup"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+type testExternalStorageSenderSuite struct{}
+
+var _ = Suite(&testExternalStorageSenderSuite{})
+
+func (*testExternalStorageSenderSuite) TestRewriteToExternalStorage(c *C) {
+	ctx := context.Background()
+	source, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	tmp := filepath.Join(c.MkDir(), "1.sst")
+	writeSST(c, tmp, [][2][]byte{
+		{sstKey("aaa", 42), []byte("v1")},
+		{sstKey("aab", 42), []byte("v2")},
+	})
+	content, err := ioutil.ReadFile(tmp)
+	c.Assert(err, IsNil)
+	c.Assert(source.WriteFile(ctx, "1.sst", content), IsNil)
+
+	targetDir := c.MkDir()
+	target, err := storage.NewLocalStorage(targetDir)
+	c.Assert(err, IsNil)
+	sender, err := restore.NewExternalStorageSender(ctx, source, target)
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	table := fakeTableWithRange(1, []rtree.Range{{
+		StartKey: []byte("aaa"),
+		EndKey:   []byte("aac"),
+		Files:    []*backup.File{{Name: "1.sst", StartKey: []byte("aaa"), EndKey: []byte("aac")}},
+	}})
+	table.RewriteRule = fakeRewriteRules("aa", "xx")
+	batcher.Add(table)
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(collectTableIDs(outCh), DeepEquals, []int64{1})
+
+	c.Assert(readSST(c, filepath.Join(targetDir, "1.sst")), DeepEquals, [][2][]byte{
+		{sstKey("xxa", 42), []byte("v1")},
+		{sstKey("xxb", 42), []byte("v2")},
+	})
+	// the manifests of the batch and of all batches are the same, since there is only one batch.
+	expected := []restore.ExternalStorageRange{{StartKey: []byte("xxa"), EndKey: []byte("xxc"), Files: []string{"1.sst"}}}
+	c.Assert(sender.Ranges(), DeepEquals, expected)
+	c.Assert(readManifest(c, target, restore.ExternalStorageBatchManifestName(0)), DeepEquals, expected)
+	c.Assert(readManifest(c, target, restore.ExternalStorageManifestName), DeepEquals, expected)
+	// the backup is untouched.
+	origin, err := source.ReadFile(ctx, "1.sst")
+	c.Assert(err, IsNil)
+	c.Assert(origin, DeepEquals, content)
+}
+
+func readManifest(c *C, target storage.ExternalStorage, name string) []restore.ExternalStorageRange {
+	manifest, err := target.ReadFile(context.Background(), name)
+	c.Assert(err, IsNil)
+	var ranges []restore.ExternalStorageRange
+	c.Assert(json.Unmarshal(manifest, &ranges), IsNil)
+	return ranges
+}
+
+func (*testExternalStorageSenderSuite) TestManifestWrittenPerBatch(c *C) {
+	ctx := context.Background()
+	source, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	keys := []string{"aaa", "aab", "aac"}
+	for _, key := range keys {
+		tmp := filepath.Join(c.MkDir(), key+".sst")
+		writeSST(c, tmp, [][2][]byte{{sstKey(key, 42), []byte("v")}})
+		content, err := ioutil.ReadFile(tmp)
+		c.Assert(err, IsNil)
+		c.Assert(source.WriteFile(ctx, key+".sst", content), IsNil)
+	}
+
+	target, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	sender, err := restore.NewExternalStorageSender(ctx, source, target)
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(1)
+	expected := make([]restore.ExternalStorageRange, 0, len(keys))
+	for i, key := range keys {
+		table := fakeTableWithRange(int64(i), []rtree.Range{{
+			StartKey: []byte(key),
+			EndKey:   []byte(key + "z"),
+			Files:    []*backup.File{{Name: key + ".sst", StartKey: []byte(key), EndKey: []byte(key + "z")}},
+		}})
+		table.RewriteRule = fakeRewriteRules("aa", "xx")
+		batcher.Add(table)
+		rewritten := "xx" + key[2:]
+		expected = append(expected, restore.ExternalStorageRange{
+			StartKey: []byte(rewritten),
+			EndKey:   []byte(rewritten + "z"),
+			Files:    []string{key + ".sst"},
+		})
+	}
+
+	// the batches sent have their own manifests before the sender is closed.
+	var exists bool
+	for i := 0; i < 100 && !exists; i++ {
+		waitForSend()
+		exists, err = target.FileExists(ctx, restore.ExternalStorageBatchManifestName(1))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(exists, IsTrue)
+	c.Assert(readManifest(c, target, restore.ExternalStorageBatchManifestName(0)), DeepEquals, expected[:1])
+	c.Assert(readManifest(c, target, restore.ExternalStorageBatchManifestName(1)), DeepEquals, expected[1:2])
+	exists, err = target.FileExists(ctx, restore.ExternalStorageManifestName)
+	c.Assert(err, IsNil)
+	c.Assert(exists, IsFalse)
+
+	// the last batch is sent on closing, then the manifest of all batches is written once.
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(readManifest(c, target, restore.ExternalStorageBatchManifestName(2)), DeepEquals, expected[2:])
+	c.Assert(readManifest(c, target, restore.ExternalStorageManifestName), DeepEquals, expected)
+}
+
+func (*testExternalStorageSenderSuite) TestMissingRewriteRule(c *C) {
+	ctx := context.Background()
+	source, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	target, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	sender, err := restore.NewExternalStorageSender(ctx, source, target)
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	table := fakeTableWithRange(1, []rtree.Range{{
+		StartKey: []byte("aaa"),
+		EndKey:   []byte("aab"),
+		Files:    []*backup.File{{Name: "1.sst", StartKey: []byte("aaa"), EndKey: []byte("aab")}},
+	}})
+	table.RewriteRule = fakeRewriteRules("bb", "xx")
+	batcher.Add(table)
+	batcher.Close()
+	errs := restore.Exhaust(errCh)
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errors.Cause(errs[0]), Equals, berrors.ErrRestoreInvalidRewrite)
+	c.Assert(sender.Ranges(), HasLen, 0)
+}
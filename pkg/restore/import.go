@@ -6,12 +6,14 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/log"
@@ -32,8 +34,16 @@ import (
 const (
 	importScanRegionTime = 10 * time.Second
 	gRPCBackOffMaxDelay  = 3 * time.Second
+	// writeConflictMessage is how TiKV reports a write conflict when ingesting,
+	// there is no structured error for it, see IsIngestWriteConflict.
+	writeConflictMessage = "write conflict"
 )
 
+// IsIngestWriteConflict returns whether the error of an ingest response is a write conflict.
+func IsIngestWriteConflict(errPb *errorpb.Error) bool {
+	return strings.Contains(errPb.GetMessage(), writeConflictMessage)
+}
+
 // ImporterClient is used to import a file to TiKV.
 type ImporterClient interface {
 	DownloadSST(
@@ -199,6 +209,16 @@ func (importer *FileImporter) Import(
 	ctx context.Context,
 	file *backup.File,
 	rewriteRules *RewriteRules,
+) error {
+	return importer.ImportWithPriority(ctx, file, rewriteRules, kvrpcpb.CommandPri_Normal)
+}
+
+// ImportWithPriority is like Import, but the ingest requests are sent with the priority.
+func (importer *FileImporter) ImportWithPriority(
+	ctx context.Context,
+	file *backup.File,
+	rewriteRules *RewriteRules,
+	pri kvrpcpb.CommandPri,
 ) error {
 	log.Debug("import file", logutil.File(file))
 	// Rewrite the start key and end key of file to scan regions
@@ -267,7 +287,7 @@ func (importer *FileImporter) Import(
 				return errors.Trace(errDownload)
 			}
 
-			ingestResp, errIngest := importer.ingestSST(ctx, downloadMeta, info)
+			ingestResp, errIngest := importer.ingestSST(ctx, downloadMeta, info, pri)
 		ingestRetry:
 			for errIngest == nil {
 				errPb := ingestResp.GetError()
@@ -306,7 +326,7 @@ func (importer *FileImporter) Import(
 						errIngest = errors.Trace(berrors.ErrKVEpochNotMatch)
 						break ingestRetry
 					}
-					ingestResp, errIngest = importer.ingestSST(ctx, downloadMeta, newInfo)
+					ingestResp, errIngest = importer.ingestSST(ctx, downloadMeta, newInfo, pri)
 				case errPb.EpochNotMatch != nil:
 					// TODO handle epoch not match error
 					//      1. retry download if needed
@@ -316,6 +336,9 @@ func (importer *FileImporter) Import(
 				case errPb.KeyNotInRegion != nil:
 					errIngest = errors.Trace(berrors.ErrKVKeyNotInRegion)
 					break ingestRetry
+				case IsIngestWriteConflict(errPb):
+					errIngest = errors.Annotate(berrors.ErrKVWriteConflict, errPb.GetMessage())
+					break ingestRetry
 				default:
 					// Other errors like `ServerIsBusy`, `RegionNotFound`, etc. should be retryable
 					errIngest = errors.Annotatef(berrors.ErrKVIngestFailed, "ingest error %s", errPb)
@@ -454,6 +477,7 @@ func (importer *FileImporter) ingestSST(
 	ctx context.Context,
 	sstMeta *import_sstpb.SSTMeta,
 	regionInfo *RegionInfo,
+	pri kvrpcpb.CommandPri,
 ) (*import_sstpb.IngestResponse, error) {
 	leader := regionInfo.Leader
 	if leader == nil {
@@ -463,7 +487,10 @@ func (importer *FileImporter) ingestSST(
 		RegionId:    regionInfo.Region.GetId(),
 		RegionEpoch: regionInfo.Region.GetRegionEpoch(),
 		Peer:        leader,
+		Priority:    pri,
 	}
+	// the request has no field for an idempotency key, so a re-sent batch is downloaded
+	// as new SSTs(with new UUIDs) and ingested again.
 	req := &import_sstpb.IngestRequest{
 		Context: reqCtx,
 		Sst:     sstMeta,
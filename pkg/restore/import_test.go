@@ -0,0 +1,26 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+
+	"github.com/pingcap/br/pkg/restore"
+)
+
+var _ = Suite(&testImportSuite{})
+
+type testImportSuite struct{}
+
+func (*testImportSuite) TestIsIngestWriteConflict(c *C) {
+	c.Assert(restore.IsIngestWriteConflict(&errorpb.Error{
+		Message: "ingest sst failed: write conflict on key 7480000000000000",
+	}), IsTrue)
+	c.Assert(restore.IsIngestWriteConflict(&errorpb.Error{Message: "server is busy"}), IsFalse)
+	c.Assert(restore.IsIngestWriteConflict(&errorpb.Error{
+		Message:   "peer is not leader",
+		NotLeader: &errorpb.NotLeader{RegionId: 1},
+	}), IsFalse)
+	c.Assert(restore.IsIngestWriteConflict(nil), IsFalse)
+}
@@ -0,0 +1,46 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+)
+
+const (
+	// txnKeyspaceMode is the mode byte of the keys of transactional keyspaces in API V2.
+	txnKeyspaceMode = 'x'
+	// MaxKeyspaceID is the max ID of a keyspace, which is encoded in 3 bytes.
+	MaxKeyspaceID KeyspaceID = 1<<24 - 1
+)
+
+// KeyspaceID is the ID of a keyspace of an API V2 cluster.
+type KeyspaceID uint32
+
+// Prefix returns the prefix of the transactional keys in the keyspace,
+// i.e. the mode byte followed by the big endian 3 bytes ID.
+func (id KeyspaceID) Prefix() []byte {
+	return []byte{txnKeyspaceMode, byte(id >> 16), byte(id >> 8), byte(id)}
+}
+
+// WithNewKeyPrefix returns a copy of the rewrite rules whose new key prefixes are prefixed by `prefix`,
+// so the keys would be rewritten into the key space under the prefix(e.g. a keyspace).
+func (r *RewriteRules) WithNewKeyPrefix(prefix []byte) *RewriteRules {
+	prefixed := func(rules []*import_sstpb.RewriteRule) []*import_sstpb.RewriteRule {
+		result := make([]*import_sstpb.RewriteRule, 0, len(rules))
+		for _, rule := range rules {
+			newKeyPrefix := make([]byte, 0, len(prefix)+len(rule.GetNewKeyPrefix()))
+			newKeyPrefix = append(newKeyPrefix, prefix...)
+			newKeyPrefix = append(newKeyPrefix, rule.GetNewKeyPrefix()...)
+			result = append(result, &import_sstpb.RewriteRule{
+				OldKeyPrefix: rule.GetOldKeyPrefix(),
+				NewKeyPrefix: newKeyPrefix,
+				NewTimestamp: rule.GetNewTimestamp(),
+			})
+		}
+		return result
+	}
+	return &RewriteRules{
+		Table: prefixed(r.Table),
+		Data:  prefixed(r.Data),
+	}
+}
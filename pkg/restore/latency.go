@@ -0,0 +1,123 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyDigestMin is the upper bound of the first bucket of a latency digest,
+	// latencies shorter than it are indistinguishable.
+	latencyDigestMin = time.Microsecond
+	// latencyDigestGrowth is the ratio between the bounds of the adjacent buckets of a latency digest,
+	// which is also the max relative error of the percentiles estimated.
+	latencyDigestGrowth = 1.02
+)
+
+// LatencyPercentiles is the percentiles of the latencies observed by a LatencyDigest.
+type LatencyPercentiles struct {
+	Count uint64        `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// LatencyDigest is a histogram of latencies with exponential buckets,
+// which estimates the percentiles within a relative error of 2%, in memory bounded by the range of latencies
+// rather than the count of them. It is safe to use it concurrently.
+type LatencyDigest struct {
+	mu sync.Mutex
+	// buckets is the count of latencies in each bucket,
+	// the i-th bucket holds the latencies in (latencyDigestMin * growth^(i-1), latencyDigestMin * growth^i].
+	buckets []uint64
+	count   uint64
+	min     time.Duration
+	max     time.Duration
+}
+
+// NewLatencyDigest creates an empty digest.
+func NewLatencyDigest() *LatencyDigest {
+	return &LatencyDigest{}
+}
+
+func latencyBucketOf(latency time.Duration) int {
+	if latency <= latencyDigestMin {
+		return 0
+	}
+	return int(math.Ceil(math.Log(float64(latency)/float64(latencyDigestMin)) / math.Log(latencyDigestGrowth)))
+}
+
+func latencyBucketUpperBound(bucket int) time.Duration {
+	return time.Duration(float64(latencyDigestMin) * math.Pow(latencyDigestGrowth, float64(bucket)))
+}
+
+// Observe records a latency.
+func (d *LatencyDigest) Observe(latency time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	bucket := latencyBucketOf(latency)
+	for len(d.buckets) <= bucket {
+		d.buckets = append(d.buckets, 0)
+	}
+	d.buckets[bucket]++
+	if d.count == 0 || latency < d.min {
+		d.min = latency
+	}
+	if latency > d.max {
+		d.max = latency
+	}
+	d.count++
+}
+
+// Percentile returns the estimated q-th(0 < q <= 1) quantile of the latencies observed,
+// the second return value is false if nothing is observed yet.
+func (d *LatencyDigest) Percentile(q float64) (time.Duration, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.percentile(q)
+}
+
+func (d *LatencyDigest) percentile(q float64) (time.Duration, bool) {
+	if d.count == 0 {
+		return 0, false
+	}
+	rank := uint64(math.Ceil(q * float64(d.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	seen := uint64(0)
+	for bucket, n := range d.buckets {
+		seen += n
+		if seen < rank {
+			continue
+		}
+		// the bounds of the bucket may be beyond what is observed.
+		latency := latencyBucketUpperBound(bucket)
+		if latency > d.max {
+			latency = d.max
+		}
+		if latency < d.min {
+			latency = d.min
+		}
+		return latency, true
+	}
+	return d.max, true
+}
+
+// Percentiles returns the usual percentiles of the latencies observed,
+// the second return value is false if nothing is observed yet.
+func (d *LatencyDigest) Percentiles() (LatencyPercentiles, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.count == 0 {
+		return LatencyPercentiles{}, false
+	}
+	p50, _ := d.percentile(0.5)
+	p90, _ := d.percentile(0.9)
+	p99, _ := d.percentile(0.99)
+	return LatencyPercentiles{Count: d.count, P50: p50, P90: p90, P99: p99, Max: d.max}, true
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	. "github.com/pingcap/check"
+
+	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/rtree"
+)
+
+type testLatencySuite struct{}
+
+var _ = Suite(&testLatencySuite{})
+
+func assertWithin(c *C, actual, expected time.Duration, tolerance float64) {
+	diff := float64(actual - expected)
+	if diff < 0 {
+		diff = -diff
+	}
+	c.Assert(diff <= tolerance*float64(expected), IsTrue, Commentf("actual %s, expected %s", actual, expected))
+}
+
+func (*testLatencySuite) TestLatencyPercentiles(c *C) {
+	digest := restore.NewLatencyDigest()
+	_, ok := digest.Percentiles()
+	c.Assert(ok, IsFalse)
+
+	// 1ms, 2ms, ..., 1000ms, in random order.
+	for _, i := range rand.Perm(1000) {
+		digest.Observe(time.Duration(i+1) * time.Millisecond)
+	}
+	latency, ok := digest.Percentiles()
+	c.Assert(ok, IsTrue)
+	c.Assert(latency.Count, Equals, uint64(1000))
+	c.Assert(latency.Max, Equals, time.Second)
+	assertWithin(c, latency.P50, 500*time.Millisecond, 0.02)
+	assertWithin(c, latency.P90, 900*time.Millisecond, 0.02)
+	assertWithin(c, latency.P99, 990*time.Millisecond, 0.02)
+
+	// a long tail only affects the high percentiles.
+	for i := 0; i < 100; i++ {
+		digest.Observe(time.Minute)
+	}
+	latency, ok = digest.Percentiles()
+	c.Assert(ok, IsTrue)
+	assertWithin(c, latency.P50, 550*time.Millisecond, 0.02)
+	assertWithin(c, latency.P90, 990*time.Millisecond, 0.02)
+	c.Assert(latency.P99, Equals, time.Minute)
+}
+
+func (*testLatencySuite) TestLatencyPercentilesOfSingleValue(c *C) {
+	digest := restore.NewLatencyDigest()
+	digest.Observe(123 * time.Microsecond)
+	for _, q := range []float64{0.01, 0.5, 1} {
+		p, ok := digest.Percentile(q)
+		c.Assert(ok, IsTrue)
+		c.Assert(p, Equals, 123*time.Microsecond)
+	}
+}
+
+func (*testLatencySuite) TestBatcherLatency(c *C) {
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(context.Background(), newDrySender(), newMockManager(), errCh)
+	c.Assert(batcher.Stats().BatchLatency, IsNil)
+	batcher.SetThreshold(1)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab"), fakeRange("aab", "aac")}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+
+	latency := batcher.Stats().BatchLatency
+	c.Assert(latency, NotNil)
+	c.Assert(latency.Count, Equals, uint64(2))
+	c.Assert(latency.P50 <= latency.P99, IsTrue)
+	c.Assert(latency.P99 <= latency.Max, IsTrue)
+}
@@ -0,0 +1,182 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/logutil"
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+// sstDataKeyPrefix is the prefix of the keys in the backup SSTs.
+const sstDataKeyPrefix = 'z'
+
+// LocalSSTSender is a BatchSender which restores the batches into a local directory instead of a live cluster.
+// It rewrites the keys of the backup files by the rewrite rules, and writes the result SSTs to the directory,
+// so they can be loaded elsewhere(e.g. for an air-gapped migration). Regions are never split.
+type LocalSSTSender struct {
+	storage storage.ExternalStorage
+	dir     string
+
+	inCh chan DrainResult
+	wg   *sync.WaitGroup
+	sink TableSink
+}
+
+// NewLocalSSTSender creates a sender which reads the backup files from the storage,
+// and writes the rewritten SSTs to the directory. the batches are written in background until ctx is done.
+func NewLocalSSTSender(ctx context.Context, s storage.ExternalStorage, dir string) (*LocalSSTSender, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	sender := &LocalSSTSender{
+		storage: s,
+		dir:     dir,
+		inCh:    make(chan DrainResult, defaultChannelSize),
+		wg:      new(sync.WaitGroup),
+	}
+	sender.wg.Add(1)
+	go sender.restoreWorker(ctx)
+	return sender, nil
+}
+
+// PutSink implements BatchSender.
+func (s *LocalSSTSender) PutSink(sink TableSink) {
+	s.sink = sink
+}
+
+// RestoreBatch implements BatchSender.
+func (s *LocalSSTSender) RestoreBatch(result DrainResult) {
+	s.inCh <- result
+}
+
+// restoreWorker writes the batches one by one until the sender is closed.
+// it stops once ctx is done, and the batches not written yet are dropped.
+func (s *LocalSSTSender) restoreWorker(ctx context.Context) {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case result, ok := <-s.inCh:
+			if !ok {
+				return
+			}
+			s.restoreBatch(ctx, result)
+		}
+	}
+}
+
+// restoreBatch writes the rewritten SSTs of the batch.
+func (s *LocalSSTSender) restoreBatch(ctx context.Context, result DrainResult) {
+	for _, file := range result.Files() {
+		if err := ctx.Err(); err != nil {
+			s.sink.EmitError(errors.Trace(err))
+			return
+		}
+		if err := rewriteSSTToDir(ctx, s.storage, file, result.RewriteRules, s.dir); err != nil {
+			log.Error("failed to write the rewritten SST", logutil.File(file), zap.Error(err))
+			s.sink.EmitError(err)
+			return
+		}
+	}
+	log.Info("local restore batch done", rtree.ZapRanges(result.Ranges))
+	s.sink.EmitTables(result.BlankTablesAfterSend...)
+}
+
+// Close implements BatchSender.
+// it waits for the batches sent to be written.
+func (s *LocalSSTSender) Close() {
+	close(s.inCh)
+	s.wg.Wait()
+	s.sink.Close()
+}
+
+// rewriteSSTToDir reads the backup file from the storage, rewrites its keys,
+// and writes it to the local directory with the same(base) name.
+func rewriteSSTToDir(
+	ctx context.Context,
+	s storage.ExternalStorage,
+	file *backup.File,
+	rewriteRules *RewriteRules,
+	dir string,
+) error {
+	content, err := s.ReadFile(ctx, file.GetName())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// the SST reader needs a file, copy the backup file to local first.
+	name := filepath.Base(file.GetName())
+	inputPath := filepath.Join(dir, name+".origin")
+	if err := ioutil.WriteFile(inputPath, content, 0o644); err != nil {
+		return errors.Trace(err)
+	}
+	defer os.Remove(inputPath)
+	input, err := os.Open(inputPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	reader, err := sstable.NewReader(input, sstable.ReaderOptions{})
+	if err != nil {
+		input.Close()
+		return errors.Annotatef(err, "failed to open SST %s", file.GetName())
+	}
+	defer reader.Close()
+	iter, err := reader.NewIter(nil, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer iter.Close()
+
+	output, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	writer := sstable.NewWriter(output, sstable.WriterOptions{})
+	for key, value := iter.First(); key != nil; key, value = iter.Next() {
+		newKey, err := rewriteSSTKey(key.UserKey, rewriteRules)
+		if err != nil {
+			writer.Close()
+			return errors.Trace(err)
+		}
+		if err := writer.Set(newKey, value); err != nil {
+			writer.Close()
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(writer.Close())
+}
+
+// rewriteSSTKey rewrites a key in the backup SST,
+// which is in the form of `z{memcomparable encoded key}{timestamp}`.
+func rewriteSSTKey(key []byte, rewriteRules *RewriteRules) ([]byte, error) {
+	if len(key) == 0 || key[0] != sstDataKeyPrefix {
+		return nil, errors.Annotatef(berrors.ErrRestoreInvalidBackup, "unexpected key %X in SST", key)
+	}
+	suffix, rawKey, err := codec.DecodeBytes(key[1:], nil)
+	if err != nil {
+		return nil, errors.Annotatef(berrors.ErrRestoreInvalidBackup, "failed to decode key %X in SST: %v", key, err)
+	}
+	encodedKey, rule := rewriteRawKey(rawKey, rewriteRules)
+	if rewriteRules != nil && len(rewriteRules.Table)+len(rewriteRules.Data) > 0 && rule == nil {
+		return nil, errors.Annotatef(berrors.ErrRestoreInvalidRewrite, "cannot find rewrite rule for key %X", key)
+	}
+	newKey := make([]byte, 0, 1+len(encodedKey)+len(suffix))
+	newKey = append(newKey, sstDataKeyPrefix)
+	newKey = append(newKey, encodedKey...)
+	return append(newKey, suffix...), nil
+}
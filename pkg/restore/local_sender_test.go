@@ -0,0 +1,133 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cockroachdb/pebble/sstable"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/tidb/util/codec"
+
+	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+type testLocalSSTSenderSuite struct{}
+
+var _ = Suite(&testLocalSSTSenderSuite{})
+
+// sstKey makes a key in the same form as the keys in the backup SSTs.
+func sstKey(key string, ts uint64) []byte {
+	k := append([]byte{'z'}, codec.EncodeBytes(nil, []byte(key))...)
+	var tsBytes [8]byte
+	binary.BigEndian.PutUint64(tsBytes[:], ^ts)
+	return append(k, tsBytes[:]...)
+}
+
+func writeSST(c *C, path string, kvs [][2][]byte) {
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	w := sstable.NewWriter(f, sstable.WriterOptions{})
+	for _, kv := range kvs {
+		c.Assert(w.Set(kv[0], kv[1]), IsNil)
+	}
+	c.Assert(w.Close(), IsNil)
+}
+
+func readSST(c *C, path string) [][2][]byte {
+	f, err := os.Open(path)
+	c.Assert(err, IsNil)
+	r, err := sstable.NewReader(f, sstable.ReaderOptions{})
+	c.Assert(err, IsNil)
+	defer r.Close()
+	iter, err := r.NewIter(nil, nil)
+	c.Assert(err, IsNil)
+	defer iter.Close()
+	kvs := make([][2][]byte, 0)
+	for key, value := iter.First(); key != nil; key, value = iter.Next() {
+		kvs = append(kvs, [2][]byte{append([]byte{}, key.UserKey...), append([]byte{}, value...)})
+	}
+	return kvs
+}
+
+func (*testLocalSSTSenderSuite) TestRewriteToLocalSST(c *C) {
+	ctx := context.Background()
+	backupDir := c.MkDir()
+	s, err := storage.NewLocalStorage(backupDir)
+	c.Assert(err, IsNil)
+	tmp := filepath.Join(c.MkDir(), "1.sst")
+	writeSST(c, tmp, [][2][]byte{
+		{sstKey("aaa", 42), []byte("v1")},
+		{sstKey("aab", 42), []byte("v2")},
+	})
+	content, err := ioutil.ReadFile(tmp)
+	c.Assert(err, IsNil)
+	c.Assert(s.WriteFile(ctx, "1.sst", content), IsNil)
+
+	outputDir := filepath.Join(c.MkDir(), "output")
+	sender, err := restore.NewLocalSSTSender(ctx, s, outputDir)
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	table := fakeTableWithRange(1, []rtree.Range{{
+		StartKey: []byte("aaa"),
+		EndKey:   []byte("aac"),
+		Files:    []*backup.File{{Name: "1.sst", StartKey: []byte("aaa"), EndKey: []byte("aac")}},
+	}})
+	table.RewriteRule = fakeRewriteRules("aa", "xx")
+	batcher.Add(table)
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	tables := 0
+	for range outCh {
+		tables++
+	}
+	c.Assert(tables, Equals, 1)
+
+	c.Assert(readSST(c, filepath.Join(outputDir, "1.sst")), DeepEquals, [][2][]byte{
+		{sstKey("xxa", 42), []byte("v1")},
+		{sstKey("xxb", 42), []byte("v2")},
+	})
+}
+
+func (*testLocalSSTSenderSuite) TestCanceled(c *C) {
+	ctx := context.Background()
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	tmp := filepath.Join(c.MkDir(), "1.sst")
+	writeSST(c, tmp, [][2][]byte{{sstKey("aaa", 42), []byte("v1")}})
+	content, err := ioutil.ReadFile(tmp)
+	c.Assert(err, IsNil)
+	c.Assert(s.WriteFile(ctx, "1.sst", content), IsNil)
+
+	// the restore is canceled before the batch is written.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	outputDir := filepath.Join(c.MkDir(), "output")
+	sender, err := restore.NewLocalSSTSender(canceled, s, outputDir)
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	table := fakeTableWithRange(1, []rtree.Range{{
+		StartKey: []byte("aaa"),
+		EndKey:   []byte("aab"),
+		Files:    []*backup.File{{Name: "1.sst", StartKey: []byte("aaa"), EndKey: []byte("aab")}},
+	}})
+	table.RewriteRule = fakeRewriteRules("aa", "xx")
+	batcher.Add(table)
+	batcher.Close()
+	for _, err := range restore.Exhaust(errCh) {
+		c.Assert(errors.Cause(err), Equals, context.Canceled)
+	}
+	c.Assert(collectTableIDs(outCh), HasLen, 0)
+	_, err = os.Stat(filepath.Join(outputDir, "1.sst"))
+	c.Assert(os.IsNotExist(err), IsTrue)
+}
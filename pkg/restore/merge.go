@@ -25,6 +25,8 @@ const (
 
 	writeCFName   = "write"
 	defaultCFName = "default"
+	lockCFName    = "lock"
+	unknownCFName = "unknown"
 )
 
 // MergeRangesStat holds statistics for the MergeRanges.
@@ -0,0 +1,69 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BatcherMetrics is the prometheus metrics of a batcher, see BatcherOptions.Metrics.
+type BatcherMetrics struct {
+	// RangesPerBatch is the histogram of the count of ranges of each batch.
+	RangesPerBatch prometheus.Histogram
+	// BytesPerBatch is the histogram of the size of files of each batch.
+	BytesPerBatch prometheus.Histogram
+	// BatchesSent is the count of batches sent.
+	BatchesSent prometheus.Counter
+	// SendDuration is the histogram of the duration of passing each batch to the sender(i.e. RestoreBatch).
+	SendDuration prometheus.Histogram
+}
+
+// NewBatcherMetrics creates the metrics of a batcher, and registers them to the registerer.
+func NewBatcherMetrics(registerer prometheus.Registerer) (*BatcherMetrics, error) {
+	m := &BatcherMetrics{
+		RangesPerBatch: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "br",
+			Subsystem: "restore",
+			Name:      "batch_ranges",
+			Help:      "The count of ranges of each batch.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 16),
+		}),
+		BytesPerBatch: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "br",
+			Subsystem: "restore",
+			Name:      "batch_bytes",
+			Help:      "The size of files of each batch.",
+			Buckets:   prometheus.ExponentialBuckets(1024*1024, 2, 16),
+		}),
+		BatchesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "br",
+			Subsystem: "restore",
+			Name:      "batches_sent",
+			Help:      "The count of batches sent.",
+		}),
+		SendDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "br",
+			Subsystem: "restore",
+			Name:      "batch_send_seconds",
+			Help:      "The duration of sending each batch.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 20),
+		}),
+	}
+	for _, collector := range []prometheus.Collector{m.RangesPerBatch, m.BytesPerBatch, m.BatchesSent, m.SendDuration} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return m, nil
+}
+
+// observeBatch records a batch sent, which took `took` to pass to the sender.
+func (m *BatcherMetrics) observeBatch(result DrainResult, took time.Duration) {
+	m.RangesPerBatch.Observe(float64(len(result.Ranges)))
+	m.BytesPerBatch.Observe(float64(result.Size()))
+	m.BatchesSent.Inc()
+	m.SendDuration.Observe(took.Seconds())
+}
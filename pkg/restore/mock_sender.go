@@ -0,0 +1,76 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"sync"
+
+	"github.com/pingcap/br/pkg/rtree"
+)
+
+// MockBatch is a batch received by a MockSender.
+type MockBatch struct {
+	Ranges       []rtree.Range
+	RewriteRules *RewriteRules
+	// Tables are the tables fully drained by the batch, they are emitted once the batch is restored.
+	Tables []CreatedTable
+}
+
+// MockSender is a BatchSender which restores nothing, so the code driving the batcher can be tested without a cluster.
+// It records each batch, then emits the tables of the batch as if they are restored,
+// unless an error is injected for the batch(see FailBatch).
+type MockSender struct {
+	mu      sync.Mutex
+	sink    TableSink
+	batches []MockBatch
+	// failures are the errors injected, by the index of the batch.
+	failures map[int]error
+}
+
+// NewMockSender creates a MockSender.
+func NewMockSender() *MockSender {
+	return &MockSender{failures: make(map[int]error)}
+}
+
+// FailBatch makes the n-th batch(counted from zero) fail with err,
+// i.e. err is emitted instead of the tables of the batch.
+func (s *MockSender) FailBatch(n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[n] = err
+}
+
+// PutSink implements BatchSender.
+func (s *MockSender) PutSink(sink TableSink) {
+	s.sink = sink
+}
+
+// RestoreBatch implements BatchSender.
+func (s *MockSender) RestoreBatch(ranges DrainResult) {
+	s.mu.Lock()
+	n := len(s.batches)
+	s.batches = append(s.batches, MockBatch{
+		Ranges:       ranges.Ranges,
+		RewriteRules: ranges.RewriteRules,
+		Tables:       ranges.BlankTablesAfterSend,
+	})
+	err, fail := s.failures[n]
+	s.mu.Unlock()
+	if fail {
+		s.sink.EmitError(err)
+		return
+	}
+	s.sink.EmitTables(ranges.BlankTablesAfterSend...)
+}
+
+// Close implements BatchSender.
+func (s *MockSender) Close() {
+	s.sink.Close()
+}
+
+// Batches returns the batches received so far, in the order they are received.
+func (s *MockSender) Batches() []MockBatch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]MockBatch{}, s.batches...)
+}
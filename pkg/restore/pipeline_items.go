@@ -4,15 +4,25 @@ package restore
 
 import (
 	"context"
+	"math"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/log"
 	"github.com/pingcap/parser/model"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 
+	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/logutil"
 	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/summary"
 	"github.com/pingcap/br/pkg/utils"
 )
 
@@ -20,6 +30,14 @@ const (
 	defaultChannelSize = 1024
 )
 
+// AbortableSender is a BatchSender which can cancel the batches in flight,
+// it is used by Batcher.Abort.
+type AbortableSender interface {
+	BatchSender
+	// Abort cancels the batches in flight, the batches would neither be restored nor emitted.
+	Abort()
+}
+
 // TableSink is the 'sink' of restored data by a sender.
 type TableSink interface {
 	EmitTables(tables ...CreatedTable)
@@ -28,8 +46,9 @@ type TableSink interface {
 }
 
 type chanTableSink struct {
-	outCh chan<- []CreatedTable
-	errCh chan<- error
+	outCh  chan<- []CreatedTable
+	errCh  chan<- error
+	events *eventRing
 }
 
 func (sink chanTableSink) EmitTables(tables ...CreatedTable) {
@@ -37,6 +56,7 @@ func (sink chanTableSink) EmitTables(tables ...CreatedTable) {
 }
 
 func (sink chanTableSink) EmitError(err error) {
+	sink.events.record(EventError, err.Error())
 	sink.errCh <- err
 }
 
@@ -72,27 +92,33 @@ func NewBRContextManager(client *Client) ContextManager {
 type brContextManager struct {
 	client *Client
 
+	// mu protects hasTable, since Enter and Leave are called by different goroutines of the batcher.
+	mu sync.Mutex
 	// This 'set' of table ID allow us to handle each table just once.
 	hasTable map[int64]CreatedTable
 }
 
 func (manager *brContextManager) Close(ctx context.Context) {
+	manager.mu.Lock()
 	tbls := make([]*model.TableInfo, 0, len(manager.hasTable))
 	for _, tbl := range manager.hasTable {
 		tbls = append(tbls, tbl.Table)
 	}
+	manager.mu.Unlock()
 	splitPostWork(ctx, manager.client, tbls)
 }
 
 func (manager *brContextManager) Enter(ctx context.Context, tables []CreatedTable) error {
 	placementRuleTables := make([]*model.TableInfo, 0, len(tables))
 
+	manager.mu.Lock()
 	for _, tbl := range tables {
 		if _, ok := manager.hasTable[tbl.Table.ID]; !ok {
 			placementRuleTables = append(placementRuleTables, tbl.Table)
 		}
 		manager.hasTable[tbl.Table.ID] = tbl
 	}
+	manager.mu.Unlock()
 
 	return splitPrepareWork(ctx, manager.client, placementRuleTables)
 }
@@ -106,9 +132,11 @@ func (manager *brContextManager) Leave(ctx context.Context, tables []CreatedTabl
 
 	splitPostWork(ctx, manager.client, placementRuleTables)
 	log.Info("restore table done", ZapTables(tables))
+	manager.mu.Lock()
 	for _, tbl := range placementRuleTables {
 		delete(manager.hasTable, tbl.ID)
 	}
+	manager.mu.Unlock()
 	return nil
 }
 
@@ -165,6 +193,65 @@ func Exhaust(ec <-chan error) []error {
 	}
 }
 
+// ExhaustErr drains all remaining errors in the channel like Exhaust, into a single error.
+// it returns nil if there is no error, the error itself if there is only one,
+// or the errors combined, annotated with the count of them.
+func ExhaustErr(ec <-chan error) error {
+	errs := Exhaust(ec)
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return errors.Annotatef(multierr.Combine(errs...), "%d errors occurred", len(errs))
+	}
+}
+
+// RestoreProgress is the snapshot of the progress of a batcher.
+type RestoreProgress struct {
+	// TablesDone is the count of tables fully restored.
+	TablesDone int
+	// RangesSent is the count of ranges sent to the sender.
+	RangesSent int
+	// BytesSent is the total size of files sent to the sender.
+	BytesSent uint64
+}
+
+// RestoreStats is the snapshot of the statistics of a batcher.
+type RestoreStats struct {
+	RestoreProgress
+	// TotalBytes is the total size of files to restore, zero if it isn't set.
+	TotalBytes uint64
+	// ETA is the estimated remaining time, nil if it cannot be estimated(yet).
+	ETA *time.Duration
+	// BytesPerCF is the total size of files sent of each column family.
+	BytesPerCF map[string]uint64
+	// Split is the outcome of splitting, nil if the sender doesn't expose it.
+	Split *SplitResult
+	// TimeToFirstIngest is how long it takes from the sender started to the first files ingested,
+	// i.e. the time spent on setting up, nil if nothing is ingested yet, or the sender doesn't expose it.
+	TimeToFirstIngest *time.Duration
+	// DryRun is what would have been restored, nil if the sender isn't in dry-run mode.
+	DryRun *DryRunReport
+	// SkippedEmptyFiles is the count of empty files skipped by the sender, see TiKVSenderOptions.IngestEmptyFiles.
+	SkippedEmptyFiles int
+	// SkippedLockFiles is the count of lock CF files skipped by the sender, see TiKVSenderOptions.IngestLockCF.
+	SkippedLockFiles int
+	// BatchLatency is the percentiles of the duration of passing each batch to the sender(i.e. RestoreBatch),
+	// nil if no batch is sent yet.
+	BatchLatency *LatencyPercentiles
+}
+
+// ProgressReporter is the receiver of the progress of a batcher,
+// which can be adapted to something like a gRPC status stream, so the restore
+// can be watched by some orchestration systems.
+type ProgressReporter interface {
+	// ReportProgress would be called each time a batch is sent or some tables are restored.
+	// the calls are serialized, so the implementation needn't be goroutine safe.
+	ReportProgress(progress RestoreProgress)
+}
+
 // BatchSender is the abstract of how the batcher send a batch.
 type BatchSender interface {
 	// PutSink sets the sink of this sender, user to this interface promise
@@ -175,16 +262,467 @@ type BatchSender interface {
 	Close()
 }
 
+// TiKVRestorer is the minimal methods required for restoring.
+// It contains the primitive APIs extract from `restore.Client`, so some of arguments may seem redundant.
+type TiKVRestorer interface {
+	// SplitRanges splits regions implicated by the ranges and rewrite rules.
+	// After splitting, it also scatters the fresh regions.
+	SplitRanges(ctx context.Context, ranges []rtree.Range, rewriteRules *RewriteRules, updateCh glue.Progress) error
+	// RestoreFiles imports the files to TiKV.
+	RestoreFiles(ctx context.Context, files []*backup.File, rewriteRules *RewriteRules, updateCh glue.Progress) error
+}
+
+// ClassifiedSplitter is a TiKVRestorer which can also split as the options and classify the outcome of splitting,
+// the sender would split by it instead of SplitRanges if the restorer implements it.
+type ClassifiedSplitter interface {
+	SplitRangesWithResult(
+		ctx context.Context, ranges []rtree.Range, rewriteRules *RewriteRules, opts SplitOptions, updateCh glue.Progress,
+	) (SplitResult, error)
+}
+
+// PrioritizedRestorer is a TiKVRestorer which can also ingest the files with a priority,
+// the files are ingested with low priority by it when throttled(see ReadThrottle),
+// otherwise the throttle only limits the concurrency.
+type PrioritizedRestorer interface {
+	RestoreFilesWithPriority(
+		ctx context.Context, files []*backup.File, rewriteRules *RewriteRules, pri kvrpcpb.CommandPri, updateCh glue.Progress,
+	) error
+}
+
+// FileWriter is a TiKVRestorer which can also apply the files by writing the keys one by one,
+// rather than ingesting SSTs, which avoids splitting and scattering regions for small tables.
+// see TiKVSenderOptions.WriteModeThreshold.
+type FileWriter interface {
+	WriteFiles(ctx context.Context, files []*backup.File, rewriteRules *RewriteRules, updateCh glue.Progress) error
+}
+
+// FileGrouper groups the files by the region they would be ingested into.
+type FileGrouper interface {
+	GroupFilesByRegion(ctx context.Context, files []*backup.File, rewriteRules *RewriteRules) ([][]*backup.File, error)
+}
+
+// ReadLoadSampler samples the foreground read load of the cluster.
+type ReadLoadSampler interface {
+	SampleReadQPS(ctx context.Context) (float64, error)
+}
+
+// ReadLoadSamplerFunc is a function that implements ReadLoadSampler.
+type ReadLoadSamplerFunc func(ctx context.Context) (float64, error)
+
+// SampleReadQPS implements ReadLoadSampler.
+func (f ReadLoadSamplerFunc) SampleReadQPS(ctx context.Context) (float64, error) {
+	return f(ctx)
+}
+
+// ReadThrottle makes ingesting yield to the foreground reads, which is useful for online restore.
+// The read load is sampled before restoring each batch,
+// once it is high, the files of the batch would be ingested with limited concurrency,
+// and with low priority if the restorer is a PrioritizedRestorer.
+type ReadThrottle struct {
+	Sampler ReadLoadSampler
+	// HighReadQPS is the read QPS from which the foreground is considered busy.
+	HighReadQPS float64
+	// Concurrency is the max count of files being ingested at the same time when the foreground is busy.
+	Concurrency int
+}
+
+// ConcurrencyRampUp makes the ingesting concurrency start low, and increase over the warm-up period,
+// so a just started cluster(e.g. with cold caches) won't be shocked by the restore.
+type ConcurrencyRampUp struct {
+	// Initial is the concurrency at the start, at least one.
+	Initial int `json:"initial"`
+	// Target is the concurrency at the end of the warm-up period.
+	Target int `json:"target"`
+	// WarmUp is how long the concurrency increases linearly from Initial to Target,
+	// after it, the concurrency isn't limited by the ramp-up any more.
+	WarmUp time.Duration `json:"warm-up"`
+}
+
+// concurrencyAt returns the concurrency at `elapsed` since the start, false if the warm-up is over.
+func (r *ConcurrencyRampUp) concurrencyAt(elapsed time.Duration) (int, bool) {
+	if elapsed >= r.WarmUp {
+		return 0, false
+	}
+	initial := r.Initial
+	if initial < 1 {
+		initial = 1
+	}
+	target := r.Target
+	if target < initial {
+		target = initial
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return initial + int(int64(target-initial)*int64(elapsed)/int64(r.WarmUp)), true
+}
+
+// SplitKeyProvider provides the split keys precomputed for ranges(e.g. from the backup metadata).
+type SplitKeyProvider interface {
+	// SplitKeys returns the raw split keys(after rewriting) of the range,
+	// returns false if there aren't precomputed split keys for the range.
+	SplitKeys(rng rtree.Range) ([][]byte, bool)
+}
+
+// KeySplitter splits regions by the keys directly.
+type KeySplitter interface {
+	SplitKeys(ctx context.Context, keys [][]byte, opts SplitOptions, updateCh glue.Progress) error
+}
+
+// PrecomputedSplit makes the sender split regions by the precomputed split keys,
+// rather than computing the split keys from ranges and rewrite rules.
+// ranges without precomputed split keys are still split in the normal way.
+type PrecomputedSplit struct {
+	Provider SplitKeyProvider
+	Splitter KeySplitter
+}
+
+// NoopSender is a BatchSender which restores nothing but counts the batches and ranges,
+// it is useful for measuring the overhead of the batcher itself, without the latency of the cluster.
+type NoopSender struct {
+	delay time.Duration
+	sink  TableSink
+
+	batches int64
+	ranges  int64
+}
+
+// NewNoopSender creates a sender that sleeps `delay` for each batch, zero means returning immediately.
+func NewNoopSender(delay time.Duration) *NoopSender {
+	return &NoopSender{delay: delay}
+}
+
+// PutSink implements BatchSender.
+func (s *NoopSender) PutSink(sink TableSink) {
+	s.sink = sink
+}
+
+// RestoreBatch implements BatchSender.
+func (s *NoopSender) RestoreBatch(result DrainResult) {
+	if s.delay > 0 {
+		time.Sleep(s.delay)
+	}
+	atomic.AddInt64(&s.batches, 1)
+	atomic.AddInt64(&s.ranges, int64(len(result.Ranges)))
+	s.sink.EmitTables(result.BlankTablesAfterSend...)
+}
+
+// Close implements BatchSender.
+func (s *NoopSender) Close() {
+	s.sink.Close()
+}
+
+// BatchCount returns the count of batches received.
+func (s *NoopSender) BatchCount() int {
+	return int(atomic.LoadInt64(&s.batches))
+}
+
+// RangeCount returns the count of ranges received.
+func (s *NoopSender) RangeCount() int {
+	return int(atomic.LoadInt64(&s.ranges))
+}
+
+// WriteConflictPolicy is how the sender reacts to write conflicts when ingesting files.
+type WriteConflictPolicy int
+
+const (
+	// WriteConflictFail fails the restore once any file conflicts.
+	WriteConflictFail WriteConflictPolicy = iota
+	// WriteConflictSkip skips the conflicting files, and restores the others.
+	// the tables owning the skipped files are withheld, i.e. never emitted nor checkpointed as restored.
+	WriteConflictSkip
+	// WriteConflictRetry retries the conflicting files after a delay.
+	WriteConflictRetry
+)
+
+// WriteConflictHandling is the configuration of handling write conflicts,
+// which may happen when there are concurrent writes during online restore.
+type WriteConflictHandling struct {
+	Policy WriteConflictPolicy
+	// RetryDelay and MaxRetry only work with WriteConflictRetry,
+	// a batch still conflicting after MaxRetry retries would fail the restore.
+	RetryDelay time.Duration
+	MaxRetry   int
+}
+
+// TiKVSenderOptions are the options of the sender that sends restore requests to TiKV.
+// The zero value is the default options.
+type TiKVSenderOptions struct {
+	// Checkpoint records the ranges restored if it isn't nil.
+	Checkpoint *Checkpoint
+	// Validator validates the files of each batch before ingesting if it isn't nil,
+	// a batch with any corrupted file would fail without being ingested.
+	Validator FileValidator
+	// Grouper groups the files of each batch by region if it isn't nil,
+	// then the groups would be restored one by one,
+	// so files ingested concurrently are less likely to cross the same regions.
+	Grouper FileGrouper
+	// ReadThrottle throttles ingesting when the foreground read load is high if it isn't nil.
+	ReadThrottle *ReadThrottle
+	// IngestCounter counts the bytes ingested into each store if it isn't nil.
+	IngestCounter *StoreIngestCounter
+	// WrittenStores tracks the stores which received data if it isn't nil.
+	WrittenStores *WrittenStoreTracker
+	// PoisonRangeDetector makes a failed batch be retried range by range if it isn't nil,
+	// ranges failed too many times would be quarantined and skipped, instead of failing the whole restore.
+	// tables with any quarantined range are withheld, i.e. never emitted nor checkpointed as restored.
+	PoisonRangeDetector *PoisonRangeDetector
+	// PrecomputedSplit splits regions by precomputed split keys if it isn't nil.
+	PrecomputedSplit *PrecomputedSplit
+	// FailedRangesManifest is where the ranges failed to restore(including the quarantined ones)
+	// would be written to once the sender stops, if it isn't nil.
+	FailedRangesManifest *FailedRangesManifest
+	// WriteConflictHandling is how to handle write conflicts when ingesting,
+	// a write conflict would fail the restore if it is nil.
+	WriteConflictHandling *WriteConflictHandling
+	// SplitBatchSize is the max count of split keys submitted per split request, zero means unlimited.
+	// lower it for clusters sensitive to large split requests.
+	SplitBatchSize int
+	// SplitConcurrency is the max count of batches being split concurrently, shared by all batches of the sender.
+	// the regions of a batch are split one by one, so it also limits the regions being split concurrently.
+	// zero means one, i.e. the batches are split one by one.
+	SplitConcurrency uint
+	// MinRegionsPerStore makes the regions created by splitting a batch be re-scattered,
+	// until each store holds at least MinRegionsPerStore of them where possible. zero means no minimum.
+	MinRegionsPerStore int
+	// KeyTransform transforms the key ranges of the files before ingesting if it isn't nil.
+	KeyTransform KeyTransform
+	// SettleDelay is how long to wait after splitting a batch before ingesting it, zero means no wait.
+	// on some clusters, regions need a brief settling period after split, or ingesting hits epoch not match.
+	SettleDelay time.Duration
+	// Clock is the source of time for the settle delay, the system clock is used if it is nil.
+	Clock utils.Clock
+	// RampUp makes the ingesting concurrency increase over a warm-up period since the sender is created,
+	// along with ReadThrottle, the lower concurrency wins. nil means no ramp-up.
+	RampUp *ConcurrencyRampUp
+	// FailedTableRetry makes a failed batch be restored table by table if it is positive,
+	// then only the failed tables would be retried, at most FailedTableRetry times,
+	// so the good tables of the batch still complete. It takes precedence over PoisonRangeDetector.
+	FailedTableRetry int
+	// MaxBatchRetry makes a failed batch be split and restored again if it is positive,
+	// at most MaxBatchRetry times, before falling back to FailedTableRetry or PoisonRangeDetector.
+	// it helps to survive transient failures, e.g. region errors or a store restarting.
+	MaxBatchRetry int
+	// BatchBackoffBase is the backoff before the first retry of a failed batch or range(see PoisonRangeDetector),
+	// it is doubled for each following retry, up to maxBatchBackoff.
+	// ranges are retried after defaultRangeRetryBackoff if it is zero.
+	BatchBackoffBase time.Duration
+	// WriteModeThreshold makes the tables smaller than it be applied by writing rather than ingesting if it is positive,
+	// their ranges are never split. the restorer must implement FileWriter then.
+	// the size of a table is the size of its files in the backup, or of its ranges in the batch if it's unknown.
+	WriteModeThreshold uint64
+	// ScatterWaitTimeout is how long to wait for the split regions to be scattered before ingesting,
+	// once it times out, the batch is ingested anyway, at the risk of hotspots. zero means ScatterWaitUpperInterval.
+	ScatterWaitTimeout time.Duration
+	// ScatterRetry is how many times the regions failed to scatter are retried, zero means no retry.
+	// the regions still failed after retrying are ingested unscattered.
+	ScatterRetry int
+	// IngestRateLimit is the max bytes of files ingested per second, zero means unlimited.
+	// ingesting blocks until there is budget, which keeps the restore from starving the foreground workload.
+	IngestRateLimit uint64
+	// DryRun makes the sender split the regions for each batch, but never restore the files,
+	// so the rewrite rules and splitting can be validated before a large restore.
+	// the tables are still emitted as if they are restored, but never recorded to the checkpoint.
+	// what would have been restored can be fetched by DryRunReport.
+	DryRun bool
+	// IngestEmptyFiles makes the files with neither data nor kvs(e.g. of an empty column family) be ingested,
+	// by default they are skipped, which saves the requests and some clients reject them.
+	// the skipped files are neither written(see WriteModeThreshold) nor counted by the dry run.
+	IngestEmptyFiles bool
+	// IngestLockCF makes the files of the lock column family be ingested, for some specialized recovery.
+	// by default they are skipped, since the locks are the uncommitted state at the time of the backup.
+	// like IngestEmptyFiles, it applies to writing and the dry run too.
+	IngestLockCF bool
+	// KeyRangeFilter makes only the keys inside it be restored if it isn't nil, e.g. for recovering a hot shard.
+	// the ranges(and files) entirely outside it are dropped before splitting, and the overlapping ones are clipped.
+	KeyRangeFilter *KeyRangeFilter
+}
+
+// splitOptions returns the options for the region splitter of the restorer.
+func (opts *TiKVSenderOptions) splitOptions() SplitOptions {
+	return SplitOptions{
+		BatchSize:          opts.SplitBatchSize,
+		ScatterWaitTimeout: opts.ScatterWaitTimeout,
+		ScatterRetry:       opts.ScatterRetry,
+		MinRegionsPerStore: opts.MinRegionsPerStore,
+	}
+}
+
+// DryRunReport is what a dry-run sender would have restored, see TiKVSenderOptions.DryRun.
+type DryRunReport struct {
+	Batches int    `json:"batches"`
+	Ranges  int    `json:"ranges"`
+	Files   int    `json:"files"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// maxBatchBackoff is the max backoff between the retries of a failed batch.
+const maxBatchBackoff = 30 * time.Second
+
+// defaultRangeRetryBackoff is the backoff before the first retry of a failed range,
+// when TiKVSenderOptions.BatchBackoffBase isn't set.
+const defaultRangeRetryBackoff = 100 * time.Millisecond
+
+// KeyTransform transforms the encoding of keys beyond prefix rewriting,
+// e.g. migrating the keys from an old row format to the new one when restoring across versions.
+//
+// It must be a pure transform:
+// - deterministic and without side effects, it may be called concurrently and repeatedly on the same key.
+// - never modifies the input key.
+// - order-preserving, i.e. a < b implies TransformKey(a) < TransformKey(b), so a transformed range is still a range.
+// - keeps the table prefix, so the rewrite rules still apply to the transformed keys.
+// An empty key means unbounded, it is never passed to the transform.
+type KeyTransform interface {
+	TransformKey(key []byte) []byte
+}
+
+// transformFiles returns copies of the files with their key ranges transformed.
+func transformFiles(files []*backup.File, transform KeyTransform) []*backup.File {
+	transformed := make([]*backup.File, 0, len(files))
+	for _, f := range files {
+		file := *f
+		if len(file.StartKey) > 0 {
+			file.StartKey = transform.TransformKey(file.StartKey)
+		}
+		if len(file.EndKey) > 0 {
+			file.EndKey = transform.TransformKey(file.EndKey)
+		}
+		transformed = append(transformed, &file)
+	}
+	return transformed
+}
+
+// KeyRangeFilter is the key range [StartKey, EndKey) to restore, in the keys of the backup(i.e. before rewriting).
+// an empty EndKey means unbounded.
+type KeyRangeFilter struct {
+	StartKey []byte `json:"start-key"`
+	EndKey   []byte `json:"end-key"`
+}
+
+// clip returns the part of the range inside the filter, with the files outside it dropped,
+// and the files overlapping it clipped. it returns false if the range is entirely outside the filter.
+// the files of the backup are untouched, the clipped ones are copies.
+func (f *KeyRangeFilter) clip(rng rtree.Range) (rtree.Range, bool) {
+	startKey, endKey, ok := rng.Intersect(f.StartKey, f.EndKey)
+	if !ok {
+		return rtree.Range{}, false
+	}
+	clipped := rtree.Range{StartKey: startKey, EndKey: endKey, Files: make([]*backup.File, 0, len(rng.Files))}
+	for _, file := range rng.Files {
+		fileRange := rtree.Range{StartKey: file.StartKey, EndKey: file.EndKey}
+		fileStart, fileEnd, ok := fileRange.Intersect(f.StartKey, f.EndKey)
+		if !ok {
+			continue
+		}
+		clippedFile := *file
+		clippedFile.StartKey, clippedFile.EndKey = fileStart, fileEnd
+		clipped.Files = append(clipped.Files, &clippedFile)
+	}
+	return clipped, true
+}
+
+// clipRanges clips the ranges by the filter, see clip.
+func (f *KeyRangeFilter) clipRanges(ranges []rtree.Range) []rtree.Range {
+	clipped := make([]rtree.Range, 0, len(ranges))
+	for _, rng := range ranges {
+		if c, ok := f.clip(rng); ok {
+			clipped = append(clipped, c)
+		}
+	}
+	return clipped
+}
+
+// SenderConfig is a snapshot of the configuration of a sender.
+type SenderConfig struct {
+	Checkpoint         bool `json:"checkpoint"`
+	ValidateFiles      bool `json:"validate-files"`
+	GroupFilesByRegion bool `json:"group-files-by-region"`
+	CountIngestedBytes bool `json:"count-ingested-bytes"`
+	TrackWrittenStores bool `json:"track-written-stores"`
+	PrecomputedSplit   bool `json:"precomputed-split"`
+	SplitBatchSize     int  `json:"split-batch-size"`
+	SplitConcurrency   uint `json:"split-concurrency"`
+	MinRegionsPerStore int  `json:"min-regions-per-store"`
+	KeyTransform       bool `json:"key-transform"`
+	// SettleDelay is zero if the sender doesn't wait between splitting and ingesting.
+	SettleDelay      time.Duration `json:"settle-delay"`
+	FailedTableRetry int           `json:"failed-table-retry"`
+	MaxBatchRetry    int           `json:"max-batch-retry"`
+	BatchBackoffBase time.Duration `json:"batch-backoff-base"`
+	// WriteModeThreshold is zero if all tables are ingested.
+	WriteModeThreshold uint64 `json:"write-mode-threshold"`
+	// ScatterWaitTimeout is zero if the default ScatterWaitUpperInterval is used.
+	ScatterWaitTimeout time.Duration `json:"scatter-wait-timeout"`
+	ScatterRetry       int           `json:"scatter-retry"`
+	// IngestRateLimit is zero if ingesting is unlimited.
+	IngestRateLimit uint64 `json:"ingest-rate-limit"`
+	DryRun          bool   `json:"dry-run"`
+	// IngestEmptyFiles is false if the empty files are skipped.
+	IngestEmptyFiles bool `json:"ingest-empty-files"`
+	// IngestLockCF is false if the lock CF files are skipped.
+	IngestLockCF bool `json:"ingest-lock-cf"`
+	// ReadThrottleQPS and ThrottledConcurrency are zero if read throttle is disabled.
+	ReadThrottleQPS      float64 `json:"read-throttle-qps"`
+	ThrottledConcurrency int     `json:"throttled-concurrency"`
+	// RampUp is nil if the concurrency doesn't ramp up.
+	RampUp *ConcurrencyRampUp `json:"ramp-up,omitempty"`
+	// KeyRangeFilter is nil if all keys are restored.
+	KeyRangeFilter *KeyRangeFilter `json:"key-range-filter,omitempty"`
+}
+
 type tikvSender struct {
-	client   *Client
+	client   TiKVRestorer
 	updateCh glue.Progress
+	opts     TiKVSenderOptions
 
 	sink TableSink
 	inCh chan<- DrainResult
 
+	// cancel cancels the context of the workers.
+	cancel context.CancelFunc
+
+	// splitLimiter limits the batches being split concurrently.
+	splitLimiter *utils.WorkerPool
+	// splitFailed is set once splitting any batch failed.
+	splitFailed int32
+	// splitResult is the outcome of splitting all batches so far.
+	splitResult   SplitResult
+	splitResultMu sync.Mutex
+
+	// ingestLimiter limits the bytes of files ingested per second, nil means unlimited.
+	ingestLimiter *rate.Limiter
+
+	// dryRunReport is what would have been restored so far in dry-run mode.
+	dryRunReport   DryRunReport
+	dryRunReportMu sync.Mutex
+	// skippedEmptyFiles is the count of empty files skipped, see TiKVSenderOptions.IngestEmptyFiles.
+	skippedEmptyFiles int64
+	// skippedLockFiles is the count of lock CF files skipped, see TiKVSenderOptions.IngestLockCF.
+	skippedLockFiles int64
+
+	// startedAt is when the sender is created.
+	startedAt time.Time
+	// firstIngestAt is when the first files are ingested, zero if nothing is ingested yet.
+	firstIngestAt   time.Time
+	firstIngestAtMu sync.Mutex
+
+	// withheldTables are the IDs of the tables with any quarantined range, they would never be emitted.
+	withheldTables   map[int64]struct{}
+	withheldTablesMu sync.Mutex
+	// conflictSkipped are the names of the files skipped because of write conflicts,
+	// which are taken by the restore worker once the batch is done.
+	conflictSkipped   map[string]struct{}
+	conflictSkippedMu sync.Mutex
+
 	wg *sync.WaitGroup
 }
 
+// splitJob is a batch being split, err receives the result of splitting.
+type splitJob struct {
+	result DrainResult
+	err    chan error
+}
+
 func (b *tikvSender) PutSink(sink TableSink) {
 	// don't worry about visibility, since we will call this before first call to
 	// RestoreBatch, which is a sync point.
@@ -192,23 +730,72 @@ func (b *tikvSender) PutSink(sink TableSink) {
 }
 
 func (b *tikvSender) RestoreBatch(ranges DrainResult) {
-	b.inCh <- ranges
+	b.inCh <- b.filterKeyRange(ranges)
+}
+
+// filterKeyRange clips the ranges of the batch by the KeyRangeFilter.
+// the tables of the batch are still emitted, even if all of their ranges are dropped.
+func (b *tikvSender) filterKeyRange(result DrainResult) DrainResult {
+	filter := b.opts.KeyRangeFilter
+	if filter == nil {
+		return result
+	}
+	filtered := result
+	filtered.Ranges = filter.clipRanges(result.Ranges)
+	filtered.tableRanges = make([]tableRanges, 0, len(result.tableRanges))
+	for _, tr := range result.tableRanges {
+		filtered.tableRanges = append(filtered.tableRanges, tableRanges{table: tr.table, ranges: filter.clipRanges(tr.ranges)})
+	}
+	if dropped := len(result.Ranges) - len(filtered.Ranges); dropped > 0 {
+		log.Debug("drop ranges outside the key range filter",
+			zap.Int("dropped", dropped), zap.Int("total", len(result.Ranges)))
+	}
+	return filtered
 }
 
 // NewTiKVSender make a sender that send restore requests to TiKV.
 func NewTiKVSender(
 	ctx context.Context,
-	cli *Client,
+	cli TiKVRestorer,
 	updateCh glue.Progress,
+	opts TiKVSenderOptions,
 ) (BatchSender, error) {
 	inCh := make(chan DrainResult, defaultChannelSize)
 	midCh := make(chan DrainResult, defaultChannelSize)
 
+	splitConcurrency := opts.SplitConcurrency
+	if splitConcurrency == 0 {
+		splitConcurrency = 1
+	}
+	if opts.Clock == nil {
+		opts.Clock = utils.SystemClock
+	}
+	if _, ok := cli.(FileWriter); opts.WriteModeThreshold > 0 && !ok {
+		return nil, errors.Annotate(berrors.ErrInvalidArgument, "the restorer doesn't support applying files by writing")
+	}
+	if _, ok := cli.(ClassifiedSplitter); opts.splitOptions() != (SplitOptions{}) && !ok {
+		return nil, errors.Annotate(berrors.ErrInvalidArgument, "the restorer doesn't support the split options")
+	}
+	ctx, cancel := context.WithCancel(ctx)
 	sender := &tikvSender{
-		client:   cli,
-		updateCh: updateCh,
-		inCh:     inCh,
-		wg:       new(sync.WaitGroup),
+		client:          cli,
+		updateCh:        updateCh,
+		opts:            opts,
+		inCh:            inCh,
+		cancel:          cancel,
+		splitLimiter:    utils.NewWorkerPool(splitConcurrency, "split batch"),
+		startedAt:       opts.Clock.Now(),
+		withheldTables:  make(map[int64]struct{}),
+		conflictSkipped: make(map[string]struct{}),
+		wg:              new(sync.WaitGroup),
+	}
+	if opts.IngestRateLimit > 0 {
+		// allow bursting one second of budget.
+		burst := opts.IngestRateLimit
+		if burst > math.MaxInt32 {
+			burst = math.MaxInt32
+		}
+		sender.ingestLimiter = rate.NewLimiter(rate.Limit(opts.IngestRateLimit), int(burst))
 	}
 
 	sender.wg.Add(2)
@@ -218,8 +805,17 @@ func NewTiKVSender(
 }
 
 func (b *tikvSender) splitWorker(ctx context.Context, ranges <-chan DrainResult, next chan<- DrainResult) {
+	// batches may be split concurrently, but they are forwarded to the restore worker in order.
+	jobs := make(chan splitJob, defaultChannelSize)
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		b.forwardSplit(ctx, jobs, next)
+	}()
 	defer log.Debug("split worker closed")
 	defer func() {
+		close(jobs)
+		<-forwarded
 		b.wg.Done()
 		close(next)
 	}()
@@ -228,22 +824,167 @@ func (b *tikvSender) splitWorker(ctx context.Context, ranges <-chan DrainResult,
 		case <-ctx.Done():
 			return
 		case result, ok := <-ranges:
-			if !ok {
+			if !ok || atomic.LoadInt32(&b.splitFailed) != 0 {
 				return
 			}
-			if err := SplitRanges(ctx, b.client, result.Ranges, result.RewriteRules, b.updateCh); err != nil {
-				log.Error("failed on split range", rtree.ZapRanges(result.Ranges), zap.Error(err))
-				b.sink.EmitError(err)
-				return
-			}
-			next <- result
+			job := splitJob{result: result, err: make(chan error, 1)}
+			b.splitLimiter.Apply(func() {
+				job.err <- b.withBatchRetry(ctx, result.Ranges, func(int) error {
+					return b.splitRanges(ctx, result)
+				})
+			})
+			jobs <- job
+		}
+	}
+}
+
+// forwardSplit forwards the batches to the next stage in order once they are split,
+// once any batch failed, the rest are dropped.
+func (b *tikvSender) forwardSplit(ctx context.Context, jobs <-chan splitJob, next chan<- DrainResult) {
+	failed := false
+	for job := range jobs {
+		err := <-job.err
+		if failed {
+			continue
+		}
+		if err != nil {
+			log.Error("failed on split range", rtree.ZapRanges(job.result.Ranges), zap.Error(err))
+			b.sink.EmitError(err)
+			atomic.StoreInt32(&b.splitFailed, 1)
+			failed = true
+			continue
+		}
+		job.result.splitAt = b.opts.Clock.Now()
+		select {
+		case <-ctx.Done():
+			failed = true
+		case next <- job.result:
+		}
+	}
+}
+
+// splitRanges splits the regions for the ranges of the batch,
+// by the precomputed split keys if possible.
+func (b *tikvSender) splitRanges(ctx context.Context, result DrainResult) error {
+	// tables applied by writing needn't be split.
+	_, result = b.partitionByMode(result)
+	if len(result.Ranges) == 0 {
+		return nil
+	}
+	if b.opts.PrecomputedSplit == nil {
+		return b.splitRangesByClient(ctx, result.Ranges, result.RewriteRules)
+	}
+	keys := make([][]byte, 0, len(result.Ranges))
+	rest := make([]rtree.Range, 0)
+	for _, rng := range result.Ranges {
+		rangeKeys, ok := b.opts.PrecomputedSplit.Provider.SplitKeys(rng)
+		if !ok {
+			rest = append(rest, rng)
+			continue
 		}
+		keys = append(keys, rangeKeys...)
+	}
+	if err := b.opts.PrecomputedSplit.Splitter.SplitKeys(ctx, keys, b.opts.splitOptions(), b.updateCh); err != nil {
+		return errors.Trace(err)
+	}
+	if len(rest) > 0 {
+		log.Info("some ranges have no precomputed split keys, split them in the normal way",
+			zap.Int("ranges", len(rest)))
+		return b.splitRangesByClient(ctx, rest, result.RewriteRules)
+	}
+	return nil
+}
+
+// waitSettled waits until the settle delay elapsed since the batch was split.
+func (b *tikvSender) waitSettled(ctx context.Context, result DrainResult) error {
+	if b.opts.SettleDelay <= 0 {
+		return nil
+	}
+	wait := result.splitAt.Add(b.opts.SettleDelay).Sub(b.opts.Clock.Now())
+	if wait <= 0 {
+		return nil
+	}
+	log.Debug("waiting for the regions to settle after split", zap.Duration("wait", wait))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.opts.Clock.After(wait):
+		return nil
+	}
+}
+
+// splitRangesByClient splits the ranges by the client, and records the outcome if the client can classify it.
+func (b *tikvSender) splitRangesByClient(ctx context.Context, ranges []rtree.Range, rewriteRules *RewriteRules) error {
+	splitter, ok := b.client.(ClassifiedSplitter)
+	if !ok {
+		return b.client.SplitRanges(ctx, ranges, rewriteRules, b.updateCh)
+	}
+	result, err := splitter.SplitRangesWithResult(ctx, ranges, rewriteRules, b.opts.splitOptions(), b.updateCh)
+	b.splitResultMu.Lock()
+	b.splitResult.add(result)
+	b.splitResultMu.Unlock()
+	return errors.Trace(err)
+}
+
+// SplitResult returns the outcome of splitting all batches so far.
+func (b *tikvSender) SplitResult() SplitResult {
+	b.splitResultMu.Lock()
+	defer b.splitResultMu.Unlock()
+	return b.splitResult
+}
+
+// recordDryRun records the batch which would have been restored in dry-run mode.
+func (b *tikvSender) recordDryRun(result DrainResult) {
+	files := result.Files()
+	log.Info("dry run, skip restoring batch",
+		rtree.ZapRanges(result.Ranges),
+		zap.Int("files", len(files)),
+		zap.Uint64("bytes", result.Size()))
+	b.dryRunReportMu.Lock()
+	defer b.dryRunReportMu.Unlock()
+	b.dryRunReport.Batches++
+	b.dryRunReport.Ranges += len(result.Ranges)
+	b.dryRunReport.Files += len(files)
+	b.dryRunReport.Bytes += result.Size()
+}
+
+// DryRunReport returns what would have been restored so far, false if the sender isn't in dry-run mode.
+func (b *tikvSender) DryRunReport() (DryRunReport, bool) {
+	b.dryRunReportMu.Lock()
+	defer b.dryRunReportMu.Unlock()
+	return b.dryRunReport, b.opts.DryRun
+}
+
+// TimeToFirstIngest returns how long it takes from the sender started to the first files ingested,
+// false if nothing is ingested yet.
+func (b *tikvSender) TimeToFirstIngest() (time.Duration, bool) {
+	b.firstIngestAtMu.Lock()
+	defer b.firstIngestAtMu.Unlock()
+	if b.firstIngestAt.IsZero() {
+		return 0, false
 	}
+	return b.firstIngestAt.Sub(b.startedAt), true
+}
+
+// recordIngested records the time of the first files ingested.
+func (b *tikvSender) recordIngested() {
+	b.firstIngestAtMu.Lock()
+	defer b.firstIngestAtMu.Unlock()
+	if !b.firstIngestAt.IsZero() {
+		return
+	}
+	b.firstIngestAt = b.opts.Clock.Now()
+	elapsed := b.firstIngestAt.Sub(b.startedAt)
+	log.Info("the first files ingested", zap.Duration("time-to-first-ingest", elapsed))
+	summary.CollectDuration("time to first ingest", elapsed)
 }
 
 func (b *tikvSender) restoreWorker(ctx context.Context, ranges <-chan DrainResult) {
+	// aborted is the ranges of the batch failed to restore, which aborts the restore.
+	var aborted []rtree.Range
 	defer func() {
 		log.Debug("restore worker closed")
+		b.writeFailedRanges(ctx, aborted)
 		b.wg.Done()
 		b.sink.Close()
 	}()
@@ -255,20 +996,718 @@ func (b *tikvSender) restoreWorker(ctx context.Context, ranges <-chan DrainResul
 			if !ok {
 				return
 			}
-			files := result.Files()
-			if err := b.client.RestoreFiles(ctx, files, result.RewriteRules, b.updateCh); err != nil {
+			if err := b.waitSettled(ctx, result); err != nil {
+				return
+			}
+			if b.opts.Validator != nil {
+				if err := b.opts.Validator.ValidateFiles(ctx, result.Files()); err != nil {
+					log.Error("failed on validate files", rtree.ZapRanges(result.Ranges), zap.Error(err))
+					b.sink.EmitError(err)
+					return
+				}
+			}
+			result = b.skipFiles(result)
+			if b.opts.DryRun {
+				b.recordDryRun(result)
+				b.sink.EmitTables(result.BlankTablesAfterSend...)
+				continue
+			}
+			written, ingest := b.partitionByMode(result)
+			if err := b.writeTables(ctx, written, result.RewriteRules); err != nil {
+				aborted = result.Ranges
 				b.sink.EmitError(err)
 				return
 			}
+			restored := ingest.Ranges
+			var err error
+			// don't bother the restorer if all tables of the batch are written.
+			if len(written) == 0 || len(ingest.Ranges) > 0 {
+				err = b.restoreBatch(ctx, ingest, ingest.Files())
+			}
+			if err != nil {
+				switch {
+				case b.opts.FailedTableRetry > 0:
+					log.Warn("failed to restore batch, retrying table by table",
+						rtree.ZapRanges(ingest.Ranges), zap.Error(err))
+					var failed []rtree.Range
+					failed, err = b.restoreTablesOneByOne(ctx, ingest)
+					if err != nil {
+						aborted = failed
+						b.sink.EmitError(err)
+						return
+					}
+				case b.opts.PoisonRangeDetector == nil:
+					aborted = ingest.Ranges
+					b.sink.EmitError(err)
+					return
+				default:
+					log.Warn("failed to restore batch, retrying range by range",
+						rtree.ZapRanges(ingest.Ranges), zap.Error(err))
+					var quarantined []rtree.Range
+					restored, quarantined, err = b.restoreRangesOneByOne(ctx, ingest)
+					if err != nil {
+						aborted = ingest.Ranges
+						b.sink.EmitError(err)
+						return
+					}
+					b.withholdTables(ingest, quarantined)
+				}
+			}
+			// the ranges with files skipped because of write conflicts aren't restored completely.
+			if skipped := b.takeConflictSkipped(ingest); len(skipped) > 0 {
+				b.withholdTables(ingest, skipped)
+				restored = excludeRanges(restored, skipped)
+			}
+			for _, tr := range written {
+				restored = append(restored, tr.ranges...)
+			}
+			if b.opts.Checkpoint != nil {
+				if err := b.opts.Checkpoint.RecordRestored(ctx, restored, result.RewriteRules); err != nil {
+					b.sink.EmitError(err)
+					return
+				}
+			}
 
 			log.Info("restore batch done", rtree.ZapRanges(result.Ranges))
-			b.sink.EmitTables(result.BlankTablesAfterSend...)
+			b.sink.EmitTables(b.unwithheldTables(result.BlankTablesAfterSend)...)
+		}
+	}
+}
+
+// partitionByMode picks the tables of the batch which should be applied by writing(see WriteModeThreshold),
+// and returns them with the rest of the batch, which should be ingested.
+func (b *tikvSender) partitionByMode(result DrainResult) ([]tableRanges, DrainResult) {
+	if b.opts.WriteModeThreshold == 0 {
+		return nil, result
+	}
+	written := make([]tableRanges, 0)
+	ingest := result
+	ingest.Ranges = make([]rtree.Range, 0, len(result.Ranges))
+	ingest.tableRanges = make([]tableRanges, 0, len(result.tableRanges))
+	for _, tr := range result.tableRanges {
+		if b.tableSize(tr) < b.opts.WriteModeThreshold {
+			written = append(written, tr)
+			continue
 		}
+		ingest.Ranges = append(ingest.Ranges, tr.ranges...)
+		ingest.tableRanges = append(ingest.tableRanges, tr)
 	}
+	return written, ingest
+}
+
+// tableSize returns the size of the table in the backup,
+// or the size of its ranges in the batch if the backup doesn't record the files of the table.
+func (b *tikvSender) tableSize(tr tableRanges) uint64 {
+	if files := tr.table.OldTable.Files; len(files) > 0 {
+		return TotalFileSize(files)
+	}
+	size := uint64(0)
+	for _, rng := range tr.ranges {
+		size += rangeSize(rng)
+	}
+	return size
+}
+
+// writeTables applies the files of the tables by writing, table by table.
+func (b *tikvSender) writeTables(ctx context.Context, tables []tableRanges, rewriteRules *RewriteRules) error {
+	if len(tables) == 0 {
+		return nil
+	}
+	writer := b.client.(FileWriter)
+	for _, tr := range tables {
+		files := tr.files()
+		if b.opts.KeyTransform != nil {
+			files = transformFiles(files, b.opts.KeyTransform)
+		}
+		log.Info("restore table by writing",
+			zap.Stringer("table", tr.table.Table.Name), zap.Int("files", len(files)))
+		if err := writer.WriteFiles(ctx, files, rewriteRules, b.updateCh); err != nil {
+			return errors.Annotatef(err, "failed to write table %s", tr.table.Table.Name)
+		}
+	}
+	return nil
+}
+
+// withBatchRetry calls fn, and retries it with exponential backoff if it fails, at most MaxBatchRetry times.
+// fn receives the count of retries so far, i.e. zero for the first call.
+func (b *tikvSender) withBatchRetry(ctx context.Context, ranges []rtree.Range, fn func(retry int) error) error {
+	err := fn(0)
+	backoff := b.opts.BatchBackoffBase
+	for retry := 1; err != nil && retry <= b.opts.MaxBatchRetry; retry++ {
+		log.Warn("failed on batch, retry later",
+			zap.Int("retry", retry), zap.Duration("backoff", backoff), rtree.ZapRanges(ranges), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case <-b.opts.Clock.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBatchBackoff {
+			backoff = maxBatchBackoff
+		}
+		err = fn(retry)
+	}
+	if err != nil && b.opts.MaxBatchRetry > 0 {
+		return errors.Annotatef(err, "batch still failed after %d retries", b.opts.MaxBatchRetry)
+	}
+	return errors.Trace(err)
+}
+
+// restoreBatch restores the files of the batch, and retries if it fails, see withBatchRetry.
+// before each retry, the ranges of the batch are split again, since the regions may have changed.
+// ingesting a file is idempotent, but a failed batch may be partially ingested,
+// the files already done are excluded from the retries,
+// so they won't be ingested again, nor counted twice by IngestCounter or WrittenStores.
+func (b *tikvSender) restoreBatch(ctx context.Context, result DrainResult, files []*backup.File) error {
+	done := make(map[string]struct{}, len(files))
+	record := func(files []*backup.File) {
+		for _, f := range files {
+			done[f.GetName()] = struct{}{}
+		}
+	}
+	return b.withBatchRetry(ctx, result.Ranges, func(retry int) error {
+		if retry == 0 {
+			return b.restoreFilesRecorded(ctx, files, result.RewriteRules, record)
+		}
+		if err := b.splitRanges(ctx, result); err != nil {
+			return errors.Trace(err)
+		}
+		pending := make([]*backup.File, 0, len(files)-len(done))
+		for _, f := range files {
+			if _, ok := done[f.GetName()]; !ok {
+				pending = append(pending, f)
+			}
+		}
+		log.Info("retrying the files not done of the batch",
+			zap.Int("pending", len(pending)), zap.Int("done", len(done)))
+		return b.restoreFilesRecorded(ctx, pending, result.RewriteRules, record)
+	})
+}
+
+// restoreTablesOneByOne restores the ranges of the batch table by table,
+// then retries only the failed tables, at most FailedTableRetry times, with exponential backoff like withBatchRetry.
+// before each retry, the ranges of the failed tables are split again, since the regions may have changed.
+// It returns the ranges of the tables still failed.
+func (b *tikvSender) restoreTablesOneByOne(ctx context.Context, result DrainResult) ([]rtree.Range, error) {
+	rangesOf := func(tables []tableRanges) []rtree.Range {
+		ranges := make([]rtree.Range, 0)
+		for _, tr := range tables {
+			ranges = append(ranges, tr.ranges...)
+		}
+		return ranges
+	}
+	pending := result.tableRanges
+	var lastErr error
+	backoff := b.opts.BatchBackoffBase
+	for attempt := 0; attempt <= b.opts.FailedTableRetry && len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			log.Warn("failed to restore some tables, retry later",
+				zap.Int("tables", len(pending)), zap.Int("attempt", attempt), zap.Duration("backoff", backoff))
+			select {
+			case <-ctx.Done():
+				return rangesOf(pending), errors.Trace(ctx.Err())
+			case <-b.opts.Clock.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxBatchBackoff {
+				backoff = maxBatchBackoff
+			}
+			retried := result
+			retried.tableRanges = pending
+			retried.Ranges = rangesOf(pending)
+			if err := b.splitRanges(ctx, retried); err != nil {
+				log.Warn("failed to split the ranges of the failed tables", zap.Int("attempt", attempt), zap.Error(err))
+				lastErr = err
+				continue
+			}
+		}
+		failed := make([]tableRanges, 0)
+		for _, tr := range pending {
+			if err := b.restoreFiles(ctx, tr.files(), result.RewriteRules); err != nil {
+				log.Warn("failed to restore the ranges of table",
+					zap.Stringer("table", tr.table.Table.Name),
+					zap.Int("attempt", attempt),
+					rtree.ZapRanges(tr.ranges),
+					zap.Error(err))
+				failed = append(failed, tr)
+				lastErr = err
+			}
+		}
+		pending = failed
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+	return rangesOf(pending), errors.Annotatef(lastErr, "%d tables still failed after %d retries",
+		len(pending), b.opts.FailedTableRetry)
+}
+
+// writeFailedRanges writes the aborted ranges and the quarantined ranges to the failed-ranges manifest.
+func (b *tikvSender) writeFailedRanges(ctx context.Context, aborted []rtree.Range) {
+	if b.opts.FailedRangesManifest == nil {
+		return
+	}
+	failed := aborted
+	if b.opts.PoisonRangeDetector != nil {
+		failed = append(b.opts.PoisonRangeDetector.Quarantined(), aborted...)
+	}
+	if len(failed) == 0 {
+		return
+	}
+	if err := b.opts.FailedRangesManifest.Write(ctx, failed); err != nil {
+		log.Warn("failed to write the failed-ranges manifest", zap.Int("ranges", len(failed)), zap.Error(err))
+		return
+	}
+	log.Info("failed ranges written to the manifest",
+		zap.String("name", b.opts.FailedRangesManifest.Name), zap.Int("ranges", len(failed)))
+}
+
+// restoreRangesOneByOne restores the ranges of the batch one by one, until each range is restored or quarantined,
+// with exponential backoff between the retries of a range.
+// returns the ranges restored and the ranges quarantined.
+func (b *tikvSender) restoreRangesOneByOne(ctx context.Context, result DrainResult) ([]rtree.Range, []rtree.Range, error) {
+	restored := make([]rtree.Range, 0, len(result.Ranges))
+	quarantined := make([]rtree.Range, 0)
+	for _, rng := range result.Ranges {
+		backoff := b.opts.BatchBackoffBase
+		if backoff <= 0 {
+			backoff = defaultRangeRetryBackoff
+		}
+		for {
+			err := b.restoreFiles(ctx, rng.Files, result.RewriteRules)
+			if err == nil {
+				restored = append(restored, rng)
+				break
+			}
+			if ctx.Err() != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			if b.opts.PoisonRangeDetector.RecordFailure(rng, err) {
+				quarantined = append(quarantined, rng)
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return nil, nil, errors.Trace(ctx.Err())
+			case <-b.opts.Clock.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxBatchBackoff {
+				backoff = maxBatchBackoff
+			}
+		}
+	}
+	return restored, quarantined, nil
+}
+
+// withholdTables marks the tables owning any of the ranges not restored(e.g. quarantined) as withheld,
+// so they won't be emitted, even if their other ranges are restored by later batches.
+func (b *tikvSender) withholdTables(result DrainResult, unrestored []rtree.Range) {
+	if len(unrestored) == 0 {
+		return
+	}
+	keys := make(map[string]struct{}, len(unrestored))
+	for _, rng := range unrestored {
+		keys[checkpointKey(rng.StartKey, rng.EndKey)] = struct{}{}
+	}
+	b.withheldTablesMu.Lock()
+	defer b.withheldTablesMu.Unlock()
+	for _, tr := range result.tableRanges {
+		for _, rng := range tr.ranges {
+			if _, ok := keys[checkpointKey(rng.StartKey, rng.EndKey)]; ok {
+				log.Warn("table has ranges not restored, withhold it", zap.Stringer("table", tr.table.Table.Name))
+				b.withheldTables[tr.table.Table.ID] = struct{}{}
+				break
+			}
+		}
+	}
+}
+
+// excludeRanges returns the ranges which aren't in `excluded`.
+func excludeRanges(ranges []rtree.Range, excluded []rtree.Range) []rtree.Range {
+	keys := make(map[string]struct{}, len(excluded))
+	for _, rng := range excluded {
+		keys[checkpointKey(rng.StartKey, rng.EndKey)] = struct{}{}
+	}
+	kept := make([]rtree.Range, 0, len(ranges))
+	for _, rng := range ranges {
+		if _, ok := keys[checkpointKey(rng.StartKey, rng.EndKey)]; !ok {
+			kept = append(kept, rng)
+		}
+	}
+	return kept
+}
+
+// recordConflictSkipped records the file skipped because of write conflicts, see takeConflictSkipped.
+func (b *tikvSender) recordConflictSkipped(file *backup.File) {
+	b.conflictSkippedMu.Lock()
+	defer b.conflictSkippedMu.Unlock()
+	b.conflictSkipped[file.GetName()] = struct{}{}
+}
+
+// takeConflictSkipped returns the ranges of the batch owning any file skipped because of write conflicts,
+// and forgets the skipped files.
+func (b *tikvSender) takeConflictSkipped(result DrainResult) []rtree.Range {
+	b.conflictSkippedMu.Lock()
+	defer b.conflictSkippedMu.Unlock()
+	if len(b.conflictSkipped) == 0 {
+		return nil
+	}
+	skipped := make([]rtree.Range, 0)
+	for _, rng := range result.Ranges {
+		for _, f := range rng.Files {
+			if _, ok := b.conflictSkipped[f.GetName()]; ok {
+				skipped = append(skipped, rng)
+				break
+			}
+		}
+	}
+	b.conflictSkipped = make(map[string]struct{})
+	return skipped
+}
+
+// unwithheldTables returns the tables which aren't withheld, see withholdTables.
+func (b *tikvSender) unwithheldTables(tables []CreatedTable) []CreatedTable {
+	b.withheldTablesMu.Lock()
+	defer b.withheldTablesMu.Unlock()
+	if len(b.withheldTables) == 0 {
+		return tables
+	}
+	result := make([]CreatedTable, 0, len(tables))
+	for _, tbl := range tables {
+		if _, ok := b.withheldTables[tbl.Table.ID]; !ok {
+			result = append(result, tbl)
+		}
+	}
+	return result
+}
+
+// restoreFiles restores the files, group by group if there is a grouper.
+func (b *tikvSender) restoreFiles(ctx context.Context, files []*backup.File, rewriteRules *RewriteRules) error {
+	return b.restoreFilesRecorded(ctx, files, rewriteRules, nil)
+}
+
+// restoreFilesRecorded is like restoreFiles,
+// and it passes the files to `record` once they are done if `record` isn't nil.
+func (b *tikvSender) restoreFilesRecorded(
+	ctx context.Context,
+	files []*backup.File,
+	rewriteRules *RewriteRules,
+	record func([]*backup.File),
+) error {
+	if b.opts.KeyTransform != nil {
+		files = transformFiles(files, b.opts.KeyTransform)
+	}
+	concurrency, pri := b.throttle(ctx)
+	concurrency = b.rampUp(concurrency)
+	if b.opts.Grouper == nil {
+		return b.restoreFilesLimited(ctx, files, rewriteRules, concurrency, pri, record)
+	}
+	groups, err := b.opts.Grouper.GroupFilesByRegion(ctx, files, rewriteRules)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Debug("files grouped by region", zap.Int("files", len(files)), zap.Int("groups", len(groups)))
+	for _, group := range groups {
+		if err := b.restoreFilesLimited(ctx, group, rewriteRules, concurrency, pri, record); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// throttle returns the concurrency and the priority which should be used for ingesting the current batch.
+// zero concurrency means unlimited.
+func (b *tikvSender) throttle(ctx context.Context) (int, kvrpcpb.CommandPri) {
+	throttle := b.opts.ReadThrottle
+	if throttle == nil {
+		return 0, kvrpcpb.CommandPri_Normal
+	}
+	qps, err := throttle.Sampler.SampleReadQPS(ctx)
+	if err != nil {
+		log.Warn("failed to sample read load, won't throttle ingesting", zap.Error(err))
+		return 0, kvrpcpb.CommandPri_Normal
+	}
+	if qps < throttle.HighReadQPS {
+		return 0, kvrpcpb.CommandPri_Normal
+	}
+	log.Info("foreground read load is high, throttling ingesting",
+		zap.Float64("read-qps", qps),
+		zap.Float64("high-read-qps", throttle.HighReadQPS),
+		zap.Int("concurrency", throttle.Concurrency))
+	return throttle.Concurrency, kvrpcpb.CommandPri_Low
+}
+
+// rampUp returns the concurrency limited by the ramp-up, zero concurrency means unlimited.
+func (b *tikvSender) rampUp(concurrency int) int {
+	if b.opts.RampUp == nil {
+		return concurrency
+	}
+	limit, warming := b.opts.RampUp.concurrencyAt(b.opts.Clock.Now().Sub(b.startedAt))
+	if !warming || (concurrency > 0 && concurrency <= limit) {
+		return concurrency
+	}
+	log.Debug("warming up, limiting ingesting concurrency", zap.Int("concurrency", limit))
+	return limit
+}
+
+// restoreFilesLimited restores the files, at most `concurrency` files at the same time.
+func (b *tikvSender) restoreFilesLimited(
+	ctx context.Context,
+	files []*backup.File,
+	rewriteRules *RewriteRules,
+	concurrency int,
+	pri kvrpcpb.CommandPri,
+	record func([]*backup.File),
+) error {
+	// all files of the batch may be skipped, see skipFiles.
+	if len(files) == 0 {
+		return nil
+	}
+	if concurrency <= 0 {
+		concurrency = len(files)
+	}
+	for {
+		n := concurrency
+		if n > len(files) {
+			n = len(files)
+		}
+		if err := b.waitIngestBudget(ctx, files[:n]); err != nil {
+			return errors.Trace(err)
+		}
+		ingested, err := b.ingestFiles(ctx, files[:n], rewriteRules, pri)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(ingested) > 0 {
+			b.recordIngested()
+		}
+		if b.opts.IngestCounter != nil {
+			b.opts.IngestCounter.Record(ctx, ingested, rewriteRules)
+		}
+		if b.opts.WrittenStores != nil {
+			b.opts.WrittenStores.Record(ctx, ingested, rewriteRules)
+		}
+		if record != nil {
+			record(files[:n])
+		}
+		files = files[n:]
+		if len(files) == 0 {
+			return nil
+		}
+	}
+}
+
+// isEmptyFile checks whether the file has neither data nor kvs.
+func isEmptyFile(file *backup.File) bool {
+	return file.GetSize_() == 0 && file.GetTotalKvs() == 0
+}
+
+// skipFiles drops the files which shouldn't be restored from the ranges of the batch,
+// i.e. the empty files unless IngestEmptyFiles is set, and the lock CF files unless IngestLockCF is set.
+// it is applied once before the batch is restored in any way, so ingesting, writing and dry run all honour it.
+func (b *tikvSender) skipFiles(result DrainResult) DrainResult {
+	if b.opts.IngestEmptyFiles && b.opts.IngestLockCF {
+		return result
+	}
+	result.Ranges = b.skipFilesOfRanges(result.Ranges, true)
+	tables := make([]tableRanges, 0, len(result.tableRanges))
+	for _, tr := range result.tableRanges {
+		tr.ranges = b.skipFilesOfRanges(tr.ranges, false)
+		tables = append(tables, tr)
+	}
+	result.tableRanges = tables
+	return result
+}
+
+// skipFilesOfRanges returns the ranges without the skipped files, the ranges passed are untouched.
+// the skipped files are counted if `count` is set.
+func (b *tikvSender) skipFilesOfRanges(ranges []rtree.Range, count bool) []rtree.Range {
+	kept := make([]rtree.Range, 0, len(ranges))
+	for _, rng := range ranges {
+		files := make([]*backup.File, 0, len(rng.Files))
+		for _, f := range rng.Files {
+			switch {
+			case !b.opts.IngestEmptyFiles && isEmptyFile(f):
+				if count {
+					log.Debug("skipping empty file", logutil.File(f))
+					atomic.AddInt64(&b.skippedEmptyFiles, 1)
+				}
+			case !b.opts.IngestLockCF && cfOf(f) == lockCFName:
+				if count {
+					log.Debug("skipping lock CF file", logutil.File(f))
+					atomic.AddInt64(&b.skippedLockFiles, 1)
+				}
+			default:
+				files = append(files, f)
+			}
+		}
+		rng.Files = files
+		kept = append(kept, rng)
+	}
+	return kept
+}
+
+// SkippedLockFiles returns the count of lock CF files skipped so far, see TiKVSenderOptions.IngestLockCF.
+func (b *tikvSender) SkippedLockFiles() int {
+	return int(atomic.LoadInt64(&b.skippedLockFiles))
+}
+
+// SkippedEmptyFiles returns the count of empty files skipped so far, see TiKVSenderOptions.IngestEmptyFiles.
+func (b *tikvSender) SkippedEmptyFiles() int {
+	return int(atomic.LoadInt64(&b.skippedEmptyFiles))
+}
+
+// waitIngestBudget blocks until the files can be ingested under IngestRateLimit, or the context is done.
+func (b *tikvSender) waitIngestBudget(ctx context.Context, files []*backup.File) error {
+	if b.ingestLimiter == nil {
+		return nil
+	}
+	size := 0
+	for _, f := range files {
+		size += int(f.GetSize_())
+	}
+	// the files may be larger than the burst, take the budget piece by piece then.
+	burst := b.ingestLimiter.Burst()
+	for size > 0 {
+		n := size
+		if n > burst {
+			n = burst
+		}
+		if err := b.ingestLimiter.WaitN(ctx, n); err != nil {
+			return errors.Annotate(err, "failed to wait for the ingest budget")
+		}
+		size -= n
+	}
+	return nil
+}
+
+func isWriteConflict(err error) bool {
+	return errors.Cause(err) == berrors.ErrKVWriteConflict // nolint:errorlint
+}
+
+// restoreFilesWithPriority restores the files with the priority if the restorer supports it.
+func (b *tikvSender) restoreFilesWithPriority(
+	ctx context.Context, files []*backup.File, rewriteRules *RewriteRules, pri kvrpcpb.CommandPri,
+) error {
+	if prioritized, ok := b.client.(PrioritizedRestorer); ok && pri != kvrpcpb.CommandPri_Normal {
+		return prioritized.RestoreFilesWithPriority(ctx, files, rewriteRules, pri, b.updateCh)
+	}
+	return b.client.RestoreFiles(ctx, files, rewriteRules, b.updateCh)
+}
+
+// ingestFiles restores the files with the priority, and handles write conflicts as configured.
+// returns the files ingested, which excludes the skipped ones.
+func (b *tikvSender) ingestFiles(
+	ctx context.Context, files []*backup.File, rewriteRules *RewriteRules, pri kvrpcpb.CommandPri,
+) ([]*backup.File, error) {
+	err := b.restoreFilesWithPriority(ctx, files, rewriteRules, pri)
+	if err == nil {
+		return files, nil
+	}
+	handling := b.opts.WriteConflictHandling
+	if handling == nil || !isWriteConflict(err) {
+		return nil, errors.Trace(err)
+	}
+	switch handling.Policy {
+	case WriteConflictSkip:
+		// we don't know which files conflict, so restore them one by one.
+		// it is OK to ingest a file twice.
+		ingested := make([]*backup.File, 0, len(files))
+		for _, file := range files {
+			err := b.restoreFilesWithPriority(ctx, []*backup.File{file}, rewriteRules, pri)
+			if err == nil {
+				ingested = append(ingested, file)
+				continue
+			}
+			if !isWriteConflict(err) {
+				return nil, errors.Trace(err)
+			}
+			log.Warn("skipping file because of write conflict", logutil.File(file), zap.Error(err))
+			b.recordConflictSkipped(file)
+		}
+		return ingested, nil
+	case WriteConflictRetry:
+		for retry := 1; retry <= handling.MaxRetry; retry++ {
+			log.Warn("write conflict when ingesting, retry later",
+				zap.Int("retry", retry), zap.Duration("delay", handling.RetryDelay), zap.Error(err))
+			select {
+			case <-ctx.Done():
+				return nil, errors.Trace(ctx.Err())
+			case <-b.opts.Clock.After(handling.RetryDelay):
+			}
+			err = b.restoreFilesWithPriority(ctx, files, rewriteRules, pri)
+			if err == nil {
+				return files, nil
+			}
+			if !isWriteConflict(err) {
+				return nil, errors.Trace(err)
+			}
+		}
+		return nil, errors.Annotatef(err, "still conflicting after %d retries", handling.MaxRetry)
+	default:
+		return nil, errors.Trace(err)
+	}
+}
+
+// Config returns the configuration of the sender.
+func (b *tikvSender) Config() SenderConfig {
+	cfg := SenderConfig{
+		Checkpoint:         b.opts.Checkpoint != nil,
+		ValidateFiles:      b.opts.Validator != nil,
+		GroupFilesByRegion: b.opts.Grouper != nil,
+		CountIngestedBytes: b.opts.IngestCounter != nil,
+		TrackWrittenStores: b.opts.WrittenStores != nil,
+		PrecomputedSplit:   b.opts.PrecomputedSplit != nil,
+		SplitBatchSize:     b.opts.SplitBatchSize,
+		SplitConcurrency:   b.opts.SplitConcurrency,
+		MinRegionsPerStore: b.opts.MinRegionsPerStore,
+		KeyTransform:       b.opts.KeyTransform != nil,
+		SettleDelay:        b.opts.SettleDelay,
+		FailedTableRetry:   b.opts.FailedTableRetry,
+		MaxBatchRetry:      b.opts.MaxBatchRetry,
+		BatchBackoffBase:   b.opts.BatchBackoffBase,
+		WriteModeThreshold: b.opts.WriteModeThreshold,
+		ScatterWaitTimeout: b.opts.ScatterWaitTimeout,
+		ScatterRetry:       b.opts.ScatterRetry,
+		IngestRateLimit:    b.opts.IngestRateLimit,
+		DryRun:             b.opts.DryRun,
+		IngestEmptyFiles:   b.opts.IngestEmptyFiles,
+		IngestLockCF:       b.opts.IngestLockCF,
+		RampUp:             b.opts.RampUp,
+		KeyRangeFilter:     b.opts.KeyRangeFilter,
+	}
+	if b.opts.ReadThrottle != nil {
+		cfg.ReadThrottleQPS = b.opts.ReadThrottle.HighReadQPS
+		cfg.ThrottledConcurrency = b.opts.ReadThrottle.Concurrency
+	}
+	return cfg
+}
+
+// Abort implements AbortableSender.
+func (b *tikvSender) Abort() {
+	b.cancel()
 }
 
 func (b *tikvSender) Close() {
 	close(b.inCh)
 	b.wg.Wait()
+	if b.opts.Checkpoint != nil {
+		if err := b.opts.Checkpoint.Flush(context.Background()); err != nil {
+			log.Warn("failed to flush the checkpoint, the progress recorded lately would be redone", zap.Error(err))
+		}
+	}
+	if b.opts.WrittenStores != nil {
+		log.Info("stores written by the restore", zap.Uint64s("stores", b.opts.WrittenStores.Stores()))
+	}
+	if report, ok := b.DryRunReport(); ok {
+		log.Info("dry run done", zap.Any("would-restore", report))
+	}
+	if skipped := b.SkippedEmptyFiles(); skipped > 0 {
+		log.Info("empty files skipped", zap.Int("files", skipped))
+	}
+	if skipped := b.SkippedLockFiles(); skipped > 0 {
+		log.Info("lock CF files skipped", zap.Int("files", skipped))
+	}
 	log.Debug("tikv sender closed")
 }
@@ -0,0 +1,1433 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/util/codec"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+type testTiKVSenderSuite struct{}
+
+var _ = Suite(&testTiKVSenderSuite{})
+
+type splitClientGrouper struct {
+	client restore.SplitClient
+}
+
+func (g splitClientGrouper) GroupFilesByRegion(
+	ctx context.Context,
+	files []*backup.File,
+	rewriteRules *restore.RewriteRules,
+) ([][]*backup.File, error) {
+	return restore.GroupFilesByRegion(ctx, g.client, files, rewriteRules)
+}
+
+func (*testTiKVSenderSuite) TestRestoreFilesGroupedByRegion(c *C) {
+	ctx := context.Background()
+	restorer := &fakeRestorer{}
+	// regions: [, aay), [aay, bba), [bba, bbh), [bbh, cca), [cca, )
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		Grouper: splitClientGrouper{client: initTestClient()},
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(4)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aac"), Files: []*backup.File{
+			fakeFile("1.sst", "aaa", "aab"),
+			fakeFile("2.sst", "aab", "aac"),
+		}},
+		{StartKey: []byte("bbb"), EndKey: []byte("bbd"), Files: []*backup.File{
+			fakeFile("3.sst", "bbb", "bbc"),
+		}},
+		{StartKey: []byte("ccc"), EndKey: []byte("cce"), Files: []*backup.File{
+			fakeFile("4.sst", "ccc", "ccd"),
+			fakeFile("5.sst", "ccd", "cce"),
+		}},
+	}))
+	batcher.Close()
+
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(restorer.Calls(), DeepEquals, [][]string{
+		{"1.sst", "2.sst"},
+		{"3.sst"},
+		{"4.sst", "5.sst"},
+	})
+	_, ok := <-outCh
+	c.Assert(ok, IsTrue)
+}
+
+func restoreWithReadQPS(c *C, qps float64) [][]string {
+	ctx := context.Background()
+	restorer := &fakeRestorer{}
+	sampler := restore.ReadLoadSamplerFunc(func(context.Context) (float64, error) {
+		return qps, nil
+	})
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		ReadThrottle: &restore.ReadThrottle{
+			Sampler:     sampler,
+			HighReadQPS: 1000,
+			Concurrency: 2,
+		},
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(8)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aaf"), Files: []*backup.File{
+			fakeFile("1.sst", "aaa", "aab"),
+			fakeFile("2.sst", "aab", "aac"),
+			fakeFile("3.sst", "aac", "aad"),
+			fakeFile("4.sst", "aad", "aae"),
+			fakeFile("5.sst", "aae", "aaf"),
+		}},
+	}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	return restorer.Calls()
+}
+
+func (*testTiKVSenderSuite) TestReadThrottle(c *C) {
+	// the foreground is idle, all files are ingested at once.
+	c.Assert(restoreWithReadQPS(c, 10), DeepEquals, [][]string{
+		{"1.sst", "2.sst", "3.sst", "4.sst", "5.sst"},
+	})
+	// the foreground is busy, at most 2 files are ingested at the same time.
+	c.Assert(restoreWithReadQPS(c, 5000), DeepEquals, [][]string{
+		{"1.sst", "2.sst"},
+		{"3.sst", "4.sst"},
+		{"5.sst"},
+	})
+}
+
+// prioritizedRestorer is a restorer which records the priority of each call to RestoreFilesWithPriority.
+type prioritizedRestorer struct {
+	*fakeRestorer
+	mu   sync.Mutex
+	pris []kvrpcpb.CommandPri
+}
+
+func (r *prioritizedRestorer) RestoreFilesWithPriority(
+	ctx context.Context,
+	files []*backup.File,
+	rewriteRules *restore.RewriteRules,
+	pri kvrpcpb.CommandPri,
+	updateCh glue.Progress,
+) error {
+	r.mu.Lock()
+	r.pris = append(r.pris, pri)
+	r.mu.Unlock()
+	return r.fakeRestorer.RestoreFiles(ctx, files, rewriteRules, updateCh)
+}
+
+func (*testTiKVSenderSuite) TestReadThrottlePriority(c *C) {
+	ctx := context.Background()
+	restorer := &prioritizedRestorer{fakeRestorer: &fakeRestorer{}}
+	sampler := restore.ReadLoadSamplerFunc(func(context.Context) (float64, error) {
+		return 5000, nil
+	})
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		ReadThrottle: &restore.ReadThrottle{Sampler: sampler, HighReadQPS: 1000, Concurrency: 1},
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(8)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aac"), Files: []*backup.File{
+			fakeFile("1.sst", "aaa", "aab"),
+			fakeFile("2.sst", "aab", "aac"),
+		}},
+	}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	// the foreground is busy, the files are ingested with low priority.
+	c.Assert(restorer.pris, DeepEquals, []kvrpcpb.CommandPri{kvrpcpb.CommandPri_Low, kvrpcpb.CommandPri_Low})
+	c.Assert(restorer.Restored(), DeepEquals, []string{"1.sst", "2.sst"})
+}
+
+type splitClientLocator struct {
+	client restore.SplitClient
+}
+
+func (l splitClientLocator) LocateFileStore(
+	ctx context.Context,
+	file *backup.File,
+	rewriteRules *restore.RewriteRules,
+) (uint64, error) {
+	return restore.LocateFileStore(ctx, l.client, file, rewriteRules)
+}
+
+func (*testTiKVSenderSuite) TestIngestedBytesPerStore(c *C) {
+	ctx := context.Background()
+	// regions: [, aay), [aay, bba), [bba, bbh), [bbh, cca), [cca, )
+	// the leader of region i is at store (i % 3 + 1).
+	client := initTestClient()
+	for id, region := range client.GetAllRegions() {
+		region.Leader = &metapb.Peer{Id: id, StoreId: id%3 + 1}
+	}
+	counter := restore.NewStoreIngestCounter(splitClientLocator{client: client})
+	sender, err := restore.NewTiKVSender(ctx, &fakeRestorer{}, nopProgress{}, restore.TiKVSenderOptions{
+		IngestCounter: counter,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(2)
+
+	files := []*backup.File{
+		fakeFile("1.sst", "aaa", "aab"),
+		fakeFile("2.sst", "bbb", "bbc"),
+		fakeFile("3.sst", "bbi", "bbj"),
+		fakeFile("4.sst", "ccc", "ccd"),
+	}
+	total := uint64(0)
+	ranges := make([]rtree.Range, 0, len(files))
+	for i, f := range files {
+		f.Size_ = uint64(i+1) * 100
+		total += f.Size_
+		ranges = append(ranges, rtree.Range{StartKey: f.StartKey, EndKey: f.EndKey, Files: []*backup.File{f}})
+	}
+	batcher.Add(fakeTableWithRange(1, ranges))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+
+	ingested := counter.IngestedBytes()
+	c.Assert(ingested, DeepEquals, map[uint64]uint64{
+		// 2.sst at region 3
+		1: 200,
+		// 1.sst at region 1, 3.sst at region 4
+		2: 400,
+		// 4.sst at region 5
+		3: 400,
+	})
+	sum := uint64(0)
+	for _, bytes := range ingested {
+		sum += bytes
+	}
+	c.Assert(sum, Equals, total)
+}
+
+type splitClientStoresLocator struct {
+	client restore.SplitClient
+}
+
+func (l splitClientStoresLocator) LocateFileStores(
+	ctx context.Context,
+	file *backup.File,
+	rewriteRules *restore.RewriteRules,
+) ([]uint64, error) {
+	return restore.LocateFileStores(ctx, l.client, file, rewriteRules)
+}
+
+func (*testTiKVSenderSuite) TestWrittenStores(c *C) {
+	ctx := context.Background()
+	// regions: [, aay), [aay, bba), [bba, bbh), [bbh, cca), [cca, )
+	// the peers of region i are at store i and store i+1.
+	client := initTestClient()
+	for id, region := range client.GetAllRegions() {
+		region.Region.Peers = []*metapb.Peer{{Id: id * 10, StoreId: id}, {Id: id*10 + 1, StoreId: id + 1}}
+	}
+	tracker := restore.NewWrittenStoreTracker(splitClientStoresLocator{client: client})
+	sender, err := restore.NewTiKVSender(ctx, &fakeRestorer{}, nopProgress{}, restore.TiKVSenderOptions{
+		WrittenStores: tracker,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	c.Assert(batcher.Config().Sender.TrackWrittenStores, IsTrue)
+
+	files := []*backup.File{
+		// at region 1
+		fakeFile("1.sst", "aaa", "aab"),
+		// at region 4
+		fakeFile("3.sst", "bbi", "bbj"),
+	}
+	ranges := make([]rtree.Range, 0, len(files))
+	for _, f := range files {
+		ranges = append(ranges, rtree.Range{StartKey: f.StartKey, EndKey: f.EndKey, Files: []*backup.File{f}})
+	}
+	batcher.Add(fakeTableWithRange(1, ranges))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(tracker.Stores(), DeepEquals, []uint64{1, 2, 4, 5})
+}
+
+func (*testTiKVSenderSuite) TestQuarantinePoisonRange(c *C) {
+	ctx := context.Background()
+	restorer := &fakeRestorer{failOn: "3.sst"}
+	detector := restore.NewPoisonRangeDetector(3)
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		PoisonRangeDetector: detector,
+		BatchBackoffBase:    time.Millisecond,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(4)
+	ranges := []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aab"), Files: []*backup.File{fakeFile("1.sst", "aaa", "aab")}},
+		{StartKey: []byte("aab"), EndKey: []byte("aac"), Files: []*backup.File{fakeFile("2.sst", "aab", "aac")}},
+		{StartKey: []byte("aac"), EndKey: []byte("aad"), Files: []*backup.File{fakeFile("3.sst", "aac", "aad")}},
+		{StartKey: []byte("aad"), EndKey: []byte("aae"), Files: []*backup.File{fakeFile("4.sst", "aad", "aae")}},
+	}
+	batcher.Add(fakeTableWithRange(1, ranges))
+	batcher.Close()
+
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(detector.Quarantined(), DeepEquals, ranges[2:3])
+	// the whole batch failed once, then each range is retried alone,
+	// and the poison range is tried 3 times before being quarantined.
+	c.Assert(restorer.Calls(), DeepEquals, [][]string{
+		{"1.sst", "2.sst", "3.sst", "4.sst"},
+		{"1.sst"},
+		{"2.sst"},
+		{"3.sst"},
+		{"3.sst"},
+		{"3.sst"},
+		{"4.sst"},
+	})
+	// the table owning the poison range is withheld.
+	c.Assert(collectTableIDs(outCh), HasLen, 0)
+}
+
+func (*testTiKVSenderSuite) TestQuarantineWithoutThreshold(c *C) {
+	rng := fakeRange("aaa", "aab")
+	for _, threshold := range []int{0, -1} {
+		detector := restore.NewPoisonRangeDetector(threshold)
+		c.Assert(detector.RecordFailure(rng, errors.New("injected")), IsTrue)
+		c.Assert(detector.RecordFailure(rng, errors.New("injected")), IsTrue)
+		c.Assert(detector.Quarantined(), HasLen, 1)
+	}
+}
+
+type fixedSplitKeyProvider map[string][][]byte
+
+func (p fixedSplitKeyProvider) SplitKeys(rng rtree.Range) ([][]byte, bool) {
+	keys, ok := p[string(rng.StartKey)]
+	return keys, ok
+}
+
+type regionKeySplitter struct {
+	splitter *restore.RegionSplitter
+}
+
+func (s regionKeySplitter) SplitKeys(
+	ctx context.Context, keys [][]byte, opts restore.SplitOptions, updateCh glue.Progress,
+) error {
+	return s.splitter.SplitKeys(ctx, keys, func([][]byte) {})
+}
+
+func (*testTiKVSenderSuite) TestPrecomputedSplit(c *C) {
+	ctx := context.Background()
+	// regions: [, aay), [aay, bba), [bba, bbh), [bbh, cca), [cca, )
+	client := initTestClient()
+	restorer := &fakeRestorer{}
+	provider := fixedSplitKeyProvider{
+		"aaa": {[]byte("aab")},
+		"bbb": {[]byte("bbc"), []byte("bbd")},
+	}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		PrecomputedSplit: &restore.PrecomputedSplit{
+			Provider: provider,
+			Splitter: regionKeySplitter{splitter: restore.NewRegionSplitter(client)},
+		},
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(4)
+	withoutKeys := rtree.Range{StartKey: []byte("ccc"), EndKey: []byte("ccd")}
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aac")},
+		{StartKey: []byte("bbb"), EndKey: []byte("bbe")},
+		withoutKeys,
+	}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+
+	startKeys := make(map[string]struct{})
+	for _, region := range client.GetAllRegions() {
+		startKeys[string(region.Region.StartKey)] = struct{}{}
+	}
+	c.Assert(startKeys, HasLen, 8)
+	for _, key := range []string{"aab", "bbc", "bbd"} {
+		_, ok := startKeys[string(codec.EncodeBytes([]byte{}, []byte(key)))]
+		c.Assert(ok, IsTrue, Commentf("region isn't split at %s", key))
+	}
+	// only the range without precomputed split keys is split in the normal way.
+	c.Assert(restorer.Splits(), DeepEquals, [][]rtree.Range{{withoutKeys}})
+}
+
+// splitOptionsRestorer is a restorer which records the split options of each call to SplitRangesWithResult.
+type splitOptionsRestorer struct {
+	*fakeRestorer
+	mu   sync.Mutex
+	opts []restore.SplitOptions
+}
+
+func (r *splitOptionsRestorer) SplitRangesWithResult(
+	ctx context.Context,
+	ranges []rtree.Range,
+	rewriteRules *restore.RewriteRules,
+	opts restore.SplitOptions,
+	updateCh glue.Progress,
+) (restore.SplitResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.opts = append(r.opts, opts)
+	return restore.SplitResult{}, nil
+}
+
+func (r *splitOptionsRestorer) SplitBatchSizes() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sizes := make([]int, 0, len(r.opts))
+	for _, opts := range r.opts {
+		sizes = append(sizes, opts.BatchSize)
+	}
+	return sizes
+}
+
+func (*testTiKVSenderSuite) TestSplitBatchSize(c *C) {
+	ctx := context.Background()
+	restorer := &splitOptionsRestorer{fakeRestorer: &fakeRestorer{}}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		SplitBatchSize: 16,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	c.Assert(batcher.Config().Sender.SplitBatchSize, Equals, 16)
+	batcher.SetThreshold(1)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		fakeRangeWithSize("aaa", "aab", 1),
+		fakeRangeWithSize("aab", "aac", 1),
+	}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(restorer.SplitBatchSizes(), DeepEquals, []int{16, 16})
+
+	// the split options are rejected rather than ignored if the restorer cannot take them.
+	_, err = restore.NewTiKVSender(ctx, &fakeRestorer{}, nopProgress{}, restore.TiKVSenderOptions{
+		SplitBatchSize: 16,
+	})
+	c.Assert(errors.Cause(err), Equals, berrors.ErrInvalidArgument)
+}
+
+// slowSplitRestorer is a restorer whose splitting takes a while, it records the max count of concurrent splits.
+type slowSplitRestorer struct {
+	*fakeRestorer
+	mu             sync.Mutex
+	splitting      int
+	maxConcurrency int
+}
+
+func (r *slowSplitRestorer) SplitRanges(
+	ctx context.Context,
+	ranges []rtree.Range,
+	rewriteRules *restore.RewriteRules,
+	updateCh glue.Progress,
+) error {
+	r.mu.Lock()
+	r.splitting++
+	if r.splitting > r.maxConcurrency {
+		r.maxConcurrency = r.splitting
+	}
+	r.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	r.mu.Lock()
+	r.splitting--
+	r.mu.Unlock()
+	return r.fakeRestorer.SplitRanges(ctx, ranges, rewriteRules, updateCh)
+}
+
+func (*testTiKVSenderSuite) TestSplitConcurrency(c *C) {
+	ctx := context.Background()
+	restorer := &slowSplitRestorer{fakeRestorer: &fakeRestorer{}}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		SplitConcurrency: 2,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	c.Assert(batcher.Config().Sender.SplitConcurrency, Equals, uint(2))
+	batcher.SetThreshold(1)
+	ranges := make([]rtree.Range, 0, 16)
+	for i := 0; i < 16; i++ {
+		ranges = append(ranges, fakeRangeWithSize(fmt.Sprintf("a%02d", i), fmt.Sprintf("a%02d", i+1), 1))
+	}
+	batcher.Add(fakeTableWithRange(1, ranges))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	tables := 0
+	for range outCh {
+		tables++
+	}
+	c.Assert(tables, Equals, 1)
+
+	c.Assert(restorer.maxConcurrency, Equals, 2)
+	// the batches are still restored in order.
+	c.Assert(restorer.Restored(), HasLen, 16)
+	for i, name := range restorer.Restored() {
+		c.Assert(name, Equals, fmt.Sprintf("a%02d.sst", i))
+	}
+}
+
+// shiftByteTransform shifts each byte of the key by one, which preserves the order if no byte overflows.
+type shiftByteTransform struct{}
+
+func (shiftByteTransform) TransformKey(key []byte) []byte {
+	transformed := make([]byte, 0, len(key))
+	for _, b := range key {
+		transformed = append(transformed, b+1)
+	}
+	return transformed
+}
+
+// keyRangeRecordingRestorer records the key ranges of the files restored.
+type keyRangeRecordingRestorer struct {
+	*fakeRestorer
+	mu        sync.Mutex
+	keyRanges [][2]string
+}
+
+func (r *keyRangeRecordingRestorer) RestoreFiles(
+	ctx context.Context,
+	files []*backup.File,
+	rewriteRules *restore.RewriteRules,
+	updateCh glue.Progress,
+) error {
+	r.mu.Lock()
+	for _, f := range files {
+		r.keyRanges = append(r.keyRanges, [2]string{string(f.GetStartKey()), string(f.GetEndKey())})
+	}
+	r.mu.Unlock()
+	return r.fakeRestorer.RestoreFiles(ctx, files, rewriteRules, updateCh)
+}
+
+func (*testTiKVSenderSuite) TestKeyTransform(c *C) {
+	ctx := context.Background()
+	restorer := &keyRangeRecordingRestorer{fakeRestorer: &fakeRestorer{}}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		KeyTransform: shiftByteTransform{},
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	c.Assert(batcher.Config().Sender.KeyTransform, IsTrue)
+	batcher.SetThreshold(2)
+	rng := fakeRangeWithSize("aaa", "aab", 1)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{rng, fakeRangeWithSize("aab", "aac", 1)}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+
+	c.Assert(restorer.keyRanges, DeepEquals, [][2]string{{"bbb", "bbc"}, {"bbc", "bbd"}})
+	// the files of the backup are untouched.
+	c.Assert(string(rng.Files[0].StartKey), Equals, "aaa")
+	c.Assert(string(rng.Files[0].EndKey), Equals, "aab")
+}
+
+func (*testTiKVSenderSuite) TestKeyRangeFilter(c *C) {
+	ctx := context.Background()
+	restorer := &keyRangeRecordingRestorer{fakeRestorer: &fakeRestorer{}}
+	filter := &restore.KeyRangeFilter{StartKey: []byte("aab"), EndKey: []byte("aacm")}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		KeyRangeFilter: filter,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	c.Assert(batcher.Config().Sender.KeyRangeFilter, DeepEquals, filter)
+	batcher.SetThreshold(3)
+	rng := fakeRangeWithSize("aac", "aad", 1)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRangeWithSize("aaa", "aab", 1), fakeRangeWithSize("aab", "aac", 1), rng}))
+	// table 2 is entirely outside the filter, but it's still emitted.
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRangeWithSize("baa", "bab", 1)}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(collectTableIDs(outCh), DeepEquals, []int64{1, 2})
+
+	// the range outside the filter is dropped, and the overlapping one is clipped.
+	c.Assert(restorer.keyRanges, DeepEquals, [][2]string{{"aab", "aac"}, {"aac", "aacm"}})
+	splitKeys := make([][2]string, 0)
+	for _, split := range restorer.Splits() {
+		for _, r := range split {
+			splitKeys = append(splitKeys, [2]string{string(r.StartKey), string(r.EndKey)})
+		}
+	}
+	c.Assert(splitKeys, DeepEquals, [][2]string{{"aab", "aac"}, {"aac", "aacm"}})
+	// the files of the backup are untouched.
+	c.Assert(string(rng.Files[0].EndKey), Equals, "aad")
+}
+
+// classifyingRestorer is a restorer which classifies the outcome of splitting by the results in order.
+type classifyingRestorer struct {
+	*fakeRestorer
+	mu      sync.Mutex
+	results []restore.SplitResult
+	errs    []error
+}
+
+func (r *classifyingRestorer) SplitRangesWithResult(
+	ctx context.Context,
+	ranges []rtree.Range,
+	rewriteRules *restore.RewriteRules,
+	opts restore.SplitOptions,
+	updateCh glue.Progress,
+) (restore.SplitResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result, err := r.results[0], r.errs[0]
+	r.results, r.errs = r.results[1:], r.errs[1:]
+	return result, err
+}
+
+func (*testTiKVSenderSuite) TestClassifySplitResult(c *C) {
+	ctx := context.Background()
+	restorer := &classifyingRestorer{
+		fakeRestorer: &fakeRestorer{},
+		results: []restore.SplitResult{
+			{Created: 3, Existing: 2},
+			{Created: 1, Failed: 1},
+		},
+		errs: []error{nil, errors.Annotate(berrors.ErrRestoreSplitFailed, "injected")},
+	}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, crashTolerantManager{newMockManager()}, errCh)
+	batcher.SetThreshold(1)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		fakeRangeWithSize("aaa", "aab", 1),
+		fakeRangeWithSize("aab", "aac", 1),
+	}))
+	batcher.Close()
+	errs := restore.Exhaust(errCh)
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errors.Cause(errs[0]), Equals, berrors.ErrRestoreSplitFailed)
+
+	stats := batcher.Stats()
+	c.Assert(stats.Split, NotNil)
+	c.Assert(*stats.Split, Equals, restore.SplitResult{Created: 4, Existing: 2, Failed: 1})
+	// the classifying splitter is used instead of SplitRanges.
+	c.Assert(restorer.Splits(), HasLen, 0)
+}
+
+// fakeClock is a clock whose time never goes, waiting on it lasts until the test fires.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+	fire  chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waits = append(c.waits, d)
+	return c.fire
+}
+
+// NewTicker returns a ticker which never ticks, the sender doesn't tick.
+func (c *fakeClock) NewTicker(d time.Duration) utils.Ticker {
+	return silentTicker{}
+}
+
+type silentTicker struct{}
+
+func (silentTicker) Chan() <-chan time.Time {
+	return nil
+}
+
+func (silentTicker) Stop() {}
+
+func (c *fakeClock) Waits() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration{}, c.waits...)
+}
+
+func (*testTiKVSenderSuite) TestSettleDelay(c *C) {
+	ctx := context.Background()
+	restorer := &fakeRestorer{}
+	clock := &fakeClock{now: time.Unix(0, 0), fire: make(chan time.Time)}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		SettleDelay: 2 * time.Second,
+		Clock:       clock,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	c.Assert(batcher.Config().Sender.SettleDelay, Equals, 2*time.Second)
+	batcher.SetThreshold(1)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{fakeRangeWithSize("aaa", "aab", 1)}))
+
+	for len(clock.Waits()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// split, but not ingested until the delay elapses.
+	c.Assert(clock.Waits(), DeepEquals, []time.Duration{2 * time.Second})
+	c.Assert(restorer.Splits(), HasLen, 1)
+	c.Assert(restorer.Restored(), HasLen, 0)
+
+	clock.fire <- clock.now.Add(2 * time.Second)
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(restorer.Restored(), DeepEquals, []string{"aaa.sst"})
+}
+
+// flakyRestorer fails restoring the file for `failures` times, it records the files of every call.
+type flakyRestorer struct {
+	*fakeRestorer
+	mu       sync.Mutex
+	failOn   string
+	failures int
+	calls    [][]string
+}
+
+func (r *flakyRestorer) RestoreFiles(
+	ctx context.Context,
+	files []*backup.File,
+	rewriteRules *restore.RewriteRules,
+	updateCh glue.Progress,
+) error {
+	r.mu.Lock()
+	call := make([]string, 0, len(files))
+	fail := false
+	for _, f := range files {
+		call = append(call, f.GetName())
+		fail = fail || f.GetName() == r.failOn
+	}
+	r.calls = append(r.calls, call)
+	if fail && r.failures > 0 {
+		r.failures--
+		r.mu.Unlock()
+		return errors.Errorf("injected failure on restoring %s", r.failOn)
+	}
+	r.mu.Unlock()
+	return r.fakeRestorer.RestoreFiles(ctx, files, rewriteRules, updateCh)
+}
+
+func (*testTiKVSenderSuite) TestRetryFailedTables(c *C) {
+	ctx := context.Background()
+	restorer := &flakyRestorer{fakeRestorer: &fakeRestorer{}, failOn: "baa.sst", failures: 2}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		FailedTableRetry: 2,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(3)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		fakeRangeWithSize("aaa", "aab", 1),
+		fakeRangeWithSize("aab", "aac", 1),
+	}))
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRangeWithSize("baa", "bab", 1)}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	tables := 0
+	for range outCh {
+		tables++
+	}
+	c.Assert(tables, Equals, 2)
+
+	c.Assert(restorer.calls, DeepEquals, [][]string{
+		// the whole batch fails.
+		{"aaa.sst", "aab.sst", "baa.sst"},
+		// restored table by table.
+		{"aaa.sst", "aab.sst"},
+		{"baa.sst"},
+		// only the failed table is retried.
+		{"baa.sst"},
+	})
+}
+
+func (*testTiKVSenderSuite) TestRetryFailedTablesBackoff(c *C) {
+	ctx := context.Background()
+	restorer := &flakyRestorer{fakeRestorer: &fakeRestorer{}, failOn: "baa.sst", failures: 3}
+	clock := firedClock(2)
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		FailedTableRetry: 2,
+		BatchBackoffBase: 100 * time.Millisecond,
+		Clock:            clock,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(3)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		fakeRangeWithSize("aaa", "aab", 1),
+		fakeRangeWithSize("aab", "aac", 1),
+	}))
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRangeWithSize("baa", "bab", 1)}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(collectTableIDs(outCh), HasLen, 2)
+
+	// the failed table is retried after the backoff doubled each time.
+	c.Assert(clock.Waits(), DeepEquals, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond})
+	// the ranges of the failed table are split again before each retry.
+	splits := restorer.Splits()
+	c.Assert(splits, HasLen, 3)
+	for _, split := range splits[1:] {
+		c.Assert(split, HasLen, 1)
+		c.Assert(split[0].StartKey, DeepEquals, []byte("baa"))
+	}
+}
+
+func restoreWithBatchRetry(c *C, restorer *flakyRestorer, maxRetry int) []error {
+	ctx := context.Background()
+	// ingest the files one by one, so the batch can be partially ingested.
+	sampler := restore.ReadLoadSamplerFunc(func(context.Context) (float64, error) {
+		return 5000, nil
+	})
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		ReadThrottle: &restore.ReadThrottle{
+			Sampler:     sampler,
+			HighReadQPS: 1000,
+			Concurrency: 1,
+		},
+		MaxBatchRetry:    maxRetry,
+		BatchBackoffBase: time.Millisecond,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, crashTolerantManager{newMockManager()}, errCh)
+	batcher.SetThreshold(8)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aad"), Files: []*backup.File{
+			fakeFile("1.sst", "aaa", "aab"),
+			fakeFile("2.sst", "aab", "aac"),
+			fakeFile("3.sst", "aac", "aad"),
+		}},
+	}))
+	batcher.Close()
+	return restore.Exhaust(errCh)
+}
+
+func (*testTiKVSenderSuite) TestBatchRetry(c *C) {
+	restorer := &flakyRestorer{fakeRestorer: &fakeRestorer{}, failOn: "2.sst", failures: 2}
+	c.Assert(restoreWithBatchRetry(c, restorer, 2), HasLen, 0)
+	c.Assert(restorer.calls, DeepEquals, [][]string{
+		{"1.sst"},
+		{"2.sst"},
+		// the file already ingested isn't retried.
+		{"2.sst"},
+		{"2.sst"},
+		{"3.sst"},
+	})
+	c.Assert(restorer.Restored(), DeepEquals, []string{"1.sst", "2.sst", "3.sst"})
+	// the batch is split again before each retry.
+	c.Assert(restorer.Splits(), HasLen, 3)
+
+	// too many failures.
+	restorer = &flakyRestorer{fakeRestorer: &fakeRestorer{}, failOn: "2.sst", failures: 3}
+	errs := restoreWithBatchRetry(c, restorer, 2)
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errs[0], ErrorMatches, ".*batch still failed after 2 retries.*")
+	c.Assert(restorer.Restored(), DeepEquals, []string{"1.sst"})
+}
+
+// splittingRestorer splits the regions by the range start keys with a real region splitter.
+type splittingRestorer struct {
+	*fakeRestorer
+	client restore.SplitClient
+}
+
+func (r *splittingRestorer) SplitRangesWithResult(
+	ctx context.Context,
+	ranges []rtree.Range,
+	rewriteRules *restore.RewriteRules,
+	opts restore.SplitOptions,
+	updateCh glue.Progress,
+) (restore.SplitResult, error) {
+	keys := make([][]byte, 0, len(ranges))
+	for _, rng := range ranges {
+		keys = append(keys, rng.StartKey)
+	}
+	err := restore.NewRegionSplitterWithOptions(r.client, opts).SplitKeys(ctx, keys, nil)
+	return restore.SplitResult{}, err
+}
+
+func (*testTiKVSenderSuite) TestScatterWaitTimeout(c *C) {
+	ctx := context.Background()
+	client := stuckScatterClient{TestClient: initTestClient()}
+	restorer := &splittingRestorer{fakeRestorer: &fakeRestorer{}, client: client}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		ScatterWaitTimeout: 100 * time.Millisecond,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(8)
+	c.Assert(batcher.Config().Sender.ScatterWaitTimeout, Equals, 100*time.Millisecond)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		{StartKey: []byte("bbb"), EndKey: []byte("bbc"), Files: []*backup.File{fakeFile("1.sst", "bbb", "bbc")}},
+		{StartKey: []byte("bbc"), EndKey: []byte("bbd"), Files: []*backup.File{fakeFile("2.sst", "bbc", "bbd")}},
+	}))
+
+	start := time.Now()
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	// the regions are split, and ingested without waiting for the stuck scatter.
+	c.Assert(time.Since(start), Less, 10*time.Second)
+	c.Assert(restorer.Restored(), DeepEquals, []string{"1.sst", "2.sst"})
+	region, err := client.GetRegion(ctx, codec.EncodeBytes([]byte{}, []byte("bbc")))
+	c.Assert(err, IsNil)
+	c.Assert(region.Region.GetStartKey(), DeepEquals, codec.EncodeBytes([]byte{}, []byte("bbc")))
+}
+
+func (*testTiKVSenderSuite) TestTimeToFirstIngest(c *C) {
+	ctx := context.Background()
+	// the first ingest fails, so the first successful one is delayed by the backoff.
+	restorer := &flakyRestorer{fakeRestorer: &fakeRestorer{}, failOn: "1.sst", failures: 1}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		MaxBatchRetry:    1,
+		BatchBackoffBase: 200 * time.Millisecond,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(8)
+	c.Assert(batcher.Stats().TimeToFirstIngest, IsNil)
+
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aab"), Files: []*backup.File{fakeFile("1.sst", "aaa", "aab")}},
+	}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	elapsed := batcher.Stats().TimeToFirstIngest
+	c.Assert(elapsed, NotNil)
+	c.Assert(*elapsed >= 200*time.Millisecond, IsTrue, Commentf("time to first ingest is %s", *elapsed))
+}
+
+func fakeFileWithSize(name, startKey, endKey string, size uint64) *backup.File {
+	f := fakeFile(name, startKey, endKey)
+	f.Size_ = size
+	return f
+}
+
+func restoreWithIngestRateLimit(ctx context.Context, c *C, limit uint64, files ...*backup.File) []error {
+	sender, err := restore.NewTiKVSender(ctx, &fakeRestorer{}, nopProgress{}, restore.TiKVSenderOptions{
+		IngestRateLimit: limit,
+		// ingest the files one by one.
+		ReadThrottle: &restore.ReadThrottle{
+			Sampler: restore.ReadLoadSamplerFunc(func(context.Context) (float64, error) {
+				return 5000, nil
+			}),
+			HighReadQPS: 1000,
+			Concurrency: 1,
+		},
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, crashTolerantManager{newMockManager()}, errCh)
+	c.Assert(batcher.Config().Sender.IngestRateLimit, Equals, limit)
+	batcher.SetThreshold(8)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aad"), Files: files},
+	}))
+	batcher.Close()
+	return restore.Exhaust(errCh)
+}
+
+func (*testTiKVSenderSuite) TestIngestRateLimit(c *C) {
+	// the first file is ingested by the burst, the following ones wait for the budget.
+	start := time.Now()
+	errs := restoreWithIngestRateLimit(context.Background(), c, 10000,
+		fakeFileWithSize("1.sst", "aaa", "aab", 5000),
+		fakeFileWithSize("2.sst", "aab", "aac", 5000),
+		fakeFileWithSize("3.sst", "aac", "aad", 5000),
+	)
+	c.Assert(errs, HasLen, 0)
+	c.Assert(time.Since(start) >= 400*time.Millisecond, IsTrue, Commentf("took %s", time.Since(start)))
+
+	// waiting for the budget respects the context.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	errs = restoreWithIngestRateLimit(ctx, c, 1,
+		fakeFileWithSize("1.sst", "aaa", "aab", 100),
+	)
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errs[0], ErrorMatches, ".*failed to wait for the ingest budget.*")
+}
+
+// writingRestorer records the files of each call to WriteFiles.
+type writingRestorer struct {
+	*fakeRestorer
+	written [][]string
+}
+
+func (r *writingRestorer) WriteFiles(
+	ctx context.Context,
+	files []*backup.File,
+	rewriteRules *restore.RewriteRules,
+	updateCh glue.Progress,
+) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	call := make([]string, 0, len(files))
+	for _, f := range files {
+		call = append(call, f.GetName())
+	}
+	r.written = append(r.written, call)
+	return nil
+}
+
+func (*testTiKVSenderSuite) TestWriteMode(c *C) {
+	ctx := context.Background()
+	_, err := restore.NewTiKVSender(ctx, &fakeRestorer{}, nopProgress{}, restore.TiKVSenderOptions{
+		WriteModeThreshold: 50,
+	})
+	c.Assert(err, ErrorMatches, ".*doesn't support applying files by writing.*")
+
+	restorer := &writingRestorer{fakeRestorer: &fakeRestorer{}}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		WriteModeThreshold: 50,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(8)
+	small := fakeTableWithRange(1, []rtree.Range{
+		fakeRangeWithSize("aaa", "aab", 10),
+		fakeRangeWithSize("aab", "aac", 10),
+	})
+	large := fakeTableWithRange(2, []rtree.Range{fakeRangeWithSize("baa", "bab", 100)})
+	batcher.Add(small)
+	batcher.Add(large)
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	tables := 0
+	for range outCh {
+		tables++
+	}
+	c.Assert(tables, Equals, 2)
+
+	// the small table is written without splitting, and the large one is split and ingested.
+	c.Assert(restorer.written, DeepEquals, [][]string{{"aaa.sst", "aab.sst"}})
+	c.Assert(restorer.Calls(), DeepEquals, [][]string{{"baa.sst"}})
+	c.Assert(restorer.Splits(), DeepEquals, [][]rtree.Range{large.Range})
+}
+
+// startKeysSerializer serializes the failed ranges as their start keys, one per line.
+type startKeysSerializer struct {
+	invoked [][]rtree.Range
+}
+
+func (s *startKeysSerializer) SerializeFailedRanges(ranges []rtree.Range) ([]byte, error) {
+	s.invoked = append(s.invoked, ranges)
+	keys := make([]string, 0, len(ranges))
+	for _, rng := range ranges {
+		keys = append(keys, string(rng.StartKey))
+	}
+	return []byte(strings.Join(keys, "\n")), nil
+}
+
+func (*testTiKVSenderSuite) TestFailedRangesManifest(c *C) {
+	ctx := context.Background()
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	serializer := new(startKeysSerializer)
+	restorer := &fakeRestorer{failOn: "aab.sst"}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		FailedRangesManifest: &restore.FailedRangesManifest{
+			Storage:    s,
+			Name:       "failed-ranges",
+			Serializer: serializer,
+		},
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, crashTolerantManager{newMockManager()}, errCh)
+	batcher.SetThreshold(2)
+	ranges := []rtree.Range{
+		fakeRangeWithSize("aaa", "aab", 1),
+		fakeRangeWithSize("aab", "aac", 1),
+		fakeRangeWithSize("aac", "aad", 1),
+	}
+	batcher.Add(fakeTableWithRange(1, ranges))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 1)
+
+	// the batch failed aborts the restore, and it is written to the manifest.
+	c.Assert(serializer.invoked, DeepEquals, [][]rtree.Range{ranges[:2]})
+	content, err := s.ReadFile(ctx, "failed-ranges")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "aaa\naab")
+}
+
+func (*testTiKVSenderSuite) TestRetryByFailedRangesManifest(c *C) {
+	ctx := context.Background()
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	manifest := &restore.FailedRangesManifest{Storage: s, Name: "failed-ranges"}
+	tables := []restore.TableWithRange{
+		fakeTableWithRange(1, []rtree.Range{
+			fakeRangeWithSize("aaa", "aab", 1),
+			fakeRangeWithSize("aab", "aac", 1),
+			fakeRangeWithSize("aac", "aad", 1),
+		}),
+		fakeTableWithRange(2, []rtree.Range{fakeRangeWithSize("baa", "bab", 1)}),
+	}
+
+	// the first batch fails, which aborts the restore.
+	restorer := &fakeRestorer{failOn: "aab.sst"}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		FailedRangesManifest: manifest,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, crashTolerantManager{newMockManager()}, errCh)
+	batcher.SetThreshold(2)
+	for _, table := range tables {
+		batcher.Add(table)
+	}
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 1)
+
+	retry, err := manifest.LoadTables(ctx, tables)
+	c.Assert(err, IsNil)
+	c.Assert(retry, HasLen, 1)
+	c.Assert(retry[0].Range, DeepEquals, tables[0].Range[:2])
+
+	// only the failed ranges are restored by the retry run.
+	restorer = &fakeRestorer{}
+	sender, err = restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{})
+	c.Assert(err, IsNil)
+	batcher, _ = restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	for _, table := range retry {
+		batcher.Add(table)
+	}
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(restorer.Restored(), DeepEquals, []string{"aaa.sst", "aab.sst"})
+
+	// a manifest of an unknown version.
+	c.Assert(s.WriteFile(ctx, "failed-ranges", []byte(`{"version":42,"ranges":[]}`)), IsNil)
+	_, err = manifest.LoadTables(ctx, tables)
+	c.Assert(errors.Cause(err), Equals, berrors.ErrRestoreInvalidManifest)
+	c.Assert(err, ErrorMatches, ".*unsupported version 42.*")
+}
+
+// conflictRestorer fails with write conflict when restoring the file named `conflictOn`,
+// for `conflicts` times, or forever if `conflicts` is negative.
+type conflictRestorer struct {
+	*fakeRestorer
+	mu         sync.Mutex
+	conflictOn string
+	conflicts  int
+}
+
+func (r *conflictRestorer) RestoreFiles(
+	ctx context.Context,
+	files []*backup.File,
+	rewriteRules *restore.RewriteRules,
+	updateCh glue.Progress,
+) error {
+	r.mu.Lock()
+	for _, f := range files {
+		if f.GetName() == r.conflictOn && r.conflicts != 0 {
+			r.conflicts--
+			r.mu.Unlock()
+			return errors.Annotatef(berrors.ErrKVWriteConflict, "injected conflict on %s", f.GetName())
+		}
+	}
+	r.mu.Unlock()
+	return r.fakeRestorer.RestoreFiles(ctx, files, rewriteRules, updateCh)
+}
+
+// runWithConflict restores table 1 in a batch, then table 2 in another, and returns the IDs of the tables emitted.
+func runWithConflict(
+	c *C, restorer *conflictRestorer, handling *restore.WriteConflictHandling, clock utils.Clock,
+) ([]int64, []error) {
+	ctx := context.Background()
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		WriteConflictHandling: handling,
+		Clock:                 clock,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, sender, crashTolerantManager{newMockManager()}, errCh)
+	batcher.SetThreshold(3)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		fakeRangeWithSize("aaa", "aab", 1),
+		fakeRangeWithSize("aab", "aac", 1),
+		fakeRangeWithSize("aac", "aad", 1),
+	}))
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRangeWithSize("baa", "bab", 1)}))
+	batcher.Close()
+	return collectTableIDs(outCh), restore.Exhaust(errCh)
+}
+
+// firedClock returns a fake clock whose waits are done at once, for `n` times.
+func firedClock(n int) *fakeClock {
+	clock := &fakeClock{now: time.Unix(0, 0), fire: make(chan time.Time, n)}
+	for i := 0; i < n; i++ {
+		clock.fire <- clock.now
+	}
+	return clock
+}
+
+func (*testTiKVSenderSuite) TestWriteConflictHandling(c *C) {
+	// fail by default.
+	restorer := &conflictRestorer{fakeRestorer: &fakeRestorer{}, conflictOn: "aab.sst", conflicts: -1}
+	tables, errs := runWithConflict(c, restorer, nil, nil)
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errors.Cause(errs[0]), Equals, berrors.ErrKVWriteConflict)
+	c.Assert(restorer.Restored(), HasLen, 0)
+	c.Assert(tables, HasLen, 0)
+
+	// skip the conflicting file, the table owning it is withheld.
+	restorer = &conflictRestorer{fakeRestorer: &fakeRestorer{}, conflictOn: "aab.sst", conflicts: -1}
+	tables, errs = runWithConflict(c, restorer, &restore.WriteConflictHandling{Policy: restore.WriteConflictSkip}, nil)
+	c.Assert(errs, HasLen, 0)
+	c.Assert(restorer.Restored(), DeepEquals, []string{"aaa.sst", "aac.sst", "baa.sst"})
+	c.Assert(tables, DeepEquals, []int64{2})
+
+	// retry until the conflict is gone, waiting by the clock.
+	restorer = &conflictRestorer{fakeRestorer: &fakeRestorer{}, conflictOn: "aab.sst", conflicts: 2}
+	clock := firedClock(2)
+	tables, errs = runWithConflict(c, restorer, &restore.WriteConflictHandling{
+		Policy:     restore.WriteConflictRetry,
+		RetryDelay: 50 * time.Millisecond,
+		MaxRetry:   3,
+	}, clock)
+	c.Assert(errs, HasLen, 0)
+	c.Assert(clock.Waits(), DeepEquals, []time.Duration{50 * time.Millisecond, 50 * time.Millisecond})
+	c.Assert(restorer.Restored(), DeepEquals, []string{"aaa.sst", "aab.sst", "aac.sst", "baa.sst"})
+	c.Assert(tables, DeepEquals, []int64{1, 2})
+
+	// fail once retried too many times.
+	restorer = &conflictRestorer{fakeRestorer: &fakeRestorer{}, conflictOn: "aab.sst", conflicts: -1}
+	_, errs = runWithConflict(c, restorer, &restore.WriteConflictHandling{
+		Policy:     restore.WriteConflictRetry,
+		RetryDelay: time.Millisecond,
+		MaxRetry:   3,
+	}, firedClock(3))
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errs[0], ErrorMatches, ".*still conflicting after 3 retries.*")
+}
+
+func (*testTiKVSenderSuite) TestDryRun(c *C) {
+	ctx := context.Background()
+	restorer := &fakeRestorer{}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		DryRun: true,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(2)
+	c.Assert(batcher.Config().Sender.DryRun, IsTrue)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		fakeRangeWithSize("aaa", "aab", 10),
+		fakeRangeWithSize("aab", "aac", 20),
+	}))
+	batcher.Add(fakeTableWithRange(2, []rtree.Range{fakeRangeWithSize("baa", "bab", 30)}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	tables := 0
+	for range outCh {
+		tables++
+	}
+	c.Assert(tables, Equals, 2)
+
+	// the regions are split, but nothing is restored.
+	c.Assert(restorer.Splits(), HasLen, 2)
+	c.Assert(restorer.Calls(), HasLen, 0)
+	report := batcher.Stats().DryRun
+	c.Assert(report, NotNil)
+	c.Assert(*report, DeepEquals, restore.DryRunReport{Batches: 2, Ranges: 3, Files: 3, Bytes: 60})
+}
+
+func restoreWithEmptyFiles(c *C, opts restore.TiKVSenderOptions) (*fakeRestorer, restore.RestoreStats) {
+	ctx := context.Background()
+	restorer := &fakeRestorer{}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, opts)
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(8)
+	empty := fakeFile("2.sst", "aab", "aac")
+	empty.TotalKvs = 0
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aad"), Files: []*backup.File{
+			fakeFile("1.sst", "aaa", "aab"),
+			empty,
+			fakeFile("3.sst", "aac", "aad"),
+		}},
+	}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	return restorer, batcher.Stats()
+}
+
+func (*testTiKVSenderSuite) TestSkipEmptyFiles(c *C) {
+	restorer, stats := restoreWithEmptyFiles(c, restore.TiKVSenderOptions{})
+	c.Assert(restorer.Restored(), DeepEquals, []string{"1.sst", "3.sst"})
+	c.Assert(stats.SkippedEmptyFiles, Equals, 1)
+
+	restorer, stats = restoreWithEmptyFiles(c, restore.TiKVSenderOptions{IngestEmptyFiles: true})
+	c.Assert(restorer.Restored(), DeepEquals, []string{"1.sst", "2.sst", "3.sst"})
+	c.Assert(stats.SkippedEmptyFiles, Equals, 0)
+}
+
+func restoreWithLockFiles(c *C, opts restore.TiKVSenderOptions) (*fakeRestorer, restore.RestoreStats) {
+	ctx := context.Background()
+	restorer := &fakeRestorer{}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, opts)
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	c.Assert(batcher.Config().Sender.IngestLockCF, Equals, opts.IngestLockCF)
+	batcher.SetThreshold(8)
+	lock := fakeFile("2.sst", "aab", "aac")
+	lock.Cf = "lock"
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aad"), Files: []*backup.File{
+			fakeFile("1_write.sst", "aaa", "aab"),
+			lock,
+			fakeFile("3_lock.sst", "aac", "aad"),
+		}},
+	}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	// the table is restored even if some of its files are skipped.
+	c.Assert(collectTableIDs(outCh), DeepEquals, []int64{1})
+	return restorer, batcher.Stats()
+}
+
+func (*testTiKVSenderSuite) TestSkipLockFiles(c *C) {
+	restorer, stats := restoreWithLockFiles(c, restore.TiKVSenderOptions{})
+	c.Assert(restorer.Restored(), DeepEquals, []string{"1_write.sst"})
+	c.Assert(stats.SkippedLockFiles, Equals, 2)
+
+	restorer, stats = restoreWithLockFiles(c, restore.TiKVSenderOptions{IngestLockCF: true})
+	c.Assert(restorer.Restored(), DeepEquals, []string{"1_write.sst", "2.sst", "3_lock.sst"})
+	c.Assert(stats.SkippedLockFiles, Equals, 0)
+}
+
+func (*testTiKVSenderSuite) TestSkipFilesInDryRun(c *C) {
+	ctx := context.Background()
+	sender, err := restore.NewTiKVSender(ctx, &fakeRestorer{}, nopProgress{}, restore.TiKVSenderOptions{
+		DryRun: true,
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(8)
+	empty := fakeFile("2.sst", "aab", "aac")
+	empty.TotalKvs = 0
+	lock := fakeFileWithSize("3.sst", "aac", "aad", 10)
+	lock.Cf = "lock"
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{
+		{StartKey: []byte("aaa"), EndKey: []byte("aad"), Files: []*backup.File{
+			fakeFileWithSize("1.sst", "aaa", "aab", 10),
+			empty,
+			lock,
+		}},
+	}))
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	// the skipped files are skipped by the dry run too.
+	stats := batcher.Stats()
+	c.Assert(*stats.DryRun, DeepEquals, restore.DryRunReport{Batches: 1, Ranges: 1, Files: 1, Bytes: 10})
+	c.Assert(stats.SkippedEmptyFiles, Equals, 1)
+	c.Assert(stats.SkippedLockFiles, Equals, 1)
+}
+
+// manualClock is a clock which goes only when set, and waits by the system clock.
+type manualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (c *manualClock) NewTicker(d time.Duration) utils.Ticker {
+	panic("unused")
+}
+
+func (*testTiKVSenderSuite) TestConcurrencyRampUp(c *C) {
+	ctx := context.Background()
+	restorer := &fakeRestorer{}
+	clock := &manualClock{now: time.Unix(0, 0)}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{
+		Clock:  clock,
+		RampUp: &restore.ConcurrencyRampUp{Initial: 1, Target: 4, WarmUp: 40 * time.Second},
+	})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, _ := restore.NewBatcher(ctx, sender, newMockManager(), errCh)
+	batcher.SetThreshold(8)
+	batcher.Pause()
+
+	// restore a batch of 8 files at each time, returns the count of files per call.
+	restoreAt := func(id int64, seconds int64) []int {
+		clock.Set(time.Unix(seconds, 0))
+		prefix := fmt.Sprintf("%d", id)
+		files := make([]*backup.File, 0, 8)
+		for i := 0; i < 8; i++ {
+			files = append(files, fakeFile(fmt.Sprintf("%s_%d.sst", prefix, i), prefix+"a", prefix+"b"))
+		}
+		batcher.Add(fakeTableWithRange(id, []rtree.Range{
+			{StartKey: []byte(prefix + "a"), EndKey: []byte(prefix + "b"), Files: files},
+		}))
+		calls := len(restorer.Calls())
+		_, err := batcher.SendAndWait(ctx)
+		c.Assert(err, IsNil)
+		sizes := make([]int, 0)
+		for _, call := range restorer.Calls()[calls:] {
+			sizes = append(sizes, len(call))
+		}
+		return sizes
+	}
+	c.Assert(restoreAt(1, 0), DeepEquals, []int{1, 1, 1, 1, 1, 1, 1, 1})
+	c.Assert(restoreAt(2, 20), DeepEquals, []int{2, 2, 2, 2})
+	c.Assert(restoreAt(3, 30), DeepEquals, []int{3, 3, 2})
+	// the warm-up is over.
+	c.Assert(restoreAt(4, 40), DeepEquals, []int{8})
+	batcher.Close()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(batcher.Config().Sender.RampUp, NotNil)
+}
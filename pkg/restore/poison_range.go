@@ -0,0 +1,204 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/logutil"
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+// PoisonRangeDetector tracks the failures of each range,
+// ranges failed too many times are considered 'poison' and would be quarantined,
+// so they won't stall the restoring of other ranges.
+type PoisonRangeDetector struct {
+	threshold int
+
+	mu          sync.Mutex
+	failures    map[string]int
+	quarantined []rtree.Range
+}
+
+// NewPoisonRangeDetector creates a detector which quarantines ranges failed `threshold` times.
+// a non-positive threshold quarantines ranges on their first failure.
+func NewPoisonRangeDetector(threshold int) *PoisonRangeDetector {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &PoisonRangeDetector{
+		threshold: threshold,
+		failures:  make(map[string]int),
+	}
+}
+
+// RecordFailure records a failure of the range, and returns whether the range has been quarantined.
+func (d *PoisonRangeDetector) RecordFailure(rng rtree.Range, err error) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := checkpointKey(rng.StartKey, rng.EndKey)
+	d.failures[key]++
+	failures := d.failures[key]
+	if failures < d.threshold {
+		log.Warn("failed to restore range, would retry",
+			logutil.Key("startKey", rng.StartKey),
+			logutil.Key("endKey", rng.EndKey),
+			zap.Int("failures", failures),
+			zap.Error(err))
+		return false
+	}
+	if failures == d.threshold {
+		log.Error("range failed too many times, quarantine it",
+			logutil.Key("startKey", rng.StartKey),
+			logutil.Key("endKey", rng.EndKey),
+			zap.Int("failures", failures),
+			zap.Error(err))
+		d.quarantined = append(d.quarantined, rng)
+	}
+	return true
+}
+
+// Quarantined returns the ranges have been quarantined.
+func (d *PoisonRangeDetector) Quarantined() []rtree.Range {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]rtree.Range{}, d.quarantined...)
+}
+
+// FailedRangesSerializer serializes the failed ranges into the content of the failed-ranges manifest.
+type FailedRangesSerializer interface {
+	SerializeFailedRanges(ranges []rtree.Range) ([]byte, error)
+}
+
+// FailedRangesDeserializer deserializes the content of the failed-ranges manifest,
+// a FailedRangesSerializer should implement it if the manifest written by it can be loaded.
+type FailedRangesDeserializer interface {
+	DeserializeFailedRanges(content []byte) ([]CheckpointRange, error)
+}
+
+// FailedRangesManifestVersion is the version of the schema of the JSON failed-ranges manifest.
+const FailedRangesManifestVersion = 1
+
+// FailedRangesManifestData is the content of the JSON failed-ranges manifest.
+type FailedRangesManifestData struct {
+	Version int `json:"version"`
+	// Ranges are in the same format as the ranges in the checkpoint.
+	Ranges []CheckpointRange `json:"ranges"`
+}
+
+// JSONFailedRangesSerializer serializes the failed ranges as JSON, see FailedRangesManifestData.
+type JSONFailedRangesSerializer struct{}
+
+// SerializeFailedRanges implements FailedRangesSerializer.
+func (JSONFailedRangesSerializer) SerializeFailedRanges(ranges []rtree.Range) ([]byte, error) {
+	manifest := FailedRangesManifestData{
+		Version: FailedRangesManifestVersion,
+		Ranges:  make([]CheckpointRange, 0, len(ranges)),
+	}
+	for _, rng := range ranges {
+		manifest.Ranges = append(manifest.Ranges, CheckpointRange{
+			StartKey: rng.StartKey,
+			EndKey:   rng.EndKey,
+		})
+	}
+	content, err := json.Marshal(manifest)
+	return content, errors.Trace(err)
+}
+
+// DeserializeFailedRanges implements FailedRangesDeserializer.
+func (JSONFailedRangesSerializer) DeserializeFailedRanges(content []byte) ([]CheckpointRange, error) {
+	var manifest FailedRangesManifestData
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, errors.Annotate(berrors.ErrRestoreInvalidManifest, err.Error())
+	}
+	if manifest.Version != FailedRangesManifestVersion {
+		return nil, errors.Annotatef(berrors.ErrRestoreInvalidManifest,
+			"unsupported version %d, expect %d", manifest.Version, FailedRangesManifestVersion)
+	}
+	return manifest.Ranges, nil
+}
+
+// FailedRangesManifest is where the ranges failed to restore would be written to when the restore aborts,
+// so they can be inspected or restored again later.
+type FailedRangesManifest struct {
+	Storage storage.ExternalStorage
+	Name    string
+	// Serializer serializes the ranges, JSONFailedRangesSerializer would be used if it is nil.
+	Serializer FailedRangesSerializer
+}
+
+// Write serializes the ranges and writes them to the manifest, overwriting the former one.
+func (m *FailedRangesManifest) Write(ctx context.Context, ranges []rtree.Range) error {
+	serializer := m.Serializer
+	if serializer == nil {
+		serializer = JSONFailedRangesSerializer{}
+	}
+	content, err := serializer.SerializeFailedRanges(ranges)
+	if err != nil {
+		return errors.Annotate(err, "failed to serialize the failed ranges")
+	}
+	return errors.Trace(m.Storage.WriteFile(ctx, m.Name, content))
+}
+
+// Load reads the failed ranges from the manifest.
+func (m *FailedRangesManifest) Load(ctx context.Context) ([]CheckpointRange, error) {
+	var deserializer FailedRangesDeserializer = JSONFailedRangesSerializer{}
+	if m.Serializer != nil {
+		var ok bool
+		if deserializer, ok = m.Serializer.(FailedRangesDeserializer); !ok {
+			return nil, errors.Annotate(berrors.ErrInvalidArgument, "the serializer of the manifest cannot deserialize")
+		}
+	}
+	content, err := m.Storage.ReadFile(ctx, m.Name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ranges, err := deserializer.DeserializeFailedRanges(content)
+	return ranges, errors.Trace(err)
+}
+
+// LoadTables loads the failed ranges from the manifest, and picks them from the ranges of the tables,
+// so the failed ranges can be added to a new batcher and restored again.
+// the tables should be built from the same backup as the restore which wrote the manifest,
+// tables without any failed range are dropped.
+func (m *FailedRangesManifest) LoadTables(ctx context.Context, tables []TableWithRange) ([]TableWithRange, error) {
+	failed, err := m.Load(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pending := make(map[string]struct{}, len(failed))
+	for _, rng := range failed {
+		pending[checkpointKey(rng.StartKey, rng.EndKey)] = struct{}{}
+	}
+	result := make([]TableWithRange, 0)
+	for _, table := range tables {
+		ranges := make([]rtree.Range, 0)
+		for _, rng := range table.Range {
+			key := checkpointKey(rng.StartKey, rng.EndKey)
+			if _, ok := pending[key]; ok {
+				ranges = append(ranges, rng)
+				delete(pending, key)
+			}
+		}
+		if len(ranges) == 0 {
+			continue
+		}
+		table.Range = ranges
+		result = append(result, table)
+	}
+	if len(pending) > 0 {
+		log.Warn("some failed ranges don't belong to any table, are they from another backup?",
+			zap.Int("ranges", len(pending)))
+	}
+	log.Info("failed ranges loaded from the manifest",
+		zap.String("name", m.Name), zap.Int("ranges", len(failed)-len(pending)), zap.Int("tables", len(result)))
+	return result, nil
+}
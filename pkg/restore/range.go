@@ -130,6 +130,143 @@ func (r *RewriteRules) Append(other RewriteRules) {
 	r.Table = append(r.Table, other.Table...)
 }
 
+// AppendUnique is like Append, but the rules of other identical to some rule already appended are skipped,
+// so appending the rules of the same table repeatedly won't grow the rules. rules with the same old key prefix
+// but different new key prefixes are still appended, see AppendChecked for rejecting them.
+// it takes O(len(r) + len(other)), so don't call it repeatedly on huge rule sets.
+func (r *RewriteRules) AppendUnique(other RewriteRules) {
+	r.Table = appendUniqueRules(r.Table, other.Table)
+	r.Data = appendUniqueRules(r.Data, other.Data)
+}
+
+func appendUniqueRules(rules []*import_sstpb.RewriteRule, others []*import_sstpb.RewriteRule) []*import_sstpb.RewriteRule {
+	if len(others) == 0 {
+		return rules
+	}
+	// index the rules by their old key prefixes.
+	appended := make(map[string][]*import_sstpb.RewriteRule, len(rules)+len(others))
+	for _, rule := range rules {
+		oldPrefix := string(rule.GetOldKeyPrefix())
+		appended[oldPrefix] = append(appended[oldPrefix], rule)
+	}
+	for _, rule := range others {
+		oldPrefix := string(rule.GetOldKeyPrefix())
+		if containsRewriteRule(appended[oldPrefix], rule) {
+			continue
+		}
+		appended[oldPrefix] = append(appended[oldPrefix], rule)
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func containsRewriteRule(rules []*import_sstpb.RewriteRule, rule *import_sstpb.RewriteRule) bool {
+	for _, r := range rules {
+		if bytes.Equal(r.GetNewKeyPrefix(), rule.GetNewKeyPrefix()) && r.GetNewTimestamp() == rule.GetNewTimestamp() {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendChecked is like Append, but fails if some rule of other maps an old key prefix
+// to a new key prefix other than the one this rewrite rules maps it to, rather than letting the later one win silently.
+// nothing would be appended if it fails.
+func (r *RewriteRules) AppendChecked(other RewriteRules) error {
+	index := newRewriteRuleIndex()
+	if err := index.add(*r); err != nil {
+		return errors.Trace(err)
+	}
+	if err := index.add(other); err != nil {
+		return errors.Trace(err)
+	}
+	r.Append(other)
+	return nil
+}
+
+// rewriteRuleIndex indexes the new key prefixes of rewrite rules by their old key prefixes, for detecting conflicts.
+type rewriteRuleIndex struct {
+	table map[string][]byte
+	data  map[string][]byte
+}
+
+func newRewriteRuleIndex() rewriteRuleIndex {
+	return rewriteRuleIndex{
+		table: make(map[string][]byte),
+		data:  make(map[string][]byte),
+	}
+}
+
+// unindexed returns the rules whose old key prefixes aren't indexed yet, without the duplicated ones.
+// once add succeeds, the other rules are the same as some rule indexed, so appending them is a no-op.
+func (idx rewriteRuleIndex) unindexed(rules RewriteRules) RewriteRules {
+	filter := func(index map[string][]byte, rules []*import_sstpb.RewriteRule) []*import_sstpb.RewriteRule {
+		result := make([]*import_sstpb.RewriteRule, 0, len(rules))
+		for _, rule := range rules {
+			if _, ok := index[string(rule.GetOldKeyPrefix())]; !ok {
+				result = append(result, rule)
+			}
+		}
+		return appendUniqueRules(nil, result)
+	}
+	return RewriteRules{
+		Table: filter(idx.table, rules.Table),
+		Data:  filter(idx.data, rules.Data),
+	}
+}
+
+// add indexes the rules, it fails with ErrRestoreRewriteRuleConflict without indexing anything
+// if some old key prefix is mapped to different new key prefixes.
+func (idx rewriteRuleIndex) add(rules RewriteRules) error {
+	if err := checkRewriteRuleConflict(idx.table, rules.Table); err != nil {
+		return errors.Trace(err)
+	}
+	if err := checkRewriteRuleConflict(idx.data, rules.Data); err != nil {
+		return errors.Trace(err)
+	}
+	for _, rule := range rules.Table {
+		idx.table[string(rule.GetOldKeyPrefix())] = rule.GetNewKeyPrefix()
+	}
+	for _, rule := range rules.Data {
+		idx.data[string(rule.GetOldKeyPrefix())] = rule.GetNewKeyPrefix()
+	}
+	return nil
+}
+
+// checkRewriteRuleConflict checks the rules against the indexed ones, and against each other.
+func checkRewriteRuleConflict(index map[string][]byte, rules []*import_sstpb.RewriteRule) error {
+	adding := make(map[string][]byte, len(rules))
+	for _, rule := range rules {
+		oldPrefix := string(rule.GetOldKeyPrefix())
+		newPrefix, ok := index[oldPrefix]
+		if !ok {
+			newPrefix, ok = adding[oldPrefix]
+		}
+		if ok && !bytes.Equal(newPrefix, rule.GetNewKeyPrefix()) {
+			return errors.Annotatef(berrors.ErrRestoreRewriteRuleConflict,
+				"old key prefix %X is rewritten to both %X and %X",
+				rule.GetOldKeyPrefix(), newPrefix, rule.GetNewKeyPrefix())
+		}
+		adding[oldPrefix] = rule.GetNewKeyPrefix()
+	}
+	return nil
+}
+
+// rewriteRuleOverhead is the estimated in-memory size of a rewrite rule besides its key prefixes,
+// (i.e. the pointer to it, the headers of the prefix slices and the timestamp.)
+const rewriteRuleOverhead = 8 + 2*24 + 8
+
+// Size estimates the in-memory size of the rewrite rules, in bytes.
+func (r *RewriteRules) Size() int {
+	size := 0
+	for _, rules := range [][]*import_sstpb.RewriteRule{r.Table, r.Data} {
+		for _, rule := range rules {
+			size += rewriteRuleOverhead + len(rule.GetOldKeyPrefix()) + len(rule.GetNewKeyPrefix())
+		}
+	}
+	return size
+}
+
 // EmptyRewriteRule make a new, empty rewrite rule.
 func EmptyRewriteRule() *RewriteRules {
 	return &RewriteRules{
@@ -6,9 +6,11 @@ import (
 	"bytes"
 
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/tidb/tablecodec"
 
+	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/restore"
 	"github.com/pingcap/br/pkg/rtree"
 )
@@ -84,3 +86,61 @@ func (s *testRangeSuite) TestSortRange(c *C) {
 		{StartKey: []byte("xxe"), EndKey: []byte("xxz"), Files: nil},
 	})
 }
+
+func (s *testRangeSuite) TestAppendConflictingRules(c *C) {
+	rules := restore.EmptyRewriteRule()
+	c.Assert(rules.AppendChecked(restore.RewriteRules{Data: []*import_sstpb.RewriteRule{
+		{OldKeyPrefix: []byte("a"), NewKeyPrefix: []byte("x")},
+	}}), IsNil)
+	// the same mapping again isn't a conflict.
+	c.Assert(rules.AppendChecked(restore.RewriteRules{Data: []*import_sstpb.RewriteRule{
+		{OldKeyPrefix: []byte("a"), NewKeyPrefix: []byte("x")},
+		{OldKeyPrefix: []byte("b"), NewKeyPrefix: []byte("y")},
+	}}), IsNil)
+	// the table rules are checked apart from the data rules.
+	c.Assert(rules.AppendChecked(restore.RewriteRules{Table: []*import_sstpb.RewriteRule{
+		{OldKeyPrefix: []byte("a"), NewKeyPrefix: []byte("z")},
+	}}), IsNil)
+	c.Assert(rules.Data, HasLen, 3)
+
+	err := rules.AppendChecked(restore.RewriteRules{Data: []*import_sstpb.RewriteRule{
+		{OldKeyPrefix: []byte("c"), NewKeyPrefix: []byte("w")},
+		{OldKeyPrefix: []byte("a"), NewKeyPrefix: []byte("y")},
+	}})
+	c.Assert(errors.Cause(err), Equals, berrors.ErrRestoreRewriteRuleConflict)
+	c.Assert(err, ErrorMatches, ".*old key prefix 61 is rewritten to both 78 and 79.*")
+	// nothing is appended if it fails.
+	c.Assert(rules.Data, HasLen, 3)
+
+	// the appended rules may conflict with each other too.
+	err = restore.EmptyRewriteRule().AppendChecked(restore.RewriteRules{Table: []*import_sstpb.RewriteRule{
+		{OldKeyPrefix: []byte("a"), NewKeyPrefix: []byte("x")},
+		{OldKeyPrefix: []byte("a"), NewKeyPrefix: []byte("y")},
+	}})
+	c.Assert(errors.Cause(err), Equals, berrors.ErrRestoreRewriteRuleConflict)
+}
+
+func (s *testRangeSuite) TestAppendUniqueRules(c *C) {
+	rules := restore.EmptyRewriteRule()
+	table := restore.RewriteRules{
+		Table: []*import_sstpb.RewriteRule{{OldKeyPrefix: []byte("a"), NewKeyPrefix: []byte("x")}},
+		Data: []*import_sstpb.RewriteRule{
+			{OldKeyPrefix: []byte("a"), NewKeyPrefix: []byte("x")},
+			{OldKeyPrefix: []byte("a"), NewKeyPrefix: []byte("x")},
+		},
+	}
+	for i := 0; i < 3; i++ {
+		rules.AppendUnique(table)
+	}
+	c.Assert(rules.Table, HasLen, 1)
+	c.Assert(rules.Data, HasLen, 1)
+
+	// only the identical rules are deduplicated.
+	rules.AppendUnique(restore.RewriteRules{Data: []*import_sstpb.RewriteRule{
+		{OldKeyPrefix: []byte("a"), NewKeyPrefix: []byte("y")},
+		{OldKeyPrefix: []byte("a"), NewKeyPrefix: []byte("x"), NewTimestamp: 42},
+		{OldKeyPrefix: []byte("b"), NewKeyPrefix: []byte("x")},
+	}})
+	c.Assert(rules.Table, HasLen, 1)
+	c.Assert(rules.Data, HasLen, 4)
+}
@@ -0,0 +1,186 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"sort"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/rtree"
+)
+
+// RangeFilter decides which ranges of a table should be restored.
+type RangeFilter interface {
+	// KeepRange returns false if the range of the table should be skipped.
+	KeepRange(table CreatedTable, rng rtree.Range) bool
+}
+
+// DefaultRangeFilterName is the name of the range filters which don't name themselves.
+const DefaultRangeFilterName = "range"
+
+// NamedRangeFilter is a RangeFilter with a name(e.g. "prefix", "cf"),
+// the ranges skipped by the filters are counted by their names.
+type NamedRangeFilter interface {
+	RangeFilter
+	FilterName() string
+}
+
+func rangeFilterName(filter RangeFilter) string {
+	if named, ok := filter.(NamedRangeFilter); ok {
+		return named.FilterName()
+	}
+	return DefaultRangeFilterName
+}
+
+// RestoreCount is the count of ranges, files and bytes.
+type RestoreCount struct {
+	Ranges int    `json:"ranges"`
+	Files  int    `json:"files"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+func countOfRanges(ranges []rtree.Range) RestoreCount {
+	count := RestoreCount{Ranges: len(ranges)}
+	for _, rng := range ranges {
+		count.Files += len(rng.Files)
+		count.Bytes += rangeSize(rng)
+	}
+	return count
+}
+
+func (c *RestoreCount) add(other RestoreCount) {
+	c.Ranges += other.Ranges
+	c.Files += other.Files
+	c.Bytes += other.Bytes
+}
+
+func (c *RestoreCount) sub(other RestoreCount) {
+	c.Ranges -= other.Ranges
+	c.Files -= other.Files
+	c.Bytes -= other.Bytes
+}
+
+// countOfTables is the count of each table by the ID in the backup.
+type countOfTables map[int64]*RestoreCount
+
+func (c countOfTables) of(table CreatedTable) *RestoreCount {
+	count, ok := c[table.OldTable.Info.ID]
+	if !ok {
+		count = new(RestoreCount)
+		c[table.OldTable.Info.ID] = count
+	}
+	return count
+}
+
+// TableReconciliation compares what a table has in the backup with what has been sent to restore.
+type TableReconciliation struct {
+	DB    string `json:"db"`
+	Table string `json:"table"`
+	// TableID is the ID of the table in the backup.
+	TableID int64 `json:"table-id"`
+	// Backup is what the table has in the backup, the files and bytes are from the backup manifest,
+	// or from the ranges added to the batcher if the manifest doesn't record the files of the table.
+	Backup RestoreCount `json:"backup"`
+	// Sent is what has been sent to the sender.
+	Sent RestoreCount `json:"sent"`
+	// Filtered is what has been skipped by the range filter.
+	Filtered RestoreCount `json:"filtered"`
+	// Checkpointed is what has been skipped because it was restored according to the checkpoint.
+	Checkpointed RestoreCount `json:"checkpointed"`
+}
+
+// HasDiscrepancy returns whether the table isn't fully restored, i.e. something in the backup
+// has been neither sent nor restored before according to the checkpoint(e.g. filtered, or rejected by the sender).
+func (r TableReconciliation) HasDiscrepancy() bool {
+	restored := r.Sent
+	restored.add(r.Checkpointed)
+	return restored != r.Backup
+}
+
+// tableAccount is the accounting of a table added to the batcher.
+type tableAccount struct {
+	TableReconciliation
+	// fromManifest is whether the backup files and bytes are from the backup manifest.
+	fromManifest bool
+	// newTableID is the ID of the table created for restoring.
+	newTableID int64
+}
+
+func newTableAccount(table CreatedTable) *tableAccount {
+	account := &tableAccount{
+		TableReconciliation: TableReconciliation{
+			DB:      table.OldTable.DB.Name.O,
+			Table:   table.OldTable.Info.Name.O,
+			TableID: table.OldTable.Info.ID,
+		},
+		newTableID: table.Table.ID,
+	}
+	if files := table.OldTable.Files; len(files) > 0 {
+		account.fromManifest = true
+		account.Backup.Files = len(files)
+		account.Backup.Bytes = TotalFileSize(files)
+	}
+	return account
+}
+
+// added records the ranges of the table added to the batcher.
+func (a *tableAccount) added(ranges []rtree.Range) {
+	count := countOfRanges(ranges)
+	a.Backup.Ranges += count.Ranges
+	if !a.fromManifest {
+		a.Backup.Files += count.Files
+		a.Backup.Bytes += count.Bytes
+	}
+}
+
+// TableProgress is the progress of restoring a table, in ranges.
+type TableProgress struct {
+	// Restored is the count of ranges sent to the sender, or restored before according to the checkpoint.
+	Restored int `json:"restored"`
+	// Total is the count of ranges to restore, i.e. the ranges added excluding the ones skipped by the range filters.
+	Total int `json:"total"`
+}
+
+// progress returns the progress of the table.
+func (a *tableAccount) progress() TableProgress {
+	return TableProgress{
+		Restored: a.Sent.Ranges + a.Checkpointed.Ranges,
+		Total:    a.Backup.Ranges - a.Filtered.Ranges,
+	}
+}
+
+// reconcile builds the reconciliation report of the accounts, sorted by the table ID.
+func reconcile(accounts map[int64]*tableAccount) []TableReconciliation {
+	report := make([]TableReconciliation, 0, len(accounts))
+	for _, account := range accounts {
+		report = append(report, account.TableReconciliation)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].TableID < report[j].TableID })
+	return report
+}
+
+// logReconciliation logs the tables with discrepancy in the report.
+func logReconciliation(report []TableReconciliation) {
+	discrepancies := 0
+	for _, r := range report {
+		if !r.HasDiscrepancy() {
+			continue
+		}
+		discrepancies++
+		log.Warn("the table isn't fully restored",
+			zap.String("db", r.DB),
+			zap.String("table", r.Table),
+			zap.Int64("table id", r.TableID),
+			zap.Any("backup", r.Backup),
+			zap.Any("sent", r.Sent),
+			zap.Any("filtered", r.Filtered),
+			zap.Any("checkpointed", r.Checkpointed),
+		)
+	}
+	log.Info("reconciliation of backup and restored",
+		zap.Int("tables", len(report)),
+		zap.Int("discrepancies", discrepancies),
+	)
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/conn"
+)
+
+// BalanceRegionsMaxRounds is the max rounds of re-scattering the new regions for the minimum regions per store.
+const BalanceRegionsMaxRounds = 3
+
+// StoreLister is a SplitClient which can list the stores, it is needed for the minimum regions per store.
+type StoreLister interface {
+	// GetAllStores returns the TiKV stores which are up.
+	GetAllStores(ctx context.Context) ([]*metapb.Store, error)
+}
+
+// GetAllStores implements StoreLister.
+func (c *pdClient) GetAllStores(ctx context.Context) ([]*metapb.Store, error) {
+	stores, err := conn.GetAllTiKVStores(ctx, c.client, conn.SkipTiFlash)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	upStores := make([]*metapb.Store, 0, len(stores))
+	for _, store := range stores {
+		if store.GetState() == metapb.StoreState_Up {
+			upStores = append(upStores, store)
+		}
+	}
+	return upStores, nil
+}
+
+// balanceRegions re-scatters the new regions until each store holds at least minPerStore of them.
+// it is best effort: PD decides where the regions go, and the minimum cannot be met if there are too few regions,
+// so it gives up after BalanceRegionsMaxRounds rounds, or if the client cannot list the stores.
+func (rs *RegionSplitter) balanceRegions(ctx context.Context, regions []*RegionInfo, minPerStore int) {
+	if minPerStore <= 0 || len(regions) == 0 {
+		return
+	}
+	lister, ok := rs.client.(StoreLister)
+	if !ok {
+		log.Warn("the split client cannot list stores, skip balancing regions")
+		return
+	}
+	stores, err := lister.GetAllStores(ctx)
+	if err != nil {
+		log.Warn("failed to list stores, skip balancing regions", zap.Error(err))
+		return
+	}
+	for round := 0; round < BalanceRegionsMaxRounds; round++ {
+		counts := make(map[uint64]int, len(stores))
+		for _, store := range stores {
+			counts[store.GetId()] = 0
+		}
+		current := make([]*RegionInfo, 0, len(regions))
+		for _, region := range regions {
+			info, err := rs.client.GetRegionByID(ctx, region.Region.GetId())
+			if err != nil || info == nil {
+				// the region may have been merged or split again, it doesn't matter.
+				continue
+			}
+			current = append(current, info)
+			for _, peer := range info.Region.GetPeers() {
+				counts[peer.GetStoreId()]++
+			}
+		}
+		deficit := 0
+		for _, count := range counts {
+			if count < minPerStore {
+				deficit += minPerStore - count
+			}
+		}
+		if deficit == 0 {
+			log.Info("the minimum regions per store is met",
+				zap.Int("min-regions-per-store", minPerStore), zap.Int("round", round))
+			return
+		}
+
+		// scatter the regions only on the stores with surplus regions again,
+		// so PD would move them to the stores with few regions.
+		rescattered := make([]*RegionInfo, 0, deficit)
+		for _, region := range current {
+			if len(rescattered) >= deficit {
+				break
+			}
+			if !allPeersAbove(region, counts, minPerStore) {
+				continue
+			}
+			if err := rs.client.ScatterRegion(ctx, region); err != nil {
+				log.Warn("scatter region failed", zap.Uint64("region", region.Region.GetId()), zap.Error(err))
+				continue
+			}
+			// the region is leaving its stores only if it is scattered.
+			for _, peer := range region.Region.GetPeers() {
+				counts[peer.GetStoreId()]--
+			}
+			rescattered = append(rescattered, region)
+		}
+		if len(rescattered) == 0 {
+			break
+		}
+		for _, region := range rescattered {
+			rs.waitForScatterRegion(ctx, region)
+		}
+		log.Info("re-scattered regions for the minimum regions per store",
+			zap.Int("regions", len(rescattered)), zap.Int("deficit", deficit), zap.Int("round", round))
+	}
+	log.Warn("cannot meet the minimum regions per store",
+		zap.Int("min-regions-per-store", minPerStore),
+		zap.Int("regions", len(regions)), zap.Int("stores", len(stores)))
+}
+
+// allPeersAbove checks whether all peers of the region are on the stores holding more than `count` regions.
+func allPeersAbove(region *RegionInfo, counts map[uint64]int, count int) bool {
+	for _, peer := range region.Region.GetPeers() {
+		if counts[peer.GetStoreId()] <= count {
+			return false
+		}
+	}
+	return true
+}
@@ -6,6 +6,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"sort"
 	"strings"
 	"time"
 
@@ -45,19 +46,66 @@ const (
 	RejectStoreMaxCheckInterval = 2 * time.Second
 )
 
+// SplitOptions tunes how the region splitter splits and scatters the regions.
+type SplitOptions struct {
+	// BatchSize is the max count of split keys submitted per split request, zero means unlimited.
+	BatchSize int
+	// ScatterWaitTimeout is how long to wait for the regions to be scattered,
+	// the regions not scattered by then are left as they are. zero means ScatterWaitUpperInterval.
+	ScatterWaitTimeout time.Duration
+	// ScatterRetry is how many times the regions failed to scatter are retried,
+	// the regions still failed after retrying are left unscattered. zero means no retry.
+	ScatterRetry int
+	// MinRegionsPerStore makes the regions created by splitting be re-scattered,
+	// until each store holds at least MinRegionsPerStore of them where possible. zero means no minimum.
+	MinRegionsPerStore int
+}
+
+func (o SplitOptions) scatterWaitTimeout() time.Duration {
+	if o.ScatterWaitTimeout <= 0 {
+		return ScatterWaitUpperInterval
+	}
+	return o.ScatterWaitTimeout
+}
+
+// SplitResult classifies the outcome of splitting regions.
+type SplitResult struct {
+	// Created is the count of regions newly created.
+	Created int `json:"created"`
+	// Existing is the count of split keys need no split, e.g. they are region boundaries already.
+	Existing int `json:"existing"`
+	// Failed is the count of split keys failed to split.
+	Failed int `json:"failed"`
+}
+
+func (r *SplitResult) add(other SplitResult) {
+	r.Created += other.Created
+	r.Existing += other.Existing
+	r.Failed += other.Failed
+}
+
 // RegionSplitter is a executor of region split by rules.
 type RegionSplitter struct {
 	client SplitClient
+	opts   SplitOptions
 }
 
 // NewRegionSplitter returns a new RegionSplitter.
 func NewRegionSplitter(client SplitClient) *RegionSplitter {
+	return NewRegionSplitterWithOptions(client, SplitOptions{})
+}
+
+// NewRegionSplitterWithOptions returns a new RegionSplitter which splits and scatters as the options.
+func NewRegionSplitterWithOptions(client SplitClient, opts SplitOptions) *RegionSplitter {
 	return &RegionSplitter{
 		client: client,
+		opts:   opts,
 	}
 }
 
-// OnSplitFunc is called before split a range.
+// OnSplitFunc is called once some keys are split, with the keys.
+// a region may be split by several requests(see SplitOptions.BatchSize), then it is called once per request,
+// so the progress can advance before all regions are split and scattered.
 type OnSplitFunc func(key [][]byte)
 
 // Split executes a region split. It will split regions by the rewrite rules,
@@ -71,9 +119,21 @@ func (rs *RegionSplitter) Split(
 	rewriteRules *RewriteRules,
 	onSplit OnSplitFunc,
 ) error {
+	_, err := rs.SplitWithResult(ctx, ranges, rewriteRules, onSplit)
+	return err
+}
+
+// SplitWithResult is like Split, but also classifies the outcome of splitting.
+func (rs *RegionSplitter) SplitWithResult(
+	ctx context.Context,
+	ranges []rtree.Range,
+	rewriteRules *RewriteRules,
+	onSplit OnSplitFunc,
+) (SplitResult, error) {
+	result := SplitResult{}
 	if len(ranges) == 0 {
 		log.Info("skip split regions, no range")
-		return nil
+		return result, nil
 	}
 
 	if span := opentracing.SpanFromContext(ctx); span != nil && span.Tracer() != nil {
@@ -86,8 +146,9 @@ func (rs *RegionSplitter) Split(
 	// Sort the range for getting the min and max key of the ranges
 	sortedRanges, errSplit := SortRanges(ranges, rewriteRules)
 	if errSplit != nil {
-		return errors.Trace(errSplit)
+		return result, errors.Trace(errSplit)
 	}
+	checkKeys := len(rewriteRules.Table) + len(rewriteRules.Data) + len(sortedRanges)
 	minKey := codec.EncodeBytes(sortedRanges[0].StartKey)
 	maxKey := codec.EncodeBytes(sortedRanges[len(sortedRanges)-1].EndKey)
 	for _, rule := range rewriteRules.Table {
@@ -112,13 +173,20 @@ SplitRegions:
 	for i := 0; i < SplitRetryTimes; i++ {
 		regions, errScan := PaginateScanRegion(ctx, rs.client, minKey, maxKey, ScanRegionPaginationLimit)
 		if errScan != nil {
-			return errors.Trace(errScan)
+			return result, errors.Trace(errScan)
 		}
 		if len(regions) == 0 {
 			log.Warn("split regions cannot scan any region")
-			return nil
+			return result, nil
 		}
 		splitKeyMap := getSplitKeys(rewriteRules, sortedRanges, regions)
+		if i == 0 {
+			// regions split in the previous attempts would be boundaries, only count at the first attempt.
+			result.Existing = checkKeys
+			for _, keys := range splitKeyMap {
+				result.Existing -= len(keys)
+			}
+		}
 		regionMap := make(map[uint64]*RegionInfo)
 		for _, region := range regions {
 			regionMap[region.Region.GetId()] = region
@@ -128,7 +196,7 @@ SplitRegions:
 			region := regionMap[regionID]
 			log.Info("split regions",
 				logutil.Region(region.Region), logutil.Keys(keys), rtree.ZapRanges(ranges))
-			newRegions, errSplit = rs.splitAndScatterRegions(ctx, region, keys)
+			newRegions, errSplit = rs.splitAndScatterRegions(ctx, region, keys, onSplit)
 			if errSplit != nil {
 				if strings.Contains(errSplit.Error(), "no valid key") {
 					for _, key := range keys {
@@ -140,8 +208,10 @@ SplitRegions:
 							logutil.Key("key", codec.EncodeBytes(key)),
 							rtree.ZapRanges(ranges))
 					}
-					return errors.Trace(errSplit)
+					result.Failed = len(keys)
+					return result, errors.Trace(errSplit)
 				}
+				result.Failed = len(keys)
 				interval = 2 * interval
 				if interval > SplitMaxRetryInterval {
 					interval = SplitMaxRetryInterval
@@ -159,34 +229,71 @@ SplitRegions:
 					zap.Int("new region count", len(newRegions)),
 					zap.Int("split key count", len(keys)))
 			}
+			result.Created += len(newRegions)
 			scatterRegions = append(scatterRegions, newRegions...)
-			onSplit(keys)
 		}
+		result.Failed = 0
 		break
 	}
 	if errSplit != nil {
-		return errors.Trace(errSplit)
+		return result, errors.Trace(errSplit)
 	}
 	log.Info("start to wait for scattering regions",
 		zap.Int("regions", len(scatterRegions)), zap.Duration("take", time.Since(startTime)))
-	startTime = time.Now()
-	scatterCount := 0
-	for _, region := range scatterRegions {
-		rs.waitForScatterRegion(ctx, region)
-		if time.Since(startTime) > ScatterWaitUpperInterval {
-			break
-		}
-		scatterCount++
+	rs.waitForScatterRegions(ctx, scatterRegions)
+	rs.balanceRegions(ctx, scatterRegions, rs.opts.MinRegionsPerStore)
+	return result, nil
+}
+
+// SplitKeys splits regions by the keys directly, without computing split keys from ranges.
+// It is useful when the split keys are precomputed(e.g. from the backup metadata).
+// note: the keys must be raw keys after rewriting.
+func (rs *RegionSplitter) SplitKeys(ctx context.Context, keys [][]byte, onSplit OnSplitFunc) error {
+	if len(keys) == 0 {
+		log.Info("skip split regions, no key")
+		return nil
 	}
-	if scatterCount == len(scatterRegions) {
-		log.Info("waiting for scattering regions done",
-			zap.Int("regions", len(scatterRegions)), zap.Duration("take", time.Since(startTime)))
-	} else {
-		log.Warn("waiting for scattering regions timeout",
-			zap.Int("scatterCount", scatterCount),
-			zap.Int("regions", len(scatterRegions)),
-			zap.Duration("take", time.Since(startTime)))
+	sortedKeys := make([][]byte, len(keys))
+	copy(sortedKeys, keys)
+	sort.Slice(sortedKeys, func(i, j int) bool {
+		return bytes.Compare(sortedKeys[i], sortedKeys[j]) < 0
+	})
+
+	startTime := time.Now()
+	// group the keys by the region they split, so each region would be split in one request.
+	regionKeys := make(map[uint64][][]byte)
+	regionMap := make(map[uint64]*RegionInfo)
+	for _, key := range sortedKeys {
+		region, err := rs.client.GetRegion(ctx, codec.EncodeBytes(key))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if region == nil {
+			return errors.Annotatef(berrors.ErrPDInvalidResponse, "region of split key %s not found", hex.EncodeToString(key))
+		}
+		if bytes.Equal(region.Region.GetStartKey(), codec.EncodeBytes(key)) {
+			// the region has been split by the key.
+			continue
+		}
+		regionID := region.Region.GetId()
+		regionMap[regionID] = region
+		regionKeys[regionID] = append(regionKeys[regionID], key)
+	}
+	scatterRegions := make([]*RegionInfo, 0, len(sortedKeys))
+	for regionID, keys := range regionKeys {
+		region := regionMap[regionID]
+		log.Info("split regions by precomputed keys", logutil.Region(region.Region), logutil.Keys(keys))
+		newRegions, err := rs.splitAndScatterRegions(ctx, region, keys, onSplit)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		scatterRegions = append(scatterRegions, newRegions...)
 	}
+	rs.waitForScatterRegions(ctx, scatterRegions)
+	rs.balanceRegions(ctx, scatterRegions, rs.opts.MinRegionsPerStore)
+	log.Info("split regions by precomputed keys done",
+		zap.Int("keys", len(keys)), zap.Int("regions", len(scatterRegions)),
+		zap.Duration("take", time.Since(startTime)))
 	return nil
 }
 
@@ -243,10 +350,42 @@ type retryTimeKey struct{}
 
 var retryTimes = new(retryTimeKey)
 
+// waitForScatterRegions waits for the regions to be scattered, at most the scatter wait timeout(see SplitOptions.ScatterWaitTimeout).
+// PD may never finish scattering(e.g. the operators are stuck), then the regions are left as they are,
+// and the ingest proceeds anyway.
+func (rs *RegionSplitter) waitForScatterRegions(ctx context.Context, regions []*RegionInfo) {
+	startTime := time.Now()
+	timeout := rs.opts.scatterWaitTimeout()
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	scatterCount := 0
+	for _, region := range regions {
+		rs.waitForScatterRegion(waitCtx, region)
+		if waitCtx.Err() != nil {
+			break
+		}
+		scatterCount++
+	}
+	if scatterCount == len(regions) {
+		log.Info("waiting for scattering regions done",
+			zap.Int("regions", len(regions)), zap.Duration("take", time.Since(startTime)))
+	} else {
+		log.Warn("waiting for scattering regions timeout, ingest without waiting, the regions may be hotspots",
+			zap.Int("scatterCount", scatterCount),
+			zap.Int("regions", len(regions)),
+			zap.Duration("timeout", timeout),
+			zap.Duration("take", time.Since(startTime)))
+	}
+}
+
+// waitForScatterRegion waits for the region to be scattered, it returns once the context is done.
 func (rs *RegionSplitter) waitForScatterRegion(ctx context.Context, regionInfo *RegionInfo) {
 	interval := ScatterWaitInterval
 	regionID := regionInfo.Region.GetId()
 	for i := 0; i < ScatterWaitMaxRetryTimes; i++ {
+		if ctx.Err() != nil {
+			return
+		}
 		ctx1 := context.WithValue(ctx, retryTimes, i)
 		ok, err := rs.isScatterRegionFinished(ctx1, regionID)
 		if err != nil {
@@ -261,22 +400,104 @@ func (rs *RegionSplitter) waitForScatterRegion(ctx context.Context, regionInfo *
 		if interval > ScatterMaxWaitInterval {
 			interval = ScatterMaxWaitInterval
 		}
-		time.Sleep(interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
 	}
 }
 
 func (rs *RegionSplitter) splitAndScatterRegions(
-	ctx context.Context, regionInfo *RegionInfo, keys [][]byte,
+	ctx context.Context, regionInfo *RegionInfo, keys [][]byte, onSplit OnSplitFunc,
 ) ([]*RegionInfo, error) {
-	newRegions, err := rs.client.BatchSplitRegions(ctx, regionInfo, keys)
+	newRegions, err := rs.splitRegionInBatches(ctx, regionInfo, keys, rs.opts.BatchSize, onSplit)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 	for _, region := range newRegions {
 		// Wait for a while until the regions successfully split.
 		rs.waitForSplit(ctx, region.Region.Id)
-		if err = rs.client.ScatterRegion(ctx, region); err != nil {
-			log.Warn("scatter region failed", logutil.Region(region.Region), zap.Error(err))
+	}
+	rs.scatterRegions(ctx, newRegions)
+	return newRegions, nil
+}
+
+// scatterRegions scatters the regions, the regions failed to scatter are retried at most SplitOptions.ScatterRetry times.
+// failing to scatter isn't fatal, the regions still failed are left as they are.
+func (rs *RegionSplitter) scatterRegions(ctx context.Context, regions []*RegionInfo) {
+	retry := rs.opts.ScatterRetry
+	interval := ScatterWaitInterval
+	for i := 0; ; i++ {
+		failed := make([]*RegionInfo, 0)
+		for _, region := range regions {
+			if err := rs.client.ScatterRegion(ctx, region); err != nil {
+				log.Warn("scatter region failed", logutil.Region(region.Region), zap.Int("attempt", i+1), zap.Error(err))
+				failed = append(failed, region)
+			}
+		}
+		regions = failed
+		if len(regions) == 0 {
+			return
+		}
+		if i >= retry {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		interval = 2 * interval
+		if interval > ScatterMaxWaitInterval {
+			interval = ScatterMaxWaitInterval
+		}
+	}
+	log.Warn("some regions are left unscattered, the regions may be hotspots",
+		zap.Int("regions", len(regions)), zap.Int("retry", retry))
+}
+
+// splitRegionInBatches splits the region by the sorted keys, submitting at most batchSize keys per request.
+// onSplit is called with the keys of each request done.
+func (rs *RegionSplitter) splitRegionInBatches(
+	ctx context.Context, regionInfo *RegionInfo, keys [][]byte, batchSize int, onSplit OnSplitFunc,
+) ([]*RegionInfo, error) {
+	if batchSize <= 0 || len(keys) <= batchSize {
+		newRegions, err := rs.client.BatchSplitRegions(ctx, regionInfo, keys)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		onSplit(keys)
+		return newRegions, nil
+	}
+	newRegions := make([]*RegionInfo, 0, len(keys))
+	region := regionInfo
+	for start := 0; start < len(keys); start += batchSize {
+		end := start + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		origin, regions, err := rs.client.BatchSplitRegionsWithOrigin(ctx, region, keys[start:end])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		newRegions = append(newRegions, regions...)
+		onSplit(keys[start:end])
+		if end == len(keys) {
+			break
+		}
+		// the rest keys should be split in the region(with the new epoch) containing them.
+		nextKey := codec.EncodeBytes(keys[end])
+		region = origin
+		for _, r := range regions {
+			if r.ContainsInterior(nextKey) {
+				region = r
+				break
+			}
+		}
+		if region == nil {
+			return nil, errors.Annotatef(berrors.ErrRestoreSplitFailed,
+				"cannot find the region containing key %s after split", hex.EncodeToString(nextKey))
 		}
 	}
 	return newRegions, nil
@@ -5,6 +5,7 @@ package restore_test
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"sync"
 
 	. "github.com/pingcap/check"
@@ -224,6 +225,218 @@ func (s *testRangeSuite) TestSplit(c *C) {
 	}
 }
 
+// batchRecordingClient records the count of keys of each split request.
+type batchRecordingClient struct {
+	*TestClient
+	batches []int
+}
+
+func (c *batchRecordingClient) BatchSplitRegionsWithOrigin(
+	ctx context.Context, regionInfo *restore.RegionInfo, keys [][]byte,
+) (*restore.RegionInfo, []*restore.RegionInfo, error) {
+	c.batches = append(c.batches, len(keys))
+	return c.TestClient.BatchSplitRegionsWithOrigin(ctx, regionInfo, keys)
+}
+
+func (c *batchRecordingClient) BatchSplitRegions(
+	ctx context.Context, regionInfo *restore.RegionInfo, keys [][]byte,
+) ([]*restore.RegionInfo, error) {
+	_, newRegions, err := c.BatchSplitRegionsWithOrigin(ctx, regionInfo, keys)
+	return newRegions, err
+}
+
+func (s *testRangeSuite) TestSplitInBatches(c *C) {
+	client := &batchRecordingClient{TestClient: initTestClient()}
+	regionSplitter := restore.NewRegionSplitterWithOptions(client, restore.SplitOptions{BatchSize: 2})
+	keys := [][]byte{[]byte("bbb"), []byte("bbc"), []byte("bbd"), []byte("bbe"), []byte("bbf")}
+
+	err := regionSplitter.SplitKeys(context.Background(), keys, func(key [][]byte) {})
+	c.Assert(err, IsNil)
+	c.Assert(client.batches, DeepEquals, []int{2, 2, 1})
+	c.Assert(client.GetAllRegions(), HasLen, 10)
+}
+
+// scatterRecordingClient records the scatter requests into the events.
+type scatterRecordingClient struct {
+	*TestClient
+	events *[]string
+}
+
+func (c scatterRecordingClient) ScatterRegion(ctx context.Context, regionInfo *restore.RegionInfo) error {
+	*c.events = append(*c.events, "scatter")
+	return nil
+}
+
+func (s *testRangeSuite) TestSplitProgress(c *C) {
+	events := make([]string, 0)
+	client := scatterRecordingClient{TestClient: initTestClient(), events: &events}
+	regionSplitter := restore.NewRegionSplitterWithOptions(client, restore.SplitOptions{BatchSize: 2})
+	keys := [][]byte{[]byte("bbb"), []byte("bbc"), []byte("bbd"), []byte("bbe"), []byte("bbf")}
+
+	err := regionSplitter.SplitKeys(context.Background(), keys, func(keys [][]byte) {
+		events = append(events, fmt.Sprintf("split %d", len(keys)))
+	})
+	c.Assert(err, IsNil)
+	// the progress advances by each split request, before the new regions are scattered.
+	c.Assert(events, DeepEquals, []string{
+		"split 2", "split 2", "split 1",
+		"scatter", "scatter", "scatter", "scatter", "scatter",
+	})
+}
+
+// stuckScatterClient never finishes scattering, as if the scatter operators are stuck in PD.
+type stuckScatterClient struct {
+	*TestClient
+}
+
+func (c stuckScatterClient) GetOperator(ctx context.Context, regionID uint64) (*pdpb.GetOperatorResponse, error) {
+	return &pdpb.GetOperatorResponse{
+		Header: new(pdpb.ResponseHeader),
+		Desc:   []byte("scatter-region"),
+		Status: pdpb.OperatorStatus_RUNNING,
+	}, nil
+}
+
+// lazyScatterClient ignores the first scatter request of each region(as if PD doesn't know the new region yet),
+// and moves the region to the store with the fewest regions on the following ones.
+type lazyScatterClient struct {
+	*TestClient
+	scattered map[uint64]bool
+}
+
+func (c *lazyScatterClient) GetAllStores(ctx context.Context) ([]*metapb.Store, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	stores := make([]*metapb.Store, 0, len(c.stores))
+	for _, store := range c.stores {
+		stores = append(stores, store)
+	}
+	return stores, nil
+}
+
+func (c *lazyScatterClient) ScatterRegion(ctx context.Context, regionInfo *restore.RegionInfo) error {
+	regionID := regionInfo.Region.GetId()
+	if !c.scattered[regionID] {
+		c.scattered[regionID] = true
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := c.regionsPerStore()
+	target := uint64(0)
+	for storeID := range c.stores {
+		if target == 0 || counts[storeID] < counts[target] ||
+			(counts[storeID] == counts[target] && storeID < target) {
+			target = storeID
+		}
+	}
+	region := c.regions[regionID]
+	region.Region.Peers = []*metapb.Peer{{Id: regionID, StoreId: target}}
+	return nil
+}
+
+func (c *lazyScatterClient) regionsPerStore() map[uint64]int {
+	counts := make(map[uint64]int)
+	for _, region := range c.regions {
+		for _, peer := range region.Region.GetPeers() {
+			counts[peer.GetStoreId()]++
+		}
+	}
+	return counts
+}
+
+func (s *testRangeSuite) TestMinRegionsPerStore(c *C) {
+	testClient := initTestClient()
+	for storeID := uint64(2); storeID <= 3; storeID++ {
+		testClient.stores[storeID] = &metapb.Store{Id: storeID}
+	}
+	client := &lazyScatterClient{TestClient: testClient, scattered: make(map[uint64]bool)}
+	regionSplitter := restore.NewRegionSplitterWithOptions(client, restore.SplitOptions{MinRegionsPerStore: 2})
+
+	err := regionSplitter.Split(context.Background(), initRanges(), initRewriteRules(), func(key [][]byte) {})
+	c.Assert(err, IsNil)
+	c.Assert(validateRegions(client.GetAllRegions()), IsTrue)
+	counts := client.regionsPerStore()
+	for storeID := uint64(1); storeID <= 3; storeID++ {
+		c.Assert(counts[storeID] >= 2, IsTrue, Commentf("store %d has %d regions", storeID, counts[storeID]))
+	}
+}
+
+// stuckRescatterClient is like lazyScatterClient, but the region re-scattered first always fails to be re-scattered.
+type stuckRescatterClient struct {
+	*lazyScatterClient
+	stuck uint64
+}
+
+func (c *stuckRescatterClient) ScatterRegion(ctx context.Context, regionInfo *restore.RegionInfo) error {
+	regionID := regionInfo.Region.GetId()
+	if c.scattered[regionID] && (c.stuck == 0 || c.stuck == regionID) {
+		c.stuck = regionID
+		return errors.New("scatter region failed")
+	}
+	return c.lazyScatterClient.ScatterRegion(ctx, regionInfo)
+}
+
+func (s *testRangeSuite) TestMinRegionsPerStoreWithFailedScatter(c *C) {
+	testClient := initTestClient()
+	for storeID := uint64(2); storeID <= 3; storeID++ {
+		testClient.stores[storeID] = &metapb.Store{Id: storeID}
+	}
+	client := &stuckRescatterClient{
+		lazyScatterClient: &lazyScatterClient{TestClient: testClient, scattered: make(map[uint64]bool)},
+	}
+	regionSplitter := restore.NewRegionSplitterWithOptions(client, restore.SplitOptions{MinRegionsPerStore: 2})
+
+	err := regionSplitter.Split(context.Background(), initRanges(), initRewriteRules(), func(key [][]byte) {})
+	c.Assert(err, IsNil)
+	c.Assert(client.stuck, Not(Equals), uint64(0))
+	// the region failed to scatter still counts for its store, so the others are moved instead.
+	counts := client.regionsPerStore()
+	for storeID := uint64(1); storeID <= 3; storeID++ {
+		c.Assert(counts[storeID] >= 2, IsTrue, Commentf("store %d has %d regions", storeID, counts[storeID]))
+	}
+}
+
+// flakyScatterClient fails the first scatter request of the regions with even IDs, and records the scatter requests.
+type flakyScatterClient struct {
+	*TestClient
+	attempts map[uint64]int
+}
+
+func (c *flakyScatterClient) ScatterRegion(ctx context.Context, regionInfo *restore.RegionInfo) error {
+	regionID := regionInfo.Region.GetId()
+	c.attempts[regionID]++
+	if regionID%2 == 0 && c.attempts[regionID] == 1 {
+		return errors.New("scatter region failed")
+	}
+	return nil
+}
+
+func (s *testRangeSuite) TestScatterRetry(c *C) {
+	// without retry, the regions failed to scatter are left as they are.
+	client := &flakyScatterClient{TestClient: initTestClient(), attempts: make(map[uint64]int)}
+	err := restore.NewRegionSplitter(client).Split(context.Background(), initRanges(), initRewriteRules(), func(key [][]byte) {})
+	c.Assert(err, IsNil)
+	c.Assert(client.attempts, Not(HasLen), 0)
+	for regionID, attempts := range client.attempts {
+		c.Assert(attempts, Equals, 1, Commentf("region %d", regionID))
+	}
+
+	// with retry, only the regions failed to scatter are retried.
+	client = &flakyScatterClient{TestClient: initTestClient(), attempts: make(map[uint64]int)}
+	regionSplitter := restore.NewRegionSplitterWithOptions(client, restore.SplitOptions{ScatterRetry: 3})
+	err = regionSplitter.Split(context.Background(), initRanges(), initRewriteRules(), func(key [][]byte) {})
+	c.Assert(err, IsNil)
+	c.Assert(validateRegions(client.GetAllRegions()), IsTrue)
+	for regionID, attempts := range client.attempts {
+		if regionID%2 == 0 {
+			c.Assert(attempts, Equals, 2, Commentf("region %d", regionID))
+		} else {
+			c.Assert(attempts, Equals, 1, Commentf("region %d", regionID))
+		}
+	}
+}
+
 // region: [, aay), [aay, bba), [bba, bbh), [bbh, cca), [cca, )
 func initTestClient() *TestClient {
 	peers := make([]*metapb.Peer, 1)
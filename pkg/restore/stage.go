@@ -0,0 +1,106 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// Stage wraps a batcher as a stage of a pipeline, so restoring can be embedded into larger data flows:
+// it consumes the tables from the input channel, and produces the tables restored to the output channel.
+type Stage struct {
+	ctx     context.Context
+	batcher *Batcher
+	input   <-chan TableWithRange
+	output  <-chan CreatedTable
+	errCh   chan<- error
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	// stop notifies the stage to stop consuming the input.
+	stop chan struct{}
+	// done is closed once the batcher of the stage is closed.
+	done chan struct{}
+}
+
+// NewStage creates a stage restoring the tables from the input by the sender.
+// the batcher of the stage can be configured by Batcher before Start.
+func NewStage(
+	ctx context.Context,
+	input <-chan TableWithRange,
+	sender BatchSender,
+	manager ContextManager,
+	errCh chan<- error,
+) *Stage {
+	batcher, output := NewBatcher(ctx, sender, manager, errCh)
+	return &Stage{
+		ctx:     ctx,
+		batcher: batcher,
+		input:   input,
+		output:  output,
+		errCh:   errCh,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Batcher returns the batcher of the stage.
+func (s *Stage) Batcher() *Batcher {
+	return s.batcher
+}
+
+// Output returns the channel of the tables restored, it is closed once the stage stops.
+// it must be drained, or the stage would be blocked.
+func (s *Stage) Output() <-chan CreatedTable {
+	return s.output
+}
+
+// Done returns a channel which is closed once the stage stops.
+func (s *Stage) Done() <-chan struct{} {
+	return s.done
+}
+
+// Start starts consuming the input in background, calling it more than once is a no-op.
+// the stage stops once the input is closed, the context is done, or Stop is called,
+// then the tables consumed are restored, and the output is closed.
+func (s *Stage) Start() {
+	s.startOnce.Do(func() {
+		go s.run()
+	})
+}
+
+// Stop stops consuming the input, and waits for the tables consumed being restored.
+// the tables left in the input wouldn't be restored. calling it more than once is OK.
+func (s *Stage) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	// make sure the batcher is closed even if the stage isn't started.
+	s.Start()
+	<-s.done
+}
+
+func (s *Stage) run() {
+	defer close(s.done)
+	defer s.batcher.Close()
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.errCh <- s.ctx.Err()
+			return
+		case <-s.stop:
+			log.Info("stage stopped, the tables left in the input won't be restored")
+			return
+		case t, ok := <-s.input:
+			if !ok {
+				return
+			}
+			log.Debug("stage consumed table", zap.Stringer("table", t.Table.Name))
+			s.batcher.Add(t)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"context"
+
+	. "github.com/pingcap/check"
+
+	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/rtree"
+)
+
+type testStageSuite struct{}
+
+var _ = Suite(&testStageSuite{})
+
+func collectTableIDs(output <-chan restore.CreatedTable) []int64 {
+	ids := make([]int64, 0)
+	for t := range output {
+		ids = append(ids, t.Table.ID)
+	}
+	return ids
+}
+
+func (*testStageSuite) TestStage(c *C) {
+	input := make(chan restore.TableWithRange, 3)
+	input <- fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab"), fakeRange("aac", "aad")})
+	input <- fakeTableWithRange(2, []rtree.Range{fakeRange("baa", "bab")})
+	input <- fakeTableWithRange(3, []rtree.Range{fakeRange("caa", "cab"), fakeRange("cac", "cad")})
+	close(input)
+
+	errCh := make(chan error, 8)
+	sender := restore.NewMockSender()
+	stage := restore.NewStage(context.Background(), input, sender, newMockManager(), errCh)
+	stage.Batcher().SetThreshold(2)
+	stage.Start()
+
+	c.Assert(collectTableIDs(stage.Output()), DeepEquals, []int64{1, 2, 3})
+	<-stage.Done()
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	ranges := make([]rtree.Range, 0)
+	for _, batch := range sender.Batches() {
+		ranges = append(ranges, batch.Ranges...)
+	}
+	c.Assert(ranges, DeepEquals, []rtree.Range{
+		fakeRange("aaa", "aab"), fakeRange("aac", "aad"),
+		fakeRange("baa", "bab"),
+		fakeRange("caa", "cab"), fakeRange("cac", "cad"),
+	})
+	// stopping a stopped stage is OK.
+	stage.Stop()
+}
+
+func (*testStageSuite) TestStopStage(c *C) {
+	input := make(chan restore.TableWithRange)
+	errCh := make(chan error, 8)
+	sender := restore.NewMockSender()
+	stage := restore.NewStage(context.Background(), input, sender, newMockManager(), errCh)
+	stage.Batcher().SetThreshold(100)
+	stage.Start()
+
+	input <- fakeTableWithRange(1, []rtree.Range{fakeRange("aaa", "aab")})
+	stage.Stop()
+	// the table consumed is restored, even the batch isn't full.
+	c.Assert(collectTableIDs(stage.Output()), DeepEquals, []int64{1})
+	c.Assert(restore.Exhaust(errCh), HasLen, 0)
+	c.Assert(sender.Batches(), HasLen, 1)
+
+	// stopping a stage not started closes the batcher.
+	stage = restore.NewStage(context.Background(), input, restore.NewMockSender(), newMockManager(), errCh)
+	stage.Stop()
+	c.Assert(collectTableIDs(stage.Output()), HasLen, 0)
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/logutil"
+)
+
+// UnknownStoreID is the store ID which the bytes of files failed to locate are accounted to.
+const UnknownStoreID uint64 = 0
+
+// FileStoreLocator locates the store which a file would be ingested into.
+type FileStoreLocator interface {
+	LocateFileStore(ctx context.Context, file *backup.File, rewriteRules *RewriteRules) (uint64, error)
+}
+
+// StoreIngestCounter counts the bytes ingested into each store,
+// which reveals the skew between stores during restoring.
+type StoreIngestCounter struct {
+	locator FileStoreLocator
+
+	mu    sync.Mutex
+	bytes map[uint64]uint64
+}
+
+// NewStoreIngestCounter creates a counter which locates the files by the locator.
+func NewStoreIngestCounter(locator FileStoreLocator) *StoreIngestCounter {
+	return &StoreIngestCounter{
+		locator: locator,
+		bytes:   make(map[uint64]uint64),
+	}
+}
+
+// Record accounts the size of the files ingested to the stores they are ingested into.
+// files failed to locate would be accounted to UnknownStoreID.
+func (c *StoreIngestCounter) Record(ctx context.Context, files []*backup.File, rewriteRules *RewriteRules) {
+	stores := make([]uint64, 0, len(files))
+	for _, file := range files {
+		storeID, err := c.locator.LocateFileStore(ctx, file, rewriteRules)
+		if err != nil {
+			log.Warn("failed to locate the store of file", logutil.File(file), zap.Error(err))
+			storeID = UnknownStoreID
+		}
+		stores = append(stores, storeID)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, file := range files {
+		c.bytes[stores[i]] += file.GetSize_()
+	}
+}
+
+// IngestedBytes returns a snapshot of the bytes ingested into each store, keyed by store ID.
+func (c *StoreIngestCounter) IngestedBytes() map[uint64]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make(map[uint64]uint64, len(c.bytes))
+	for store, bytes := range c.bytes {
+		result[store] = bytes
+	}
+	return result
+}
+
+// FileStoresLocator locates all the stores which a file would be written to,
+// i.e. the stores of all peers of the regions the file overlaps.
+type FileStoresLocator interface {
+	LocateFileStores(ctx context.Context, file *backup.File, rewriteRules *RewriteRules) ([]uint64, error)
+}
+
+// WrittenStoreTracker tracks the stores which received data during restoring,
+// for auditing and verifying after the restore.
+type WrittenStoreTracker struct {
+	locator FileStoresLocator
+
+	mu     sync.Mutex
+	stores map[uint64]struct{}
+}
+
+// NewWrittenStoreTracker creates a tracker which locates the files by the locator.
+func NewWrittenStoreTracker(locator FileStoresLocator) *WrittenStoreTracker {
+	return &WrittenStoreTracker{
+		locator: locator,
+		stores:  make(map[uint64]struct{}),
+	}
+}
+
+// Record adds the stores which the ingested files are written to.
+// files failed to locate would be accounted to UnknownStoreID.
+func (t *WrittenStoreTracker) Record(ctx context.Context, files []*backup.File, rewriteRules *RewriteRules) {
+	stores := make([]uint64, 0, len(files))
+	for _, file := range files {
+		fileStores, err := t.locator.LocateFileStores(ctx, file, rewriteRules)
+		if err != nil {
+			log.Warn("failed to locate the stores of file", logutil.File(file), zap.Error(err))
+			fileStores = []uint64{UnknownStoreID}
+		}
+		stores = append(stores, fileStores...)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, store := range stores {
+		t.stores[store] = struct{}{}
+	}
+}
+
+// Stores returns the IDs of the stores written to, in ascending order.
+func (t *WrittenStoreTracker) Stores() []uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := make([]uint64, 0, len(t.stores))
+	for store := range t.stores {
+		result = append(result, store)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
@@ -170,6 +170,15 @@ func EstimateRangeSize(files []*kvproto.File) int {
 	return result
 }
 
+// TotalFileSize returns the total size of the files.
+func TotalFileSize(files []*kvproto.File) uint64 {
+	total := uint64(0)
+	for _, file := range files {
+		total += file.GetSize_()
+	}
+	return total
+}
+
 // MapTableToFiles makes a map that mapping table ID to its backup files.
 // aware that one file can and only can hold one table.
 func MapTableToFiles(files []*kvproto.File) map[int64][]*kvproto.File {
@@ -194,6 +203,99 @@ func MapTableToFiles(files []*kvproto.File) map[int64][]*kvproto.File {
 	return result
 }
 
+// GroupFilesByRegion groups the files by the region which their start key(after rewriting) lands in.
+// The groups are ordered by their first file, and files in each group keep their original order.
+// Note a file may still cross many regions, it is grouped by the region its start key lands in.
+func GroupFilesByRegion(
+	ctx context.Context,
+	client SplitClient,
+	files []*kvproto.File,
+	rewriteRules *RewriteRules,
+) ([][]*kvproto.File, error) {
+	groups := make([][]*kvproto.File, 0)
+	groupOfRegion := make(map[uint64]int)
+	for _, file := range files {
+		startKey, _, err := rewriteFileKeys(file, rewriteRules)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		region, err := client.GetRegion(ctx, startKey)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if region == nil {
+			return nil, errors.Annotatef(berrors.ErrPDInvalidResponse,
+				"region of file %s not found", file.GetName())
+		}
+		regionID := region.Region.GetId()
+		idx, ok := groupOfRegion[regionID]
+		if !ok {
+			idx = len(groups)
+			groupOfRegion[regionID] = idx
+			groups = append(groups, nil)
+		}
+		groups[idx] = append(groups[idx], file)
+	}
+	return groups, nil
+}
+
+// LocateFileStore returns the store which the file would be ingested into,
+// that is, the store of the leader of the region which its start key(after rewriting) lands in.
+func LocateFileStore(
+	ctx context.Context,
+	client SplitClient,
+	file *kvproto.File,
+	rewriteRules *RewriteRules,
+) (uint64, error) {
+	startKey, _, err := rewriteFileKeys(file, rewriteRules)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	region, err := client.GetRegion(ctx, startKey)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if region == nil {
+		return 0, errors.Annotatef(berrors.ErrPDInvalidResponse,
+			"region of file %s not found", file.GetName())
+	}
+	leader := region.Leader
+	if leader == nil {
+		if len(region.Region.GetPeers()) == 0 {
+			return 0, errors.Annotatef(berrors.ErrRestoreNoPeer, "region %d", region.Region.GetId())
+		}
+		leader = region.Region.GetPeers()[0]
+	}
+	return leader.GetStoreId(), nil
+}
+
+// LocateFileStores returns the stores of all peers of the regions which the file would be ingested into.
+func LocateFileStores(
+	ctx context.Context,
+	client SplitClient,
+	file *kvproto.File,
+	rewriteRules *RewriteRules,
+) ([]uint64, error) {
+	startKey, endKey, err := rewriteFileKeys(file, rewriteRules)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	regions, err := PaginateScanRegion(ctx, client, startKey, endKey, ScanRegionPaginationLimit)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	stores := make([]uint64, 0, len(regions))
+	for _, region := range regions {
+		if len(region.Region.GetPeers()) == 0 {
+			return nil, errors.Annotatef(berrors.ErrRestoreNoPeer, "region %d", region.Region.GetId())
+		}
+		for _, peer := range region.Region.GetPeers() {
+			stores = append(stores, peer.GetStoreId())
+		}
+	}
+	return stores, nil
+}
+
 // GoValidateFileRanges validate files by a stream of tables and yields
 // tables with range.
 func GoValidateFileRanges(
@@ -380,14 +482,27 @@ func SplitRanges(
 	rewriteRules *RewriteRules,
 	updateCh glue.Progress,
 ) error {
+	_, err := SplitRangesWithResult(ctx, client, ranges, rewriteRules, SplitOptions{}, updateCh)
+	return err
+}
+
+// SplitRangesWithResult is like SplitRanges, but splits as the options and classifies the outcome of splitting.
+func SplitRangesWithResult(
+	ctx context.Context,
+	client *Client,
+	ranges []rtree.Range,
+	rewriteRules *RewriteRules,
+	opts SplitOptions,
+	updateCh glue.Progress,
+) (SplitResult, error) {
 	start := time.Now()
 	defer func() {
 		elapsed := time.Since(start)
 		summary.CollectDuration("split region", elapsed)
 	}()
-	splitter := NewRegionSplitter(NewSplitClient(client.GetPDClient(), client.GetTLSConfig()))
+	splitter := NewRegionSplitterWithOptions(NewSplitClient(client.GetPDClient(), client.GetTLSConfig()), opts)
 
-	return splitter.Split(ctx, ranges, rewriteRules, func(keys [][]byte) {
+	return splitter.SplitWithResult(ctx, ranges, rewriteRules, func(keys [][]byte) {
 		for range keys {
 			updateCh.Inc()
 		}
@@ -268,3 +268,44 @@ func (s *testRestoreUtilSuite) TestPaginateScanRegion(c *C) {
 	_, err = restore.PaginateScanRegion(ctx, NewTestClient(stores, regionMap, 0), []byte{2}, []byte{1}, 3)
 	c.Assert(err, ErrorMatches, ".*startKey >= endKey.*")
 }
+
+func fakeFile(name, startKey, endKey string) *backup.File {
+	return &backup.File{
+		Name:     name,
+		StartKey: []byte(startKey),
+		EndKey:   []byte(endKey),
+		// the empty files are skipped by the tikv sender.
+		TotalKvs: 1,
+	}
+}
+
+func fileNames(groups [][]*backup.File) [][]string {
+	names := make([][]string, 0, len(groups))
+	for _, group := range groups {
+		groupNames := make([]string, 0, len(group))
+		for _, f := range group {
+			groupNames = append(groupNames, f.GetName())
+		}
+		names = append(names, groupNames)
+	}
+	return names
+}
+
+func (s *testRestoreUtilSuite) TestGroupFilesByRegion(c *C) {
+	// regions: [, aay), [aay, bba), [bba, bbh), [bbh, cca), [cca, )
+	client := initTestClient()
+	files := []*backup.File{
+		fakeFile("1.sst", "aaa", "aab"),
+		fakeFile("2.sst", "bbb", "bbc"),
+		fakeFile("3.sst", "aab", "aac"),
+		fakeFile("4.sst", "ccc", "ccd"),
+		fakeFile("5.sst", "bbd", "bbe"),
+	}
+	groups, err := restore.GroupFilesByRegion(context.Background(), client, files, nil)
+	c.Assert(err, IsNil)
+	c.Assert(fileNames(groups), DeepEquals, [][]string{
+		{"1.sst", "3.sst"},
+		{"2.sst", "5.sst"},
+		{"4.sst"},
+	})
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/logutil"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+// FileValidator validates the files before ingesting them.
+type FileValidator interface {
+	// ValidateFiles returns error if any of the files is corrupted.
+	ValidateFiles(ctx context.Context, files []*backup.File) error
+}
+
+type storageFileValidator struct {
+	storage storage.ExternalStorage
+}
+
+// NewStorageFileValidator makes a validator that reads the files from the external storage,
+// and compares their checksum with the checksum recorded in the backup meta.
+// Files without checksum(e.g. backed up by old version of BR) would be skipped.
+func NewStorageFileValidator(s storage.ExternalStorage) FileValidator {
+	return storageFileValidator{storage: s}
+}
+
+func (v storageFileValidator) ValidateFiles(ctx context.Context, files []*backup.File) error {
+	for _, file := range files {
+		if len(file.GetSha256()) == 0 {
+			log.Debug("skip validating file without checksum", logutil.File(file))
+			continue
+		}
+		content, err := v.storage.ReadFile(ctx, file.GetName())
+		if err != nil {
+			return errors.Trace(err)
+		}
+		checksum := sha256.Sum256(content)
+		if !bytes.Equal(checksum[:], file.GetSha256()) {
+			log.Error("file corrupted", logutil.File(file),
+				zap.String("actual sha256", hex.EncodeToString(checksum[:])))
+			return errors.Annotatef(berrors.ErrRestoreFileCorrupted,
+				"the sha256 of file %s is %s, but %s is expected",
+				file.GetName(), hex.EncodeToString(checksum[:]), hex.EncodeToString(file.GetSha256()))
+		}
+	}
+	return nil
+}
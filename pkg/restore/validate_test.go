@@ -0,0 +1,57 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"context"
+	"crypto/sha256"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/backup"
+
+	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+type testValidateSuite struct{}
+
+var _ = Suite(&testValidateSuite{})
+
+func (*testValidateSuite) TestCorruptedFileFailsBeforeIngest(c *C) {
+	ctx := context.Background()
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+
+	content := []byte("some sst content")
+	checksum := sha256.Sum256(content)
+	c.Assert(s.WriteFile(ctx, "good.sst", content), IsNil)
+	c.Assert(s.WriteFile(ctx, "corrupted.sst", []byte("some sst c0ntent")), IsNil)
+	rng := rtree.Range{
+		StartKey: []byte("aaa"),
+		EndKey:   []byte("aab"),
+		Files: []*backup.File{
+			{Name: "good.sst", Sha256: checksum[:]},
+			{Name: "corrupted.sst", Sha256: checksum[:]},
+		},
+	}
+
+	validator := restore.NewStorageFileValidator(s)
+	c.Assert(validator.ValidateFiles(ctx, rng.Files[:1]), IsNil)
+
+	restorer := &fakeRestorer{}
+	sender, err := restore.NewTiKVSender(ctx, restorer, nopProgress{}, restore.TiKVSenderOptions{Validator: validator})
+	c.Assert(err, IsNil)
+	errCh := make(chan error, 8)
+	batcher, outCh := restore.NewBatcher(ctx, sender, crashTolerantManager{newMockManager()}, errCh)
+	batcher.Add(fakeTableWithRange(1, []rtree.Range{rng}))
+	batcher.Close()
+
+	errs := restore.Exhaust(errCh)
+	c.Assert(errs, HasLen, 1)
+	c.Assert(errs[0], ErrorMatches, ".*the sha256 of file corrupted.sst.*restore file corrupted.*")
+	// nothing should be ingested, even the good file in the same batch.
+	c.Assert(restorer.Restored(), HasLen, 0)
+	_, ok := <-outCh
+	c.Assert(ok, IsFalse)
+}
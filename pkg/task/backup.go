@@ -181,7 +181,7 @@ func (cfg *BackupConfig) adjustBackupConfig() {
 }
 
 // RunBackup starts a backup task inside the current goroutine.
-func RunBackup(c context.Context, g glue.Glue, cmdName string, cfg *BackupConfig) error {
+func RunBackup(c context.Context, g glue.Glue, cmdName string, cfg *BackupConfig) (err error) {
 	cfg.adjustBackupConfig()
 
 	defer summary.Summary(cmdName)
@@ -234,7 +234,12 @@ func RunBackup(c context.Context, g glue.Glue, cmdName string, cfg *BackupConfig
 
 	log.Info("current backup safePoint job",
 		zap.Object("safePoint", sp))
-	utils.StartServiceSafePointKeeper(ctx, mgr.GetPDClient(), sp)
+	utils.CheckClockSkew(ctx, mgr.GetPDClient(), utils.DefaultMaxClockSkew)
+	keeperErr := utils.StartServiceSafePointKeeper(ctx, mgr.GetPDClient(), sp)
+	keeper := cancelOnKeeperFailure(keeperErr, cancel)
+	defer func() {
+		err = keeper.wrap(err)
+	}()
 
 	isIncrementalBackup := cfg.LastBackupTS > 0
 
@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	gcs "cloud.google.com/go/storage"
@@ -434,6 +435,44 @@ func ReadBackupMeta(
 	return u, s, backupMeta, nil
 }
 
+// keeperFailure is the failure reported by the service safe point keeper, see cancelOnKeeperFailure.
+type keeperFailure struct {
+	mu  sync.Mutex
+	err error
+}
+
+// wrap returns the keeper failure in place of the error of the task,
+// which is usually a bare "context canceled" caused by the failure.
+// the task fails even if it completed, since the data it depends on may have been GCed.
+func (f *keeperFailure) wrap(err error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		return err
+	}
+	if err == nil {
+		return errors.Annotate(f.err, "service safe point keeper failed")
+	}
+	return errors.Annotatef(f.err, "service safe point keeper failed, the task stopped with: %v", err)
+}
+
+// cancelOnKeeperFailure cancels the task once the service safe point keeper
+// reports a failure, since the data the task depends on may have been GCed.
+// the failure is kept, the task should return keeperFailure.wrap(err) for the real cause.
+func cancelOnKeeperFailure(keeperErr <-chan error, cancel context.CancelFunc) *keeperFailure {
+	failure := new(keeperFailure)
+	go func() {
+		if err, ok := <-keeperErr; ok {
+			log.Error("service safe point keeper failed, canceling the task", zap.Error(err))
+			failure.mu.Lock()
+			failure.err = err
+			failure.mu.Unlock()
+			cancel()
+		}
+	}()
+	return failure
+}
+
 // flagToZapField checks whether this flag can be logged,
 // if need to log, return its zap field. Or return a field with hidden value.
 func flagToZapField(f *pflag.Flag) zap.Field {
@@ -3,11 +3,13 @@
 package task
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/pingcap/tidb/config"
 
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
 	"github.com/spf13/pflag"
 )
 
@@ -63,3 +65,16 @@ func (s *testCommonSuite) TestStripingPDURL(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(noChange, Equals, "127.0.0.1:2379")
 }
+
+func (s *testCommonSuite) TestKeeperFailureReturned(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	keeperErr := make(chan error, 1)
+	keeper := cancelOnKeeperFailure(keeperErr, cancel)
+	c.Assert(keeper.wrap(nil), IsNil)
+
+	keeperErr <- errors.New("failed to update the service safe point")
+	<-ctx.Done()
+	err := keeper.wrap(errors.Trace(ctx.Err()))
+	c.Assert(err, ErrorMatches, ".*failed to update the service safe point.*")
+	c.Assert(keeper.wrap(nil), NotNil)
+}
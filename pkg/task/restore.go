@@ -4,6 +4,10 @@ package task
 
 import (
 	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/opentracing/opentracing-go"
@@ -11,6 +15,7 @@ import (
 	"github.com/pingcap/failpoint"
 	"github.com/pingcap/kvproto/pkg/backup"
 	"github.com/pingcap/log"
+	"github.com/pingcap/parser/model"
 	"github.com/pingcap/tidb/config"
 	"github.com/spf13/pflag"
 	"go.uber.org/multierr"
@@ -30,6 +35,17 @@ const (
 	flagOnline   = "online"
 	flagNoSchema = "no-schema"
 
+	flagValidateFiles      = "validate-files"
+	flagGroupFilesByRegion = "group-files-by-region"
+	flagReadThrottleQPS    = "read-throttle-qps"
+	flagSplitBatchSize     = "split-batch-size"
+	flagSplitConcurrency   = "split-concurrency"
+	flagMinRegionsPerStore = "min-regions-per-store"
+	flagBatchBytes         = "batch-bytes"
+	flagTrackWrittenStores = "track-written-stores"
+	flagDBRename           = "db-rename"
+	flagCompletionReport   = "completion-report"
+
 	// FlagMergeRegionSizeBytes is the flag name of merge small regions by size
 	FlagMergeRegionSizeBytes = "merge-region-size-bytes"
 	// FlagMergeRegionKeyCount is the flag name of merge small regions by key count
@@ -38,6 +54,8 @@ const (
 	defaultRestoreConcurrency = 128
 	maxRestoreBatchSizeLimit  = 10240
 	defaultDDLConcurrency     = 16
+	// throttledIngestConcurrency is the ingest concurrency of online restore when the foreground read load is high.
+	throttledIngestConcurrency = 4
 )
 
 // RestoreCommonConfig is the common configuration for all BR restore tasks.
@@ -98,7 +116,28 @@ type RestoreConfig struct {
 	Config
 	RestoreCommonConfig
 
-	NoSchema bool `json:"no-schema" toml:"no-schema"`
+	NoSchema           bool `json:"no-schema" toml:"no-schema"`
+	ValidateFiles      bool `json:"validate-files" toml:"validate-files"`
+	GroupFilesByRegion bool `json:"group-files-by-region" toml:"group-files-by-region"`
+	// ReadThrottleQPS is the foreground read QPS from which online restore would throttle ingesting,
+	// zero means never throttle.
+	ReadThrottleQPS float64 `json:"read-throttle-qps" toml:"read-throttle-qps"`
+	// SplitBatchSize is the max count of split keys per split request, zero means unlimited.
+	SplitBatchSize int `json:"split-batch-size" toml:"split-batch-size"`
+	// SplitConcurrency is the max count of batches being split concurrently, zero means one.
+	SplitConcurrency uint `json:"split-concurrency" toml:"split-concurrency"`
+	// MinRegionsPerStore is the min count of regions each store should get from splitting, zero means no minimum.
+	MinRegionsPerStore int `json:"min-regions-per-store" toml:"min-regions-per-store"`
+	// BatchBytes makes the batches measured by the total size of files instead of the count of ranges,
+	// zero means measuring by the count of ranges.
+	BatchBytes uint64 `json:"batch-bytes" toml:"batch-bytes"`
+	// TrackWrittenStores makes the restore track the stores which received data, and report them in the summary.
+	TrackWrittenStores bool `json:"track-written-stores" toml:"track-written-stores"`
+	// DBRename maps the lower-cased names of databases in the backup to the names of the databases restoring into.
+	DBRename map[string]string `json:"db-rename" toml:"db-rename"`
+	// CompletionReport is the path of the local file each table verified by checksum is reported to,
+	// as a line of JSON, empty means no report.
+	CompletionReport string `json:"completion-report" toml:"completion-report"`
 }
 
 // DefineRestoreFlags defines common flags for the restore tidb command.
@@ -106,6 +145,38 @@ func DefineRestoreFlags(flags *pflag.FlagSet) {
 	flags.Bool(flagNoSchema, false, "skip creating schemas and tables, reuse existing empty ones")
 	// Do not expose this flag
 	_ = flags.MarkHidden(flagNoSchema)
+	flags.Bool(flagValidateFiles, false,
+		"(experimental) validate the checksum of the backup files before ingesting them, this requires downloading the files to BR")
+	flags.Bool(flagGroupFilesByRegion, false,
+		"(experimental) ingest the files of a batch group by group, each group contains files landing in the same region")
+	_ = flags.MarkHidden(flagGroupFilesByRegion)
+	flags.Float64(flagReadThrottleQPS, 0,
+		"(experimental) when restoring online, ingest with low priority and limited concurrency "+
+			"if the foreground read QPS(keys per second of hot regions) is higher than this, zero means never throttle")
+	flags.Int(flagSplitBatchSize, 0,
+		"the max count of split keys submitted per split request, zero means unlimited")
+	_ = flags.MarkHidden(flagSplitBatchSize)
+	flags.Uint(flagSplitConcurrency, 1,
+		"the max count of batches(hence regions) being split concurrently during the whole restore")
+	_ = flags.MarkHidden(flagSplitConcurrency)
+	flags.Int(flagMinRegionsPerStore, 0,
+		"re-scatter the regions created by splitting until each store gets at least this many of them where possible, "+
+			"zero means no minimum")
+	_ = flags.MarkHidden(flagMinRegionsPerStore)
+	flags.Uint64(flagBatchBytes, 0,
+		"restore in batches of about this many bytes of files instead of a fixed count of ranges, "+
+			"zero means batching by the count of ranges")
+	_ = flags.MarkHidden(flagBatchBytes)
+	flags.Bool(flagTrackWrittenStores, false,
+		"track the stores which received data and report them in the summary, "+
+			"this requires locating the regions of each file ingested")
+	_ = flags.MarkHidden(flagTrackWrittenStores)
+	flags.StringSlice(flagDBRename, nil,
+		"restore the databases into renamed ones, each in the form of old-name:new-name")
+	flags.String(flagCompletionReport, "",
+		"the local file each table is reported to once its checksum is verified, as a line of JSON, "+
+			"nothing is reported if checksum is disabled")
+	_ = flags.MarkHidden(flagCompletionReport)
 
 	DefineRestoreCommonFlags(flags)
 }
@@ -117,6 +188,50 @@ func (cfg *RestoreConfig) ParseFromFlags(flags *pflag.FlagSet) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	cfg.ValidateFiles, err = flags.GetBool(flagValidateFiles)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.GroupFilesByRegion, err = flags.GetBool(flagGroupFilesByRegion)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.ReadThrottleQPS, err = flags.GetFloat64(flagReadThrottleQPS)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.SplitBatchSize, err = flags.GetInt(flagSplitBatchSize)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.SplitConcurrency, err = flags.GetUint(flagSplitConcurrency)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.MinRegionsPerStore, err = flags.GetInt(flagMinRegionsPerStore)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.BatchBytes, err = flags.GetUint64(flagBatchBytes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.TrackWrittenStores, err = flags.GetBool(flagTrackWrittenStores)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	renames, err := flags.GetStringSlice(flagDBRename)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.DBRename, err = parseDBRename(renames)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.CompletionReport, err = flags.GetString(flagCompletionReport)
+	if err != nil {
+		return errors.Trace(err)
+	}
 	err = cfg.Config.ParseFromFlags(flags)
 	if err != nil {
 		return errors.Trace(err)
@@ -132,6 +247,86 @@ func (cfg *RestoreConfig) ParseFromFlags(flags *pflag.FlagSet) error {
 	return nil
 }
 
+// parseDBRename parses the renames of databases in the form of old-name:new-name.
+func parseDBRename(renames []string) (map[string]string, error) {
+	if len(renames) == 0 {
+		return nil, nil
+	}
+	mapping := make(map[string]string, len(renames))
+	for _, rename := range renames {
+		parts := strings.Split(rename, ":")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+				"invalid database rename '%s', it should be old-name:new-name", rename)
+		}
+		old := strings.ToLower(parts[0])
+		if _, ok := mapping[old]; ok {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument, "database %s is renamed more than once", parts[0])
+		}
+		mapping[old] = parts[1]
+	}
+	return mapping, nil
+}
+
+// dbNameMapper returns the mapper of the names of databases by the renames, the databases not renamed keep their names.
+func dbNameMapper(renames map[string]string) func(name model.CIStr) model.CIStr {
+	return func(name model.CIStr) model.CIStr {
+		if target, ok := renames[name.L]; ok {
+			return model.NewCIStr(target)
+		}
+		return name
+	}
+}
+
+// tableCompletionRecord is a line of the completion report, the database is named as in the backup.
+type tableCompletionRecord struct {
+	DB         string `json:"db"`
+	Table      string `json:"table"`
+	Crc64Xor   uint64 `json:"crc64-xor,omitempty"`
+	TotalKvs   uint64 `json:"total-kvs,omitempty"`
+	TotalBytes uint64 `json:"total-bytes,omitempty"`
+}
+
+// completionFile reports the completion of tables to a local file, a line of JSON for each table.
+type completionFile struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func newCompletionFile(path string) (*completionFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to open the completion report %s", path)
+	}
+	return &completionFile{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// ReportCompletion implements restore.CompletionReporter.
+func (r *completionFile) ReportCompletion(completion restore.TableCompletion) {
+	record := tableCompletionRecord{
+		DB:    completion.Table.OldTable.DB.Name.O,
+		Table: completion.Table.Table.Name.O,
+	}
+	if cs := completion.Checksum; cs != nil {
+		record.Crc64Xor = cs.Crc64Xor
+		record.TotalKvs = cs.TotalKvs
+		record.TotalBytes = cs.TotalBytes
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(record); err != nil {
+		log.Warn("failed to report the completion of table",
+			zap.String("db", record.DB), zap.String("table", record.Table), zap.Error(err))
+	}
+}
+
+func (r *completionFile) Close() {
+	if err := r.file.Close(); err != nil {
+		log.Warn("failed to close the completion report", zap.Error(err))
+	}
+}
+
 // adjustRestoreConfig is use for BR(binary) and BR in TiDB.
 // When new config was add and not included in parser.
 // we should set proper value in this function.
@@ -149,7 +344,7 @@ func (cfg *RestoreConfig) adjustRestoreConfig() {
 }
 
 // RunRestore starts a restore task inside the current goroutine.
-func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConfig) error {
+func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConfig) (err error) {
 	cfg.adjustRestoreConfig()
 
 	defer summary.Summary(cmdName)
@@ -191,6 +386,17 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	if cfg.NoSchema {
 		client.EnableSkipCreateSQL()
 	}
+	if len(cfg.DBRename) > 0 {
+		client.SetDBNameMapper(dbNameMapper(cfg.DBRename))
+	}
+	if cfg.CompletionReport != "" {
+		reporter, err := newCompletionFile(cfg.CompletionReport)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer reporter.Close()
+		client.SetCompletionReporter(reporter)
+	}
 	client.SetSwitchModeInterval(cfg.SwitchModeInterval)
 	err = client.LoadRestoreStores(ctx)
 	if err != nil {
@@ -220,6 +426,7 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	if err != nil {
 		return errors.Trace(err)
 	}
+	utils.CheckClockSkew(ctx, mgr.GetPDClient(), utils.DefaultMaxClockSkew)
 
 	sp := utils.BRServiceSafePoint{
 		BackupTS: restoreTS,
@@ -229,7 +436,11 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	// restore checksum will check safe point with its start ts, see details at
 	// https://github.com/pingcap/tidb/blob/180c02127105bed73712050594da6ead4d70a85f/store/tikv/kv.go#L186-L190
 	// so, we should keep the safe point unchangeable. to avoid GC life time is shorter than transaction duration.
-	utils.StartServiceSafePointKeeper(ctx, mgr.GetPDClient(), sp)
+	keeperErr := utils.StartServiceSafePointKeeper(ctx, mgr.GetPDClient(), sp)
+	keeper := cancelOnKeeperFailure(keeperErr, cancel)
+	defer func() {
+		err = keeper.wrap(err)
+	}()
 
 	var newTS uint64
 	if client.IsIncremental() {
@@ -337,14 +548,50 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 		int64(rangeSize+len(files)+len(tables)),
 		!cfg.LogProgress)
 	defer updateCh.Close()
-	sender, err := restore.NewTiKVSender(ctx, client, updateCh)
+	senderOpts := restore.TiKVSenderOptions{
+		SplitBatchSize:     cfg.SplitBatchSize,
+		SplitConcurrency:   cfg.SplitConcurrency,
+		MinRegionsPerStore: cfg.MinRegionsPerStore,
+	}
+	if cfg.TrackWrittenStores {
+		senderOpts.WrittenStores = restore.NewWrittenStoreTracker(client)
+	}
+	if cfg.ValidateFiles {
+		senderOpts.Validator = client
+	}
+	if cfg.GroupFilesByRegion {
+		senderOpts.Grouper = client
+	}
+	if cfg.Online && cfg.ReadThrottleQPS > 0 {
+		senderOpts.ReadThrottle = &restore.ReadThrottle{
+			Sampler: restore.ReadLoadSamplerFunc(func(ctx context.Context) (float64, error) {
+				return client.GetHotReadKeysRate(ctx, cfg.PD)
+			}),
+			HighReadQPS: cfg.ReadThrottleQPS,
+			Concurrency: throttledIngestConcurrency,
+		}
+	}
+	sender, err := restore.NewTiKVSender(ctx, client, updateCh, senderOpts)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	manager := restore.NewBRContextManager(client)
-	batcher, afterRestoreStream := restore.NewBatcher(ctx, sender, manager, errCh)
-	batcher.SetThreshold(batchSize)
-	batcher.EnableAutoCommit(ctx, time.Second)
+	batcher, afterRestoreStream, err := restore.NewBatcherWithOptions(ctx, sender, manager, errCh, restore.BatcherOptions{
+		BytesThreshold: cfg.BatchBytes,
+		TotalBytes:     restore.TotalFileSize(files),
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.BatchBytes > 0 {
+		batcher.SetThreshold(0)
+	} else {
+		batcher.SetThreshold(batchSize)
+	}
+	if err := batcher.EnableAutoCommit(ctx, time.Second); err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("restore pipeline configured", zap.Any("config", batcher.Config()))
 	go restoreTableStream(ctx, rangeStream, batcher, errCh)
 
 	var finish <-chan struct{}
@@ -359,7 +606,7 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 
 	select {
 	case err = <-errCh:
-		err = multierr.Append(err, multierr.Combine(restore.Exhaust(errCh)...))
+		err = multierr.Append(err, restore.ExhaustErr(errCh))
 	case <-finish:
 	}
 
@@ -367,6 +614,9 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if senderOpts.WrittenStores != nil {
+		summary.CollectInt("written stores", len(senderOpts.WrittenStores.Stores()))
+	}
 
 	// Set task summary to success status.
 	summary.SetSuccessStatus(true)
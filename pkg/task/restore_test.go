@@ -3,9 +3,16 @@
 package task
 
 import (
+	"io/ioutil"
+	"path/filepath"
+
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/model"
 
+	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/utils"
 )
 
 type testRestoreSuite struct{}
@@ -21,3 +28,42 @@ func (s *testRestoreSuite) TestRestoreConfigAdjust(c *C) {
 	c.Assert(cfg.MergeSmallRegionKeyCount, Equals, restore.DefaultMergeRegionKeyCount)
 	c.Assert(cfg.MergeSmallRegionSizeBytes, Equals, restore.DefaultMergeRegionSizeBytes)
 }
+
+func (s *testRestoreSuite) TestParseDBRename(c *C) {
+	renames, err := parseDBRename([]string{"Test:test_restored", "db2:db3"})
+	c.Assert(err, IsNil)
+	c.Assert(renames, DeepEquals, map[string]string{"test": "test_restored", "db2": "db3"})
+	mapper := dbNameMapper(renames)
+	c.Assert(mapper(model.NewCIStr("TEST")), Equals, model.NewCIStr("test_restored"))
+	c.Assert(mapper(model.NewCIStr("db1")), Equals, model.NewCIStr("db1"))
+
+	renames, err = parseDBRename(nil)
+	c.Assert(err, IsNil)
+	c.Assert(renames, IsNil)
+	for _, invalid := range [][]string{{"test"}, {"test:"}, {"a:b:c"}, {"test:a", "TEST:b"}} {
+		_, err = parseDBRename(invalid)
+		c.Assert(errors.Cause(err), Equals, berrors.ErrInvalidArgument, Commentf("renames %v", invalid))
+	}
+}
+
+func (s *testRestoreSuite) TestCompletionFile(c *C) {
+	path := filepath.Join(c.MkDir(), "completion.json")
+	reporter, err := newCompletionFile(path)
+	c.Assert(err, IsNil)
+	table := restore.CreatedTable{
+		Table:    &model.TableInfo{Name: model.NewCIStr("t1")},
+		OldTable: &utils.Table{DB: &model.DBInfo{Name: model.NewCIStr("test")}},
+	}
+	reporter.ReportCompletion(restore.TableCompletion{
+		Table:    table,
+		Checksum: &restore.TableChecksum{Crc64Xor: 1, TotalKvs: 2, TotalBytes: 3},
+	})
+	reporter.ReportCompletion(restore.TableCompletion{Table: table})
+	reporter.Close()
+
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals,
+		`{"db":"test","table":"t1","crc64-xor":1,"total-kvs":2,"total-bytes":3}`+"\n"+
+			`{"db":"test","table":"t1"}`+"\n")
+}
@@ -5,6 +5,7 @@ package utils
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"time"
 
 	"github.com/google/uuid"
@@ -19,20 +20,116 @@ import (
 )
 
 const (
-	brServiceSafePointIDFormat      = "br-%s"
+	brServiceSafePointIDFormat = "br-%s"
+	// DefaultBRServiceSafePointID is the ID of the service safe point if the ID isn't specified,
+	// BR processes with the default ID share the same service safe point, see MakeSafePointID.
+	DefaultBRServiceSafePointID     = "br"
 	preUpdateServiceSafePointFactor = 3
 	checkGCSafePointGapTime         = 5 * time.Second
+	// defaultPDRequestTimeout is the default max duration of a PD request about safe point,
+	// see ServiceSafePointKeeperConfig.RequestTimeout.
+	defaultPDRequestTimeout = 3 * time.Second
 	// DefaultBRGCSafePointTTL means PD keep safePoint limit at least 5min.
 	DefaultBRGCSafePointTTL = 5 * 60
+	// DefaultMaxClockSkew is the max skew between the clock of BR and PD before warning.
+	DefaultMaxClockSkew = 5 * time.Second
+	// maxAdaptiveUpdateFactor is the default upper bound of the factor when the adaptive mode is enabled.
+	maxAdaptiveUpdateFactor = 10
+	// defaultUpdateJitter is the jitter of StartServiceSafePointKeeper.
+	defaultUpdateJitter = 0.1
+	// maxUpdateJitter is the upper bound of the jitter, so the gap won't be too short.
+	maxUpdateJitter = 0.5
 )
 
+// ServiceSafePointKeeperConfig is the config of the service safe point keeper.
+type ServiceSafePointKeeperConfig struct {
+	// Adaptive makes the keeper measure the latency of updating the service safe point,
+	// and raise the factor (hence refresh more frequently) once the latency approaches the gap (TTL / factor).
+	Adaptive bool
+	// MinFactor is the initial factor, zero means preUpdateServiceSafePointFactor.
+	MinFactor int
+	// MaxFactor is the upper bound of the factor in the adaptive mode, zero means maxAdaptiveUpdateFactor.
+	MaxFactor int
+	// Clock is the source of the ticks and the latency, SystemClock is used if it is nil.
+	Clock Clock
+	// Jitter makes each gap of updating be shortened randomly by at most Jitter * gap,
+	// so the keepers started at the same time won't refresh at the same time. it is capped at maxUpdateJitter.
+	// the gap is never lengthened, so the service safe point won't expire between the updates.
+	// zero means no jitter.
+	Jitter float64
+	// RequestTimeout is the max duration of each PD request of the keeper, zero means defaultPDRequestTimeout.
+	// it should be shorter than checkGCSafePointGapTime, so a hung request won't delay the next tick.
+	// it is capped at the gap of updating, so a hung update won't delay the next one.
+	RequestTimeout time.Duration
+}
+
+func (cfg ServiceSafePointKeeperConfig) requestTimeout() time.Duration {
+	if cfg.RequestTimeout <= 0 {
+		return defaultPDRequestTimeout
+	}
+	return cfg.RequestTimeout
+}
+
+func (cfg ServiceSafePointKeeperConfig) jitter() float64 {
+	if cfg.Jitter <= 0 {
+		return 0
+	}
+	if cfg.Jitter > maxUpdateJitter {
+		return maxUpdateJitter
+	}
+	return cfg.Jitter
+}
+
+func (cfg ServiceSafePointKeeperConfig) clock() Clock {
+	if cfg.Clock == nil {
+		return SystemClock
+	}
+	return cfg.Clock
+}
+
+func (cfg ServiceSafePointKeeperConfig) minFactor() int {
+	if cfg.MinFactor <= 0 {
+		return preUpdateServiceSafePointFactor
+	}
+	return cfg.MinFactor
+}
+
+func (cfg ServiceSafePointKeeperConfig) maxFactor() int {
+	maxFactor := cfg.MaxFactor
+	if maxFactor <= 0 {
+		maxFactor = maxAdaptiveUpdateFactor
+	}
+	if maxFactor < cfg.minFactor() {
+		return cfg.minFactor()
+	}
+	return maxFactor
+}
+
 // BRServiceSafePoint is metadata of service safe point from a BR 'instance'.
 type BRServiceSafePoint struct {
+	// ID is the ID of the service safe point, DefaultBRServiceSafePointID is used if it is empty.
 	ID       string
 	TTL      int64
 	BackupTS uint64
 }
 
+// withDefaultID returns the service safe point whose ID is DefaultBRServiceSafePointID if the ID is empty.
+func (sp BRServiceSafePoint) withDefaultID() BRServiceSafePoint {
+	if sp.ID == "" {
+		sp.ID = DefaultBRServiceSafePointID
+	}
+	return sp
+}
+
+// validate checks whether the TTL is positive, PD would never keep a service safe point with non-positive TTL.
+func (sp BRServiceSafePoint) validate() error {
+	if sp.TTL <= 0 {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"the TTL of service safe point %s must be positive, but it is %d", sp.ID, sp.TTL)
+	}
+	return nil
+}
+
 // MarshalLogObject implements zapcore.ObjectMarshaler.
 func (sp BRServiceSafePoint) MarshalLogObject(encoder zapcore.ObjectEncoder) error {
 	encoder.AddString("ID", sp.ID)
@@ -44,9 +141,26 @@ func (sp BRServiceSafePoint) MarshalLogObject(encoder zapcore.ObjectEncoder) err
 	return nil
 }
 
+// GCSafePointGetter is a PD client which can read the gc safe point without updating it.
+// it is exposed by newer PD clients.
+type GCSafePointGetter interface {
+	GetGCSafePoint(ctx context.Context) (uint64, error)
+}
+
 // getGCSafePoint returns the current gc safe point.
 // TODO: Some cluster may not enable distributed GC.
-func getGCSafePoint(ctx context.Context, pdClient pd.Client) (uint64, error) {
+func getGCSafePoint(ctx context.Context, pdClient pd.Client, timeout time.Duration) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if getter, ok := pdClient.(GCSafePointGetter); ok {
+		safePoint, err := getter.GetGCSafePoint(ctx)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		return safePoint, nil
+	}
+	// old PD clients have no getter, updating the gc safe point to zero never advances it,
+	// but returns the current one.
 	safePoint, err := pdClient.UpdateGCSafePoint(ctx, 0)
 	if err != nil {
 		return 0, errors.Trace(err)
@@ -60,14 +174,31 @@ func MakeSafePointID() string {
 }
 
 // CheckGCSafePoint checks whether the ts is older than GC safepoint.
-// Note: It ignores errors other than exceed GC safepoint.
+// Note: It ignores errors other than exceed GC safepoint, see CheckGCSafePointStrict.
 func CheckGCSafePoint(ctx context.Context, pdClient pd.Client, ts uint64) error {
-	// TODO: use PDClient.GetGCSafePoint instead once PD client exports it.
-	safePoint, err := getGCSafePoint(ctx, pdClient)
-	if err != nil {
+	return checkGCSafePoint(ctx, pdClient, ts, defaultPDRequestTimeout)
+}
+
+func checkGCSafePoint(ctx context.Context, pdClient pd.Client, ts uint64, timeout time.Duration) error {
+	err := checkGCSafePointStrict(ctx, pdClient, ts, timeout)
+	if err != nil && errors.Cause(err) != berrors.ErrBackupGCSafepointExceeded { // nolint:errorlint
 		log.Warn("fail to get GC safe point", zap.Error(err))
 		return nil
 	}
+	return err
+}
+
+// CheckGCSafePointStrict is like CheckGCSafePoint, but it fails once the GC safepoint can't be fetched,
+// rather than assuming the ts is safe, which is useful for the critical restores.
+func CheckGCSafePointStrict(ctx context.Context, pdClient pd.Client, ts uint64) error {
+	return checkGCSafePointStrict(ctx, pdClient, ts, defaultPDRequestTimeout)
+}
+
+func checkGCSafePointStrict(ctx context.Context, pdClient pd.Client, ts uint64, timeout time.Duration) error {
+	safePoint, err := getGCSafePoint(ctx, pdClient, timeout)
+	if err != nil {
+		return errors.Annotate(err, "failed to get GC safe point")
+	}
 	if ts <= safePoint {
 		return errors.Annotatef(berrors.ErrBackupGCSafepointExceeded, "GC safepoint %d exceed TS %d", safePoint, ts)
 	}
@@ -75,10 +206,21 @@ func CheckGCSafePoint(ctx context.Context, pdClient pd.Client, ts uint64) error
 }
 
 // UpdateServiceSafePoint register BackupTS to PD, to lock down BackupTS as safePoint with TTL seconds.
+// the TTL must be positive.
 func UpdateServiceSafePoint(ctx context.Context, pdClient pd.Client, sp BRServiceSafePoint) error {
+	return updateServiceSafePoint(ctx, pdClient, sp, defaultPDRequestTimeout)
+}
+
+func updateServiceSafePoint(ctx context.Context, pdClient pd.Client, sp BRServiceSafePoint, timeout time.Duration) error {
+	sp = sp.withDefaultID()
+	if err := sp.validate(); err != nil {
+		return err
+	}
 	log.Debug("update PD safePoint limit with TTL",
 		zap.Object("safePoint", sp))
 
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 	lastSafePoint, err := pdClient.UpdateServiceGCSafePoint(ctx,
 		sp.ID, sp.TTL, sp.BackupTS-1)
 	if lastSafePoint > sp.BackupTS-1 {
@@ -90,46 +232,243 @@ func UpdateServiceSafePoint(ctx context.Context, pdClient pd.Client, sp BRServic
 	return errors.Trace(err)
 }
 
+// GetClockSkew returns the skew of the local wall clock against the physical time of a TSO from PD,
+// a positive skew means the local clock is ahead of PD.
+// the local time is taken at the middle of the request, so the latency of the request is mostly canceled out.
+func GetClockSkew(ctx context.Context, pdClient pd.Client) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultPDRequestTimeout)
+	defer cancel()
+	before := time.Now()
+	physical, _, err := pdClient.GetTS(ctx)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	after := time.Now()
+	local := before.Add(after.Sub(before) / 2)
+	pdTime := time.Unix(0, physical*int64(time.Millisecond))
+	return local.Sub(pdTime), nil
+}
+
+// CheckClockSkew warns if the skew between the local clock and PD exceeds maxSkew,
+// since the GC safe point checks depend on TS semantics, a large skew may cause confusing safe point errors.
+// It returns whether the skew exceeds. Like CheckGCSafePoint, it ignores errors.
+func CheckClockSkew(ctx context.Context, pdClient pd.Client, maxSkew time.Duration) bool {
+	skew, err := GetClockSkew(ctx, pdClient)
+	if err != nil {
+		log.Warn("fail to get the clock skew against PD", zap.Error(err))
+		return false
+	}
+	if skew > maxSkew || skew < -maxSkew {
+		log.Warn("the clock of BR is skewed against PD, the GC safe point may not work as expected",
+			zap.Duration("skew", skew),
+			zap.Duration("max-skew", maxSkew),
+		)
+		return true
+	}
+	log.Debug("clock skew against PD", zap.Duration("skew", skew))
+	return false
+}
+
+// CheckBackupTSNotInFuture checks whether the backupTS is ahead of the current TSO of PD by more than tolerance,
+// e.g. it is input wrongly, or the clock is skewed. such a backupTS passes CheckGCSafePoint trivially,
+// but the backup(or the restore from it) is logically invalid, then ErrBackupTSInFuture is returned.
+// Like CheckClockSkew, it ignores the errors of requesting PD.
+func CheckBackupTSNotInFuture(ctx context.Context, pdClient pd.Client, backupTS uint64, tolerance time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultPDRequestTimeout)
+	defer cancel()
+	physical, _, err := pdClient.GetTS(ctx)
+	if err != nil {
+		log.Warn("fail to get the TSO to check whether backup ts is in the future", zap.Error(err))
+		return nil
+	}
+	pdTime := time.Unix(0, physical*int64(time.Millisecond))
+	backupTime, _ := tsoutil.ParseTS(backupTS)
+	if ahead := backupTime.Sub(pdTime); ahead > tolerance {
+		log.Error("backup ts is in the future",
+			zap.Uint64("backup-ts", backupTS),
+			zap.Time("backup-time", backupTime),
+			zap.Time("pd-time", pdTime),
+			zap.Duration("tolerance", tolerance),
+		)
+		return errors.Annotatef(berrors.ErrBackupTSInFuture,
+			"backup ts %d(%s) is %s ahead of PD", backupTS, backupTime, ahead)
+	}
+	return nil
+}
+
 // StartServiceSafePointKeeper will run UpdateServiceSafePoint periodicity
 // hence keeping service safepoint won't lose.
+// It also checks periodically whether the BackupTS is still above the GC safe point,
+// once it isn't (e.g. GC advanced because of misconfiguration), refreshing the service
+// safe point is meaningless: the keeper would send the error to the returned channel and stop.
+// Failures of updating the service safe point are tolerated, until they last so long that the service safe point
+// would expire before the next update, then the keeper sends ErrPDServiceSafePointExpiring and stops.
+// The refreshing is jittered by defaultUpdateJitter, so the BR processes started at the same time won't
+// refresh at the same time.
+// The returned channel would be closed once the keeper exits.
+// If the TTL isn't positive, the keeper doesn't start, and the error is sent to the returned channel.
 func StartServiceSafePointKeeper(
 	ctx context.Context,
 	pdClient pd.Client,
 	sp BRServiceSafePoint,
-) {
-	// It would be OK since TTL won't be zero, so gapTime should > `0.
-	updateGapTime := time.Duration(sp.TTL) * time.Second / preUpdateServiceSafePointFactor
-	update := func(ctx context.Context) {
-		if err := UpdateServiceSafePoint(ctx, pdClient, sp); err != nil {
+) <-chan error {
+	return StartServiceSafePointKeeperWithConfig(ctx, pdClient, sp, ServiceSafePointKeeperConfig{
+		Jitter: defaultUpdateJitter,
+	})
+}
+
+// StartServiceSafePointKeeperWithConfig is like StartServiceSafePointKeeper, but with the config.
+func StartServiceSafePointKeeperWithConfig(
+	ctx context.Context,
+	pdClient pd.Client,
+	sp BRServiceSafePoint,
+	cfg ServiceSafePointKeeperConfig,
+) <-chan error {
+	sp = sp.withDefaultID()
+	if err := sp.validate(); err != nil {
+		log.Error("invalid service safe point, won't keep it", zap.Error(err))
+		errCh := make(chan error, 1)
+		errCh <- err
+		close(errCh)
+		return errCh
+	}
+	factor := cfg.minFactor()
+	clock := cfg.clock()
+	// It would be OK since TTL is positive, so gapTime should > `0.
+	updateGapTime := time.Duration(sp.TTL) * time.Second / time.Duration(factor)
+	// Check the GC safe point at least as frequent as we update the service safe point.
+	checkGapTime := checkGCSafePointGapTime
+	if checkGapTime > updateGapTime {
+		checkGapTime = updateGapTime
+	}
+	ttl := time.Duration(sp.TTL) * time.Second
+	// lastUpdated is when the last successful update started, the service safe point expires at TTL after it.
+	// it is zero until the first successful update, the service safe point may not exist at all then.
+	var lastUpdated time.Time
+	requestTimeout := cfg.requestTimeout()
+	// a PD request shouldn't last longer than the gap, or it may delay the next tick and let the safe point expire.
+	// once it times out, the next tick would retry.
+	// it returns the latency of the update.
+	update := func(ctx context.Context) time.Duration {
+		timeout := requestTimeout
+		if timeout > updateGapTime {
+			timeout = updateGapTime
+		}
+		start := clock.Now()
+		if err := updateServiceSafePoint(ctx, pdClient, sp, timeout); err != nil {
 			log.Warn("failed to update service safe point, backup may fail if gc triggered",
 				zap.Error(err),
+				zap.Time("last-updated", lastUpdated),
 			)
+		} else {
+			lastUpdated = start
+		}
+		return clock.Now().Sub(start)
+	}
+	// expiring returns an error if the service safe point would expire before the next update,
+	// a single failure is transient as long as the next update can still refresh it in time.
+	// it is always expiring if it has never been updated.
+	expiring := func() error {
+		if lastUpdated.IsZero() {
+			log.Error("failed to update service safe point since the keeper started", zap.Object("safePoint", sp))
+			return errors.Annotate(berrors.ErrPDServiceSafePointExpiring,
+				"failed to update service safe point since the keeper started")
+		}
+		expireAt := lastUpdated.Add(ttl)
+		if clock.Now().Add(updateGapTime).Before(expireAt) {
+			return nil
+		}
+		log.Error("failed to update service safe point for too long, it would expire soon",
+			zap.Time("last-updated", lastUpdated),
+			zap.Time("expire-at", expireAt),
+			zap.Object("safePoint", sp),
+		)
+		return errors.Annotatef(berrors.ErrPDServiceSafePointExpiring,
+			"failed to update service safe point since %s, it expires at %s", lastUpdated, expireAt)
+	}
+	// tighten raises the factor if the latency of the update takes more than half of the gap,
+	// the gap of checking is shortened with it if necessary. it returns whether the gap changed.
+	tighten := func(latency time.Duration) bool {
+		if !cfg.Adaptive || factor >= cfg.maxFactor() || latency*2 <= updateGapTime {
+			return false
 		}
+		factor++
+		updateGapTime = time.Duration(sp.TTL) * time.Second / time.Duration(factor)
+		if checkGapTime > updateGapTime {
+			checkGapTime = updateGapTime
+		}
+		log.Info("updating service safe point is slow, refresh it more frequently",
+			zap.Duration("latency", latency),
+			zap.Int("factor", factor),
+			zap.Duration("gap", updateGapTime),
+		)
+		return true
 	}
-	check := func(ctx context.Context) {
-		if err := CheckGCSafePoint(ctx, pdClient, sp.BackupTS); err != nil {
-			log.Panic("cannot pass gc safe point check, aborting",
+	check := func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, checkGapTime)
+		defer cancel()
+		if err := checkGCSafePoint(ctx, pdClient, sp.BackupTS, requestTimeout); err != nil {
+			log.Error("cannot pass gc safe point check, stop keeping service safe point",
 				zap.Error(err),
 				zap.Object("safePoint", sp),
 			)
+			return err
 		}
+		return nil
 	}
-	updateTick := time.NewTicker(updateGapTime)
-	checkTick := time.NewTicker(checkGCSafePointGapTime)
-	update(ctx)
+	jitter := cfg.jitter()
+	var updateTick Ticker
+	var updateCh <-chan time.Time
+	// schedule schedules the next updates, with jitter, the updates are scheduled one by one, each after a random gap.
+	schedule := func() {
+		if jitter > 0 {
+			gap := updateGapTime - time.Duration(rand.Float64()*jitter*float64(updateGapTime)) //nolint:gosec
+			updateCh = clock.After(gap)
+			return
+		}
+		if updateTick != nil {
+			updateTick.Stop()
+		}
+		updateTick = clock.NewTicker(updateGapTime)
+		updateCh = updateTick.Chan()
+	}
+	errCh := make(chan error, 1)
+	tighten(update(ctx))
+	schedule()
+	checkTick := clock.NewTicker(checkGapTime)
 	go func() {
-		defer updateTick.Stop()
-		defer checkTick.Stop()
+		defer close(errCh)
+		defer func() {
+			if updateTick != nil {
+				updateTick.Stop()
+			}
+			checkTick.Stop()
+		}()
 		for {
 			select {
 			case <-ctx.Done():
 				log.Debug("service safe point keeper exited")
 				return
-			case <-updateTick.C:
-				update(ctx)
-			case <-checkTick.C:
-				check(ctx)
+			case <-updateCh:
+				lastCheckGap := checkGapTime
+				if tighten(update(ctx)) || jitter > 0 {
+					schedule()
+				}
+				if checkGapTime != lastCheckGap {
+					checkTick.Stop()
+					checkTick = clock.NewTicker(checkGapTime)
+				}
+				if err := expiring(); err != nil {
+					errCh <- err
+					return
+				}
+			case <-checkTick.Chan():
+				if err := check(ctx); err != nil {
+					errCh <- err
+					return
+				}
 			}
 		}
 	}()
+	return errCh
 }
@@ -4,12 +4,17 @@ package utils_test
 
 import (
 	"context"
+	"reflect"
 	"sync"
+	"time"
 
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/store/tikv/oracle"
 	"github.com/pingcap/tidb/util/testleak"
 	pd "github.com/tikv/pd/client"
 
+	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/utils"
 )
 
@@ -44,10 +49,577 @@ func (s *testSafePointSuite) TestCheckGCSafepoint(c *C) {
 	}
 }
 
+func (s *testSafePointSuite) TestCheckGCSafePointStrict(c *C) {
+	ctx := context.Background()
+	pdClient := &mockSafePoint{safepoint: 2333}
+	c.Assert(utils.CheckGCSafePointStrict(ctx, pdClient, 2333+1), IsNil)
+	c.Assert(utils.CheckGCSafePointStrict(ctx, pdClient, 2333), ErrorMatches, ".*GC safepoint 2333 exceed TS 2333.*")
+
+	// the lenient one assumes the ts is safe once PD fails, but the strict one fails.
+	unreachable := unreachableSafePoint{}
+	c.Assert(utils.CheckGCSafePoint(ctx, unreachable, 2333), IsNil)
+	c.Assert(utils.CheckGCSafePointStrict(ctx, unreachable, 2333), ErrorMatches, ".*PD is unreachable.*")
+}
+
+func (s *testSafePointSuite) TestGetGCSafePointByGetter(c *C) {
+	ctx := context.Background()
+	pdClient := &gettableSafePoint{mockSafePoint: &mockSafePoint{safepoint: 2333}}
+	c.Assert(utils.CheckGCSafePoint(ctx, pdClient, 2333+1), IsNil)
+	c.Assert(utils.CheckGCSafePoint(ctx, pdClient, 2333), ErrorMatches, ".*GC safepoint 2333 exceed TS 2333.*")
+	// the safe point is read without updating.
+	c.Assert(pdClient.updated, Equals, 0)
+	c.Assert(pdClient.read, Equals, 2)
+}
+
+func (s *testSafePointSuite) TestServiceSafePointID(c *C) {
+	ctx := context.Background()
+	pdClient := &mockSafePoint{safepoint: 2333}
+	sp := utils.BRServiceSafePoint{TTL: 30, BackupTS: 2334}
+	c.Assert(utils.UpdateServiceSafePoint(ctx, pdClient, sp), IsNil)
+	sp.ID = utils.MakeSafePointID()
+	c.Assert(utils.UpdateServiceSafePoint(ctx, pdClient, sp), IsNil)
+	c.Assert(pdClient.serviceIDs, DeepEquals, []string{utils.DefaultBRServiceSafePointID, sp.ID})
+	c.Assert(sp.ID, Matches, "br-.+")
+	c.Assert(utils.MakeSafePointID(), Not(Equals), sp.ID)
+}
+
+func (s *testSafePointSuite) TestServiceSafePointKeeperStopsWhenGCExceeded(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pdClient := &mockSafePoint{safepoint: 2333}
+	sp := utils.BRServiceSafePoint{
+		ID:       "br-test",
+		TTL:      1,
+		BackupTS: 2333 + 1,
+	}
+	errCh := utils.StartServiceSafePointKeeper(ctx, pdClient, sp)
+	// GC advances past the protected TS anyway.
+	_, err := pdClient.UpdateGCSafePoint(ctx, 3000)
+	c.Assert(err, IsNil)
+
+	select {
+	case err := <-errCh:
+		c.Assert(err, ErrorMatches, ".*GC safepoint 3000 exceed TS 2334.*")
+	case <-time.After(5 * time.Second):
+		c.Fatal("the keeper doesn't stop after GC safe point exceeds the backup TS")
+	}
+	_, ok := <-errCh
+	c.Assert(ok, IsFalse)
+}
+
+func (s *testSafePointSuite) TestHungPDRequestTimesOut(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pdClient := &hungSafePoint{}
+	sp := utils.BRServiceSafePoint{
+		ID:       "br-test",
+		TTL:      3,
+		BackupTS: 2333,
+	}
+	// the keeper updates the service safe point once it starts,
+	// the hung request should be canceled within the gap(TTL / 3).
+	start := time.Now()
+	errCh := utils.StartServiceSafePointKeeper(ctx, pdClient, sp)
+	c.Assert(time.Since(start), Less, 2*time.Second)
+	c.Assert(pdClient.Calls(), Equals, 1)
+
+	// the next tick retries.
+	time.Sleep(2500 * time.Millisecond)
+	c.Assert(pdClient.Calls(), Greater, 1)
+	cancel()
+	for range errCh {
+	}
+}
+
+func (s *testSafePointSuite) TestKeeperRequestTimeout(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pdClient := &hungSafePoint{}
+	sp := utils.BRServiceSafePoint{
+		ID:       "br-test",
+		TTL:      300,
+		BackupTS: 2333,
+	}
+	// the gap is far longer than the request timeout, so the hung request is canceled by the request timeout.
+	start := time.Now()
+	errCh := utils.StartServiceSafePointKeeperWithConfig(ctx, pdClient, sp, utils.ServiceSafePointKeeperConfig{
+		RequestTimeout: 100 * time.Millisecond,
+	})
+	c.Assert(time.Since(start), Less, time.Second)
+	c.Assert(pdClient.Calls(), Equals, 1)
+	cancel()
+	for range errCh {
+	}
+}
+
+func (s *testSafePointSuite) TestAdaptiveUpdateFactor(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pdClient := &slowSafePoint{latency: 600 * time.Millisecond}
+	sp := utils.BRServiceSafePoint{
+		ID:       "br-test",
+		TTL:      3,
+		BackupTS: 2333,
+	}
+	// the gap starts from 1s (TTL / 3), and the latency is more than the half of it.
+	errCh := utils.StartServiceSafePointKeeperWithConfig(ctx, pdClient, sp, utils.ServiceSafePointKeeperConfig{
+		Adaptive:  true,
+		MaxFactor: 5,
+	})
+	time.Sleep(4 * time.Second)
+	cancel()
+	for range errCh {
+	}
+
+	calls := pdClient.CallTimes()
+	c.Assert(len(calls), GreaterEqual, 4)
+	first := calls[1].Sub(calls[0])
+	last := calls[len(calls)-1].Sub(calls[len(calls)-2])
+	// the first tick comes at the gap after the first update is done, which is TTL / 4 = 750ms,
+	// and the gap would finally be TTL / 5 = 600ms, the slow update itself may delay the ticks.
+	c.Assert(first, Greater, time.Second)
+	c.Assert(last, Less, 900*time.Millisecond)
+}
+
+func (s *testSafePointSuite) TestAdaptiveCheckGap(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	pdClient := &clockSafePoint{clock: clock}
+	sp := utils.BRServiceSafePoint{
+		ID:       "br-test",
+		TTL:      12,
+		BackupTS: 2333,
+	}
+	// the gaps of updating and checking are both 4s (TTL / 3).
+	errCh := utils.StartServiceSafePointKeeperWithConfig(ctx, pdClient, sp, utils.ServiceSafePointKeeperConfig{
+		Clock:     clock,
+		Adaptive:  true,
+		MaxFactor: 4,
+	})
+	c.Assert(clock.livePeriods(), DeepEquals, []time.Duration{4 * time.Second, 4 * time.Second})
+
+	// the update takes more than half of the gap, then both gaps are tightened to 3s (TTL / 4).
+	pdClient.SetLatency(3 * time.Second)
+	clock.Advance(4 * time.Second)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pdClient.CallTimes()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	expected := []time.Duration{3 * time.Second, 3 * time.Second}
+	for !reflect.DeepEqual(clock.livePeriods(), expected) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(clock.livePeriods(), DeepEquals, expected)
+	cancel()
+	for range errCh {
+	}
+}
+
+func (s *testSafePointSuite) TestKeeperTicksByClock(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	pdClient := &clockSafePoint{clock: clock}
+	sp := utils.BRServiceSafePoint{
+		ID:       "br-test",
+		TTL:      30,
+		BackupTS: 2333,
+	}
+	// the gap of updating is 10s (TTL / 3), the gap of checking is 5s.
+	errCh := utils.StartServiceSafePointKeeperWithConfig(ctx, pdClient, sp, utils.ServiceSafePointKeeperConfig{
+		Clock: clock,
+	})
+	for i := 1; i <= 30; i++ {
+		clock.Advance(time.Second)
+		expected := 1 + i/10
+		deadline := time.Now().Add(5 * time.Second)
+		for len(pdClient.CallTimes()) < expected && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		c.Assert(pdClient.CallTimes(), HasLen, expected, Commentf("after %d seconds", i))
+	}
+	cancel()
+	for range errCh {
+	}
+	c.Assert(pdClient.CallTimes(), DeepEquals, []time.Time{
+		time.Unix(0, 0), time.Unix(10, 0), time.Unix(20, 0), time.Unix(30, 0),
+	})
+}
+
+func (s *testSafePointSuite) TestKeeperJitter(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	pdClient := &clockSafePoint{clock: clock}
+	sp := utils.BRServiceSafePoint{
+		ID:       "br-test",
+		TTL:      30,
+		BackupTS: 2333,
+	}
+	// the gap of updating is 10s (TTL / 3), shortened by at most 1s.
+	errCh := utils.StartServiceSafePointKeeperWithConfig(ctx, pdClient, sp, utils.ServiceSafePointKeeperConfig{
+		Clock:  clock,
+		Jitter: 0.1,
+	})
+	for i := 0; i < 600; i++ {
+		clock.Advance(100 * time.Millisecond)
+		// wait for the next update being scheduled.
+		deadline := time.Now().Add(5 * time.Second)
+		for clock.pendingTimers() == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	cancel()
+	for range errCh {
+	}
+	calls := pdClient.CallTimes()
+	c.Assert(len(calls), GreaterEqual, 6)
+	jittered := false
+	for i := 1; i < len(calls); i++ {
+		gap := calls[i].Sub(calls[i-1])
+		c.Assert(gap >= 9*time.Second && gap <= 10*time.Second, IsTrue, Commentf("gap %d is %s", i, gap))
+		jittered = jittered || gap < 10*time.Second
+	}
+	c.Assert(jittered, IsTrue)
+}
+
+func (s *testSafePointSuite) TestKeeperReportsExpiring(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	pdClient := &clockSafePoint{clock: clock}
+	sp := utils.BRServiceSafePoint{
+		ID:       "br-test",
+		TTL:      30,
+		BackupTS: 2333,
+	}
+	errCh := utils.StartServiceSafePointKeeperWithConfig(ctx, pdClient, sp, utils.ServiceSafePointKeeperConfig{
+		Clock: clock,
+	})
+	// PD becomes unreachable after the first update.
+	pdClient.SetFailing(true)
+	advanceUntilCalls := func(seconds, calls int) {
+		for i := 0; i < seconds; i++ {
+			clock.Advance(time.Second)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for len(pdClient.CallTimes()) < calls && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		c.Assert(pdClient.CallTimes(), HasLen, calls)
+	}
+
+	// a single failure is transient, the service safe point can still be refreshed at 20s.
+	advanceUntilCalls(10, 2)
+	select {
+	case err := <-errCh:
+		c.Fatalf("unexpected error %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the service safe point would expire at 30s, before the next update.
+	advanceUntilCalls(10, 3)
+	select {
+	case err := <-errCh:
+		c.Assert(errors.Cause(err), Equals, berrors.ErrPDServiceSafePointExpiring)
+	case <-time.After(5 * time.Second):
+		c.Fatal("the keeper doesn't report the service safe point expiring")
+	}
+	_, ok := <-errCh
+	c.Assert(ok, IsFalse)
+}
+
+func (s *testSafePointSuite) TestKeeperReportsNeverUpdated(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	pdClient := &clockSafePoint{clock: clock}
+	// PD is unreachable since the keeper starts.
+	pdClient.SetFailing(true)
+	sp := utils.BRServiceSafePoint{
+		ID:       "br-test",
+		TTL:      30,
+		BackupTS: 2333,
+	}
+	errCh := utils.StartServiceSafePointKeeperWithConfig(ctx, pdClient, sp, utils.ServiceSafePointKeeperConfig{
+		Clock: clock,
+	})
+
+	// the service safe point may not exist at all, it is expiring even though it is far from the TTL.
+	clock.Advance(10 * time.Second)
+	select {
+	case err := <-errCh:
+		c.Assert(errors.Cause(err), Equals, berrors.ErrPDServiceSafePointExpiring)
+	case <-time.After(5 * time.Second):
+		c.Fatal("the keeper doesn't report the service safe point never updated")
+	}
+	c.Assert(pdClient.CallTimes(), HasLen, 2)
+}
+
+// fakeClock is a clock which goes only when advanced, the ticks are delivered like time.Ticker.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	clock   *fakeClock
+	c       chan time.Time
+	period  time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func (t *fakeTicker) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.newTicker(d, 0).c
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) utils.Ticker {
+	return c.newTicker(d, d)
+}
+
+// newTicker creates a ticker ticks at d, then every period, it ticks only once if period is zero.
+func (c *fakeClock) newTicker(d, period time.Duration) *fakeTicker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), period: period, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// livePeriods returns the periods of the tickers(created by NewTicker) not stopped yet.
+func (c *fakeClock) livePeriods() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	periods := make([]time.Duration, 0, len(c.tickers))
+	for _, t := range c.tickers {
+		if t.period != 0 && !t.stopped {
+			periods = append(periods, t.period)
+		}
+	}
+	return periods
+}
+
+// pendingTimers returns the count of the timers(created by After) not fired yet.
+func (c *fakeClock) pendingTimers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := 0
+	for _, t := range c.tickers {
+		if t.period == 0 && !t.stopped {
+			pending++
+		}
+	}
+	return pending
+}
+
+// Advance makes the clock go, ticks would be dropped if the receiver is slow, like time.Ticker.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		for !t.stopped && !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			if t.period == 0 {
+				t.stopped = true
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+// clockSafePoint is a PD client which records the time of updating the service safe point by the clock.
+type clockSafePoint struct {
+	pd.Client
+	clock *fakeClock
+
+	mu      sync.Mutex
+	calls   []time.Time
+	failing bool
+	// latency is how long the clock goes while updating the service safe point.
+	latency time.Duration
+}
+
+func (m *clockSafePoint) SetLatency(latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency = latency
+}
+
+func (m *clockSafePoint) SetFailing(failing bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failing = failing
+}
+
+func (m *clockSafePoint) CallTimes() []time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]time.Time{}, m.calls...)
+}
+
+func (m *clockSafePoint) UpdateGCSafePoint(ctx context.Context, safePoint uint64) (uint64, error) {
+	return 0, nil
+}
+
+func (m *clockSafePoint) UpdateServiceGCSafePoint(ctx context.Context, serviceID string, ttl int64, safePoint uint64) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, m.clock.Now())
+	if m.latency > 0 {
+		m.clock.Advance(m.latency)
+	}
+	if m.failing {
+		return 0, errors.New("PD is unreachable")
+	}
+	return 0, nil
+}
+
+// slowSafePoint is a PD client whose updating of the service safe point takes the latency.
+type slowSafePoint struct {
+	pd.Client
+	latency time.Duration
+
+	mu    sync.Mutex
+	calls []time.Time
+}
+
+func (m *slowSafePoint) CallTimes() []time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]time.Time{}, m.calls...)
+}
+
+func (m *slowSafePoint) UpdateGCSafePoint(ctx context.Context, safePoint uint64) (uint64, error) {
+	return 0, nil
+}
+
+func (m *slowSafePoint) UpdateServiceGCSafePoint(ctx context.Context, serviceID string, ttl int64, safePoint uint64) (uint64, error) {
+	m.mu.Lock()
+	m.calls = append(m.calls, time.Now())
+	m.mu.Unlock()
+	select {
+	case <-time.After(m.latency):
+	case <-ctx.Done():
+	}
+	return 0, nil
+}
+
+func (s *testSafePointSuite) TestCheckClockSkew(c *C) {
+	ctx := context.Background()
+	pdClient := &mockTSO{offset: 0}
+	c.Assert(utils.CheckClockSkew(ctx, pdClient, time.Second), IsFalse)
+
+	// PD is an hour ahead.
+	pdClient.offset = time.Hour
+	skew, err := utils.GetClockSkew(ctx, pdClient)
+	c.Assert(err, IsNil)
+	c.Assert(skew, Less, -59*time.Minute)
+	c.Assert(utils.CheckClockSkew(ctx, pdClient, time.Second), IsTrue)
+
+	// PD is an hour behind.
+	pdClient.offset = -time.Hour
+	c.Assert(utils.CheckClockSkew(ctx, pdClient, time.Second), IsTrue)
+}
+
+func (s *testSafePointSuite) TestCheckBackupTSNotInFuture(c *C) {
+	ctx := context.Background()
+	pdClient := &mockTSO{offset: 0}
+	now := oracle.ComposeTS(time.Now().UnixNano()/int64(time.Millisecond), 0)
+	c.Assert(utils.CheckBackupTSNotInFuture(ctx, pdClient, now, time.Second), IsNil)
+	hourAgo := oracle.ComposeTS(time.Now().Add(-time.Hour).UnixNano()/int64(time.Millisecond), 0)
+	c.Assert(utils.CheckBackupTSNotInFuture(ctx, pdClient, hourAgo, time.Second), IsNil)
+
+	hourLater := oracle.ComposeTS(time.Now().Add(time.Hour).UnixNano()/int64(time.Millisecond), 0)
+	err := utils.CheckBackupTSNotInFuture(ctx, pdClient, hourLater, time.Second)
+	c.Assert(errors.Cause(err), Equals, berrors.ErrBackupTSInFuture)
+	// it is tolerated if PD is an hour ahead, too.
+	pdClient.offset = time.Hour
+	c.Assert(utils.CheckBackupTSNotInFuture(ctx, pdClient, hourLater, time.Minute), IsNil)
+}
+
+func (s *testSafePointSuite) TestNonPositiveTTL(c *C) {
+	ctx := context.Background()
+	pdClient := &slowSafePoint{}
+	sp := utils.BRServiceSafePoint{ID: "br-test", BackupTS: 2333}
+	err := utils.UpdateServiceSafePoint(ctx, pdClient, sp)
+	c.Assert(errors.Cause(err), Equals, berrors.ErrInvalidArgument)
+	c.Assert(err, ErrorMatches, ".*TTL of service safe point br-test must be positive.*")
+
+	// the keeper doesn't start, rather than panicking in background.
+	sp.TTL = -1
+	errCh := utils.StartServiceSafePointKeeper(ctx, pdClient, sp)
+	err = <-errCh
+	c.Assert(errors.Cause(err), Equals, berrors.ErrInvalidArgument)
+	_, ok := <-errCh
+	c.Assert(ok, IsFalse)
+	c.Assert(pdClient.CallTimes(), HasLen, 0)
+}
+
+// mockTSO is a PD client whose TSO is the local time plus the offset.
+type mockTSO struct {
+	pd.Client
+	offset time.Duration
+}
+
+func (m *mockTSO) GetTS(ctx context.Context) (int64, int64, error) {
+	return time.Now().Add(m.offset).UnixNano() / int64(time.Millisecond), 0, nil
+}
+
+// hungSafePoint is a PD client whose requests about safe point hang until the context is done.
+type hungSafePoint struct {
+	pd.Client
+	mu    sync.Mutex
+	calls int
+}
+
+func (m *hungSafePoint) Calls() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls
+}
+
+func (m *hungSafePoint) UpdateGCSafePoint(ctx context.Context, safePoint uint64) (uint64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func (m *hungSafePoint) UpdateServiceGCSafePoint(ctx context.Context, serviceID string, ttl int64, safePoint uint64) (uint64, error) {
+	m.mu.Lock()
+	m.calls++
+	m.mu.Unlock()
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
 type mockSafePoint struct {
 	sync.Mutex
 	pd.Client
 	safepoint uint64
+	// serviceIDs are the IDs of the service safe points updated.
+	serviceIDs []string
 }
 
 func (m *mockSafePoint) UpdateGCSafePoint(ctx context.Context, safePoint uint64) (uint64, error) {
@@ -59,3 +631,42 @@ func (m *mockSafePoint) UpdateGCSafePoint(ctx context.Context, safePoint uint64)
 	}
 	return m.safepoint, nil
 }
+
+func (m *mockSafePoint) UpdateServiceGCSafePoint(ctx context.Context, serviceID string, ttl int64, safePoint uint64) (uint64, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.serviceIDs = append(m.serviceIDs, serviceID)
+
+	return m.safepoint, nil
+}
+
+// gettableSafePoint is a mockSafePoint which can read the gc safe point without updating it,
+// it records how many times the gc safe point is read and updated.
+type gettableSafePoint struct {
+	*mockSafePoint
+	read    int
+	updated int
+}
+
+func (m *gettableSafePoint) GetGCSafePoint(ctx context.Context) (uint64, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.read++
+	return m.safepoint, nil
+}
+
+func (m *gettableSafePoint) UpdateGCSafePoint(ctx context.Context, safePoint uint64) (uint64, error) {
+	m.Lock()
+	m.updated++
+	m.Unlock()
+	return m.mockSafePoint.UpdateGCSafePoint(ctx, safePoint)
+}
+
+// unreachableSafePoint fails to get the gc safe point.
+type unreachableSafePoint struct {
+	pd.Client
+}
+
+func (unreachableSafePoint) UpdateGCSafePoint(ctx context.Context, safePoint uint64) (uint64, error) {
+	return 0, errors.New("PD is unreachable")
+}